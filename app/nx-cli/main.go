@@ -7,11 +7,14 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/urfave/cli/v2"
@@ -19,7 +22,19 @@ import (
 	"github.com/duxthemux/netmux/app/nx-cli/installer"
 )
 
+type RuntimeState struct {
+	StartedAt   *time.Time `json:"startedAt"`
+	LastError   string     `json:"lastError"`
+	LastErrorAt *time.Time `json:"lastErrorAt"`
+	Failures    int        `json:"failures"`
+	Restarts    int        `json:"restarts"`
+	ActiveConns int64      `json:"activeConns"`
+	BytesIn     int64      `json:"bytesIn"`
+	BytesOut    int64      `json:"bytesOut"`
+}
+
 type Endpoint struct {
+	RuntimeState
 	Name       string `json:"name"`
 	Endpoint   string `json:"endpoint"`
 	Kubernetes struct {
@@ -31,6 +46,7 @@ type Endpoint struct {
 	} `json:"kubernetes"`
 	Status  string `json:"status"`
 	Bridges []struct {
+		RuntimeState
 		Namespace     string `json:"namespace"`
 		Name          string `json:"name"`
 		LocalAddr     string `json:"localAddr"`
@@ -49,6 +65,51 @@ type ListRow struct {
 	Parent string
 	Desc   string
 	Status string
+	State  RuntimeState
+}
+
+const KiB = 1024
+
+func humanBytes(n int64) string {
+	if n < KiB {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(KiB), 0
+	for m := n / KiB; m >= KiB; m /= KiB {
+		div *= KiB
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func since(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return time.Since(*t).Round(time.Second).String()
+}
+
+// stateColumns renders the runtime state of endpoints and bridges as table columns.
+func (l *ListRow) stateColumns() []any {
+	if l.State.StartedAt == nil {
+		return []any{"", "", "", "", ""}
+	}
+
+	lastErr := ""
+	if l.State.LastError != "" {
+		lastErr = fmt.Sprintf("%s ago: %s (%d total)", since(l.State.LastErrorAt), l.State.LastError, l.State.Failures)
+	}
+
+	return []any{
+		since(l.State.StartedAt),
+		l.State.ActiveConns,
+		fmt.Sprintf("%s/%s", humanBytes(l.State.BytesIn), humanBytes(l.State.BytesOut)),
+		l.State.Restarts,
+		lastErr,
+	}
 }
 
 func (l *ListRow) String() string {
@@ -60,7 +121,18 @@ func (l *ListRow) String() string {
 }
 
 type ListOutput struct {
-	Endpoints []Endpoint `json:"endpoints"`
+	Endpoints        []Endpoint `json:"endpoints"`
+	Network          string     `json:"network"`
+	NetworkConflicts []struct {
+		Network string `json:"network"`
+		With    string `json:"with"`
+		Source  string `json:"source"`
+	} `json:"networkConflicts"`
+	NameConflicts []struct {
+		Name   string `json:"name"`
+		Owner  string `json:"owner"`
+		Bridge string `json:"bridge"`
+	} `json:"nameConflicts"`
 }
 
 func httpGet(ctx context.Context, cli http.Client, url string) ([]byte, error) {
@@ -104,6 +176,16 @@ func list(ctx context.Context, cli http.Client, filter string) error {
 		return fmt.Errorf("error unmarshalling status: %w", err)
 	}
 
+	for _, conflict := range out.NetworkConflicts {
+		fmt.Fprintf(os.Stderr, "warning: %s overlaps %s (%s), using %s\n",
+			conflict.Network, conflict.With, conflict.Source, out.Network)
+	}
+
+	for _, conflict := range out.NameConflicts {
+		fmt.Fprintf(os.Stderr, "warning: %s is taken by endpoint %s, use %s\n",
+			conflict.Name, conflict.Owner, conflict.Bridge)
+	}
+
 	var rx *regexp.Regexp
 
 	if filter != "" {
@@ -127,6 +209,7 @@ func list(ctx context.Context, cli http.Client, filter string) error {
 				endpoint.Kubernetes.Endpoint,
 				endpoint.Kubernetes.Port),
 			Status: endpoint.Status,
+			State:  endpoint.RuntimeState,
 		}
 
 		if rx != nil {
@@ -144,14 +227,13 @@ func list(ctx context.Context, cli http.Client, filter string) error {
 				Name:   svc.Name,
 				Parent: endpoint.Name,
 				Desc: fmt.Sprintf(
-					"%s %s: %s:%s => %s:%s",
+					"%s %s: %s => %s",
 					svc.Name,
 					svc.Direction,
-					svc.LocalAddr,
-					svc.LocalPort,
-					svc.ContainerAddr,
-					svc.ContainerPort),
+					net.JoinHostPort(svc.LocalAddr, svc.LocalPort),
+					net.JoinHostPort(svc.ContainerAddr, svc.ContainerPort)),
 				Status: svc.Status,
+				State:  svc.RuntimeState,
 			}
 
 			if rx != nil {
@@ -178,23 +260,121 @@ func list(ctx context.Context, cli http.Client, filter string) error {
 
 	defer tbWriter.Render()
 
-	tbWriter.AppendHeader(table.Row{"#", "K", "Name", "Parent", "Description", "Status"})
+	tbWriter.AppendHeader(table.Row{
+		"#", "K", "Name", "Parent", "Description", "Status", "Up", "Conns", "In/Out", "Restarts", "Last Error",
+	})
 
 	for i, row := range rows {
-		tbWriter.AppendRow(table.Row{
+		tbRow := table.Row{
 			fmt.Sprintf("%03d", i),
 			row.Type,
 			row.Name,
 			row.Parent,
 			row.Desc,
 			row.Status,
-		})
+		}
+
+		tbWriter.AppendRow(append(tbRow, row.stateColumns()...))
+	}
+
+	return nil
+}
+
+type Conn struct {
+	ID        string    `json:"id"`
+	Endpoint  string    `json:"endpoint"`
+	Bridge    string    `json:"bridge"`
+	Direction string    `json:"direction"`
+	Local     string    `json:"local"`
+	Peer      string    `json:"peer"`
+	StartedAt time.Time `json:"startedAt"`
+	BytesIn   int64     `json:"bytesIn"`
+	BytesOut  int64     `json:"bytesOut"`
+	PID       int       `json:"pid"`
+	Process   string    `json:"process"`
+}
+
+func conns(ctx context.Context, cli http.Client, filter string) error {
+	responseBytes, err := httpGet(ctx, cli, "https://nx/api/v1/conns/")
+	if err != nil {
+		return err
+	}
+
+	out := make([]Conn, 0)
+	if err = json.Unmarshal(responseBytes, &out); err != nil {
+		return fmt.Errorf("error unmarshalling conns: %w", err)
+	}
+
+	var rx *regexp.Regexp
+
+	if filter != "" {
+		rx, err = regexp.Compile(strings.ReplaceAll(filter, "+", ".*"))
+		if err != nil {
+			return err
+		}
+	}
+
+	tbWriter := table.NewWriter()
+	tbWriter.SetOutputMirror(os.Stdout)
+
+	defer tbWriter.Render()
+
+	tbWriter.AppendHeader(table.Row{"ID", "Endpoint", "Bridge", "Dir", "Peer", "Process", "Up", "In/Out"})
+
+	for _, conn := range out {
+		if rx != nil && !rx.MatchString(fmt.Sprintf("%s.%s", conn.Endpoint, conn.Bridge)) {
+			continue
+		}
 
+		process := ""
+		if conn.PID != 0 {
+			process = fmt.Sprintf("%s (%d)", conn.Process, conn.PID)
+		}
+
+		tbWriter.AppendRow(table.Row{
+			conn.ID,
+			conn.Endpoint,
+			conn.Bridge,
+			conn.Direction,
+			conn.Peer,
+			process,
+			since(&conn.StartedAt),
+			fmt.Sprintf("%s/%s", humanBytes(conn.BytesIn), humanBytes(conn.BytesOut)),
+		})
 	}
 
 	return nil
 }
 
+// killConns closes a single connection when called with its id, or all connections of a bridge when called with
+// endpoint and bridge names.
+func killConns(ctx context.Context, cli http.Client, args ...string) error {
+	switch len(args) {
+	case 1:
+		_, err := httpGet(ctx, cli, fmt.Sprintf("https://nx/api/v1/conns/%s/close", args[0]))
+
+		return err
+	case 2: //nolint:gomnd
+		responseBytes, err := httpGet(ctx, cli, fmt.Sprintf("https://nx/api/v1/conns/%s/%s/close", args[0], args[1]))
+		if err != nil {
+			return err
+		}
+
+		res := struct {
+			Closed int `json:"closed"`
+		}{}
+		if err = json.Unmarshal(responseBytes, &res); err != nil {
+			return fmt.Errorf("error unmarshalling response: %w", err)
+		}
+
+		fmt.Printf("%d connection(s) closed\n", res.Closed) //nolint:forbidigo
+
+		return nil
+	default:
+		return fmt.Errorf("either [id] or [endpoint] [svc] are required")
+	}
+}
+
 func connect(ctx context.Context, cli http.Client, ctxName string) error {
 	_, err := httpGet(ctx, cli, fmt.Sprintf("https://nx/api/v1/context/%s/connect", ctxName))
 
@@ -231,6 +411,34 @@ func reload(ctx context.Context, cli http.Client) error {
 	return err
 }
 
+func hostsBackups(ctx context.Context, cli http.Client) error {
+	responseBytes, err := httpGet(ctx, cli, "https://nx/api/v1/userconfig/hosts/backups")
+	if err != nil {
+		return err
+	}
+
+	backups := make([]string, 0)
+	if err = json.Unmarshal(responseBytes, &backups); err != nil {
+		return fmt.Errorf("error unmarshalling backups: %w", err)
+	}
+
+	for i, backup := range backups {
+		fmt.Printf("%d: %s\n", i+1, backup)
+	}
+
+	return nil
+}
+
+func hostsRestore(ctx context.Context, cli http.Client, backup string) error {
+	if backup == "" {
+		backup = "1"
+	}
+
+	_, err := httpGet(ctx, cli, "https://nx/api/v1/userconfig/hosts/restore/"+url.PathEscape(backup))
+
+	return err
+}
+
 func cleanup(ctx context.Context, cli http.Client) error {
 	_, err := httpGet(ctx, cli, "https://nx/api/v1/misc/cleanup")
 
@@ -290,6 +498,31 @@ func main() {
 					return list(ctx, httpCli, listFilter)
 				},
 			},
+			{
+				Name:    "conns",
+				Aliases: []string{"cs"},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "filter",
+						Usage:       "regex on [endpoint].[svc]",
+						Destination: &listFilter,
+					},
+				},
+				Usage: "Lists active connections",
+				Action: func(cCtx *cli.Context) error {
+					return conns(ctx, httpCli, listFilter)
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:    "kill",
+						Aliases: []string{"k"},
+						Usage:   "Closes connection [id] or all connections of a service [endpoint] [svc]",
+						Action: func(cCtx *cli.Context) error {
+							return killConns(ctx, httpCli, cCtx.Args().Slice()...)
+						},
+					},
+				},
+			},
 			{
 				Name:    "connect",
 				Aliases: []string{"con", "c"},
@@ -338,6 +571,26 @@ func main() {
 					return reload(ctx, httpCli)
 				},
 			},
+			{
+				Name:  "hosts",
+				Usage: "Manages the hosts file",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "backups",
+						Usage: "Lists the backups of the hosts file, the most recent first",
+						Action: func(cCtx *cli.Context) error {
+							return hostsBackups(ctx, httpCli)
+						},
+					},
+					{
+						Name:  "restore",
+						Usage: "Restores the hosts file from backup [n] - 1, the most recent, by default",
+						Action: func(cCtx *cli.Context) error {
+							return hostsRestore(ctx, httpCli, cCtx.Args().Get(0))
+						},
+					},
+				},
+			},
 			{
 				Name:    "cleanup",
 				Aliases: []string{},
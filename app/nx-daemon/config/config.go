@@ -1,12 +1,21 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 
+	"github.com/duxthemux/netmux/business/netmux"
+	"github.com/duxthemux/netmux/business/networkallocator"
 	"github.com/duxthemux/netmux/business/portforwarder"
+	"github.com/duxthemux/netmux/foundation/upstream"
 )
 
 // Config represents the agent central userconfig file.
@@ -20,6 +29,63 @@ type Config struct {
 	LogLevel  string    `json:"logLevel"  yaml:"logLevel,omitempty"`
 	LogFormat string    `json:"logFormat" yaml:"logFormat,omitempty"`
 	Endpoints Endpoints `json:"endpoints" yaml:"endpoints,omitempty"`
+	DNS       DNS       `json:"dns"       yaml:"dns,omitempty"`
+	// DisableProxies turns off all endpoint proxies (socks and http), and makes the PAC file route everything directly.
+	DisableProxies bool `json:"disableProxies" yaml:"disableProxies,omitempty"`
+	// Allocator tells how bridge addresses are made reachable: "alias" adds them to IFace (requires root), while
+	// "loopback" (linux only) uses addresses from 127.0.0.0/8, so the daemon can run as a normal user.
+	Allocator string `json:"allocator" yaml:"allocator,omitempty"`
+	// LeaseFile keeps the address of each bridge name, so they get the same one across restarts.
+	LeaseFile string `json:"leaseFile" yaml:"leaseFile,omitempty"`
+	// Network6 is an optional ipv6 network (ie: a ULA /112) used to give bridges to ipv6 services a second address.
+	Network6 string `json:"network6" yaml:"network6,omitempty"`
+	// NetworkCandidates are tried, in order, when Network conflicts with a local network (as the ones of docker or
+	// VPNs). Without candidates, a conflicting network keeps the daemon from starting.
+	NetworkCandidates []string `json:"networkCandidates" yaml:"networkCandidates,omitempty"`
+	// Leftovers tells what to do, on start, with aliases and hosts entries left behind by a run that did not end
+	// cleanly: "remove" them, or "adopt" the ones still usable, so bridges get them back.
+	Leftovers string `json:"leftovers" yaml:"leftovers,omitempty"`
+}
+
+const (
+	LeftoversRemove = "remove"
+	LeftoversAdopt  = "adopt"
+)
+
+const (
+	DNSBackendHosts  = "hosts"
+	DNSBackendServer = "server"
+	DNSBackendBoth   = "both"
+)
+
+// DNS tells how bridge names are published: in the hosts file, by the dns server embedded in the daemon, or both.
+type DNS struct {
+	Backend string `json:"backend" yaml:"backend,omitempty"`
+	// Upstreams are the resolvers used for names we don't know about. Defaults to the ones in resolv.conf.
+	Upstreams []string `json:"upstreams" yaml:"upstreams,omitempty"`
+	// Domains served by the clusters: names under them that are not bridges are resolved through the connected
+	// endpoints, with the cluster resolver, and never forwarded upstream.
+	Domains []string `json:"domains" yaml:"domains,omitempty"`
+	// Search domains are stripped from queried names, so svc.ns.<search> resolves as svc.ns.
+	Search []string `json:"search" yaml:"search,omitempty"`
+	TTL    uint32   `json:"ttl"    yaml:"ttl,omitempty"`
+	// SplitDNS registers the embedded server with the OS resolver (systemd-resolved or /etc/resolver on macOS) for
+	// Domains and Search.
+	SplitDNS bool `json:"splitDns" yaml:"splitDns,omitempty"`
+	// Link is the interface systemd-resolved associates the server with. It is created if it does not exist.
+	Link string `json:"link" yaml:"link,omitempty"`
+	// Aliases are the short names of bridges, besides the fully qualified svc.ns.endpoint one. An alias is only given
+	// to the first bridge asking for it: bridges of other endpoints keep their fully qualified name only. {svc}, {ns}
+	// and {endpoint} are replaced.
+	Aliases []string `json:"aliases" yaml:"aliases,omitempty"`
+}
+
+func (d *DNS) ServerEnabled() bool {
+	return d.Backend == DNSBackendServer || d.Backend == DNSBackendBoth
+}
+
+func (d *DNS) HostsFileEnabled() bool {
+	return d.Backend != DNSBackendServer
 }
 
 func (c *Config) Load(fname string) error {
@@ -50,8 +116,63 @@ func (c *Config) Load(fname string) error {
 		c.Address = "localhost:50000"
 	}
 
+	if c.LeaseFile == "" {
+		c.LeaseFile = DefaultLeaseFile
+	}
+
+	if c.Allocator == "" {
+		c.Allocator = networkallocator.ModeAlias
+	}
+
+	if c.Allocator != networkallocator.ModeAlias && c.Allocator != networkallocator.ModeLoopback {
+		return fmt.Errorf("invalid allocator: %s", c.Allocator)
+	}
+
+	if c.Leftovers == "" {
+		c.Leftovers = LeftoversRemove
+	}
+
+	if c.Leftovers != LeftoversRemove && c.Leftovers != LeftoversAdopt {
+		return fmt.Errorf("invalid leftovers: %s", c.Leftovers)
+	}
+
 	if c.Network == "" {
-		c.Network = "10.10.10.0/24"
+		c.Network = DefaultNetwork
+		if c.Allocator == networkallocator.ModeLoopback {
+			c.Network = DefaultLoopbackNetwork
+		} else if len(c.NetworkCandidates) == 0 {
+			c.NetworkCandidates = DefaultNetworkCandidates
+		}
+	}
+
+	if c.DNS.Backend == "" {
+		c.DNS.Backend = DNSBackendHosts
+	}
+
+	if c.DNS.Backend != DNSBackendHosts && c.DNS.Backend != DNSBackendServer && c.DNS.Backend != DNSBackendBoth {
+		return fmt.Errorf("invalid dns backend: %s", c.DNS.Backend)
+	}
+
+	if len(c.DNS.Domains) == 0 {
+		c.DNS.Domains = []string{"cluster.local"}
+	}
+
+	if c.DNS.Aliases == nil {
+		c.DNS.Aliases = DefaultAliases
+	}
+
+	for i := range c.Endpoints {
+		if c.Endpoints[i].DefaultNamespace == "" {
+			c.Endpoints[i].DefaultNamespace = DefaultNamespace
+		}
+
+		if err = c.Endpoints[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.DNS.Link == "" {
+		c.DNS.Link = DefaultDNSLink
 	}
 
 	return nil
@@ -59,6 +180,73 @@ func (c *Config) Load(fname string) error {
 
 type Endpoints []Endpoint
 
+//nolint:cyclop
+func (e Endpoint) validate() error {
+	if (e.TLS.Cert == "") != (e.TLS.Key == "") {
+		return fmt.Errorf("endpoint %s: tls cert and key go together", e.Name)
+	}
+
+	if e.IsWebSocket() && e.Kubernetes != (portforwarder.KubernetesInfo{}) {
+		return fmt.Errorf("endpoint %s: websocket endpoints are dialed directly, without kubernetes", e.Name)
+	}
+
+	if e.QUIC != "" && (e.IsWebSocket() || e.Kubernetes != (portforwarder.KubernetesInfo{})) {
+		return fmt.Errorf("endpoint %s: quic falls back to a tcp endpoint, not to websockets or kubernetes", e.Name)
+	}
+
+	if e.IsSSH() {
+		if e.IsWebSocket() || e.QUIC != "" || e.Kubernetes != (portforwarder.KubernetesInfo{}) {
+			return fmt.Errorf("endpoint %s: ssh reaches a tcp endpoint, not websockets, quic or kubernetes", e.Name)
+		}
+
+		if e.SSH.User == "" {
+			return fmt.Errorf("endpoint %s: ssh requires a user", e.Name)
+		}
+	}
+
+	for _, cidr := range e.TunCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("endpoint %s: invalid tun cidr: %w", e.Name, err)
+		}
+	}
+
+	if err := e.Upstream.validate(); err != nil {
+		return fmt.Errorf("endpoint %s: %w", e.Name, err)
+	}
+
+	return nil
+}
+
+func (u EndpointUpstream) validate() error {
+	switch u.Auth {
+	case "", upstream.AuthBasic, upstream.AuthNTLM:
+	default:
+		return fmt.Errorf("%w: %s", upstream.ErrUnknownAuth, u.Auth)
+	}
+
+	if u.URL == "" {
+		return nil
+	}
+
+	proxyURL, err := url.Parse(u.URL)
+	if err != nil {
+		// the url error would carry the password along.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+
+		return fmt.Errorf("error parsing upstream url: %w", err)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", upstream.ErrUnsupportedScheme, proxyURL.Scheme)
+	}
+}
+
 func (e Endpoints) FindByName(name string) (Endpoint, bool) {
 	for _, v := range e {
 		if v.Name == name {
@@ -73,12 +261,121 @@ type Endpoint struct {
 	Name       string                       `yaml:"name"`
 	Endpoint   string                       `yaml:"endpoint"`
 	Kubernetes portforwarder.KubernetesInfo `yaml:"kubernetes"`
+	Filter     netmux.Filter                `yaml:"filter,omitempty"`
+	// ProxyRetry is for how long a failing proxy connection is retried before giving up. Zero means no retries.
+	ProxyRetry time.Duration `yaml:"proxyRetry,omitempty"`
+	// Socks is the address (eg: 127.0.0.1:1080) of a SOCKS5 proxy reaching the cluster through this endpoint.
+	Socks string `yaml:"socks,omitempty"`
+	// HTTPProxy is the address (eg: 127.0.0.1:3128) of an HTTP proxy reaching the cluster through this endpoint.
+	HTTPProxy string `yaml:"httpProxy,omitempty"`
+	// Tun is the name of a TUN device (eg: nxtun0) routing the cluster networks through this endpoint. Linux only.
+	Tun string `yaml:"tun,omitempty"`
+	// TunCIDRs are the networks routed to Tun. Defaults to the cluster networks, as told by the server.
+	TunCIDRs []string `yaml:"tunCidrs,omitempty"`
+	// DefaultNamespace is the namespace whose bridges are reachable by their bare name (svc) too, as with kubectl.
+	DefaultNamespace string `yaml:"defaultNamespace,omitempty"`
+	// TLS of wss:// and quic endpoints.
+	TLS EndpointTLS `yaml:"tls,omitempty"`
+	// QUIC is the address (host:port, udp) of the quic listener of the server. When set, it is tried first, falling
+	// back to Endpoint (over tcp) if it can not be reached.
+	QUIC string `yaml:"quic,omitempty"`
+	// Token is sent to ws:// and wss:// endpoints as a bearer token, and to quic ones. TokenFile, read on each
+	// connection, takes precedence. As key files, they are kept out of the json the api serves.
+	Token     string `json:"-" yaml:"token,omitempty"`
+	TokenFile string `json:"-" yaml:"tokenFile,omitempty"`
+	// SSH reaches Endpoint through an ssh server (a jump host, or bastion), as ssh -L does.
+	SSH EndpointSSH `yaml:"ssh,omitempty"`
+	// Upstream is the proxy connections to the server (or to the ssh server) go through, when required. Quic is
+	// never proxied.
+	Upstream EndpointUpstream `yaml:"upstream,omitempty"`
+}
+
+// EndpointUpstream is an outbound proxy. Without URL, the ones of HTTPS_PROXY and NO_PROXY are used.
+type EndpointUpstream struct {
+	// URL is http://, https://, socks5:// or socks5h://, with user:password when the proxy requires them.
+	URL string `yaml:"url,omitempty"`
+	// Auth of http proxies: basic (default) or ntlm, the user being DOMAIN\user.
+	Auth string `yaml:"auth,omitempty"`
+	// NoProxy lists hosts, domains and networks dialed directly instead of through URL, as NO_PROXY does.
+	NoProxy string `yaml:"noProxy,omitempty"`
+}
+
+// MarshalJSON keeps the password of URL out of the json the api serves.
+func (u EndpointUpstream) MarshalJSON() ([]byte, error) {
+	type plain EndpointUpstream
+
+	ret := plain(u)
+
+	if proxyURL, err := url.Parse(u.URL); err == nil {
+		ret.URL = proxyURL.Redacted()
+	} else if u.URL != "" {
+		ret.URL = "invalid"
+	}
+
+	return json.Marshal(ret) //nolint:wrapcheck
+}
+
+// EndpointSSH is the ssh server endpoints are reached through. Without Key (or with Agent set), the keys of the ssh
+// agent at SSH_AUTH_SOCK are used.
+type EndpointSSH struct {
+	// Host is host or host:port, 22 by default.
+	Host  string `yaml:"host,omitempty"`
+	User  string `yaml:"user,omitempty"`
+	Key   string `json:"-" yaml:"key,omitempty"`
+	Agent bool   `yaml:"agent,omitempty"`
+	// KnownHosts verifies the host key of the server. Defaults to ~/.ssh/known_hosts (of the user running the daemon).
+	KnownHosts string `yaml:"knownHosts,omitempty"`
 }
 
+// EndpointTLS verifies the server with CA (besides the system roots) and, with Cert and Key, authenticates the
+// client (mTLS). Files are PEM encoded.
+type EndpointTLS struct {
+	CA   string `yaml:"ca,omitempty"`
+	Cert string `yaml:"cert,omitempty"`
+	Key  string `json:"-" yaml:"key,omitempty"`
+}
+
+// IsSSH tells if the endpoint is reached through an ssh server.
+func (e Endpoint) IsSSH() bool {
+	return e.SSH.Host != ""
+}
+
+// IsWebSocket tells if the endpoint is a ws:// or wss:// url, dialed directly instead of through a port forward.
+func (e Endpoint) IsWebSocket() bool {
+	return strings.HasPrefix(e.Endpoint, "ws://") || strings.HasPrefix(e.Endpoint, "wss://")
+}
+
+const (
+	DefaultNetwork         = "10.10.10.0/24"
+	DefaultLoopbackNetwork = "127.10.10.0/24"
+	DefaultLeaseFile       = "netmux-leases.json"
+)
+
+// DefaultNamespace is the default namespace of endpoints.
+const DefaultNamespace = "default"
+
+// DefaultAliases are the short names of bridges, when not configured.
+//
+//nolint:gochecknoglobals
+var DefaultAliases = []string{"{svc}.{ns}", "{svc}.{ns}.svc.cluster.local"}
+
+// DefaultNetworkCandidates are used when no network is configured, and DefaultNetwork conflicts with a local one.
+//
+//nolint:gochecknoglobals
+var DefaultNetworkCandidates = []string{"10.239.10.0/24", "172.31.239.0/24", "192.168.239.0/24"}
+
 func New() *Config {
 	return &Config{
-		IFace:   DefaultIface,
-		Address: "localhost:50000",
+		IFace:     DefaultIface,
+		Allocator: networkallocator.ModeAlias,
+		LeaseFile: DefaultLeaseFile,
+		Address:   "localhost:50000",
+		DNS: DNS{
+			Backend: DNSBackendHosts,
+			Domains: []string{"cluster.local"},
+			Link:    DefaultDNSLink,
+			Aliases: DefaultAliases,
+		},
 		Endpoints: []Endpoint{{
 			Name:     "",
 			Endpoint: "",
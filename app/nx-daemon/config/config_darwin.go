@@ -4,4 +4,5 @@ const (
 	DefaultLogFile    = "/tmp/nx-daemon.log"
 	DefaultConfigPath = "netmux.yaml"
 	DefaultIface      = "lo0"
+	DefaultDNSLink    = ""
 )
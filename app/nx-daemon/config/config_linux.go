@@ -5,4 +5,5 @@ const (
 	DefaultConfigPath      = "netmux.yaml"
 	DefaultIface           = "lo"
 	DefaultTokensVaultPath = "/etc/netmux-tokens.yaml"
+	DefaultDNSLink         = "nx0"
 )
@@ -5,4 +5,5 @@ const (
 	DefaultTokensVaultPath = "netmux-tokens.yaml"
 	DefaultIface           = "LB"
 	DefaultLogFile         = `nx-daemon.log`
+	DefaultDNSLink         = ""
 )
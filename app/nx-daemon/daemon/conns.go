@@ -0,0 +1,136 @@
+package daemon
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/duxthemux/netmux/business/netmux"
+	"github.com/duxthemux/netmux/foundation/sockowner"
+)
+
+var ErrConnNotFound = fmt.Errorf("connection not found")
+
+// trackedConn is an active connection through one of the bridges of an endpoint.
+type trackedConn struct {
+	*netmux.BridgeConn
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+// ConnInfo is the public view of an active connection.
+type ConnInfo struct {
+	ID        string    `json:"id"`
+	Endpoint  string    `json:"endpoint"`
+	Bridge    string    `json:"bridge"`
+	Direction string    `json:"direction"`
+	Local     string    `json:"local"`
+	Peer      string    `json:"peer"`
+	StartedAt time.Time `json:"startedAt"`
+	BytesIn   int64     `json:"bytesIn"`
+	BytesOut  int64     `json:"bytesOut"`
+	PID       int       `json:"pid,omitempty"`
+	Process   string    `json:"process,omitempty"`
+}
+
+// Conns lists all active connections, from all endpoints. The local process owning the peer side of each connection
+// is looked up when the platform allows it.
+func (d *Daemon) Conns() []ConnInfo {
+	ret := make([]ConnInfo, 0)
+
+	_ = d.operationalEndpoints.ForEach(func(epName string, ep *OperationalEndPoint) error {
+		return ep.conns.ForEach(func(_ string, conn *trackedConn) error {
+			info := ConnInfo{
+				ID:        conn.ID,
+				Endpoint:  epName,
+				Bridge:    conn.Bridge.Name,
+				Direction: conn.Bridge.Direction,
+				Local:     conn.Local,
+				Peer:      conn.Peer,
+				StartedAt: conn.StartedAt,
+				BytesIn:   conn.bytesIn.Load(),
+				BytesOut:  conn.bytesOut.Load(),
+			}
+
+			ret = append(ret, info)
+
+			return nil
+		})
+	})
+
+	// looked up out of the maps iteration, as it may take a while.
+	lookupOwners(ret)
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].StartedAt.Before(ret[j].StartedAt)
+	})
+
+	return ret
+}
+
+// lookupOwners fills in the local process owning the peer side of each connection, in a single scan of the sockets of
+// the host. The peer socket has the peer address as its local side.
+func lookupOwners(conns []ConnInfo) {
+	if len(conns) == 0 {
+		return
+	}
+
+	owners, err := sockowner.NewTable()
+	if err != nil {
+		return
+	}
+
+	for i := range conns {
+		if proc, err := owners.Lookup(conns[i].Peer, conns[i].Local); err == nil {
+			conns[i].PID = proc.PID
+			conns[i].Process = proc.Name
+		}
+	}
+}
+
+// CloseConn terminates a single connection, whichever endpoint it belongs to.
+func (d *Daemon) CloseConn(id string) error {
+	var found *trackedConn
+
+	_ = d.operationalEndpoints.ForEach(func(_ string, ep *OperationalEndPoint) error {
+		if conn := ep.conns.Get(id); conn != nil {
+			found = conn
+		}
+
+		return nil
+	})
+
+	if found == nil {
+		return fmt.Errorf("%w: %s", ErrConnNotFound, id)
+	}
+
+	found.Close()
+
+	return nil
+}
+
+// CloseBridgeConns terminates all connections of a bridge, keeping the bridge itself running. It returns the amount
+// of connections closed.
+func (d *Daemon) CloseBridgeConns(endpoint string, bridge string) (int, error) {
+	operationalEndpoint := d.operationalEndpoints.Get(endpoint)
+	if operationalEndpoint == nil {
+		return 0, fmt.Errorf("%w: %s", ErrEndpointNotConnected, endpoint)
+	}
+
+	toClose := make([]*trackedConn, 0)
+
+	_ = operationalEndpoint.conns.ForEach(func(_ string, conn *trackedConn) error {
+		if conn.Bridge.Name == bridge {
+			toClose = append(toClose, conn)
+		}
+
+		return nil
+	})
+
+	for _, conn := range toClose {
+		conn.Close()
+	}
+
+	return len(toClose), nil
+}
@@ -5,18 +5,25 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/miekg/dns"
 
 	"github.com/duxthemux/netmux/app/nx-daemon/config"
 	"github.com/duxthemux/netmux/business/netmux"
 	"github.com/duxthemux/netmux/business/networkallocator"
 	"github.com/duxthemux/netmux/business/networkallocator/dnsallocator"
+	"github.com/duxthemux/netmux/business/networkallocator/ipallocator"
 	"github.com/duxthemux/netmux/business/portforwarder"
+	"github.com/duxthemux/netmux/business/tun"
 	"github.com/duxthemux/netmux/foundation/memstore"
 	"github.com/duxthemux/netmux/foundation/metrics"
+	"github.com/duxthemux/netmux/foundation/sshdial"
 )
 
 var (
@@ -27,42 +34,285 @@ var (
 	ErrBridgeDirectionInvalid   = fmt.Errorf("bridge direction invalid")
 )
 
+const (
+	BridgeStatusOff   = "off"
+	BridgeStatusOn    = "on"
+	BridgeStatusError = "error"
+)
+
 type OperationalBridge struct {
 	netmux.Bridge
+	mx     sync.Mutex
 	cancel func(err error)
+	down   bool
+	state  runtimeState
+}
+
+// setError records a bridge failure. When down is true the bridge itself is not being served anymore.
+func (o *OperationalBridge) setError(err error, down bool) {
+	o.state.recordError(err)
+
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	o.down = o.down || down
+}
+
+func (o *OperationalBridge) Status() string {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	if o.down {
+		return BridgeStatusError
+	}
+
+	return BridgeStatusOn
 }
 
+func (o *OperationalBridge) setCancel(cancel func(err error)) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	o.cancel = cancel
+}
+
+func (o *OperationalBridge) Cancel(err error) {
+	o.mx.Lock()
+	cancel := o.cancel
+	o.mx.Unlock()
+
+	if cancel != nil {
+		cancel(err)
+	}
+}
+
+const (
+	EndpointStatusOff          = "off"
+	EndpointStatusConnecting   = "connecting"
+	EndpointStatusConnected    = "connected"
+	EndpointStatusReconnecting = "reconnecting"
+	EndpointStatusFailed       = "failed"
+)
+
+// ReconnectMaxElapsedTime limits for how long the daemon will try to restore a lost control connection before
+// flagging the endpoint as failed.
+const ReconnectMaxElapsedTime = time.Minute * 5
+
 type OperationalEndPoint struct {
+	sync.RWMutex
 	agent              *netmux.Agent
+	closeSession       func(err error)
+	status             string
 	config             config.Endpoint
 	cancel             func(err error)
 	availableBridges   *memstore.Map[netmux.Bridge]
 	operationalBridges *memstore.Map[*OperationalBridge]
+	// bridgeRestarts counts, per bridge name, how many times bridges were restarted after failures or reconnections.
+	bridgeRestarts *memstore.Map[int]
+	conns          *memstore.Map[*trackedConn]
+	state          runtimeState
+	// ctx lives as long as the endpoint is connected, and portForwarder or sshDialer (when the endpoint is reached
+	// through one) along with it, across sessions.
+	ctx           context.Context //nolint:containedctx
+	portForwarder *portforwarder.PortForwarder
+	sshDialer     *sshdial.Dialer
+	// transport is the one the current session goes over.
+	transport string
+	// tun is the TUN device routing the cluster networks through the endpoint, if any.
+	tun *tun.Device
 }
 
 func NewOperationalEndPoint() *OperationalEndPoint {
 	return &OperationalEndPoint{
 		agent:              &netmux.Agent{},
+		closeSession:       func(err error) {},
+		status:             EndpointStatusConnecting,
 		config:             config.Endpoint{},
 		cancel:             func(err error) {},
 		availableBridges:   memstore.New[netmux.Bridge](),
 		operationalBridges: memstore.New[*OperationalBridge](),
+		bridgeRestarts:     memstore.New[int](),
+		conns:              memstore.New[*trackedConn](),
+	}
+}
+
+func (o *OperationalEndPoint) Agent() *netmux.Agent {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.agent
+}
+
+func (o *OperationalEndPoint) Status() string {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.status
+}
+
+func (o *OperationalEndPoint) setStatus(status string) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.status = status
+}
+
+// setSession replaces the agent (and the function closing its session) used by this endpoint.
+func (o *OperationalEndPoint) setSession(agent *netmux.Agent, closeSession func(err error)) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.agent = agent
+	o.closeSession = closeSession
+	o.status = EndpointStatusConnected
+}
+
+func (o *OperationalEndPoint) setTransport(transport string) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.transport = transport
+}
+
+func (o *OperationalEndPoint) setTunDevice(device *tun.Device) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.tun = device
+}
+
+func (o *OperationalEndPoint) tunDevice() *tun.Device {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.tun
+}
+
+func (o *OperationalEndPoint) Transport() string {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.transport
+}
+
+func (o *OperationalEndPoint) portForwardPods() []string {
+	o.RLock()
+	defer o.RUnlock()
+
+	if o.portForwarder == nil {
+		return nil
+	}
+
+	return o.portForwarder.Pods()
+}
+
+// restartSession closes the current session, for the agent to reconnect.
+func (o *OperationalEndPoint) restartSession(err error) {
+	o.RLock()
+	closeSession := o.closeSession
+	o.RUnlock()
+
+	closeSession(err)
+}
+
+// BridgeError implements netmux.BridgeObserver, keeping track of failures on running bridges.
+func (o *OperationalEndPoint) BridgeError(bridge netmux.Bridge, err error) {
+	if opBridge := o.operationalBridges.Get(bridge.Name); opBridge != nil {
+		opBridge.setError(err, false)
+	}
+}
+
+// BridgeConnOpened implements netmux.BridgeObserver.
+func (o *OperationalEndPoint) BridgeConnOpened(conn *netmux.BridgeConn) {
+	o.conns.Set(conn.ID, &trackedConn{BridgeConn: conn})
+	o.state.connOpened()
+
+	if opBridge := o.operationalBridges.Get(conn.Bridge.Name); opBridge != nil {
+		opBridge.state.connOpened()
+	}
+}
+
+// BridgeConnClosed implements netmux.BridgeObserver.
+func (o *OperationalEndPoint) BridgeConnClosed(conn *netmux.BridgeConn) {
+	o.conns.Del(conn.ID)
+	o.state.connClosed()
+
+	if opBridge := o.operationalBridges.Get(conn.Bridge.Name); opBridge != nil {
+		opBridge.state.connClosed()
+	}
+}
+
+// BridgeTraffic implements netmux.BridgeObserver.
+func (o *OperationalEndPoint) BridgeTraffic(conn *netmux.BridgeConn, in int64, out int64) {
+	if tracked := o.conns.Get(conn.ID); tracked != nil {
+		tracked.bytesIn.Add(in)
+		tracked.bytesOut.Add(out)
 	}
+
+	o.state.traffic(in, out)
+
+	if opBridge := o.operationalBridges.Get(conn.Bridge.Name); opBridge != nil {
+		opBridge.state.traffic(in, out)
+	}
+}
+
+// countRestart increments, and returns, the amount of restarts of a bridge.
+func (o *OperationalEndPoint) countRestart(name string) int {
+	o.Lock()
+	defer o.Unlock()
+
+	restarts := o.bridgeRestarts.Get(name) + 1
+	o.bridgeRestarts.Set(name, restarts)
+
+	return restarts
+}
+
+// suspendBridges stops all running bridges, returning their names, so they can be restored later on.
+func (o *OperationalEndPoint) suspendBridges(cause error) []string {
+	names := make([]string, 0)
+
+	_ = o.operationalBridges.ForEach(func(k string, v *OperationalBridge) error {
+		names = append(names, k)
+
+		return nil
+	})
+
+	for _, name := range names {
+		if v := o.operationalBridges.Get(name); v != nil {
+			v.Cancel(cause)
+		}
+
+		o.operationalBridges.Del(name)
+	}
+
+	return names
 }
 
 type StatusBridges struct {
 	netmux.Bridge
+	RuntimeState
 	Status string `json:"status"`
 }
 
 type StatusEndPoints struct {
 	config.Endpoint
+	RuntimeState
 	Status  string          `json:"status"`
 	Bridges []StatusBridges `json:"bridges"`
+	// PortForwardPods are the pods the port forwards of the endpoint currently go to, the primary one first.
+	PortForwardPods []string `json:"portForwardPods,omitempty"`
+	// Transport is the one the session of the endpoint goes over: tcp, websocket, quic or ssh.
+	Transport string `json:"transport,omitempty"`
 }
 
 type Status struct {
 	Endpoints []StatusEndPoints `json:"endpoints"`
+	// Network is the one bridge addresses come from, and NetworkConflicts the local networks found overlapping the
+	// configured one.
+	Network          string                      `json:"network"`
+	NetworkConflicts []networkallocator.Conflict `json:"networkConflicts,omitempty"`
+	// NameConflicts are the aliases bridges could not get, as bridges of other endpoints have them.
+	NameConflicts []NameConflict `json:"nameConflicts,omitempty"`
 }
 
 type Daemon struct {
@@ -70,6 +320,11 @@ type Daemon struct {
 	networkAllocator     *networkallocator.NetworkAllocator
 	operationalEndpoints *memstore.Map[*OperationalEndPoint]
 	metricsFactroy       metrics.Factory
+	naming               *naming
+	// bridges tracks running proxy bridges, so Shutdown can wait for them to release their addresses.
+	bridges  sync.WaitGroup
+	exit     chan struct{}
+	exitOnce sync.Once
 }
 
 type Opts func(d *Daemon)
@@ -85,6 +340,8 @@ func New(cfg *config.Config, nw *networkallocator.NetworkAllocator, opts ...Opts
 		cfg:                  cfg,
 		networkAllocator:     nw,
 		operationalEndpoints: memstore.New[*OperationalEndPoint](),
+		naming:               newNaming(cfg.DNS.Aliases),
+		exit:                 make(chan struct{}),
 	}
 	for _, opt := range opts {
 		opt(ret)
@@ -97,92 +354,280 @@ func (d *Daemon) GetConfig() *config.Config {
 	return d.cfg
 }
 
-//nolint:funlen,cyclop
 func (d *Daemon) Connect(ctx context.Context, endpointName string) error {
 	if ctx.Err() != nil {
 		return fmt.Errorf("context cancelled when connecting: %w", ctx.Err())
 	}
 
-	endpoint := d.operationalEndpoints.Get(endpointName)
-	if endpoint != nil {
-		return ErrEndpointAlreadyConnected
-	}
+	if endpoint := d.operationalEndpoints.Get(endpointName); endpoint != nil {
+		if endpoint.Status() != EndpointStatusFailed {
+			return ErrEndpointAlreadyConnected
+		}
 
-	ctx, cancel := context.WithCancelCause(ctx)
+		endpoint.cancel(fmt.Errorf("connecting again after failure"))
+		d.operationalEndpoints.Del(endpointName)
+	}
 
 	epCfg, found := d.cfg.Endpoints.FindByName(endpointName)
 	if !found {
 		return fmt.Errorf("config not found for endpoint %s", endpointName)
 	}
 
-	var localAgent *netmux.Agent
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	operationalEndPoint := NewOperationalEndPoint()
+
+	operationalEndPoint.cancel = cancel
+	operationalEndPoint.config = epCfg
+	operationalEndPoint.ctx = ctx
+
+	localAgent, closeSession, err := d.connectSession(ctx, operationalEndPoint)
+	if err != nil {
+		cancel(fmt.Errorf("error connecting: %w", err))
+
+		return fmt.Errorf("could not connect to endpoint: %w", err)
+	}
+
+	operationalEndPoint.setSession(localAgent, closeSession)
+	operationalEndPoint.state.started()
+
+	if err = d.serveProxies(ctx, operationalEndPoint); err != nil {
+		cancel(fmt.Errorf("error serving proxies: %w", err))
+
+		return err
+	}
+
+	if err = d.serveTun(ctx, operationalEndPoint); err != nil {
+		cancel(fmt.Errorf("error serving tun: %w", err))
+
+		return err
+	}
+
+	go d.superviseEndpoint(ctx, operationalEndPoint)
+
+	d.operationalEndpoints.Set(endpointName, operationalEndPoint)
+
+	return nil
+}
+
+// connectSession starts the port forward (if required) and the agent on top of it. Both will live until the returned
+// function is called or the context is done.
+func (d *Daemon) connectSession(
+	ctx context.Context,
+	operationalEndPoint *OperationalEndPoint,
+) (*netmux.Agent, func(err error), error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	epCfg := operationalEndPoint.config
+
+	agentEndpoint := epCfg.Endpoint
+
+	agentOpts := []netmux.AgentOpts{
+		netmux.AgentWithMetrics(d.metricsFactroy),
+		netmux.AgentWithFilter(epCfg.Filter),
+		netmux.AgentWithObserver(operationalEndPoint),
+		netmux.AgentWithNamer(&endpointNamer{naming: d.naming, endpoint: epCfg}),
+		netmux.AgentWithProxyRetry(epCfg.ProxyRetry),
+	}
+
+	dial, transport, err := dialerFor(ctx, operationalEndPoint)
+	if err != nil {
+		cancel(fmt.Errorf("error setting up dialer: %w", err))
+
+		return nil, nil, err
+	}
+
+	agentOpts = append(agentOpts, netmux.AgentWithDialer(dial))
 
-	var err error
+	operationalEndPoint.setTransport(transport)
 
 	if epCfg.Kubernetes != (portforwarder.KubernetesInfo{}) {
-		portForwarder := portforwarder.New()
-		if err := portForwarder.Start(ctx, epCfg.Kubernetes); err != nil {
+		portForwarder, err := d.portForward(operationalEndPoint)
+		if err != nil {
 			cancel(fmt.Errorf("error starting portforwad: %w", err))
 
-			return fmt.Errorf("error connecting port forward: %w", err)
+			return nil, nil, fmt.Errorf("error connecting port forward: %w", err)
 		}
 
-		agentEndPointPortForward := net.JoinHostPort("localhost", strconv.Itoa(portForwarder.Port))
+		agentEndpoint = net.JoinHostPort("localhost", strconv.Itoa(portForwarder.LocalPort()))
 
-		localAgent, err = netmux.NewAgent(ctx,
-			agentEndPointPortForward, d.networkAllocator, netmux.AgentWithMetrics(d.metricsFactroy))
-		if err != nil {
-			cancel(fmt.Errorf("error creating agent: %w", err))
+		// with several replicas forwarded, connections are spread across all of them.
+		agentOpts = append(agentOpts, netmux.AgentWithEndpoints(func() []string {
+			ports := portForwarder.LocalPorts()
+			ret := make([]string, 0, len(ports))
 
-			return fmt.Errorf("could not connect to endpoint")
-		}
-	} else {
-		localAgent, err = netmux.NewAgent(ctx, epCfg.Endpoint, d.networkAllocator, netmux.AgentWithMetrics(d.metricsFactroy))
-		if err != nil {
-			cancel(fmt.Errorf("error creating agent: %w", err))
+			for _, port := range ports {
+				ret = append(ret, net.JoinHostPort("localhost", strconv.Itoa(port)))
+			}
 
-			return fmt.Errorf("could not connect to endpoint")
-		}
+			return ret
+		}))
 	}
 
-	operationalEndPoint := NewOperationalEndPoint()
+	localAgent, err := netmux.NewAgent(ctx, agentEndpoint, d.networkAllocator, agentOpts...)
+	if err != nil {
+		cancel(fmt.Errorf("error creating agent: %w", err))
 
-	operationalEndPoint.agent = localAgent
-	operationalEndPoint.cancel = cancel
-	operationalEndPoint.config = epCfg
-	operationalEndPoint.availableBridges = memstore.New[netmux.Bridge]()
-
-	go func(operationalEndPoint *OperationalEndPoint) {
-		for {
-			select {
-			case <-ctx.Done():
-				_ = operationalEndPoint.operationalBridges.ForEach(func(k string, v *OperationalBridge) error {
-					if v == nil || v.cancel == nil {
-						return nil
-					}
+		return nil, nil, fmt.Errorf("error creating agent: %w", err)
+	}
+
+	return localAgent, cancel, nil
+}
 
-					v.cancel(fmt.Errorf("connection closing: %w", ctx.Err()))
+// portForward returns the port forward of the endpoint, starting it if needed. It lives as long as the endpoint,
+// following the pods it points at: when the primary one is established again, on a new local port, the session is
+// closed for the agent to reconnect on top of it.
+func (d *Daemon) portForward(operationalEndPoint *OperationalEndPoint) (*portforwarder.PortForwarder, error) {
+	operationalEndPoint.Lock()
+	defer operationalEndPoint.Unlock()
 
-					return nil
-				})
+	if operationalEndPoint.portForwarder != nil {
+		return operationalEndPoint.portForwarder, nil
+	}
+
+	portForwarder := portforwarder.New()
+	portForwarder.OnError = func(err error) {
+		operationalEndPoint.state.recordError(fmt.Errorf("port forward: %w", err))
+	}
+	portForwarder.OnReconnect = func(port int) {
+		slog.Info("port forward moved, reconnecting", "endpoint", operationalEndPoint.config.Name, "port", port)
+		operationalEndPoint.restartSession(fmt.Errorf("port forward moved to port %d", port))
+	}
+
+	if err := portForwarder.Start(operationalEndPoint.ctx, operationalEndPoint.config.Kubernetes); err != nil {
+		return nil, fmt.Errorf("error starting port forward: %w", err)
+	}
+
+	operationalEndPoint.portForwarder = portForwarder
+
+	return portForwarder, nil
+}
+
+// superviseEndpoint consumes the endpoint events, keeping available bridges up to date. When the control connection
+// is lost, it suspends running bridges, reconnects and restores them as soon as the server announces them again - if
+// it does before telling it announced all of them.
+//
+//nolint:cyclop
+func (d *Daemon) superviseEndpoint(ctx context.Context, operationalEndPoint *OperationalEndPoint) {
+	toRestore := map[string]bool{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			operationalEndPoint.suspendBridges(fmt.Errorf("connection closing: %w", ctx.Err()))
+
+			return
+		case evt, ok := <-operationalEndPoint.Agent().Events():
+			// on disconnect, the control connection goes away along with ctx: nothing to reconnect.
+			if !ok && ctx.Err() != nil {
+				operationalEndPoint.suspendBridges(fmt.Errorf("connection closing: %w", ctx.Err()))
 
 				return
-			case evt := <-localAgent.Events():
-				slog.Info(fmt.Sprintf("Event: %v: %s", evt.EvtName, evt.Bridge.String()))
-
-				switch evt.EvtName {
-				case netmux.EventBridgeUp:
-					operationalEndPoint.availableBridges.Set(evt.Bridge.Name, evt.Bridge)
-				case netmux.EventBridgeDel:
-					operationalEndPoint.availableBridges.Del(evt.Bridge.Name)
-				case netmux.EventBridgeAdd:
-					operationalEndPoint.availableBridges.Set(evt.Bridge.Name, evt.Bridge)
+			}
+
+			if !ok {
+				lostErr := fmt.Errorf("control connection lost")
+
+				operationalEndPoint.state.recordError(lostErr)
+
+				// bridges not announced again since the previous reconnect are gone: only running ones are restored.
+				toRestore = map[string]bool{}
+
+				for _, name := range operationalEndPoint.suspendBridges(lostErr) {
+					toRestore[name] = true
 				}
+
+				if err := d.reconnect(ctx, operationalEndPoint); err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+
+					slog.Warn("giving up reconnecting", "endpoint", operationalEndPoint.config.Name, "err", err)
+					operationalEndPoint.state.recordError(err)
+					operationalEndPoint.setStatus(EndpointStatusFailed)
+
+					return
+				}
+
+				operationalEndPoint.state.restarted()
+
+				// the cluster networks may have changed meanwhile.
+				if err := d.serveTun(ctx, operationalEndPoint); err != nil {
+					slog.Warn("error refreshing tun", "endpoint", operationalEndPoint.config.Name, "err", err)
+					operationalEndPoint.state.recordError(err)
+				}
+
+				continue
 			}
+
+			slog.Info(fmt.Sprintf("Event: %v: %s", evt.EvtName, evt.Bridge.String()))
+
+			switch evt.EvtName {
+			case netmux.EventBridgeUp:
+				operationalEndPoint.availableBridges.Set(evt.Bridge.Name, evt.Bridge)
+			case netmux.EventBridgeDel:
+				operationalEndPoint.availableBridges.Del(evt.Bridge.Name)
+				delete(toRestore, evt.Bridge.Name)
+			case netmux.EventBridgeAdd:
+				operationalEndPoint.availableBridges.Set(evt.Bridge.Name, evt.Bridge)
+			case netmux.EventReplayDone:
+				// the server announced all its bridges: the ones left were removed while reconnecting.
+				for name := range toRestore {
+					slog.Warn("bridge gone while reconnecting, not restored", "bridge", name)
+				}
+
+				toRestore = map[string]bool{}
+			}
+
+			if toRestore[evt.Bridge.Name] && evt.EvtName != netmux.EventBridgeDel {
+				delete(toRestore, evt.Bridge.Name)
+				operationalEndPoint.countRestart(evt.Bridge.Name)
+
+				if err := d.startIndividualService(ctx, operationalEndPoint.config.Name, evt.Bridge.Name); err != nil {
+					slog.Warn("error restoring bridge", "bridge", evt.Bridge.Name, "err", err)
+				}
+			}
+		}
+	}
+}
+
+// reconnect closes the current session and retries creating a new one, with exponential backoff.
+func (d *Daemon) reconnect(ctx context.Context, operationalEndPoint *OperationalEndPoint) error {
+	operationalEndPoint.setStatus(EndpointStatusReconnecting)
+	operationalEndPoint.closeSession(fmt.Errorf("control connection lost"))
+
+	// server will announce its bridges again once we are back.
+	staleBridges := make([]string, 0)
+
+	_ = operationalEndPoint.availableBridges.ForEach(func(k string, _ netmux.Bridge) error {
+		staleBridges = append(staleBridges, k)
+
+		return nil
+	})
+
+	operationalEndPoint.availableBridges.Del(staleBridges...)
+
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxElapsedTime = ReconnectMaxElapsedTime
+
+	err := backoff.Retry(func() error {
+		localAgent, closeSession, err := d.connectSession(ctx, operationalEndPoint)
+		if err != nil {
+			slog.Warn("error reconnecting", "endpoint", operationalEndPoint.config.Name, "err", err)
+			operationalEndPoint.state.recordError(err)
+
+			return err
 		}
-	}(operationalEndPoint)
 
-	d.operationalEndpoints.Set(endpointName, operationalEndPoint)
+		operationalEndPoint.setSession(localAgent, closeSession)
+
+		return nil
+	}, backoff.WithContext(bo, ctx))
+	if err != nil {
+		return fmt.Errorf("error reconnecting %s: %w", operationalEndPoint.config.Name, err)
+	}
+
+	slog.Info("endpoint reconnected", "endpoint", operationalEndPoint.config.Name)
 
 	return nil
 }
@@ -199,8 +644,48 @@ func (d *Daemon) Disconnect(endpoint string) error {
 	return nil
 }
 
+// Exit asks the daemon to exit. It returns right away: the daemon owner is told through Done, and is expected to call
+// Shutdown.
 func (d *Daemon) Exit() {
-	os.Exit(1)
+	d.exitOnce.Do(func() {
+		close(d.exit)
+	})
+}
+
+// Done is closed when Exit is called.
+func (d *Daemon) Done() <-chan struct{} {
+	return d.exit
+}
+
+// Shutdown disconnects all endpoints and waits (up to timeout) for their bridges to end, releasing their addresses.
+func (d *Daemon) Shutdown(timeout time.Duration) error {
+	endpoints := make([]string, 0)
+
+	_ = d.operationalEndpoints.ForEach(func(k string, _ *OperationalEndPoint) error {
+		endpoints = append(endpoints, k)
+
+		return nil
+	})
+
+	for _, endpoint := range endpoints {
+		if err := d.Disconnect(endpoint); err != nil {
+			slog.Warn("error disconnecting", "endpoint", endpoint, "err", err)
+		}
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		d.bridges.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out waiting for bridges to end")
+	}
 }
 
 func (d *Daemon) CleanUp() error {
@@ -212,22 +697,30 @@ func (d *Daemon) CleanUp() error {
 }
 
 func (d *Daemon) GetStatus() Status {
-	ret := Status{}
+	ret := Status{
+		Network:          d.networkAllocator.Network(),
+		NetworkConflicts: d.networkAllocator.Conflicts(),
+		NameConflicts:    d.naming.Conflicts(),
+	}
 
 	for _, endpoint := range d.cfg.Endpoints {
 		epStatus := StatusEndPoints{
 			Endpoint: endpoint,
-			Status:   "off",
+			Status:   EndpointStatusOff,
 		}
 
 		opEndpoint := d.operationalEndpoints.Get(endpoint.Name)
 		if opEndpoint != nil {
-			epStatus.Status = "on"
+			epStatus.Status = opEndpoint.Status()
+			epStatus.RuntimeState = opEndpoint.state.Snapshot()
+			epStatus.PortForwardPods = opEndpoint.portForwardPods()
+			epStatus.Transport = opEndpoint.Transport()
 			_ = opEndpoint.availableBridges.ForEach(func(k string, v netmux.Bridge) error {
-				bridge := StatusBridges{Bridge: v, Status: "off"}
+				bridge := StatusBridges{Bridge: v, Status: BridgeStatusOff}
 				opBridge := opEndpoint.operationalBridges.Get(v.Name)
 				if opBridge != nil {
-					bridge.Status = "on"
+					bridge.RuntimeState = opBridge.state.Snapshot()
+					bridge.Status = opBridge.Status()
 				}
 				epStatus.Bridges = append(epStatus.Bridges, bridge)
 
@@ -248,11 +741,18 @@ func (d *Daemon) startIndividualService(ctx context.Context, endpoint string, sv
 	}
 
 	if op := managedEndpoint.operationalBridges.Get(svc); op != nil {
-		return ErrBridgeAlreadyConnected
+		if op.Status() != BridgeStatusError {
+			return ErrBridgeAlreadyConnected
+		}
+
+		// bridges that went down may be started again
+		op.Cancel(fmt.Errorf("restarting bridge %s", svc))
+		managedEndpoint.operationalBridges.Del(svc)
+		managedEndpoint.countRestart(svc)
 	}
 
 	bridge := managedEndpoint.availableBridges.Get(svc)
-	if bridge == (netmux.Bridge{}) {
+	if bridge.Name == "" {
 		return ErrBridgeNotFound
 	}
 
@@ -263,11 +763,22 @@ func (d *Daemon) startIndividualService(ctx context.Context, endpoint string, sv
 		cancel: cancel,
 	}
 
+	operationalBridge.state.started()
+	operationalBridge.state.restarts = managedEndpoint.bridgeRestarts.Get(svc)
+
 	switch bridge.Direction {
 	case netmux.DirectionL2C:
+		d.bridges.Add(1)
+
 		go func() {
-			if err := managedEndpoint.agent.ServeProxy(ctx, bridge); err != nil {
+			defer d.bridges.Done()
+
+			if err := managedEndpoint.Agent().ServeProxy(ctx, bridge); err != nil {
 				slog.Warn("error serving proxy", "err", err)
+
+				if ctx.Err() == nil {
+					operationalBridge.setError(err, true)
+				}
 			}
 		}()
 		managedEndpoint.operationalBridges.Set(svc, operationalBridge)
@@ -275,17 +786,25 @@ func (d *Daemon) startIndividualService(ctx context.Context, endpoint string, sv
 		return nil
 	case netmux.DirectionC2L:
 		go func() {
-			closer, err := managedEndpoint.agent.ServeReverse(ctx, bridge)
+			closer, err := managedEndpoint.Agent().ServeReverse(ctx, bridge)
 			if err != nil {
 				slog.Warn("error serving proxy", "err", err)
+				operationalBridge.setError(err, true)
+
+				return
 			}
 
-			operationalBridge.cancel = closer
+			operationalBridge.setCancel(func(err error) {
+				cancel(err)
+				closer(err)
+			})
 		}()
 		managedEndpoint.operationalBridges.Set(svc, operationalBridge)
 
 		return nil
 	default:
+		cancel(ErrBridgeDirectionInvalid)
+
 		return ErrBridgeDirectionInvalid
 	}
 }
@@ -380,7 +899,7 @@ func (d *Daemon) stopIndividualService(endpoint string, svc string) error {
 		return ErrBridgeNotFound
 	}
 
-	operationalBridge.cancel(fmt.Errorf("StopService called for %s", endpoint))
+	operationalBridge.Cancel(fmt.Errorf("StopService called for %s", endpoint))
 	managedEndpoint.operationalBridges.Del(svc)
 
 	return nil
@@ -390,6 +909,78 @@ func (d *Daemon) DNSEntries() []dnsallocator.DNSEntry {
 	return d.networkAllocator.DNSEntries()
 }
 
+// Hosts tells the names published by the daemon, and the addresses leased to them.
+type Hosts struct {
+	Entries []dnsallocator.DNSEntry `json:"entries"`
+	Leases  []ipallocator.Lease     `json:"leases"`
+}
+
+func (d *Daemon) Hosts() Hosts {
+	return Hosts{
+		Entries: d.networkAllocator.DNSEntries(),
+		Leases:  d.networkAllocator.Leases(),
+	}
+}
+
+// HostsBackups lists the backups of the hosts file, the most recent first.
+func (d *Daemon) HostsBackups() []string {
+	return d.networkAllocator.HostsBackups()
+}
+
+// RestoreHosts replaces the hosts file with its nth backup, from 1 - the most recent.
+func (d *Daemon) RestoreHosts(backup int) error {
+	return d.networkAllocator.RestoreHosts(backup) //nolint:wrapcheck
+}
+
+// ResolveDNS resolves query through the connected endpoints, with their cluster resolvers. The first successful answer
+// is returned; when no endpoint knows the name, the last negative answer is.
+func (d *Daemon) ResolveDNS(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	agents := make([]*netmux.Agent, 0)
+
+	_ = d.operationalEndpoints.ForEach(func(_ string, ep *OperationalEndPoint) error {
+		if ep.Status() == EndpointStatusConnected {
+			agents = append(agents, ep.Agent())
+		}
+
+		return nil
+	})
+
+	var (
+		answer *dns.Msg
+		err    error
+	)
+
+	for _, agent := range agents {
+		var res *dns.Msg
+
+		res, err = agent.ResolveDNS(ctx, query)
+		if err != nil {
+			continue
+		}
+
+		answer = res
+
+		if res.Rcode == dns.RcodeSuccess && len(res.Answer) > 0 {
+			return res, nil
+		}
+	}
+
+	switch {
+	case answer != nil:
+		return answer, nil
+	case err != nil:
+		return nil, fmt.Errorf("error resolving through endpoints: %w", err)
+	default:
+		return nil, ErrEndpointNotConnected
+	}
+}
+
 func (d *Daemon) Reload() error {
-	return d.cfg.Load("")
+	if err := d.cfg.Load(""); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	d.naming.setAliases(d.cfg.DNS.Aliases)
+
+	return nil
 }
@@ -0,0 +1,189 @@
+package daemon
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/duxthemux/netmux/app/nx-daemon/config"
+	"github.com/duxthemux/netmux/business/netmux"
+)
+
+// NameConflict is an alias a bridge could not get, as the bridge of another endpoint (or namespace) has it.
+type NameConflict struct {
+	Name string `json:"name"`
+	// Owner is the endpoint whose bridge, OwnerBridge, has the name.
+	Owner       string `json:"owner"`
+	OwnerBridge string `json:"ownerBridge"`
+	// Endpoint is the one whose bridge, Bridge, is reachable at its fully qualified name only.
+	Endpoint string `json:"endpoint"`
+	Bridge   string `json:"bridge"`
+}
+
+type nameOwner struct {
+	endpoint string
+	fqdn     string
+}
+
+// naming gives bridges their names: the fully qualified svc.ns.endpoint one, always unique, and the aliases nobody else
+// has. Aliases go to the first bridge asking for them, until it releases them.
+type naming struct {
+	mx        sync.Mutex
+	aliases   []string
+	owners    map[string]nameOwner
+	conflicts []NameConflict
+}
+
+func newNaming(aliases []string) *naming {
+	return &naming{
+		aliases: aliases,
+		owners:  map[string]nameOwner{},
+	}
+}
+
+// setAliases changes the aliases given to bridges from now on.
+func (n *naming) setAliases(aliases []string) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	n.aliases = aliases
+}
+
+// candidates returns the fully qualified name of a bridge of endpoint, and the aliases it would like to have.
+func (n *naming) candidates(endpoint config.Endpoint, bridge netmux.Bridge) (string, []string) {
+	svc := bridge.LocalAddr
+	if svc == "" {
+		svc = bridge.Name
+	}
+
+	svc = strings.ToLower(svc)
+	ns := strings.ToLower(bridge.Namespace)
+	epName := strings.ToLower(endpoint.Name)
+
+	fqdn := strings.Join(slices.DeleteFunc([]string{svc, ns, epName}, func(s string) bool { return s == "" }), ".")
+
+	replacer := strings.NewReplacer("{svc}", svc, "{ns}", ns, "{endpoint}", epName)
+
+	n.mx.Lock()
+	templates := n.aliases
+	n.mx.Unlock()
+
+	aliases := make([]string, 0, len(templates)+1)
+
+	if ns == "" || strings.EqualFold(bridge.Namespace, endpoint.DefaultNamespace) {
+		aliases = append(aliases, svc)
+	}
+
+	for _, alias := range templates {
+		if ns == "" && strings.Contains(alias, "{ns}") {
+			continue
+		}
+
+		alias = strings.ToLower(replacer.Replace(alias))
+		if alias != fqdn && !slices.Contains(aliases, alias) {
+			aliases = append(aliases, alias)
+		}
+	}
+
+	return fqdn, aliases
+}
+
+// claim returns the names of a bridge: its fully qualified name first, and the aliases it could get.
+func (n *naming) claim(endpoint config.Endpoint, bridge netmux.Bridge) []string {
+	fqdn, aliases := n.candidates(endpoint, bridge)
+
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	ret := []string{fqdn}
+
+	for _, alias := range aliases {
+		owner, owned := n.owners[alias]
+		if owned && owner.fqdn != fqdn {
+			n.unSyncConflict(NameConflict{
+				Name:        alias,
+				Owner:       owner.endpoint,
+				OwnerBridge: owner.fqdn,
+				Endpoint:    endpoint.Name,
+				Bridge:      fqdn,
+			})
+
+			continue
+		}
+
+		n.owners[alias] = nameOwner{endpoint: endpoint.Name, fqdn: fqdn}
+		ret = append(ret, alias)
+	}
+
+	return ret
+}
+
+func (n *naming) unSyncConflict(conflict NameConflict) {
+	slog.Warn("name already taken by another bridge, use the fully qualified name instead",
+		"name", conflict.Name, "owner", conflict.Owner, "ownerBridge", conflict.OwnerBridge,
+		"endpoint", conflict.Endpoint, "bridge", conflict.Bridge)
+
+	if !slices.Contains(n.conflicts, conflict) {
+		n.conflicts = append(n.conflicts, conflict)
+	}
+}
+
+// release gives up the aliases of a bridge, forgetting its conflicts.
+func (n *naming) release(endpoint config.Endpoint, bridge netmux.Bridge) {
+	fqdn, _ := n.candidates(endpoint, bridge)
+
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	for alias, owner := range n.owners {
+		if owner.fqdn == fqdn {
+			delete(n.owners, alias)
+		}
+	}
+
+	n.conflicts = slices.DeleteFunc(n.conflicts, func(conflict NameConflict) bool {
+		return conflict.Bridge == fqdn || conflict.OwnerBridge == fqdn
+	})
+}
+
+// reachable returns the names a bridge of endpoint is (or would be) reachable at: its fully qualified name and the
+// aliases no other bridge has.
+func (n *naming) reachable(endpoint config.Endpoint, bridge netmux.Bridge) []string {
+	fqdn, aliases := n.candidates(endpoint, bridge)
+
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	ret := []string{fqdn}
+
+	for _, alias := range aliases {
+		if owner, owned := n.owners[alias]; !owned || owner.fqdn == fqdn {
+			ret = append(ret, alias)
+		}
+	}
+
+	return ret
+}
+
+// Conflicts lists the aliases bridges could not get.
+func (n *naming) Conflicts() []NameConflict {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	return slices.Clone(n.conflicts)
+}
+
+// endpointNamer names the bridges of an endpoint.
+type endpointNamer struct {
+	naming   *naming
+	endpoint config.Endpoint
+}
+
+func (e *endpointNamer) Names(bridge netmux.Bridge) []string {
+	return e.naming.claim(e.endpoint, bridge)
+}
+
+func (e *endpointNamer) ReleaseNames(bridge netmux.Bridge) {
+	e.naming.release(e.endpoint, bridge)
+}
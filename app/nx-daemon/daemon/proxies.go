@@ -0,0 +1,168 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/duxthemux/netmux/app/nx-daemon/config"
+	"github.com/duxthemux/netmux/business/netmux"
+	"github.com/duxthemux/netmux/foundation/httpproxy"
+	"github.com/duxthemux/netmux/foundation/socks5"
+)
+
+// serveProxies runs the SOCKS5 and HTTP proxies configured for the endpoint, until ctx is done. Proxies carry
+// connections through whatever agent the endpoint has at the moment.
+func (d *Daemon) serveProxies(ctx context.Context, operationalEndPoint *OperationalEndPoint) error {
+	if d.cfg.DisableProxies {
+		return nil
+	}
+
+	epCfg := operationalEndPoint.config
+
+	if epCfg.Socks != "" {
+		srv := socks5.New(endpointDialer(operationalEndPoint, socks5.ErrNotAllowed))
+
+		if err := serveProxy(ctx, operationalEndPoint, "socks", epCfg.Socks, srv.Serve); err != nil {
+			return err
+		}
+	}
+
+	if epCfg.HTTPProxy != "" {
+		srv := httpproxy.New(endpointDialer(operationalEndPoint, httpproxy.ErrNotAllowed))
+
+		if err := serveProxy(ctx, operationalEndPoint, "http proxy", epCfg.HTTPProxy, srv.Serve); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func serveProxy(
+	ctx context.Context,
+	operationalEndPoint *OperationalEndPoint,
+	kind string,
+	addr string,
+	serve func(ctx context.Context, listener net.Listener) error,
+) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening for %s at %s: %w", kind, addr, err)
+	}
+
+	go func() {
+		if err := serve(ctx, listener); err != nil && ctx.Err() == nil {
+			operationalEndPoint.state.recordError(err)
+			slog.Warn(kind+" ended", "endpoint", operationalEndPoint.config.Name, "err", err)
+		}
+	}()
+
+	return nil
+}
+
+// endpointDialer connects through the endpoint agent, wrapping notAllowed in errors caused by the service dial policy.
+func endpointDialer(
+	operationalEndPoint *OperationalEndPoint,
+	notAllowed error,
+) func(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+	return func(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+		conn, err := operationalEndPoint.Agent().Proxy(ctx, netmux.ProxyRequest{
+			Name:     "proxy",
+			Family:   netmux.FamilyTCP,
+			Endpoint: addr,
+		})
+		if errors.Is(err, netmux.ErrDialDenied) {
+			return nil, fmt.Errorf("%w: %w", notAllowed, err)
+		}
+
+		return conn, err //nolint:wrapcheck
+	}
+}
+
+// proxiesFor returns, in PAC format, the proxies configured for the endpoint.
+func proxiesFor(epCfg config.Endpoint) string {
+	proxies := make([]string, 0)
+
+	if epCfg.HTTPProxy != "" {
+		proxies = append(proxies, "PROXY "+epCfg.HTTPProxy)
+	}
+
+	if epCfg.Socks != "" {
+		proxies = append(proxies, "SOCKS5 "+epCfg.Socks, "SOCKS "+epCfg.Socks)
+	}
+
+	return strings.Join(proxies, "; ")
+}
+
+// PAC generates a proxy auto-config file routing cluster domains and the names of known bridges through the proxies
+// of connected endpoints, and everything else directly.
+func (d *Daemon) PAC() string {
+	buf := &strings.Builder{}
+
+	buf.WriteString("function FindProxyForURL(url, host) {\n")
+	buf.WriteString("  host = host.toLowerCase();\n")
+
+	if !d.cfg.DisableProxies {
+		d.writePACRules(buf)
+	}
+
+	buf.WriteString("  return \"DIRECT\";\n}\n")
+
+	return buf.String()
+}
+
+func (d *Daemon) writePACRules(buf *strings.Builder) {
+	names := make([]string, 0)
+	endpoints := map[string]*OperationalEndPoint{}
+
+	_ = d.operationalEndpoints.ForEach(func(name string, ep *OperationalEndPoint) error {
+		if ep.Status() == EndpointStatusConnected && proxiesFor(ep.config) != "" {
+			names = append(names, name)
+			endpoints[name] = ep
+		}
+
+		return nil
+	})
+
+	sort.Strings(names)
+
+	clusterProxies := ""
+
+	for _, name := range names {
+		ep := endpoints[name]
+		proxies := proxiesFor(ep.config)
+
+		if clusterProxies == "" {
+			clusterProxies = proxies
+		}
+
+		hosts := make([]string, 0)
+
+		_ = ep.availableBridges.ForEach(func(_ string, bridge netmux.Bridge) error {
+			hosts = append(hosts, d.naming.reachable(ep.config, bridge)...)
+
+			return nil
+		})
+
+		sort.Strings(hosts)
+
+		for _, host := range hosts {
+			fmt.Fprintf(buf, "  if (host == %q) return %q;\n", strings.ToLower(host), proxies)
+		}
+	}
+
+	if clusterProxies == "" {
+		return
+	}
+
+	for _, domain := range d.cfg.DNS.Domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		fmt.Fprintf(buf, "  if (host == %q || dnsDomainIs(host, %q)) return %q;\n", domain, "."+domain, clusterProxies)
+	}
+}
@@ -0,0 +1,102 @@
+package daemon
+
+import (
+	"sync"
+	"time"
+)
+
+// RuntimeState is the public view of what happened to an endpoint or bridge while it was running.
+type RuntimeState struct {
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+	Failures    int        `json:"failures,omitempty"`
+	Restarts    int        `json:"restarts,omitempty"`
+	ActiveConns int64      `json:"activeConns"`
+	BytesIn     int64      `json:"bytesIn"`
+	BytesOut    int64      `json:"bytesOut"`
+}
+
+// runtimeState keeps track of RuntimeState, allowing concurrent updates.
+type runtimeState struct {
+	sync.Mutex
+	startedAt   time.Time
+	lastErr     string
+	lastErrAt   time.Time
+	failures    int
+	restarts    int
+	activeConns int64
+	bytesIn     int64
+	bytesOut    int64
+}
+
+func (r *runtimeState) started() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.startedAt = time.Now()
+}
+
+func (r *runtimeState) restarted() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.restarts++
+}
+
+func (r *runtimeState) recordError(err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.lastErr = err.Error()
+	r.lastErrAt = time.Now()
+	r.failures++
+}
+
+func (r *runtimeState) connOpened() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.activeConns++
+}
+
+func (r *runtimeState) connClosed() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.activeConns--
+}
+
+func (r *runtimeState) traffic(in int64, out int64) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.bytesIn += in
+	r.bytesOut += out
+}
+
+func (r *runtimeState) Snapshot() RuntimeState {
+	r.Lock()
+	defer r.Unlock()
+
+	ret := RuntimeState{
+		LastError:   r.lastErr,
+		Failures:    r.failures,
+		Restarts:    r.restarts,
+		ActiveConns: r.activeConns,
+		BytesIn:     r.bytesIn,
+		BytesOut:    r.bytesOut,
+	}
+
+	if !r.startedAt.IsZero() {
+		startedAt := r.startedAt
+		ret.StartedAt = &startedAt
+	}
+
+	if !r.lastErrAt.IsZero() {
+		lastErrAt := r.lastErrAt
+		ret.LastErrorAt = &lastErrAt
+	}
+
+	return ret
+}
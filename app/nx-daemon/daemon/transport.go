@@ -0,0 +1,275 @@
+package daemon
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/duxthemux/netmux/app/nx-daemon/config"
+	"github.com/duxthemux/netmux/business/netmux"
+	"github.com/duxthemux/netmux/foundation/quicconn"
+	"github.com/duxthemux/netmux/foundation/sshdial"
+	"github.com/duxthemux/netmux/foundation/upstream"
+	"github.com/duxthemux/netmux/foundation/wsconn"
+)
+
+// Transports sessions go over.
+const (
+	TransportTCP       = "tcp"
+	TransportWebSocket = "websocket"
+	TransportQUIC      = "quic"
+	TransportSSH       = "ssh"
+)
+
+var ErrNoSSHAuth = fmt.Errorf("no ssh key configured, nor ssh agent running (SSH_AUTH_SOCK)")
+
+// QUICConnectTimeout is for how long quic is tried, when connecting, before falling back to tcp.
+const QUICConnectTimeout = time.Second * 5
+
+// dialerFor returns how the agent of the endpoint reaches the service, for as long as ctx lives, and the transport it
+// goes over. Connections over tcp (websockets and ssh included) go through the upstream proxy, if any.
+func dialerFor(ctx context.Context, operationalEndPoint *OperationalEndPoint) (netmux.DialFunc, string, error) {
+	epCfg := operationalEndPoint.config
+	upstreamDialer := upstreamFor(epCfg)
+
+	if epCfg.IsSSH() {
+		dialer, err := sshDial(ctx, operationalEndPoint, upstreamDialer)
+		if err != nil {
+			return nil, "", fmt.Errorf("endpoint %s: %w", epCfg.Name, err)
+		}
+
+		return dialer.Dial, TransportSSH, nil
+	}
+
+	if !epCfg.IsWebSocket() && epCfg.QUIC == "" {
+		return upstreamDialer.Dial, TransportTCP, nil
+	}
+
+	tlsConfig, err := endpointTLSConfig(epCfg.TLS)
+	if err != nil {
+		return nil, "", fmt.Errorf("endpoint %s: %w", epCfg.Name, err)
+	}
+
+	token, err := endpointToken(epCfg)
+	if err != nil {
+		return nil, "", fmt.Errorf("endpoint %s: %w", epCfg.Name, err)
+	}
+
+	if epCfg.IsWebSocket() {
+		dialer := &wsconn.Dialer{TLSConfig: tlsConfig, Token: token, NetDial: upstreamDialer.Dial}
+
+		return dialer.Dial, TransportWebSocket, nil
+	}
+
+	dialer := quicconn.NewDialer(epCfg.QUIC, tlsConfig, token)
+
+	connectCtx, cancel := context.WithTimeout(ctx, QUICConnectTimeout)
+	defer cancel()
+
+	if err = dialer.Connect(connectCtx); err != nil {
+		slog.Warn("could not connect over quic, falling back to tcp", "endpoint", epCfg.Name, "quic", epCfg.QUIC,
+			"err", err)
+
+		return upstreamDialer.Dial, TransportTCP, nil
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		if err := dialer.Close(); err != nil {
+			slog.Warn("error closing quic connection", "endpoint", epCfg.Name, "err", err)
+		}
+	}()
+
+	return dialer.Dial, TransportQUIC, nil
+}
+
+// upstreamFor returns the dialer going through the upstream proxy of the endpoint, or the ones of the environment.
+func upstreamFor(epCfg config.Endpoint) *upstream.Dialer {
+	opts := []upstream.Opts{upstream.WithAuth(epCfg.Upstream.Auth)}
+
+	if epCfg.Upstream.URL != "" {
+		opts = append(opts, upstream.WithProxy(epCfg.Upstream.URL, epCfg.Upstream.NoProxy))
+	}
+
+	return upstream.New(opts...)
+}
+
+// sshDial returns the ssh dialer of the endpoint, connecting it if needed. As the port forward, it lives as long as the
+// endpoint: sessions established again reuse its ssh connection, when still up.
+func sshDial(
+	ctx context.Context,
+	operationalEndPoint *OperationalEndPoint,
+	upstreamDialer *upstream.Dialer,
+) (*sshdial.Dialer, error) {
+	operationalEndPoint.Lock()
+	defer operationalEndPoint.Unlock()
+
+	if operationalEndPoint.sshDialer != nil {
+		return operationalEndPoint.sshDialer, nil
+	}
+
+	sshCfg := operationalEndPoint.config.SSH
+
+	clientConfig, agentConn, err := sshClientConfig(sshCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := sshdial.NewDialer(sshCfg.Host, clientConfig, sshdial.WithNetDial(upstreamDialer.Dial))
+
+	closeAll := func() {
+		if err := dialer.Close(); err != nil {
+			slog.Warn("error closing ssh connection", "endpoint", operationalEndPoint.config.Name, "err", err)
+		}
+
+		if agentConn != nil {
+			_ = agentConn.Close()
+		}
+	}
+
+	if err = dialer.Connect(ctx); err != nil {
+		closeAll()
+
+		return nil, fmt.Errorf("error connecting to ssh server %s: %w", sshCfg.Host, err)
+	}
+
+	go func() {
+		<-operationalEndPoint.ctx.Done()
+
+		closeAll()
+	}()
+
+	operationalEndPoint.sshDialer = dialer
+
+	return dialer, nil
+}
+
+// sshClientConfig authenticates with the key configured and/or the ssh agent, verifying the server against known
+// hosts. The connection to the agent, if any, is returned to be closed once done with the ssh server.
+func sshClientConfig(cfg config.EndpointSSH) (*ssh.ClientConfig, io.Closer, error) {
+	knownHosts := cfg.KnownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error finding known hosts: %w", err)
+		}
+
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading known hosts: %w", err)
+	}
+
+	var auth []ssh.AuthMethod
+
+	if cfg.Key != "" {
+		keyBytes, err := os.ReadFile(cfg.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading ssh key: %w", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			var passphraseErr *ssh.PassphraseMissingError
+			if errors.As(err, &passphraseErr) {
+				return nil, nil, fmt.Errorf("ssh key %s is passphrase protected, add it to the ssh agent instead: %w",
+					cfg.Key, err)
+			}
+
+			return nil, nil, fmt.Errorf("error parsing ssh key: %w", err)
+		}
+
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	var agentConn net.Conn
+
+	if cfg.Agent || cfg.Key == "" {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, nil, ErrNoSSHAuth
+		}
+
+		agentConn, err = net.Dial("unix", sock)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error connecting to ssh agent: %w", err)
+		}
+
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+	}
+
+	ret := &ssh.ClientConfig{ //nolint:exhaustruct
+		User:            cfg.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshdial.HandshakeTimeout,
+	}
+
+	if agentConn == nil {
+		return ret, nil, nil
+	}
+
+	return ret, agentConn, nil
+}
+
+func endpointToken(epCfg config.Endpoint) (string, error) {
+	if epCfg.TokenFile == "" {
+		return epCfg.Token, nil
+	}
+
+	tokenBytes, err := os.ReadFile(epCfg.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("error reading token: %w", err)
+	}
+
+	return strings.TrimSpace(string(tokenBytes)), nil
+}
+
+func endpointTLSConfig(cfg config.EndpointTLS) (*tls.Config, error) {
+	ret := &tls.Config{MinVersion: tls.VersionTLS12} //nolint:exhaustruct
+
+	if cfg.CA != "" {
+		caBytes, err := os.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ca: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("no certificate found in ca %s", cfg.CA)
+		}
+
+		ret.RootCAs = pool
+	}
+
+	if cfg.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+
+		ret.Certificates = []tls.Certificate{cert}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,81 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/duxthemux/netmux/business/netmux"
+	"github.com/duxthemux/netmux/business/tun"
+)
+
+// serveTun routes the cluster networks - as configured for the endpoint, or else as told by the service - to the TUN
+// device configured for the endpoint. The device lives until ctx is done. Once open, its routes are refreshed each time
+// it is called again, as after reconnecting.
+func (d *Daemon) serveTun(ctx context.Context, operationalEndPoint *OperationalEndPoint) error {
+	epCfg := operationalEndPoint.config
+
+	if epCfg.Tun == "" {
+		return nil
+	}
+
+	cidrs := epCfg.TunCIDRs
+	if len(cidrs) == 0 {
+		cidrs = operationalEndPoint.Agent().ClusterCIDRs()
+	}
+
+	if len(cidrs) == 0 {
+		slog.Warn("tun mode disabled: service did not tell the cluster networks", "endpoint", epCfg.Name)
+
+		return nil
+	}
+
+	if device := operationalEndPoint.tunDevice(); device != nil {
+		if err := device.Route(cidrs); err != nil {
+			return fmt.Errorf("error routing tun device: %w", err)
+		}
+
+		slog.Info("tun routes refreshed", "endpoint", epCfg.Name, "device", device.Name(), "cidrs", cidrs)
+
+		return nil
+	}
+
+	device, err := tun.Open(ctx, epCfg.Tun, cidrs, &tunDialer{operationalEndPoint: operationalEndPoint})
+	if err != nil {
+		return fmt.Errorf("error opening tun device: %w", err)
+	}
+
+	operationalEndPoint.setTunDevice(device)
+
+	slog.Info("tun mode on", "endpoint", epCfg.Name, "device", device.Name(), "cidrs", cidrs)
+
+	go func() {
+		<-ctx.Done()
+		device.Close()
+	}()
+
+	return nil
+}
+
+// tunDialer carries the connections and flows of the TUN device through the endpoint agent.
+type tunDialer struct {
+	operationalEndPoint *OperationalEndPoint
+}
+
+func (t *tunDialer) DialTCP(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+	return t.operationalEndPoint.Agent().Proxy(ctx, netmux.ProxyRequest{ //nolint:wrapcheck
+		Name:     "tun",
+		Family:   netmux.FamilyTCP,
+		Endpoint: addr,
+	})
+}
+
+func (t *tunDialer) DialUDP(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+	return t.operationalEndPoint.Agent().Proxy(ctx, netmux.ProxyRequest{ //nolint:wrapcheck
+		Name:      "tun",
+		Family:    netmux.FamilyUDP,
+		Endpoint:  addr,
+		Datagrams: true,
+	})
+}
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 	"gopkg.in/natefinch/lumberjack.v2"
@@ -17,6 +19,7 @@ import (
 	configlib "github.com/duxthemux/netmux/app/nx-daemon/config"
 	"github.com/duxthemux/netmux/app/nx-daemon/daemon"
 	"github.com/duxthemux/netmux/business/caroot"
+	"github.com/duxthemux/netmux/business/dnsserver"
 	"github.com/duxthemux/netmux/business/networkallocator"
 	"github.com/duxthemux/netmux/foundation/buildinfo"
 	"github.com/duxthemux/netmux/foundation/metrics"
@@ -30,6 +33,11 @@ const (
 	MaxAge     = 28
 )
 
+// ShutdownTimeout limits for how long bridges are waited for, when exiting, before releasing their addresses.
+const ShutdownTimeout = time.Second * 10
+
+var errExitRequested = fmt.Errorf("exit requested")
+
 func setupLog() {
 	var logWriter io.Writer = os.Stdout
 
@@ -56,7 +64,8 @@ func run() error {
 	ctx, cancel := context.WithCancelCause(context.Background())
 	defer cancel(fmt.Errorf("nx-server main run ended"))
 
-	ctx, _ = signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGKILL)
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
 	slog.Info(buildinfo.String("nx-daemon"))
 
@@ -66,28 +75,40 @@ func run() error {
 		slog.Warn(fmt.Sprintf("error loading userconfig: %s", err.Error()))
 	}
 
-	networkAllocator, err := networkallocator.New(agentConfig.IFace, agentConfig.Network)
+	if agentConfig.Allocator == networkallocator.ModeLoopback && agentConfig.DNS.HostsFileEnabled() && os.Geteuid() != 0 {
+		slog.Warn("loopback allocator running as a normal user: the hosts file may not be writable, " +
+			"consider the server dns backend")
+	}
+
+	networkAllocator, err := networkallocator.New(agentConfig.IFace, agentConfig.Network,
+		networkallocator.WithHostsFile(agentConfig.DNS.HostsFileEnabled()),
+		networkallocator.WithMode(agentConfig.Allocator),
+		networkallocator.WithLeaseFile(agentConfig.LeaseFile),
+		networkallocator.WithIPv6Network(agentConfig.Network6),
+		networkallocator.WithCandidates(agentConfig.NetworkCandidates...))
 	if err != nil {
 		return fmt.Errorf("error creating network allocator: %w", err)
 	}
 
-	_ = networkAllocator.CleanUp("")
+	if _, err = networkAllocator.Reconcile(agentConfig.Leftovers == configlib.LeftoversAdopt); err != nil {
+		slog.Warn("error reconciling leftovers of a previous run", "err", err)
+	}
 
 	metricsFactory := metrics.NewPromFactory()
 
 	svc := daemon.New(agentConfig, networkAllocator, daemon.WithMetrics(metricsFactory))
 
+	splitDNSRegistered := false
+
+	defer func() {
+		shutdown(svc, networkAllocator, agentConfig.DNS.Link, splitDNSRegistered)
+	}()
+
 	address, err := networkAllocator.GetIP("nx")
 	if err != nil {
 		return fmt.Errorf("failed to allocate address: %w", err)
 	}
 
-	defer func() {
-		if err := networkAllocator.ReleaseIP(address); err != nil {
-			slog.Warn("error releasing address", "err", err)
-		}
-	}()
-
 	aCa := caroot.New()
 
 	if err = aCa.Init(".", nil); err != nil {
@@ -96,10 +117,28 @@ func run() error {
 
 	aWebserver := webserver.New(svc)
 
+	// built before any goroutine starts, so failing leaves nothing running.
+	var dnsServer *dnsserver.Server
+
+	if agentConfig.DNS.ServerEnabled() {
+		if dnsServer, err = newDNSServer(agentConfig.DNS, networkAllocator, address, svc.ResolveDNS); err != nil {
+			return err
+		}
+	}
+
 	group, ctx := errgroup.WithContext(ctx)
 
 	group.Go(func() error {
-		if err = aWebserver.Run(ctx, "nx", address, "443", aCa); err != nil {
+		select {
+		case <-svc.Done():
+			return errExitRequested
+		case <-ctx.Done():
+			return nil
+		}
+	})
+
+	group.Go(func() error {
+		if err := aWebserver.Run(ctx, "nx", address, "443", aCa); err != nil {
 			if errors.Is(http.ErrServerClosed, err) {
 				return nil
 			}
@@ -110,21 +149,92 @@ func run() error {
 		return nil
 	})
 
+	if dnsServer != nil {
+		group.Go(func() error {
+			return dnsServer.Serve(ctx, net.JoinHostPort(address, "53")) //nolint:wrapcheck
+		})
+
+		if agentConfig.DNS.SplitDNS {
+			if err := dnsserver.RegisterSplitDNS(
+				agentConfig.DNS.Link, address, agentConfig.DNS.Domains, agentConfig.DNS.Search); err != nil {
+				slog.Warn("error registering split dns, names only available through the hosts file", "err", err)
+			} else {
+				splitDNSRegistered = true
+			}
+		}
+	}
+
 	group.Go(func() error {
-		if err = metricsFactory.Start(ctx, ":50001"); err != nil {
+		if err := metricsFactory.Start(ctx, ":50001"); err != nil {
 			return fmt.Errorf("error starting metrics factory: %w", err)
 		}
 
 		return nil
 	})
 
-	if err = group.Wait(); err != nil {
+	if err = group.Wait(); err != nil && !errors.Is(err, errExitRequested) {
 		return fmt.Errorf("error processing group: %w", err)
 	}
 
+	slog.Info("nx-daemon exiting")
+
 	return nil
 }
 
+// shutdown stops the bridges, releases all addresses and restores dns - in this order, so no address is released while
+// still in use.
+func shutdown(
+	svc *daemon.Daemon,
+	networkAllocator *networkallocator.NetworkAllocator,
+	splitDNSLink string,
+	splitDNSRegistered bool,
+) {
+	if err := svc.Shutdown(ShutdownTimeout); err != nil {
+		slog.Warn("error stopping bridges", "err", err)
+	}
+
+	if err := networkAllocator.ReleaseAll(); err != nil {
+		slog.Warn("error releasing addresses", "err", err)
+	}
+
+	if splitDNSRegistered {
+		if err := dnsserver.UnregisterSplitDNS(splitDNSLink); err != nil {
+			slog.Warn("error unregistering split dns", "err", err)
+		}
+	}
+}
+
+func newDNSServer(
+	cfg configlib.DNS,
+	resolver dnsserver.Resolver,
+	address string,
+	tunnel dnsserver.Exchanger,
+) (*dnsserver.Server, error) {
+	upstreams := cfg.Upstreams
+
+	if len(upstreams) == 0 {
+		var err error
+
+		upstreams, err = dnsserver.SystemUpstreams(dnsserver.ResolvConfPath, address)
+		if err != nil {
+			return nil, fmt.Errorf("error finding upstream dns servers: %w", err)
+		}
+	}
+
+	opts := []dnsserver.Opts{
+		dnsserver.WithUpstreams(upstreams...),
+		dnsserver.WithDomains(cfg.Domains...),
+		dnsserver.WithSearch(cfg.Search...),
+		dnsserver.WithTunnel(tunnel),
+	}
+
+	if cfg.TTL > 0 {
+		opts = append(opts, dnsserver.WithTTL(cfg.TTL))
+	}
+
+	return dnsserver.New(resolver, opts...), nil
+}
+
 func main() {
 	setupLog()
 
@@ -3,12 +3,15 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 
 	"github.com/duxthemux/netmux/app/nx-daemon/daemon"
 	"github.com/duxthemux/netmux/business/caroot"
+	"github.com/duxthemux/netmux/business/networkallocator/dnsallocator"
 )
 
 type API struct {
@@ -103,6 +106,53 @@ func (a *API) pluginServices(ctx context.Context, router *mux.Router) {
 		})
 }
 
+func (a *API) pluginConns(_ context.Context, router *mux.Router) {
+	router.Name("connsList").
+		Methods(http.MethodGet).
+		Path("/").
+		HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			conns := a.Service.Conns()
+			responseWriter.Header().Set("Content-Type", "application/json")
+			err := json.NewEncoder(responseWriter).Encode(conns)
+			if err != nil {
+				http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+			}
+		})
+
+	router.Name("connsClose").
+		Methods(http.MethodGet).
+		Path("/{id}/close").
+		HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			err := a.Service.CloseConn(mux.Vars(request)["id"])
+			if errors.Is(err, daemon.ErrConnNotFound) {
+				http.Error(responseWriter, err.Error(), http.StatusNotFound)
+
+				return
+			}
+
+			if err != nil {
+				http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+			}
+		})
+
+	router.Name("connsCloseBridge").
+		Methods(http.MethodGet).
+		Path("/{context}/{name}/close").
+		HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			vars := mux.Vars(request)
+
+			closed, err := a.Service.CloseBridgeConns(vars["context"], vars["name"])
+			if err != nil {
+				http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+
+				return
+			}
+
+			responseWriter.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(responseWriter).Encode(map[string]int{"closed": closed})
+		})
+}
+
 func (a *API) pluginConfig(_ context.Context, router *mux.Router, caRoot *caroot.CA) {
 	router.Name("configMain").
 		Methods(http.MethodGet).
@@ -120,7 +170,7 @@ func (a *API) pluginConfig(_ context.Context, router *mux.Router, caRoot *caroot
 		Methods(http.MethodGet).
 		Path("/hosts").
 		HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
-			cfg := a.Service.DNSEntries()
+			cfg := a.Service.Hosts()
 			responseWriter.Header().Set("Content-Type", "application/json")
 
 			err := json.NewEncoder(responseWriter).Encode(cfg)
@@ -129,6 +179,39 @@ func (a *API) pluginConfig(_ context.Context, router *mux.Router, caRoot *caroot
 			}
 		})
 
+	router.Name("configHostsBackups").
+		Methods(http.MethodGet).
+		Path("/hosts/backups").
+		HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			responseWriter.Header().Set("Content-Type", "application/json")
+
+			err := json.NewEncoder(responseWriter).Encode(a.Service.HostsBackups())
+			if err != nil {
+				http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+			}
+		})
+
+	router.Name("configHostsRestore").
+		Methods(http.MethodGet).
+		Path("/hosts/restore/{backup}").
+		HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			backup, err := strconv.Atoi(mux.Vars(request)["backup"])
+			if err != nil {
+				http.Error(responseWriter, "backup must be a number", http.StatusBadRequest)
+
+				return
+			}
+
+			err = a.Service.RestoreHosts(backup)
+
+			switch {
+			case errors.Is(err, dnsallocator.ErrNoSuchBackup):
+				http.Error(responseWriter, err.Error(), http.StatusNotFound)
+			case err != nil:
+				http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+			}
+		})
+
 	router.Name("configCa").
 		Methods(http.MethodGet).
 		Path("/caRoot").
@@ -190,6 +273,18 @@ func (a *API) Plugin(ctx context.Context, rootRouter *mux.Router, ca *caroot.CA)
 	servicesRouter := apiV1Router.Name("services-router").PathPrefix("/services/").Subrouter()
 	a.pluginServices(ctx, servicesRouter)
 
+	connsRouter := apiV1Router.Name("conns-router").PathPrefix("/conns/").Subrouter()
+	a.pluginConns(ctx, connsRouter)
+
+	apiV1Router.Name("proxyPac").
+		Methods(http.MethodGet).
+		Path("/proxy.pac").
+		HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			responseWriter.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+
+			_, _ = responseWriter.Write([]byte(a.Service.PAC()))
+		})
+
 	miscRouter := apiV1Router.Name("misc-router").PathPrefix("/misc/").Subrouter()
 
 	a.pluginMisc(ctx, miscRouter)
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -24,7 +25,10 @@ type WebServer struct {
 	api     api.API
 }
 
-const ReaderTimeout = time.Second * 5
+const (
+	ReaderTimeout   = time.Second * 5
+	ShutdownTimeout = time.Second * 5
+)
 
 //nolint:funlen
 func (w *WebServer) Run(ctx context.Context, name string, addr string, port string, certAuth *caroot.CA) error {
@@ -43,7 +47,7 @@ func (w *WebServer) Run(ctx context.Context, name string, addr string, port stri
 	}
 
 	server := http.Server{
-		Addr:    addr + ":" + port,
+		Addr:    net.JoinHostPort(addr, port),
 		Handler: root,
 		TLSConfig: &tls.Config{
 			MinVersion:   tls.VersionTLS13,
@@ -55,7 +59,12 @@ func (w *WebServer) Run(ctx context.Context, name string, addr string, port stri
 
 	go func() {
 		<-ctx.Done()
-		_ = server.Shutdown(ctx)
+
+		// in flight requests (as the one asking to exit) are given some time to finish.
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), ShutdownTimeout)
+		defer cancel()
+
+		_ = server.Shutdown(shutdownCtx)
 	}()
 
 	err = root.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
@@ -81,7 +90,7 @@ func (w *WebServer) Run(ctx context.Context, name string, addr string, port stri
 		return fmt.Errorf("error walking routes: %w", err)
 	}
 
-	slog.Info(fmt.Sprintf("Webserver running at: %s:%s", addr, port))
+	slog.Info("Webserver running at: " + net.JoinHostPort(addr, port))
 
 	err = server.ListenAndServeTLS("", "")
 	if err != nil {
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
 	"os"
 	"strconv"
+	"strings"
 
 	"golang.org/x/sync/errgroup"
 
@@ -49,12 +51,51 @@ func run() error {
 
 	metricsProvider := metrics.NewPromFactory()
 
-	netmuxService := netmux.NewService(
+	serviceOpts := []netmux.Opts{
 		netmux.WithEventsLogger(func(evt netmux.Event) {
 			slog.Info(fmt.Sprintf("Event: %v: %s", evt.EvtName, evt.Bridge.String()))
 		}),
 		netmux.WithMetrics(metricsProvider),
-	)
+	}
+
+	// resolvers used to answer dns queries from agents - defaults to the ones in resolv.conf (the cluster dns).
+	if resolvers := os.Getenv("DNS_RESOLVERS"); resolvers != "" {
+		serviceOpts = append(serviceOpts, netmux.WithDNSResolvers(strings.Split(resolvers, ",")...))
+	}
+
+	// comma separated cidrs agents are allowed to connect to - everything is allowed if not set.
+	if dialAllow := os.Getenv("DIAL_ALLOW"); dialAllow != "" {
+		policy, err := netmux.CIDRDialPolicy(strings.Split(dialAllow, ",")...)
+		if err != nil {
+			return fmt.Errorf("error setting up dial policy: %w", err)
+		}
+
+		serviceOpts = append(serviceOpts, netmux.WithDialPolicy(policy))
+	}
+
+	k8sOpts := k8s.Opts{}
+
+	// comma separated service cidrs of the cluster, used instead of guessing them when discovering its networks.
+	if serviceCIDRs := os.Getenv("SERVICE_CIDRS"); serviceCIDRs != "" {
+		for _, cidr := range strings.Split(serviceCIDRs, ",") {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				return fmt.Errorf("error parsing SERVICE_CIDRS: %w", err)
+			}
+
+			k8sOpts.ServiceCIDRs = append(k8sOpts.ServiceCIDRs, cidr)
+		}
+	}
+
+	k8sRuntime := k8s.NewRuntime(k8sOpts)
+
+	// comma separated cidrs routed by agents in tun mode - discovered from the cluster if not set.
+	if clusterCIDRs := os.Getenv("CLUSTER_CIDRS"); clusterCIDRs != "" {
+		serviceOpts = append(serviceOpts, netmux.WithClusterInfo(netmux.StaticClusterInfo(strings.Split(clusterCIDRs, ","))))
+	} else {
+		serviceOpts = append(serviceOpts, netmux.WithClusterInfo(k8sRuntime))
+	}
+
+	netmuxService := netmux.NewService(serviceOpts...)
 
 	logInit()
 
@@ -70,8 +111,6 @@ func run() error {
 		return fmt.Errorf("error setting up service listener: %w", err)
 	}
 
-	k8sRuntime := k8s.NewRuntime(k8s.Opts{})
-
 	defer func() {
 		if err := k8sRuntime.Close(); err != nil {
 			slog.Warn("error closing k8s runtime", "err", err)
@@ -84,6 +123,14 @@ func run() error {
 
 	group, ctx := errgroup.WithContext(ctx)
 
+	if err = serveWebSocket(ctx, group, netmuxService); err != nil {
+		return fmt.Errorf("error setting up websockets: %w", err)
+	}
+
+	if err = serveQUIC(ctx, group, netmuxService); err != nil {
+		return fmt.Errorf("error setting up quic: %w", err)
+	}
+
 	group.Go(func() error {
 		defer cancel(fmt.Errorf("k8sRuntime ended"))
 
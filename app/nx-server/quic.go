@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/duxthemux/netmux/business/netmux"
+	"github.com/duxthemux/netmux/foundation/quicconn"
+)
+
+const EnvQUICAddr = "QUIC_ADDR"
+
+var ErrQUICNeedsTLS = fmt.Errorf("quic requires %s and %s", EnvTLSCert, EnvTLSKey)
+
+// serveQUIC accepts agent sessions over quic (udp), when QUIC_ADDR is set: each proxied connection gets its own
+// stream, so a lost packet only holds back the connection it belongs to. It takes the tls config and AUTH_TOKEN as
+// websockets do, a certificate being required.
+func serveQUIC(ctx context.Context, group *errgroup.Group, service *netmux.Service) error {
+	addr := os.Getenv(EnvQUICAddr)
+	if addr == "" {
+		return nil
+	}
+
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	if tlsConfig == nil {
+		return ErrQUICNeedsTLS
+	}
+
+	listener, err := quicconn.Listen(addr, tlsConfig, quicconn.WithToken(os.Getenv(EnvAuthToken)))
+	if err != nil {
+		return fmt.Errorf("error setting up quic listener: %w", err)
+	}
+
+	slog.Info("accepting agents over quic", "addr", listener.Addr().String())
+
+	group.Go(func() error {
+		return service.Serve(ctx, listener) //nolint:wrapcheck
+	})
+
+	return nil
+}
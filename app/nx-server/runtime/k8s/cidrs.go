@@ -0,0 +1,124 @@
+package k8s
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"sort"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// guessedPrefixBits is the size assumed for networks we only know an address of.
+const guessedPrefixBits = 16
+
+// ClusterCIDRs returns the service networks, as configured, and pod networks discovered when Run started.
+func (k *Runtime) ClusterCIDRs() []string {
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+
+	return k.clusterCIDRs
+}
+
+// discoverClusterCIDRs finds out the cluster networks. Pod networks come from the nodes pod cidrs - or, if nodes
+// can't be listed, from the ip of the pods in our namespace. There is no api telling the service network: unless set
+// with Opts.ServiceCIDRs, a /16 around the ip of the kubernetes service is used.
+func (k *Runtime) discoverClusterCIDRs(ctx context.Context, cli *kubernetes.Clientset, ns string) {
+	prefixes := make(map[netip.Prefix]struct{})
+
+	add := func(s string, isPrefix bool) {
+		var (
+			prefix netip.Prefix
+			err    error
+		)
+
+		if isPrefix {
+			prefix, err = netip.ParsePrefix(s)
+		} else {
+			var addr netip.Addr
+
+			addr, err = netip.ParseAddr(s)
+			if err == nil {
+				prefix, err = addr.Prefix(guessedPrefixBits)
+			}
+		}
+
+		if err != nil {
+			slog.Debug("ignoring invalid cluster address", "addr", s, "err", err)
+
+			return
+		}
+
+		prefixes[prefix.Masked()] = struct{}{}
+	}
+
+	nodes, err := cli.CoreV1().Nodes().List(ctx, v1.ListOptions{})
+	if err != nil {
+		slog.Warn("could not list nodes, guessing pod networks from pods", "err", err)
+	}
+
+	if nodes != nil {
+		for _, node := range nodes.Items {
+			for _, cidr := range append([]string{node.Spec.PodCIDR}, node.Spec.PodCIDRs...) {
+				if cidr != "" {
+					add(cidr, true)
+				}
+			}
+		}
+	}
+
+	if len(prefixes) == 0 {
+		pods, err := cli.CoreV1().Pods(ns).List(ctx, v1.ListOptions{})
+		if err != nil {
+			slog.Warn("could not list pods", "err", err)
+		}
+
+		if pods != nil {
+			for _, pod := range pods.Items {
+				if pod.Status.PodIP != "" && !pod.Spec.HostNetwork {
+					add(pod.Status.PodIP, false)
+				}
+			}
+		}
+	}
+
+	if len(k.opts.ServiceCIDRs) > 0 {
+		for _, cidr := range k.opts.ServiceCIDRs {
+			add(cidr, true)
+		}
+	} else {
+		k.guessServiceCIDRs(ctx, cli, add)
+	}
+
+	cidrs := make([]string, 0, len(prefixes))
+	for prefix := range prefixes {
+		cidrs = append(cidrs, prefix.String())
+	}
+
+	sort.Strings(cidrs)
+
+	slog.Info("cluster networks discovered", "cidrs", cidrs)
+
+	k.mx.Lock()
+	k.clusterCIDRs = cidrs
+	k.mx.Unlock()
+}
+
+// guessServiceCIDRs adds, through add, the networks around the ips of the kubernetes service.
+func (k *Runtime) guessServiceCIDRs(ctx context.Context, cli *kubernetes.Clientset, add func(s string, isPrefix bool)) {
+	svc, err := cli.CoreV1().Services("default").Get(ctx, "kubernetes", v1.GetOptions{})
+	if err != nil {
+		slog.Warn("could not get the kubernetes service", "err", err)
+
+		return
+	}
+
+	slog.Warn("guessing the service networks from the kubernetes service, set SERVICE_CIDRS to tell them")
+
+	for _, ip := range append([]string{svc.Spec.ClusterIP}, svc.Spec.ClusterIPs...) {
+		if ip != "" {
+			add(ip, false)
+		}
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"sync"
 
 	"gopkg.in/yaml.v3"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -21,6 +23,8 @@ type Opts struct {
 	Kubefile   string
 	Namespaces []string
 	All        bool
+	// ServiceCIDRs are the service networks of the cluster. No api tells them: if not set, they are guessed.
+	ServiceCIDRs []string
 }
 
 func MyNamespace() (string, error) {
@@ -33,9 +37,11 @@ func MyNamespace() (string, error) {
 }
 
 type Runtime struct {
-	opts     Opts
-	cancel   func(err error)
-	chEvents chan netmux.Event
+	opts         Opts
+	cancel       func(err error)
+	chEvents     chan netmux.Event
+	mx           sync.RWMutex
+	clusterCIDRs []string
 }
 
 func (k *Runtime) Events() <-chan netmux.Event {
@@ -100,6 +106,7 @@ func (k *Runtime) handleServiceWithAnnotations(evt watch.EventType, dep *corev1.
 
 		if nxa.ContainerAddr == "" {
 			nxa.ContainerAddr = dep.Spec.ClusterIP
+			nxa.ContainerAddrs = dep.Spec.ClusterIPs
 			slog.Debug(fmt.Sprintf("Fixing bridge w/o remote addr: %s.%s => %s", dep.Namespace, dep.Name, nxa.ContainerAddr))
 		}
 
@@ -131,6 +138,7 @@ func (k *Runtime) handleServiceWithAnnotations(evt watch.EventType, dep *corev1.
 		}
 
 		nxa.Namespace = dep.Namespace
+		nxa.Labels = labels.Set(dep.Labels).String()
 
 		slog.Info(fmt.Sprintf("K8S Event %v for %s.%s", evt, dep.Name, dep.Namespace))
 
@@ -169,11 +177,13 @@ func (k *Runtime) handleServiceWithoutAnnotations(evt watch.EventType, dep *core
 	nxa := netmux.Bridge{}
 	nxa.Name = dep.Name
 	nxa.ContainerAddr = dep.Spec.ClusterIP
+	nxa.ContainerAddrs = dep.Spec.ClusterIPs
 	nxa.ContainerPort = fmt.Sprintf("%v", dep.Spec.Ports[0].Port)
 	nxa.LocalAddr = dep.Name
 	nxa.LocalPort = fmt.Sprintf("%v", dep.Spec.Ports[0].Port)
 	nxa.Direction = "L2C"
 	nxa.Namespace = dep.Namespace
+	nxa.Labels = labels.Set(dep.Labels).String()
 	nxa.Family = "tcp"
 	nxa.Name = dep.Name
 
@@ -271,6 +281,8 @@ func (k *Runtime) Run(ctx context.Context) error {
 		return fmt.Errorf("error getting my namespace: %w", err)
 	}
 
+	k.discoverClusterCIDRs(ctx, clientset, ns)
+
 	err = k.runOnNS(ctx, clientset, ns)
 	if err != nil {
 		return err
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+const (
+	EnvTLSCert     = "TLS_CERT"
+	EnvTLSKey      = "TLS_KEY"
+	EnvTLSClientCA = "TLS_CLIENT_CA"
+)
+
+// serverTLSConfig returns the tls config of TLS_CERT and TLS_KEY, requiring client certificates signed by
+// TLS_CLIENT_CA if set. Without a certificate it is nil.
+func serverTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv(EnvTLSCert), os.Getenv(EnvTLSKey)
+	if certFile == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading tls certificate: %w", err)
+	}
+
+	ret := &tls.Config{ //nolint:exhaustruct
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if clientCA := os.Getenv(EnvTLSClientCA); clientCA != "" {
+		caBytes, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client ca: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("no certificate found in client ca %s", clientCA)
+		}
+
+		ret.ClientCAs = pool
+		ret.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/duxthemux/netmux/business/netmux"
+	"github.com/duxthemux/netmux/foundation/wsconn"
+)
+
+const (
+	EnvWSAddr    = "WS_ADDR"
+	EnvWSPath    = "WS_PATH"
+	EnvAuthToken = "AUTH_TOKEN"
+)
+
+const (
+	defaultWSPath     = "/agent"
+	readHeaderTimeout = time.Second * 10
+	shutdownTimeout   = time.Second * 5
+)
+
+// serveWebSocket accepts agent sessions over websockets, when WS_ADDR is set, so agents can reach the service through
+// an http ingress instead of a port forward. TLS_CERT and TLS_KEY serve https - TLS_CLIENT_CA requiring client
+// certificates signed by it - and AUTH_TOKEN requires agents to send it as a bearer token.
+func serveWebSocket(ctx context.Context, group *errgroup.Group, service *netmux.Service) error {
+	addr := os.Getenv(EnvWSAddr)
+	if addr == "" {
+		return nil
+	}
+
+	path := os.Getenv(EnvWSPath)
+	if path == "" {
+		path = defaultWSPath
+	}
+
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	listener := wsconn.NewListener(addr+path, wsconn.WithToken(os.Getenv(EnvAuthToken)))
+
+	mux := http.NewServeMux()
+	mux.Handle(path, listener)
+
+	server := &http.Server{ //nolint:exhaustruct
+		Addr:              addr,
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	group.Go(func() error {
+		return service.Serve(ctx, listener) //nolint:wrapcheck
+	})
+
+	group.Go(func() error {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+		defer cancel()
+
+		return server.Shutdown(shutdownCtx) //nolint:wrapcheck,contextcheck
+	})
+
+	group.Go(func() error {
+		slog.Info("accepting agents over websockets", "addr", addr, "path", path, "tls", tlsConfig != nil)
+
+		var err error
+
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+
+		return fmt.Errorf("error serving websockets: %w", err)
+	})
+
+	return nil
+}
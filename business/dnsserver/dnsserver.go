@@ -0,0 +1,300 @@
+// Package dnsserver implements the DNS server embedded in nx-daemon. It answers for the names allocated to bridges
+// and forwards everything else to upstream resolvers.
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	DefaultTTL     = 5
+	ResolvConfPath = "/etc/resolv.conf"
+)
+
+// Resolver provides the names we answer for.
+type Resolver interface {
+	// LookupName returns the addresses (ipv4 and/or ipv6) allocated to name, if any.
+	LookupName(name string) ([]string, bool)
+}
+
+type Server struct {
+	resolver  Resolver
+	upstreams []string
+	// domains are the zones we are authoritative for: unknown names under them are not forwarded upstream.
+	domains []string
+	// search domains are stripped from queried names before looking them up (eg: svc.ns.netmux => svc.ns).
+	search []string
+	ttl    uint32
+	// tunnel, when set, resolves names under domains we don't know about (eg: through the cluster resolver).
+	tunnel Exchanger
+}
+
+// Exchanger resolves a dns query.
+type Exchanger func(ctx context.Context, query *dns.Msg) (*dns.Msg, error)
+
+// TunnelTimeout limits how long we wait for queries sent through the tunnel.
+const TunnelTimeout = time.Second * 5
+
+type Opts func(s *Server)
+
+// WithUpstreams sets the resolvers (host:port) used for names we don't know about.
+func WithUpstreams(upstreams ...string) Opts {
+	return func(s *Server) {
+		s.upstreams = upstreams
+	}
+}
+
+func WithDomains(domains ...string) Opts {
+	return func(s *Server) {
+		s.domains = normalizeNames(domains)
+	}
+}
+
+func WithSearch(search ...string) Opts {
+	return func(s *Server) {
+		s.search = normalizeNames(search)
+	}
+}
+
+// WithTunnel sets the exchanger used for unknown names under domains, instead of answering NXDOMAIN.
+func WithTunnel(tunnel Exchanger) Opts {
+	return func(s *Server) {
+		s.tunnel = tunnel
+	}
+}
+
+func WithTTL(ttl uint32) Opts {
+	return func(s *Server) {
+		s.ttl = ttl
+	}
+}
+
+func normalizeNames(names []string) []string {
+	ret := make([]string, 0, len(names))
+
+	for _, name := range names {
+		if name = normalizeName(name); name != "" {
+			ret = append(ret, name)
+		}
+	}
+
+	return ret
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Trim(name, "."))
+}
+
+func New(resolver Resolver, opts ...Opts) *Server {
+	ret := &Server{
+		resolver: resolver,
+		ttl:      DefaultTTL,
+	}
+
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	return ret
+}
+
+// Serve answers DNS queries at addr, both over udp and tcp, until ctx is done.
+func (s *Server) Serve(ctx context.Context, addr string) error {
+	servers := []*dns.Server{
+		{Addr: addr, Net: "udp", Handler: s},
+		{Addr: addr, Net: "tcp", Handler: s},
+	}
+
+	group, groupCtx := errgroup.WithContext(ctx)
+
+	for _, srv := range servers {
+		srv := srv
+
+		group.Go(func() error {
+			if err := srv.ListenAndServe(); err != nil {
+				return fmt.Errorf("error serving dns over %s at %s: %w", srv.Net, addr, err)
+			}
+
+			return nil
+		})
+	}
+
+	group.Go(func() error {
+		<-groupCtx.Done()
+
+		for _, srv := range servers {
+			_ = srv.Shutdown()
+		}
+
+		return nil
+	})
+
+	if err := group.Wait(); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	return nil
+}
+
+// ServeDNS implements dns.Handler.
+func (s *Server) ServeDNS(writer dns.ResponseWriter, req *dns.Msg) {
+	res := s.answer(writer, req)
+
+	if err := writer.WriteMsg(res); err != nil {
+		slog.Warn("error writing dns response", "err", err)
+	}
+}
+
+func (s *Server) answer(writer dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	res := new(dns.Msg)
+
+	if len(req.Question) != 1 {
+		return res.SetRcode(req, dns.RcodeFormatError)
+	}
+
+	question := req.Question[0]
+	name := normalizeName(question.Name)
+
+	addrs, found := s.lookup(name)
+
+	switch {
+	case found:
+		res.SetReply(req)
+		res.Authoritative = true
+		res.Answer = s.records(question, addrs)
+
+		return res
+	case s.tunnel != nil && inDomains(name, s.domains):
+		return s.forwardTunnel(req)
+	case inDomains(name, s.domains) || inDomains(name, s.search):
+		res.SetRcode(req, dns.RcodeNameError)
+		res.Authoritative = true
+
+		return res
+	default:
+		return s.forward(writer, req)
+	}
+}
+
+// records answers question with the A and AAAA records it asks for. A known name with no address of the type asked
+// gets no records (NODATA).
+func (s *Server) records(question dns.Question, addrs []string) []dns.RR {
+	ret := make([]dns.RR, 0, len(addrs))
+
+	for _, addr := range addrs {
+		ipAddr := net.ParseIP(addr)
+
+		switch {
+		case ipAddr == nil:
+			continue
+		case ipAddr.To4() != nil && (question.Qtype == dns.TypeA || question.Qtype == dns.TypeANY):
+			ret = append(ret, &dns.A{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: s.ttl},
+				A:   ipAddr.To4(),
+			})
+		case ipAddr.To4() == nil && (question.Qtype == dns.TypeAAAA || question.Qtype == dns.TypeANY):
+			ret = append(ret, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: question.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: s.ttl},
+				AAAA: ipAddr,
+			})
+		}
+	}
+
+	return ret
+}
+
+// lookup resolves name, trying it as is and without each of the search domains.
+func (s *Server) lookup(name string) ([]string, bool) {
+	if addrs, found := s.resolver.LookupName(name); found {
+		return addrs, true
+	}
+
+	for _, search := range s.search {
+		if short, found := strings.CutSuffix(name, "."+search); found {
+			if addrs, found := s.resolver.LookupName(short); found {
+				return addrs, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+func inDomains(name string, domains []string) bool {
+	for _, domain := range domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) forwardTunnel(req *dns.Msg) *dns.Msg {
+	ctx, cancel := context.WithTimeout(context.Background(), TunnelTimeout)
+	defer cancel()
+
+	res, err := s.tunnel(ctx, req)
+	if err != nil {
+		slog.Debug("error resolving dns query through tunnel", "question", req.Question, "err", err)
+
+		return new(dns.Msg).SetRcode(req, dns.RcodeServerFailure)
+	}
+
+	res.Id = req.Id
+
+	return res
+}
+
+// forward sends the request to the upstreams, in order, returning the first answer received.
+func (s *Server) forward(writer dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	client := &dns.Client{Net: "udp"}
+	if _, ok := writer.RemoteAddr().(*net.TCPAddr); ok {
+		client.Net = "tcp"
+	}
+
+	for _, upstream := range s.upstreams {
+		res, _, err := client.Exchange(req, upstream)
+		if err != nil {
+			slog.Debug("error forwarding dns query", "upstream", upstream, "err", err)
+
+			continue
+		}
+
+		return res
+	}
+
+	return new(dns.Msg).SetRcode(req, dns.RcodeServerFailure)
+}
+
+// SystemUpstreams returns the resolvers configured in resolv.conf, except for the addresses in exclude (so we don't
+// forward queries to ourselves).
+func SystemUpstreams(resolvConf string, exclude ...string) ([]string, error) {
+	cfg, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", resolvConf, err)
+	}
+
+	ret := make([]string, 0, len(cfg.Servers))
+
+upstreams:
+	for _, server := range cfg.Servers {
+		for _, ex := range exclude {
+			if server == ex {
+				continue upstreams
+			}
+		}
+
+		ret = append(ret, net.JoinHostPort(server, cfg.Port))
+	}
+
+	return ret, nil
+}
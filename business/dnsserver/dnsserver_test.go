@@ -0,0 +1,183 @@
+package dnsserver_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/duxthemux/netmux/business/dnsserver"
+)
+
+const MaxWaitTime = time.Second * 5
+
+// MapResolver maps names to comma separated addresses.
+type MapResolver map[string]string
+
+func (m MapResolver) LookupName(name string) ([]string, bool) {
+	addrs, ok := m[name]
+	if !ok {
+		return nil, false
+	}
+
+	return strings.Split(addrs, ","), true
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func serve(ctx context.Context, t *testing.T, srv *dnsserver.Server) string {
+	t.Helper()
+
+	addr := freeAddr(t)
+
+	go func() {
+		_ = srv.Serve(ctx, addr)
+	}()
+
+	assert.Eventually(t, func() bool {
+		_, _, err := new(dns.Client).Exchange(new(dns.Msg).SetQuestion("ping.", dns.TypeA), addr)
+
+		return err == nil
+	}, MaxWaitTime, time.Millisecond*50)
+
+	return addr
+}
+
+func query(t *testing.T, addr string, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+
+	res, _, err := new(dns.Client).Exchange(new(dns.Msg).SetQuestion(dns.Fqdn(name), qtype), addr)
+	assert.NoError(t, err)
+
+	return res
+}
+
+//nolint:paralleltest
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	upstreamAddr := serve(ctx, t, dnsserver.New(MapResolver{"example.test": "192.168.0.1"}))
+
+	addr := serve(ctx, t, dnsserver.New(MapResolver{
+		"svc":                              "10.10.10.2",
+		"svc.ns":                           "10.10.10.2",
+		"svc.ns.svc.cluster.local":         "10.10.10.2",
+		"other.other-ns":                   "10.10.10.3",
+		"other.other-ns.svc.cluster.local": "10.10.10.3",
+		"dual.ns":                          "10.10.10.4,fd6e:786d::4",
+		"v6only.ns":                        "fd6e:786d::5",
+	},
+		dnsserver.WithUpstreams(upstreamAddr),
+		dnsserver.WithDomains("cluster.local"),
+		dnsserver.WithSearch("netmux"),
+		dnsserver.WithTTL(30)))
+
+	for _, name := range []string{"svc", "svc.ns", "SVC.ns.svc.cluster.local", "svc.ns.netmux"} {
+		res := query(t, addr, name, dns.TypeA)
+		assert.Equal(t, dns.RcodeSuccess, res.Rcode, name)
+		assert.True(t, res.Authoritative, name)
+
+		if assert.Len(t, res.Answer, 1, name) {
+			assert.Equal(t, "10.10.10.2", res.Answer[0].(*dns.A).A.String())
+			assert.Equal(t, uint32(30), res.Answer[0].Header().Ttl)
+		}
+	}
+
+	res := query(t, addr, "svc.ns", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Empty(t, res.Answer)
+
+	res = query(t, addr, "dual.ns", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "fd6e:786d::4", res.Answer[0].(*dns.AAAA).AAAA.String())
+	}
+
+	res = query(t, addr, "dual.ns", dns.TypeA)
+
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "10.10.10.4", res.Answer[0].(*dns.A).A.String())
+	}
+
+	res = query(t, addr, "v6only.ns", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Empty(t, res.Answer)
+
+	res = query(t, addr, "unknown.ns.svc.cluster.local", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+
+	res = query(t, addr, "example.test", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "192.168.0.1", res.Answer[0].(*dns.A).A.String())
+	}
+}
+
+//nolint:paralleltest
+func TestSystemUpstreams(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "resolv.conf")
+
+	err := os.WriteFile(fname, []byte("nameserver 10.10.10.1\nnameserver 1.1.1.1\nsearch local\n"), 0o600)
+	assert.NoError(t, err)
+
+	upstreams, err := dnsserver.SystemUpstreams(fname, "10.10.10.1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1.1.1.1:53"}, upstreams)
+}
+
+//nolint:paralleltest
+func TestServerTunnel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tunneled := make(chan string, 1)
+
+	addr := serve(ctx, t, dnsserver.New(MapResolver{"svc.ns.svc.cluster.local": "10.10.10.2"},
+		dnsserver.WithDomains("cluster.local"),
+		dnsserver.WithTunnel(func(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+			tunneled <- query.Question[0].Name
+
+			res := new(dns.Msg).SetReply(query)
+			res.Answer = append(res.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 5},
+				A:   net.ParseIP("172.16.0.10"),
+			})
+
+			return res, nil
+		})))
+
+	res := query(t, addr, "svc.ns.svc.cluster.local", dns.TypeA)
+
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "10.10.10.2", res.Answer[0].(*dns.A).A.String())
+	}
+
+	res = query(t, addr, "pod-1.headless.ns.svc.cluster.local", dns.TypeA)
+
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "172.16.0.10", res.Answer[0].(*dns.A).A.String())
+	}
+
+	assert.Equal(t, "pod-1.headless.ns.svc.cluster.local.", <-tunneled)
+	assert.Empty(t, tunneled)
+}
@@ -0,0 +1,5 @@
+package dnsserver
+
+import "fmt"
+
+var ErrSplitDNSNotSupported = fmt.Errorf("split dns registration not supported on this platform")
@@ -0,0 +1,67 @@
+package dnsserver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ResolverDir     = "/etc/resolver"
+	resolverMarker  = "# src: netmux"
+	resolverPerm    = 0o644
+	resolverDirPerm = 0o755
+)
+
+// RegisterSplitDNS makes the macOS resolver send queries for domains and search domains to the server at addr, by
+// adding one file per domain to /etc/resolver. The link is not used on this platform.
+func RegisterSplitDNS(_ string, addr string, domains []string, search []string) error {
+	if err := os.MkdirAll(ResolverDir, resolverDirPerm); err != nil {
+		return fmt.Errorf("error creating %s: %w", ResolverDir, err)
+	}
+
+	content := fmt.Sprintf("%s\nnameserver %s\nport 53\n", resolverMarker, addr)
+
+	allDomains := make([]string, 0, len(domains)+len(search))
+	allDomains = append(allDomains, domains...)
+	allDomains = append(allDomains, search...)
+
+	for _, domain := range allDomains {
+		fname := filepath.Join(ResolverDir, domain)
+
+		if err := os.WriteFile(fname, []byte(content), resolverPerm); err != nil {
+			return fmt.Errorf("error writing %s: %w", fname, err)
+		}
+	}
+
+	return nil
+}
+
+// UnregisterSplitDNS removes all resolver files created by RegisterSplitDNS.
+func UnregisterSplitDNS(_ string) error {
+	entries, err := os.ReadDir(ResolverDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("error reading %s: %w", ResolverDir, err)
+	}
+
+	for _, entry := range entries {
+		fname := filepath.Join(ResolverDir, entry.Name())
+
+		content, err := os.ReadFile(fname)
+		if err != nil || !strings.HasPrefix(string(content), resolverMarker) {
+			continue
+		}
+
+		if err = os.Remove(fname); err != nil {
+			return fmt.Errorf("error removing %s: %w", fname, err)
+		}
+	}
+
+	return nil
+}
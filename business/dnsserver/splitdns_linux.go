@@ -0,0 +1,66 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// linkAlias marks the links created by RegisterSplitDNS, so only those are deleted by UnregisterSplitDNS - even by
+// another run of the daemon.
+const linkAlias = "src: netmux"
+
+// RegisterSplitDNS makes systemd-resolved send queries for domains to the server at addr, through link. As
+// systemd-resolved won't manage loopback interfaces, link is created as a dummy interface if it does not exist.
+// Search domains are registered as such, so bare names are also sent our way.
+func RegisterSplitDNS(link string, addr string, domains []string, search []string) error {
+	if _, err := net.InterfaceByName(link); err != nil {
+		if err = run("ip", "link", "add", link, "type", "dummy"); err != nil {
+			return err
+		}
+
+		if err = run("ip", "link", "set", link, "alias", linkAlias, "up"); err != nil {
+			return err
+		}
+	}
+
+	if err := run("resolvectl", "dns", link, addr); err != nil {
+		return err
+	}
+
+	args := []string{"domain", link}
+
+	for _, domain := range domains {
+		args = append(args, "~"+domain)
+	}
+
+	args = append(args, search...)
+
+	return run("resolvectl", args...)
+}
+
+// UnregisterSplitDNS reverts what was done by RegisterSplitDNS, deleting link if it was created by it.
+func UnregisterSplitDNS(link string) error {
+	if err := run("resolvectl", "revert", link); err != nil {
+		return err
+	}
+
+	alias, err := os.ReadFile(filepath.Join("/sys/class/net", link, "ifalias"))
+	if err != nil || strings.TrimSpace(string(alias)) != linkAlias {
+		return nil //nolint:nilerr
+	}
+
+	return run("ip", "link", "del", link)
+}
+
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error running %s %v: %w - %s", name, args, err, string(out))
+	}
+
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package dnsserver
+
+func RegisterSplitDNS(_ string, _ string, _ []string, _ []string) error {
+	return ErrSplitDNSNotSupported
+}
+
+func UnregisterSplitDNS(_ string) error {
+	return ErrSplitDNSNotSupported
+}
@@ -3,11 +3,18 @@ package netmux
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"runtime"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/duxthemux/netmux/foundation/memstore"
 	"github.com/duxthemux/netmux/foundation/metrics"
@@ -17,6 +24,11 @@ import (
 
 const (
 	MaxEventsBacklog = 24
+	// ProxyConfirmTimeout is for how long a service replica may take to confirm a proxy connection, before another
+	// one is tried.
+	ProxyConfirmTimeout = time.Second * 15
+	// RevProxyResync is how often reverse proxy listeners are checked against the service replicas.
+	RevProxyResync = time.Second * 5
 )
 
 func helperError(err error) {
@@ -44,12 +56,71 @@ type IPAllocator interface {
 	ReleaseIP(ip string) error
 }
 
+// IPv6Allocator is implemented by allocators that can also give ipv6 addresses, so bridges to ipv6 services are dual
+// stack locally. Addresses are released through IPAllocator.ReleaseIP.
+type IPv6Allocator interface {
+	HasIPv6() bool
+	GetIPv6(name ...string) (string, error)
+}
+
+// Namer gives bridges their local names: the first one is the main name. Names are released once the bridge is not
+// served anymore.
+type Namer interface {
+	Names(bridge Bridge) []string
+	ReleaseNames(bridge Bridge)
+}
+
+// localNamer names bridges after Bridge.LocalNames.
+type localNamer struct{}
+
+func (localNamer) Names(bridge Bridge) []string {
+	return bridge.LocalNames()
+}
+
+func (localNamer) ReleaseNames(Bridge) {}
+
+// BridgeConn is a single connection being piped through a bridge.
+type BridgeConn struct {
+	ID     string
+	Bridge Bridge
+	// Local is the address of our side of the connection to the local peer, Peer is the address of the local peer.
+	// For L2C bridges the peer is the local client, for C2L bridges it is the local service.
+	Local     string
+	Peer      string
+	StartedAt time.Time
+
+	cancel context.CancelCauseFunc
+}
+
+// Close terminates the connection.
+func (b *BridgeConn) Close() {
+	b.cancel(fmt.Errorf("connection closed on request"))
+}
+
+// BridgeObserver is notified about what happens while serving a bridge: failures that do not bring the bridge down
+// (like a single connection that could not be proxied), connections being opened and closed and traffic.
+type BridgeObserver interface {
+	BridgeError(bridge Bridge, err error)
+	BridgeConnOpened(conn *BridgeConn)
+	BridgeConnClosed(conn *BridgeConn)
+	// BridgeTraffic reports bytes received from (in) and sent to (out) the cluster since the previous call.
+	BridgeTraffic(conn *BridgeConn, in int64, out int64)
+}
+
 // PerfReporter allows reporting the amount of data copied from A to B and vice versa.
 type PerfReporter interface {
 	AtoB(total int64)
 	BotA(total int64)
 }
 
+// DialFunc opens a connection to the service at endpoint. Every connection of an agent - control, proxy and reverse
+// proxy ones - goes through it.
+type DialFunc func(ctx context.Context, endpoint string) (net.Conn, error)
+
+func dialTCP(ctx context.Context, endpoint string) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, "tcp", endpoint) //nolint:wrapcheck,exhaustruct
+}
+
 //----------------------------------------------------------------------------------------------------------------------
 
 type Agent struct {
@@ -59,12 +130,29 @@ type Agent struct {
 	wire     wire.Wire
 
 	ipAllocator IPAllocator
+	namer       Namer
 
 	bridges *memstore.Map[Bridge]
 	closers *memstore.Map[io.Closer]
 
 	response            chan CmdRawResponse
 	reportMetricFactory metrics.Factory
+	filter              Filter
+	observer            BridgeObserver
+	proxyRetry          time.Duration
+	revProxyResync      time.Duration
+	clusterCIDRs        []string
+	// proxyConfirm tells the service confirms proxy connections: older ones do not, and are not asked to.
+	proxyConfirm bool
+	// endpoints, when set, lists other replicas of the service, connections are spread across.
+	endpoints func() []string
+	balancer  *balancer
+	dial      DialFunc
+}
+
+// ClusterCIDRs are the service and pod networks of the cluster, as told by the service when connecting.
+func (c *Agent) ClusterCIDRs() []string {
+	return c.clusterCIDRs
 }
 
 //nolint:funlen,cyclop
@@ -76,77 +164,242 @@ func (c *Agent) ServeProxy(ctx context.Context, bridge Bridge) error {
 	ctx, cancel := context.WithCancelCause(ctx)
 	defer cancel(fmt.Errorf("deferred serveproxy ended"))
 
-	lname := bridge.LocalAddr
-	if lname == "" {
-		lname = bridge.Name
-	}
+	// bridge.LocalAddr is replaced by the allocated address below: names are released for the bridge as named.
+	named := bridge
+	names := c.namer.Names(named)
 
-	ipAddr, err := c.ipAllocator.GetIP(lname)
+	localAddrs, err := c.allocateLocalAddrs(bridge, names)
 	if err != nil {
-		return fmt.Errorf("error allocating ip for bridge %s: %w", bridge.Name, err)
+		c.namer.ReleaseNames(named)
+
+		return err
 	}
 
 	defer func() {
-		if err := c.ipAllocator.ReleaseIP(ipAddr); err != nil {
-			slog.Warn("error releasing ip addr", "bridge", bridge, "err", err)
+		for _, ipAddr := range localAddrs {
+			if err := c.ipAllocator.ReleaseIP(ipAddr); err != nil {
+				slog.Warn("error releasing ip addr", "bridge", bridge, "err", err)
+			}
 		}
+
+		c.namer.ReleaseNames(named)
 	}()
 
-	bridge.LocalAddr = ipAddr
+	bridge.LocalAddr = localAddrs[0]
 
-	listener, err := net.Listen(bridge.Family, bridge.FullLocalAddr())
-	if err != nil {
-		return fmt.Errorf("error listening at %s while serving proxy: %w", bridge.FullLocalAddr(), err)
+	listeners := make([]net.Listener, 0, len(localAddrs))
+
+	for _, ipAddr := range localAddrs {
+		addr := net.JoinHostPort(ipAddr, bridge.LocalPort)
+
+		listener, err := net.Listen(bridge.Family, addr)
+		if err != nil {
+			for _, l := range listeners {
+				helperIoClose(l)
+			}
+
+			return fmt.Errorf("error listening at %s while serving proxy: %w", addr, err)
+		}
+
+		listeners = append(listeners, listener)
 	}
 
+	group, ctx := errgroup.WithContext(ctx)
+
 	go func() {
 		<-ctx.Done()
-		helperIoClose(listener)
+
+		for _, listener := range listeners {
+			helperIoClose(listener)
+		}
 	}()
 
+	for _, listener := range listeners {
+		listener := listener
+
+		group.Go(func() error {
+			return c.acceptProxyConns(ctx, bridge, listener)
+		})
+	}
+
+	return group.Wait() //nolint:wrapcheck
+}
+
+// allocateLocalAddrs gets the local addresses of a bridge: one from the main network and, if the container side has
+// ipv6 addresses and the allocator can give one, an ipv6 one too. The first address is the main one.
+func (c *Agent) allocateLocalAddrs(bridge Bridge, names []string) ([]string, error) {
+	ipAddr, err := c.ipAllocator.GetIP(names...)
+	if err != nil {
+		return nil, fmt.Errorf("error allocating ip for bridge %s: %w", bridge.Name, err)
+	}
+
+	ret := []string{ipAddr}
+
+	allocator6, ok := c.ipAllocator.(IPv6Allocator)
+	if _, hasIPv6 := bridge.IPFamilies(); !hasIPv6 || !ok || !allocator6.HasIPv6() {
+		return ret, nil
+	}
+
+	ipAddr6, err := allocator6.GetIPv6(names...)
+	if err != nil {
+		slog.Warn("could not allocate ipv6 address, bridge will be ipv4 only", "bridge", bridge.Name, "err", err)
+
+		return ret, nil
+	}
+
+	return append(ret, ipAddr6), nil
+}
+
+func (c *Agent) acceptProxyConns(ctx context.Context, bridge Bridge, listener net.Listener) error {
 	for {
 		cli, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("context cancelled when serving proxy: %w", context.Cause(ctx))
+			}
+
 			return fmt.Errorf("error acceptin conn: %w", err)
 		}
 
-		lcon, err := c.Proxy(ProxyRequest{
-			Name:     bridge.Name,
-			Family:   bridge.Family,
-			Endpoint: bridge.FullContainerAddr(),
-		})
-		if err != nil {
-			return fmt.Errorf("error establishing proxy connection for %s: %w", bridge.Name, err)
+		go c.serveProxyConn(ctx, bridge, cli)
+	}
+}
+
+// serveProxyConn pipes a single accepted connection to the bridge container endpoint. Failures here are reported,
+// but will not affect the bridge nor other connections.
+func (c *Agent) serveProxyConn(ctx context.Context, bridge Bridge, cli net.Conn) {
+	lcon, err := c.proxyWithRetry(ctx, ProxyRequest{
+		Name:     bridge.Name,
+		Family:   bridge.Family,
+		Endpoint: bridge.FullContainerAddr(),
+	})
+	if err != nil {
+		helperIoClose(cli)
+		c.reportBridgeError(bridge, fmt.Errorf("error establishing proxy connection for %s: %w", bridge.Name, err))
+
+		return
+	}
+
+	piper := pipe.New(lcon, cli)
+
+	if c.reportMetricFactory != nil {
+		obsB := c.reportMetricFactory.New("proxy", "name", "from", "to").
+			Counter(map[string]string{
+				"name": bridge.Name,
+				"from": bridge.FullLocalAddr(),
+				"to":   bridge.FullContainerAddr(),
+			})
+
+		obsA := c.reportMetricFactory.New("proxy", "name", "from", "to").
+			Counter(map[string]string{
+				"name": bridge.Name,
+				"from": bridge.FullContainerAddr(),
+				"to":   bridge.FullLocalAddr(),
+			})
+
+		piper.BMetric = obsB.Add
+
+		piper.AMetric = obsA.Add
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(fmt.Errorf("proxy conn ended"))
+
+	// lcon (A) is the cluster side: what is written to it goes out, what is written to cli (B) came in.
+	c.observePipe(piper, &BridgeConn{
+		Bridge: bridge,
+		Local:  cli.LocalAddr().String(),
+		Peer:   cli.RemoteAddr().String(),
+		cancel: cancel,
+	}, false)
+
+	if err := piper.Run(ctx); err != nil {
+		slog.Warn("error while piping", "bridge", bridge.Name, "err", err)
+	}
+}
+
+// observePipe reports connection lifecycle and traffic of the pipe to the observer, if any. When aIsLocal is set,
+// data written to A is considered incoming from the cluster, otherwise it is outgoing.
+func (c *Agent) observePipe(piper *pipe.Pipe, conn *BridgeConn, aIsLocal bool) {
+	if c.observer == nil {
+		return
+	}
+
+	conn.ID = uuid.NewString()
+	conn.StartedAt = time.Now()
+
+	c.observer.BridgeConnOpened(conn)
+
+	piper.OnClose = func() {
+		c.observer.BridgeConnClosed(conn)
+	}
+
+	chain := func(metric pipe.Float64Metric, report func(v int64)) pipe.Float64Metric {
+		return func(v float64) {
+			if metric != nil {
+				metric(v)
+			}
+
+			if v > 0 {
+				report(int64(v))
+			}
 		}
+	}
 
-		piper := pipe.New(lcon, cli)
+	toIn := func(v int64) { c.observer.BridgeTraffic(conn, v, 0) }
+	toOut := func(v int64) { c.observer.BridgeTraffic(conn, 0, v) }
 
-		if c.reportMetricFactory != nil {
-			obsB := c.reportMetricFactory.New("proxy", "name", "from", "to").
-				Counter(map[string]string{
-					"name": bridge.Name,
-					"from": bridge.FullLocalAddr(),
-					"to":   bridge.FullContainerAddr(),
-				})
+	if aIsLocal {
+		piper.AMetric = chain(piper.AMetric, toIn)
+		piper.BMetric = chain(piper.BMetric, toOut)
 
-			obsA := c.reportMetricFactory.New("proxy", "name", "from", "to").
-				Counter(map[string]string{
-					"name": bridge.Name,
-					"from": bridge.FullContainerAddr(),
-					"to":   bridge.FullLocalAddr(),
-				})
+		return
+	}
 
-			piper.BMetric = obsB.Add
+	piper.AMetric = chain(piper.AMetric, toOut)
+	piper.BMetric = chain(piper.BMetric, toIn)
+}
 
-			piper.AMetric = obsA.Add
+func (c *Agent) reportBridgeError(bridge Bridge, err error) {
+	slog.Warn("bridge error", "bridge", bridge.Name, "err", err)
+
+	if c.reportMetricFactory != nil {
+		c.reportMetricFactory.New("proxy-errors", "name").
+			Counter(map[string]string{"name": bridge.Name}).
+			Add(1)
+	}
+
+	if c.observer != nil {
+		c.observer.BridgeError(bridge, err)
+	}
+}
+
+// proxyWithRetry calls Proxy, retrying with exponential backoff for up to proxyRetry, if configured.
+func (c *Agent) proxyWithRetry(ctx context.Context, req ProxyRequest) (io.ReadWriteCloser, error) {
+	if c.proxyRetry <= 0 {
+		return c.Proxy(ctx, req)
+	}
+
+	var ret io.ReadWriteCloser
+
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxElapsedTime = c.proxyRetry
+
+	err := backoff.Retry(func() error {
+		var err error
+
+		ret, err = c.Proxy(ctx, req)
+		if errors.Is(err, ErrDialDenied) {
+			return backoff.Permanent(err)
 		}
 
-		go func() {
-			if err := piper.Run(ctx); err != nil {
-				slog.Warn("error while piping", "bridge", bridge.Name, "err", err)
-			}
-		}()
+		return err
+	}, backoff.WithContext(bo, ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error proxying after retries: %w", err)
 	}
+
+	return ret, nil
 }
 
 func (c *Agent) ServeReverse(ctx context.Context, b Bridge) (func(err error), error) {
@@ -158,26 +411,172 @@ func (c *Agent) ServeReverse(ctx context.Context, b Bridge) (func(err error), er
 	})
 }
 
-func (c *Agent) Proxy(req ProxyRequest) (io.ReadWriteCloser, error) {
+// Proxy opens a connection to req.Endpoint through one of the service replicas, failing over to the others when the
+// one in turn can not be reached. ctx bounds opening the connection only.
+func (c *Agent) Proxy(ctx context.Context, req ProxyRequest) (io.ReadWriteCloser, error) {
 	if req.Family == "" {
 		return nil, fmt.Errorf("no family provided")
 	}
 
-	con, err := net.Dial(req.Family, c.endpoint)
+	var ret io.ReadWriteCloser
+
+	err := c.balancer.try(func(endpoint string) (bool, error) {
+		var (
+			failOver bool
+			err      error
+		)
+
+		ret, failOver, err = c.proxyVia(ctx, endpoint, req)
+
+		return failOver, err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error dialing: %w", err)
+		return nil, err
 	}
 
+	return ret, nil
+}
+
+// proxyVia opens a connection to req.Endpoint through the service replica at endpoint, telling if another replica
+// should be tried when failing.
+func (c *Agent) proxyVia(ctx context.Context, endpoint string, req ProxyRequest) (io.ReadWriteCloser, bool, error) {
+	// the link to the service is always tcp, whatever the family of the proxied connection.
+	con, err := c.dial(ctx, endpoint)
+	if err != nil {
+		return nil, true, fmt.Errorf("error dialing: %w", err)
+	}
+
+	req.Confirm = c.proxyConfirm
+
+	// a stalled replica (or ctx done) must not hold the connection forever: the deadline is lifted once confirmed.
+	deadline := time.Now().Add(ProxyConfirmTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	_ = con.SetDeadline(deadline)
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = con.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
 	if err = c.wire.WriteJSON(con, CmdProxy, req); err != nil {
-		return nil, fmt.Errorf("client.Proxy: error sending command: %w", err)
+		helperIoClose(con)
+
+		return nil, true, fmt.Errorf("client.Proxy: error sending command: %w", err)
 	}
 
-	return con, nil
+	if !req.Confirm {
+		_ = con.SetDeadline(time.Time{})
+
+		return c.proxyConn(con, req), false, nil
+	}
+
+	res := ProxyResponse{}
+	if err = c.wire.ReadJSON(con, CmdProxy, &res); err != nil {
+		helperIoClose(con)
+
+		if ctx.Err() != nil {
+			return nil, false, fmt.Errorf("client.Proxy: %w", ctx.Err())
+		}
+
+		return nil, true, fmt.Errorf("client.Proxy: error reading confirmation: %w", err)
+	}
+
+	if !stop() {
+		helperIoClose(con)
+
+		return nil, false, fmt.Errorf("client.Proxy: %w", ctx.Err())
+	}
+
+	_ = con.SetDeadline(time.Time{})
+
+	if res.Denied {
+		helperIoClose(con)
+
+		return nil, false, fmt.Errorf("client.Proxy: %w: %s", ErrDialDenied, res.Err)
+	}
+
+	if res.Err != "" {
+		helperIoClose(con)
+
+		return nil, false, fmt.Errorf("client.Proxy: service could not reach %s: %s", req.Endpoint, res.Err)
+	}
+
+	return c.proxyConn(con, req), false, nil
+}
+
+func (c *Agent) proxyConn(con net.Conn, req ProxyRequest) io.ReadWriteCloser {
+	if req.Datagrams {
+		return newDatagramConn(con)
+	}
+
+	return con
 }
 
+// ResolveDNS sends query to be resolved by the service, with the cluster resolver, failing over to other replicas as
+// Proxy does.
+func (c *Agent) ResolveDNS(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("error packing dns query: %w", err)
+	}
+
+	res := DNSResponse{}
+
+	err = c.balancer.try(func(endpoint string) (bool, error) {
+		if ctx.Err() != nil {
+			return false, fmt.Errorf("client.ResolveDNS: %w", ctx.Err())
+		}
+
+		return true, c.resolveDNSVia(ctx, endpoint, packed, &res)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Err != "" {
+		return nil, fmt.Errorf("client.ResolveDNS: service could not resolve: %s", res.Err)
+	}
+
+	answer := new(dns.Msg)
+	if err = answer.Unpack(res.Msg); err != nil {
+		return nil, fmt.Errorf("error unpacking dns answer: %w", err)
+	}
+
+	return answer, nil
+}
+
+func (c *Agent) resolveDNSVia(ctx context.Context, endpoint string, packed []byte, res *DNSResponse) error {
+	con, err := c.dial(ctx, endpoint)
+	if err != nil {
+		return fmt.Errorf("error dialing: %w", err)
+	}
+
+	defer helperIoClose(con)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = con.SetDeadline(deadline)
+	}
+
+	if err = c.wire.WriteJSON(con, CmdDNS, DNSRequest{Msg: packed}); err != nil {
+		return fmt.Errorf("client.ResolveDNS: error sending command: %w", err)
+	}
+
+	if err = c.wire.ReadJSON(con, CmdDNS, res); err != nil {
+		return fmt.Errorf("client.ResolveDNS: error reading response: %w", err)
+	}
+
+	return nil
+}
+
+// handleRevProxyWork takes a connection received by the service replica at endpoint: being the only one to know about
+// it, the work connection is pinned to it.
+//
 //nolint:funlen
-func (c *Agent) handleRevProxyWork(ctx context.Context, rpe RevProxyWorkRequest, rplreq RevProxyListenRequest) { //nolint:lll
-	rconn, err := net.Dial("tcp", c.endpoint)
+func (c *Agent) handleRevProxyWork(ctx context.Context, endpoint string, rpe RevProxyWorkRequest, rplreq RevProxyListenRequest) { //nolint:lll
+	rconn, err := c.dial(ctx, endpoint)
 	if err != nil {
 		slog.Warn("Agent.handleRevProxyWork:error dialing remote proxy", "err", err)
 
@@ -201,7 +600,9 @@ func (c *Agent) handleRevProxyWork(ctx context.Context, rpe RevProxyWorkRequest,
 
 	lconn, err := net.Dial("tcp", rplreq.LocalAddr)
 	if err != nil {
-		slog.Warn("error opening local port", "err", err)
+		c.reportBridgeError(
+			Bridge{Name: rplreq.Name, Direction: DirectionC2L},
+			fmt.Errorf("error opening local port %s: %w", rplreq.LocalAddr, err))
 
 		return
 	}
@@ -240,44 +641,64 @@ func (c *Agent) handleRevProxyWork(ctx context.Context, rpe RevProxyWorkRequest,
 		piper.AMetric = obsA.Add
 	}
 
+	// lconn (A) is the local service: what is written to it came in from the cluster.
+	c.observePipe(piper, &BridgeConn{
+		Bridge: Bridge{Name: rplreq.Name, Direction: DirectionC2L},
+		Local:  lconn.LocalAddr().String(),
+		Peer:   lconn.RemoteAddr().String(),
+		cancel: cancel,
+	}, true)
+
 	if err := piper.Run(ctx); err != nil {
 		slog.Warn("error piping rev proxy work", "err", err)
 	}
 }
 
-func (c *Agent) handleRevProxyListen(ctx context.Context, conn net.Conn, req RevProxyListenRequest) {
+// handleRevProxyListen takes the work connections the replica at endpoint announces on conn, until conn is lost.
+func (c *Agent) handleRevProxyListen(ctx context.Context, conn net.Conn, endpoint string, req RevProxyListenRequest) error { //nolint:lll
 	for {
 		rpe := RevProxyWorkRequest{}
 
 		if err := c.wire.ReadJSON(conn, CmdRevProxyWork, &rpe); err != nil {
-			slog.Warn("error receiving payload", "err", err)
-
-			return
+			return fmt.Errorf("reverse proxy listener lost: %w", err)
 		}
 
 		slog.Debug("client.handleRevProxyListen: got new conn", "addr", conn.RemoteAddr().String())
 
-		go c.handleRevProxyWork(ctx, rpe, req)
+		go c.handleRevProxyWork(ctx, endpoint, rpe, req)
 	}
 }
 
+// RevProxyListen asks every service replica to listen for req, as connections from the cluster may reach any of them.
+// It fails only if no replica could. Replicas are checked again every revProxyResync: the ones that showed up or lost
+// their listener are asked to listen, the ones that went away are let go. Replicas that could not listen are reported
+// as bridge errors.
 func (c *Agent) RevProxyListen(ctx context.Context, req RevProxyListenRequest) (func(err error), error) {
-	con, err := net.Dial("tcp", c.endpoint)
-	if err != nil {
-		return nil, fmt.Errorf("error dialing: %w", err)
-	}
+	listener := newRevProxyListener(c, req)
 
-	if err = c.wire.WriteJSON(con, CmdRevProxyListen, req); err != nil {
-		return nil, fmt.Errorf("error marshalling request: %w", err)
-	}
+	listenCtx, cancel := context.WithCancelCause(ctx)
 
-	rplres := RevProxyListenResponse{}
-	if err = c.wire.ReadJSON(con, CmdRevProxyListen, &rplres); err != nil {
-		return nil, fmt.Errorf("error reading rev proxy listen confirmation")
+	if err := listener.sync(listenCtx, ctx); err != nil && listener.listening() == 0 {
+		cancel(err)
+		listener.close()
+
+		return nil, err
 	}
 
 	go func() {
-		c.handleRevProxyListen(ctx, con, req)
+		defer listener.close()
+
+		ticker := time.NewTicker(c.revProxyResync)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-listenCtx.Done():
+				return
+			case <-ticker.C:
+				_ = listener.sync(listenCtx, ctx)
+			}
+		}
 	}()
 
 	return func(err error) {
@@ -285,10 +706,33 @@ func (c *Agent) RevProxyListen(ctx context.Context, req RevProxyListenRequest) (
 			slog.Warn("error closing rev. proxy", "err", err)
 		}
 
-		helperIoClose(con)
+		cancel(fmt.Errorf("rev. proxy closed: %w", err))
+		listener.close()
 	}, nil
 }
 
+func (c *Agent) revProxyListenVia(ctx context.Context, endpoint string, req RevProxyListenRequest) (net.Conn, error) {
+	con, err := c.dial(ctx, endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing: %w", err)
+	}
+
+	if err = c.wire.WriteJSON(con, CmdRevProxyListen, req); err != nil {
+		helperIoClose(con)
+
+		return nil, fmt.Errorf("error marshalling request: %w", err)
+	}
+
+	rplres := RevProxyListenResponse{}
+	if err = c.wire.ReadJSON(con, CmdRevProxyListen, &rplres); err != nil {
+		helperIoClose(con)
+
+		return nil, fmt.Errorf("error reading rev proxy listen confirmation")
+	}
+
+	return con, nil
+}
+
 func (c *Agent) Events() <-chan Event {
 	return c.events
 }
@@ -369,14 +813,84 @@ func AgentWithMetrics(m metrics.Factory) AgentOpts {
 	}
 }
 
+// AgentWithObserver registers an observer to be notified about bridge failures.
+func AgentWithObserver(o BridgeObserver) AgentOpts {
+	return func(a *Agent) {
+		a.observer = o
+	}
+}
+
+// AgentWithProxyRetry allows proxy connections to be retried, with exponential backoff, for up to maxElapsedTime
+// before giving up. Zero disables retrying.
+func AgentWithProxyRetry(maxElapsedTime time.Duration) AgentOpts {
+	return func(a *Agent) {
+		a.proxyRetry = maxElapsedTime
+	}
+}
+
+// AgentWithNamer sets how bridges are named locally. By default they are named after Bridge.LocalNames.
+func AgentWithNamer(n Namer) AgentOpts {
+	return func(a *Agent) {
+		a.namer = n
+	}
+}
+
+// AgentWithEndpoints spreads proxy connections across other replicas of the service, as listed by endpoints each time
+// a connection is opened, besides the one the agent was created for. Reverse proxies listen on all of them.
+func AgentWithEndpoints(endpoints func() []string) AgentOpts {
+	return func(a *Agent) {
+		a.endpoints = endpoints
+	}
+}
+
+// AgentWithRevProxyResync sets how often reverse proxy listeners are checked against the service replicas,
+// RevProxyResync by default.
+func AgentWithRevProxyResync(interval time.Duration) AgentOpts {
+	return func(a *Agent) {
+		a.revProxyResync = interval
+	}
+}
+
+// AgentWithDialer sets how connections to the service are opened - by default, straight over tcp.
+func AgentWithDialer(dial DialFunc) AgentOpts {
+	return func(a *Agent) {
+		a.dial = dial
+	}
+}
+
+// AgentWithFilter subscribes the agent only to bridges accepted by the filter.
+func AgentWithFilter(f Filter) AgentOpts {
+	return func(a *Agent) {
+		a.filter = f
+	}
+}
+
 func NewAgent(ctx context.Context, endponit string, ipAllocator IPAllocator, opts ...AgentOpts) (*Agent, error) {
 	if ctx.Err() != nil {
 		return nil, fmt.Errorf("context cancelled when creating agent: %w", ctx.Err())
 	}
 
-	localWire := wire.Wire{}
+	ret := &Agent{
+		wire:        wire.Wire{},
+		endpoint:    endponit,
+		events:      make(chan Event, MaxEventsBacklog),
+		response:    make(chan CmdRawResponse),
+		bridges:     memstore.New[Bridge](),
+		closers:     memstore.New[io.Closer](),
+		ipAllocator: ipAllocator,
+		namer:       localNamer{},
+		dial:        dialTCP,
+
+		revProxyResync: RevProxyResync,
+	}
 
-	cmdConn, err := net.Dial("tcp", endponit)
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	ret.balancer = newBalancer(endponit, ret.endpoints)
+
+	cmdConn, err := ret.dial(ctx, endponit)
 	if err != nil {
 		return nil, fmt.Errorf("error dialing endpoint: %w", err)
 	}
@@ -386,31 +900,26 @@ func NewAgent(ctx context.Context, endponit string, ipAllocator IPAllocator, opt
 		helperIoClose(cmdConn)
 	}()
 
-	cmdConnControlRequest := CmdConnControlRequest{}
-	if err = localWire.WriteJSON(cmdConn, CmdControl, cmdConnControlRequest); err != nil {
+	cmdConnControlRequest := CmdConnControlRequest{Filter: ret.filter}
+	if err = ret.wire.WriteJSON(cmdConn, CmdControl, cmdConnControlRequest); err != nil {
 		return nil, fmt.Errorf("error opening control conn: %w", err)
 	}
 
 	cmdConnControlResponse := CmdConnControlResponse{}
-	if err = localWire.ReadJSON(cmdConn, CmdControl, &cmdConnControlResponse); err != nil {
+	if err = ret.wire.ReadJSON(cmdConn, CmdControl, &cmdConnControlResponse); err != nil {
 		return nil, fmt.Errorf("error opening control conn: %w", err)
 	}
 
-	ret := &Agent{
-		wire:        localWire,
-		endpoint:    endponit,
-		cmdConn:     cmdConn,
-		events:      make(chan Event, MaxEventsBacklog),
-		response:    make(chan CmdRawResponse),
-		bridges:     memstore.New[Bridge](),
-		closers:     memstore.New[io.Closer](),
-		ipAllocator: ipAllocator,
-	}
+	if cmdConnControlResponse.Err != "" {
+		helperIoClose(cmdConn)
 
-	for _, opt := range opts {
-		opt(ret)
+		return nil, fmt.Errorf("control conn refused: %s", cmdConnControlResponse.Err)
 	}
 
+	ret.cmdConn = cmdConn
+	ret.clusterCIDRs = cmdConnControlResponse.ClusterCIDRs
+	ret.proxyConfirm = cmdConnControlResponse.ProxyConfirm
+
 	go func(ctx context.Context) {
 		helperError(ret.handleControlMessages(ctx, cmdConn))
 	}(ctx)
@@ -0,0 +1,108 @@
+package netmux
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// FailoverCooldown is for how long a service replica that could not be reached is tried only after the others.
+const FailoverCooldown = time.Second * 10
+
+// balancer spreads connections across the service replicas an agent can reach, round robin. Replicas that could not
+// be reached are tried last for a while, so connections fail over to the others.
+type balancer struct {
+	mx        sync.Mutex
+	primary   string
+	endpoints func() []string
+	next      int
+	failed    map[string]time.Time
+}
+
+func newBalancer(primary string, endpoints func() []string) *balancer {
+	return &balancer{
+		primary:   primary,
+		endpoints: endpoints,
+		failed:    map[string]time.Time{},
+	}
+}
+
+// all returns the endpoints of all replicas, the primary one first.
+func (b *balancer) all() []string {
+	ret := []string{b.primary}
+
+	if b.endpoints == nil {
+		return ret
+	}
+
+	for _, endpoint := range b.endpoints() {
+		if endpoint != "" && !slices.Contains(ret, endpoint) {
+			ret = append(ret, endpoint)
+		}
+	}
+
+	return ret
+}
+
+// candidates returns the endpoints to try, in order: the next one in turn first, and the ones that failed lately last.
+func (b *balancer) candidates() []string {
+	all := b.all()
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	start := b.next % len(all)
+	b.next++
+
+	healthy := make([]string, 0, len(all))
+	failed := make([]string, 0)
+
+	for i := range all {
+		endpoint := all[(start+i)%len(all)]
+
+		if failedAt, ok := b.failed[endpoint]; ok && time.Since(failedAt) < FailoverCooldown {
+			failed = append(failed, endpoint)
+
+			continue
+		}
+
+		delete(b.failed, endpoint)
+
+		healthy = append(healthy, endpoint)
+	}
+
+	return append(healthy, failed...)
+}
+
+func (b *balancer) markFailed(endpoint string, err error) {
+	slog.Debug("service endpoint failed, failing over", "endpoint", endpoint, "err", err)
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.failed[endpoint] = time.Now()
+}
+
+// try calls fn with each candidate endpoint until it succeeds or tells not to try others, by returning false.
+func (b *balancer) try(fn func(endpoint string) (bool, error)) error {
+	errs := make([]error, 0)
+
+	for _, endpoint := range b.candidates() {
+		failOver, err := fn(endpoint)
+		if err == nil {
+			return nil
+		}
+
+		errs = append(errs, err)
+
+		if !failOver {
+			break
+		}
+
+		b.markFailed(endpoint, err)
+	}
+
+	return errors.Join(errs...)
+}
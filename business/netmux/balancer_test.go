@@ -0,0 +1,441 @@
+package netmux_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/duxthemux/netmux/business/netmux"
+	"github.com/duxthemux/netmux/foundation/wire"
+)
+
+// replica serves a netmux service, counting the proxy connections it dials.
+type replica struct {
+	listener net.Listener
+	dials    atomic.Int64
+}
+
+func newReplica(ctx context.Context, t *testing.T) *replica {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ret := &replica{listener: listener}
+
+	srv := netmux.NewService(netmux.WithDialPolicy(func(_ string, _ netip.AddrPort) error {
+		ret.dials.Add(1)
+
+		return nil
+	}))
+
+	go func() {
+		_ = srv.Serve(ctx, listener)
+	}()
+
+	return ret
+}
+
+func (r *replica) addr() string {
+	return r.listener.Addr().String()
+}
+
+func okServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			_, _ = conn.Write([]byte("ok"))
+			doClose(conn)
+		}
+	}()
+
+	return listener
+}
+
+//nolint:paralleltest
+func TestProxySpreadAndFailOver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	upstream := okServer(t)
+	defer doClose(upstream)
+
+	replicaA, replicaB := newReplica(ctx, t), newReplica(ctx, t)
+	defer doClose(replicaA.listener)
+
+	cli, err := netmux.NewAgent(ctx, replicaA.addr(), &ZeroIPAllocator{},
+		netmux.AgentWithEndpoints(func() []string {
+			return []string{replicaA.addr(), replicaB.addr()}
+		}))
+	require.NoError(t, err)
+
+	proxy := func() {
+		t.Helper()
+
+		conn, err := cli.Proxy(ctx, netmux.ProxyRequest{
+			Name:     "spread",
+			Family:   netmux.FamilyTCP,
+			Endpoint: upstream.Addr().String(),
+		})
+		require.NoError(t, err)
+
+		buf, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "ok", string(buf))
+
+		doClose(conn)
+	}
+
+	for i := 0; i < 4; i++ {
+		proxy()
+	}
+
+	assert.Equal(t, int64(2), replicaA.dials.Load())
+	assert.Equal(t, int64(2), replicaB.dials.Load())
+
+	// replica b goes away: connections fail over to replica a.
+	doClose(replicaB.listener)
+
+	for i := 0; i < 3; i++ {
+		proxy()
+	}
+
+	assert.Equal(t, int64(5), replicaA.dials.Load())
+	assert.Equal(t, int64(2), replicaB.dials.Load())
+}
+
+//nolint:paralleltest
+func TestRevProxyPinnedToReplica(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	userService := okServer(t)
+	defer doClose(userService)
+
+	replicaA, replicaB := newReplica(ctx, t), newReplica(ctx, t)
+	defer doClose(replicaB.listener)
+
+	cli, err := netmux.NewAgent(ctx, replicaA.addr(), &ZeroIPAllocator{},
+		netmux.AgentWithEndpoints(func() []string {
+			return []string{replicaA.addr(), replicaB.addr()}
+		}))
+	require.NoError(t, err)
+
+	// replica a can no longer be reached: only replica b listens, and has to get the work connections.
+	doClose(replicaA.listener)
+
+	remoteAddr := net.JoinHostPort("127.0.0.1", freePort(t))
+
+	closeListener, err := cli.RevProxyListen(ctx, netmux.RevProxyListenRequest{
+		Name:       "pinned",
+		Family:     netmux.FamilyTCP,
+		RemoteAddr: remoteAddr,
+		LocalAddr:  userService.Addr().String(),
+	})
+	require.NoError(t, err)
+
+	defer closeListener(nil)
+
+	var conn net.Conn
+
+	require.Eventually(t, func() bool {
+		conn, err = net.Dial("tcp", remoteAddr)
+
+		return err == nil
+	}, MaxWaitTime, time.Millisecond*50)
+
+	defer doClose(conn)
+
+	_ = conn.SetReadDeadline(time.Now().Add(MaxWaitTime))
+
+	buf := make([]byte, 2)
+
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(buf))
+}
+
+// stalledReplica accepts connections, never replying to them.
+func stalledReplica(t *testing.T) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer doClose(conn)
+
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+//nolint:paralleltest
+func TestProxyStalledReplica(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	upstream := okServer(t)
+	defer doClose(upstream)
+
+	replica := newReplica(ctx, t)
+	defer doClose(replica.listener)
+
+	stalled := stalledReplica(t)
+	defer doClose(stalled)
+
+	cli, err := netmux.NewAgent(ctx, replica.addr(), &ZeroIPAllocator{},
+		netmux.AgentWithEndpoints(func() []string {
+			return []string{stalled.Addr().String()}
+		}))
+	require.NoError(t, err)
+
+	// round robin: one of both goes to the stalled replica, and gives up when ctx does.
+	failed := 0
+
+	for i := 0; i < 2; i++ {
+		proxyCtx, proxyCancel := context.WithTimeout(ctx, time.Millisecond*300)
+
+		conn, err := cli.Proxy(proxyCtx, netmux.ProxyRequest{
+			Name:     "stalled",
+			Family:   netmux.FamilyTCP,
+			Endpoint: upstream.Addr().String(),
+		})
+
+		proxyCancel()
+
+		if err != nil {
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+
+			failed++
+
+			continue
+		}
+
+		buf, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "ok", string(buf))
+
+		doClose(conn)
+	}
+
+	assert.Equal(t, 1, failed)
+}
+
+// oldService serves control connections and proxies as services predating proxy confirmations did.
+func oldService(t *testing.T, upstream string) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	wire := &wire.Wire{}
+
+	serve := func(conn net.Conn) {
+		defer doClose(conn)
+
+		cmd, payload, err := wire.Read(conn)
+		if err != nil {
+			return
+		}
+
+		switch cmd {
+		case netmux.CmdControl:
+			_ = wire.WriteJSON(conn, netmux.CmdControl, netmux.CmdConnControlResponse{})
+			_, _ = io.Copy(io.Discard, conn)
+		case netmux.CmdProxy:
+			req := netmux.ProxyRequest{}
+			if err := json.Unmarshal(payload, &req); err != nil || req.Confirm {
+				return
+			}
+
+			proxied, err := net.Dial("tcp", upstream)
+			if err != nil {
+				return
+			}
+
+			defer doClose(proxied)
+
+			_, _ = io.Copy(conn, proxied)
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go serve(conn)
+		}
+	}()
+
+	return listener
+}
+
+//nolint:paralleltest
+func TestProxyOldService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	upstream := okServer(t)
+	defer doClose(upstream)
+
+	service := oldService(t, upstream.Addr().String())
+	defer doClose(service)
+
+	cli, err := netmux.NewAgent(ctx, service.Addr().String(), &ZeroIPAllocator{})
+	require.NoError(t, err)
+
+	proxyCtx, proxyCancel := context.WithTimeout(ctx, MaxWaitTime)
+	defer proxyCancel()
+
+	conn, err := cli.Proxy(proxyCtx, netmux.ProxyRequest{
+		Name:     "old",
+		Family:   netmux.FamilyTCP,
+		Endpoint: upstream.Addr().String(),
+	})
+	require.NoError(t, err)
+
+	defer doClose(conn)
+
+	buf, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", string(buf))
+}
+
+// listeningReplica accepts reverse proxy listens, handing over their connections to listens.
+func listeningReplica(t *testing.T, listens chan<- net.Conn) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	wire := &wire.Wire{}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			if cmd, _, err := wire.Read(conn); err != nil || cmd != netmux.CmdRevProxyListen {
+				doClose(conn)
+
+				continue
+			}
+
+			_ = wire.WriteJSON(conn, netmux.CmdRevProxyListen, netmux.RevProxyListenResponse{})
+
+			listens <- conn
+		}
+	}()
+
+	return listener
+}
+
+//nolint:paralleltest
+func TestRevProxyFollowsReplicas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	replica := newReplica(ctx, t)
+	defer doClose(replica.listener)
+
+	listens := make(chan net.Conn, 4)
+
+	joining := listeningReplica(t, listens)
+	defer doClose(joining)
+
+	var endpoints atomic.Value
+
+	endpoints.Store([]string{})
+
+	observer := &TestBridgeObserver{ch: make(chan error, 4)}
+
+	cli, err := netmux.NewAgent(ctx, replica.addr(), &ZeroIPAllocator{},
+		netmux.AgentWithObserver(observer),
+		netmux.AgentWithRevProxyResync(time.Millisecond*50),
+		netmux.AgentWithEndpoints(func() []string {
+			return endpoints.Load().([]string) //nolint:forcetypeassert
+		}))
+	require.NoError(t, err)
+
+	closeListener, err := cli.RevProxyListen(ctx, netmux.RevProxyListenRequest{
+		Name:       "following",
+		Family:     netmux.FamilyTCP,
+		RemoteAddr: net.JoinHostPort("127.0.0.1", freePort(t)),
+		LocalAddr:  "127.0.0.1:1",
+	})
+	require.NoError(t, err)
+
+	defer closeListener(nil)
+
+	nextListen := func() net.Conn {
+		t.Helper()
+
+		select {
+		case conn := <-listens:
+			return conn
+		case <-time.After(MaxWaitTime):
+			t.Fatalf("replica was not asked to listen")
+
+			return nil
+		}
+	}
+
+	// a replica shows up: it is asked to listen.
+	endpoints.Store([]string{joining.Addr().String()})
+
+	conn := nextListen()
+
+	// its listener is lost: it is reported, and the replica asked to listen again.
+	doClose(conn)
+
+	select {
+	case err := <-observer.ch:
+		assert.ErrorContains(t, err, joining.Addr().String())
+	case <-time.After(MaxWaitTime):
+		t.Fatalf("lost listener not reported")
+	}
+
+	conn = nextListen()
+	defer doClose(conn)
+
+	// the replica goes away: its listener is let go.
+	endpoints.Store([]string{})
+
+	_ = conn.SetReadDeadline(time.Now().Add(MaxWaitTime))
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
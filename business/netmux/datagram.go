@@ -0,0 +1,65 @@
+package netmux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MaxDatagramSize is the biggest datagram that can be carried by a datagramConn.
+const MaxDatagramSize = 65535
+
+// datagramConn keeps datagram boundaries over a stream, by prefixing each datagram with its length (16 bits, big
+// endian). Each Write sends one datagram and each Read returns one datagram - truncated, as in udp, if p is too small.
+type datagramConn struct {
+	io.ReadWriteCloser
+	rmx sync.Mutex
+	wmx sync.Mutex
+}
+
+func newDatagramConn(conn io.ReadWriteCloser) *datagramConn {
+	return &datagramConn{ReadWriteCloser: conn}
+}
+
+func (d *datagramConn) Read(p []byte) (int, error) {
+	d.rmx.Lock()
+	defer d.rmx.Unlock()
+
+	header := make([]byte, 2) //nolint:gomnd
+	if _, err := io.ReadFull(d.ReadWriteCloser, header); err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+
+	size := int(binary.BigEndian.Uint16(header))
+
+	if size <= len(p) {
+		return io.ReadFull(d.ReadWriteCloser, p[:size]) //nolint:wrapcheck
+	}
+
+	datagram := make([]byte, size)
+	if _, err := io.ReadFull(d.ReadWriteCloser, datagram); err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+
+	return copy(p, datagram), nil
+}
+
+func (d *datagramConn) Write(p []byte) (int, error) {
+	if len(p) > MaxDatagramSize {
+		return 0, fmt.Errorf("datagram too big: %d bytes", len(p))
+	}
+
+	d.wmx.Lock()
+	defer d.wmx.Unlock()
+
+	frame := make([]byte, 2+len(p)) //nolint:gomnd
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+
+	if _, err := d.ReadWriteCloser.Write(frame); err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+
+	return len(p), nil
+}
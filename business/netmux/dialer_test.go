@@ -0,0 +1,238 @@
+package netmux_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/duxthemux/netmux/business/netmux"
+	"github.com/duxthemux/netmux/foundation/httpproxy"
+	"github.com/duxthemux/netmux/foundation/quicconn"
+	"github.com/duxthemux/netmux/foundation/sshdial"
+	"github.com/duxthemux/netmux/foundation/sshdial/sshdialtest"
+	"github.com/duxthemux/netmux/foundation/upstream"
+	"github.com/duxthemux/netmux/foundation/wsconn"
+)
+
+// webSocketService serves a netmux service over websockets, behind https, requiring token.
+func webSocketService(ctx context.Context, t *testing.T, token string) (string, *wsconn.Dialer) {
+	t.Helper()
+
+	listener := wsconn.NewListener("/agent", wsconn.WithToken(token))
+
+	mux := http.NewServeMux()
+	mux.Handle("/agent", listener)
+
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+
+	go func() {
+		_ = netmux.NewService().Serve(ctx, listener)
+	}()
+
+	dialer := &wsconn.Dialer{
+		TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig, //nolint:forcetypeassert
+		Token:     token,
+	}
+
+	return "wss://" + strings.TrimPrefix(srv.URL, "https://") + "/agent", dialer
+}
+
+// quicService serves a netmux service over quic, requiring token.
+func quicService(ctx context.Context, t *testing.T, token string) (string, *tls.Config) {
+	t.Helper()
+
+	// borrows the certificate (for 127.0.0.1) of an https test server.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+
+	listener, err := quicconn.Listen("127.0.0.1:0", srv.TLS, quicconn.WithToken(token))
+	require.NoError(t, err)
+
+	go func() {
+		_ = netmux.NewService().Serve(ctx, listener)
+	}()
+
+	return listener.Addr().String(), srv.Client().Transport.(*http.Transport).TLSClientConfig //nolint:forcetypeassert
+}
+
+// expectProxies checks both proxy and reverse proxy connections of the agent reach userService.
+func expectProxies(ctx context.Context, t *testing.T, cli *netmux.Agent, userService net.Listener) {
+	t.Helper()
+
+	buf := make([]byte, 2)
+
+	conn, err := cli.Proxy(ctx, netmux.ProxyRequest{Family: netmux.FamilyTCP, Endpoint: userService.Addr().String()})
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(buf))
+
+	doClose(conn)
+
+	remoteAddr := net.JoinHostPort("127.0.0.1", freePort(t))
+
+	closeListener, err := cli.RevProxyListen(ctx, netmux.RevProxyListenRequest{
+		Name:       "reverse",
+		Family:     netmux.FamilyTCP,
+		RemoteAddr: remoteAddr,
+		LocalAddr:  userService.Addr().String(),
+	})
+	require.NoError(t, err)
+
+	defer closeListener(nil)
+
+	var revConn net.Conn
+
+	require.Eventually(t, func() bool {
+		revConn, err = net.Dial("tcp", remoteAddr)
+
+		return err == nil
+	}, MaxWaitTime, time.Millisecond*50)
+
+	defer doClose(revConn)
+
+	_ = revConn.SetReadDeadline(time.Now().Add(MaxWaitTime))
+
+	_, err = io.ReadFull(revConn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(buf))
+}
+
+//nolint:paralleltest
+func TestAgentOverWebSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	userService := okServer(t)
+	defer doClose(userService)
+
+	endpoint, dialer := webSocketService(ctx, t, "secret")
+
+	cli, err := netmux.NewAgent(ctx, endpoint, &ZeroIPAllocator{}, netmux.AgentWithDialer(dialer.Dial))
+	require.NoError(t, err)
+
+	expectProxies(ctx, t, cli, userService)
+}
+
+//nolint:paralleltest
+func TestAgentOverQUIC(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	userService := okServer(t)
+	defer doClose(userService)
+
+	addr, tlsConfig := quicService(ctx, t, "secret")
+
+	dialer := quicconn.NewDialer(addr, tlsConfig, "secret")
+	defer doClose(dialer)
+
+	cli, err := netmux.NewAgent(ctx, addr, &ZeroIPAllocator{}, netmux.AgentWithDialer(dialer.Dial))
+	require.NoError(t, err)
+
+	expectProxies(ctx, t, cli, userService)
+}
+
+//nolint:paralleltest
+func TestAgentOverSSH(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	userService := okServer(t)
+	defer doClose(userService)
+
+	service := newReplica(ctx, t)
+	defer doClose(service.listener)
+
+	jumpHost := sshdialtest.NewJumpHost(t)
+
+	dialer := sshdial.NewDialer(jumpHost.Addr(), jumpHost.ClientConfig())
+	defer doClose(dialer)
+
+	cli, err := netmux.NewAgent(ctx, service.addr(), &ZeroIPAllocator{}, netmux.AgentWithDialer(dialer.Dial))
+	require.NoError(t, err)
+
+	expectProxies(ctx, t, cli, userService)
+
+	// losing the ssh connection loses the control connection: a new agent gets a new ssh connection.
+	jumpHost.Drop()
+
+	require.Eventually(t, func() bool {
+		select {
+		case _, ok := <-cli.Events():
+			return !ok
+		default:
+			return false
+		}
+	}, MaxWaitTime, time.Millisecond*10)
+
+	cli, err = netmux.NewAgent(ctx, service.addr(), &ZeroIPAllocator{}, netmux.AgentWithDialer(dialer.Dial))
+	require.NoError(t, err)
+
+	expectProxies(ctx, t, cli, userService)
+	assert.Equal(t, 1, jumpHost.Conns())
+}
+
+//nolint:paralleltest
+func TestAgentThroughUpstreamProxy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	userService := okServer(t)
+	defer doClose(userService)
+
+	service := newReplica(ctx, t)
+	defer doClose(service.listener)
+
+	// the server is only known to the proxy: the local host is never proxied.
+	const endpoint = "nx-server.example.com:50000"
+
+	var connects atomic.Int32
+
+	proxy := httpproxy.New(func(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+		if addr != endpoint {
+			return nil, httpproxy.ErrNotAllowed
+		}
+
+		connects.Add(1)
+
+		return (&net.Dialer{}).DialContext(ctx, "tcp", service.addr())
+	})
+
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	dialer := upstream.New(upstream.WithProxy(srv.URL, ""))
+
+	cli, err := netmux.NewAgent(ctx, endpoint, &ZeroIPAllocator{}, netmux.AgentWithDialer(dialer.Dial))
+	require.NoError(t, err)
+
+	expectProxies(ctx, t, cli, userService)
+
+	// control, proxy, reverse proxy listen and work connections all went through the proxy.
+	assert.GreaterOrEqual(t, connects.Load(), int32(4))
+}
+
+//nolint:paralleltest
+func TestAgentOverWebSocketWrongToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	endpoint, dialer := webSocketService(ctx, t, "secret")
+	dialer.Token = "guess"
+
+	_, err := netmux.NewAgent(ctx, endpoint, &ZeroIPAllocator{}, netmux.AgentWithDialer(dialer.Dial))
+	require.ErrorIs(t, err, wsconn.ErrRefused)
+}
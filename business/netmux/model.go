@@ -3,7 +3,12 @@ package netmux
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/netip"
+	"path"
 	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 const (
@@ -12,10 +17,14 @@ const (
 
 	FamilyTCP = "tcp"
 	FamilyUpd = "upd"
+	FamilyUDP = "udp"
 
 	EventBridgeAdd = "bridge-add"
 	EventBridgeDel = "bridge-del"
 	EventBridgeUp  = "bridge-up"
+	// EventReplayDone follows the bridges known when the agent connected, with no bridge. Older services do not send
+	// it.
+	EventReplayDone = "replay-done"
 )
 
 func CmdToString(cmdUint16 uint16) string {
@@ -32,6 +41,8 @@ func CmdToString(cmdUint16 uint16) string {
 		return "revproxy-listen"
 	case CmdRevProxyWork:
 		return "revproxy-work"
+	case CmdDNS:
+		return "dns"
 	default:
 		return fmt.Sprintf("code %d now known", cmdUint16)
 	}
@@ -46,14 +57,38 @@ type Bridge struct {
 	ContainerPort string `json:"containerPort,omitempty" yaml:"containerPort"`
 	Direction     string `json:"direction,omitempty"     yaml:"direction"`
 	Family        string `json:"family,omitempty"        yaml:"family"`
+	Labels        string `json:"labels,omitempty"        yaml:"labels,omitempty"`
+	// ContainerAddrs are all the addresses of the container side, as the cluster ips of a dual stack service.
+	ContainerAddrs []string `json:"containerAddrs,omitempty" yaml:"containerAddrs,omitempty"`
 }
 
 func (b *Bridge) FullLocalAddr() string {
-	return fmt.Sprintf("%s:%s", b.LocalAddr, b.LocalPort)
+	return net.JoinHostPort(b.LocalAddr, b.LocalPort)
 }
 
 func (b *Bridge) FullContainerAddr() string {
-	return fmt.Sprintf("%s:%s", b.ContainerAddr, b.ContainerPort)
+	return net.JoinHostPort(b.ContainerAddr, b.ContainerPort)
+}
+
+// IPFamilies tells if the container side has ipv4 and ipv6 addresses. Names count as ipv4.
+func (b *Bridge) IPFamilies() (bool, bool) {
+	addrs := b.ContainerAddrs
+	if len(addrs) == 0 {
+		addrs = []string{b.ContainerAddr}
+	}
+
+	hasIPv4, hasIPv6 := false, false
+
+	for _, addr := range addrs {
+		ipAddr, err := netip.ParseAddr(addr)
+		if err == nil && ipAddr.Is6() && !ipAddr.Is4In6() {
+			hasIPv6 = true
+		} else {
+			hasIPv4 = true
+		}
+	}
+
+	return hasIPv4, hasIPv6
 }
 
 func (b *Bridge) LocalName() string {
@@ -64,6 +99,25 @@ func (b *Bridge) LocalName() string {
 	return b.Name
 }
 
+// LocalNames are the names the bridge is reachable at in the local machine: its local address (or name) and, when the
+// namespace is known, the namespace qualified forms used inside the cluster. The first one is the main name.
+func (b *Bridge) LocalNames() []string {
+	lname := b.LocalAddr
+	if lname == "" {
+		lname = b.Name
+	}
+
+	if b.Namespace == "" {
+		return []string{lname}
+	}
+
+	return []string{
+		lname,
+		fmt.Sprintf("%s.%s", lname, b.Namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", lname, b.Namespace),
+	}
+}
+
 func (b *Bridge) Validate() error {
 	if b.Name == "" {
 		return fmt.Errorf("invalid name")
@@ -107,6 +161,7 @@ const (
 	CmdProxy
 	CmdRevProxyListen
 	CmdRevProxyWork
+	CmdDNS
 )
 
 type Message struct {
@@ -144,11 +199,81 @@ func (c *CmdRawRequest) Write(req any) error {
 	return nil
 }
 
+// Filter describes which bridges an agent is interested in. Empty fields match everything.
+//   - Namespaces: bridge namespace must be one of these
+//   - Labels: kubernetes like label selector, matched against Bridge.Labels
+//   - Name: glob pattern (as in path.Match), matched against Bridge.Name
+type Filter struct {
+	Namespaces []string `json:"namespaces,omitempty" yaml:"namespaces,omitempty"`
+	Labels     string   `json:"labels,omitempty"     yaml:"labels,omitempty"`
+	Name       string   `json:"name,omitempty"       yaml:"name,omitempty"`
+}
+
+func (f Filter) Validate() error {
+	if _, err := labels.Parse(f.Labels); err != nil {
+		return fmt.Errorf("invalid label selector %s: %w", f.Labels, err)
+	}
+
+	if _, err := path.Match(f.Name, ""); err != nil {
+		return fmt.Errorf("invalid name pattern %s: %w", f.Name, err)
+	}
+
+	return nil
+}
+
+// Match tells if the bridge is accepted by this filter. Invalid filters will not match anything.
+func (f Filter) Match(b Bridge) bool {
+	if len(f.Namespaces) > 0 {
+		found := false
+
+		for _, ns := range f.Namespaces {
+			if ns == b.Namespace {
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if f.Name != "" {
+		if ok, err := path.Match(f.Name, b.Name); err != nil || !ok {
+			return false
+		}
+	}
+
+	if f.Labels != "" {
+		selector, err := labels.Parse(f.Labels)
+		if err != nil {
+			return false
+		}
+
+		bridgeLabels, err := labels.ConvertSelectorToLabelsMap(b.Labels)
+		if err != nil {
+			return false
+		}
+
+		if !selector.Matches(bridgeLabels) {
+			return false
+		}
+	}
+
+	return true
+}
+
 type CmdConnControlRequest struct {
 	Message
+	Filter Filter `json:"filter"`
 }
 type CmdConnControlResponse struct {
 	Message
+	// ClusterCIDRs are the service and pod networks of the cluster, when known by the service.
+	ClusterCIDRs []string `json:"clusterCidrs,omitempty"`
+	// ProxyConfirm tells the service confirms proxy connections when asked to (ProxyRequest.Confirm).
+	ProxyConfirm bool `json:"proxyConfirm,omitempty"`
 }
 
 type NoopMessage struct {
@@ -171,10 +296,28 @@ type ProxyRequest struct {
 	Name     string `json:"name" yaml:"name"`
 	Family   string `json:"family,omitempty"`
 	Endpoint string `json:"endpoint,omitempty"`
+	// Confirm asks the service to reply with a ProxyResponse once the endpoint is dialed (or failed to).
+	Confirm bool `json:"confirm,omitempty"`
+	// Datagrams keeps datagram boundaries (eg: for udp) by framing them in the stream.
+	Datagrams bool `json:"datagrams,omitempty"`
 }
 
 type ProxyResponse struct {
 	Message
+	// Denied is set when the service dial policy did not allow connecting to the endpoint.
+	Denied bool `json:"denied,omitempty"`
+}
+
+// DNSRequest carries a dns query (in wire format) to be resolved by the service, using the cluster resolver.
+type DNSRequest struct {
+	Message
+	Msg []byte `json:"msg"`
+}
+
+// DNSResponse carries the dns answer (in wire format) from the cluster resolver.
+type DNSResponse struct {
+	Message
+	Msg []byte `json:"msg,omitempty"`
 }
 
 type RevProxyListenRequest struct {
@@ -0,0 +1,156 @@
+package netmux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+)
+
+// revProxyListener keeps a reverse proxy listening on every service replica, as replicas come and go.
+type revProxyListener struct {
+	agent  *Agent
+	req    RevProxyListenRequest
+	mx     sync.Mutex
+	conns  map[string]net.Conn
+	failed map[string]bool
+	closed bool
+}
+
+func newRevProxyListener(agent *Agent, req RevProxyListenRequest) *revProxyListener {
+	return &revProxyListener{
+		agent:  agent,
+		req:    req,
+		conns:  map[string]net.Conn{},
+		failed: map[string]bool{},
+	}
+}
+
+func (l *revProxyListener) bridge() Bridge {
+	return Bridge{Name: l.req.Name, Direction: DirectionC2L}
+}
+
+// sync asks the replicas not listening yet to listen, and lets go of the ones that went away. Replicas that could not
+// listen are reported once, until they do. Work connections are bound to workCtx.
+func (l *revProxyListener) sync(ctx context.Context, workCtx context.Context) error {
+	all := l.agent.balancer.all()
+	errs := make([]error, 0)
+
+	for _, endpoint := range all {
+		l.mx.Lock()
+		_, listening := l.conns[endpoint]
+		l.mx.Unlock()
+
+		if listening {
+			continue
+		}
+
+		con, err := l.agent.revProxyListenVia(ctx, endpoint, l.req)
+		if err != nil {
+			err = fmt.Errorf("service replica %s could not listen: %w", endpoint, err)
+			errs = append(errs, err)
+
+			if l.fail(endpoint) {
+				l.agent.reportBridgeError(l.bridge(), err)
+			}
+
+			continue
+		}
+
+		if !l.add(endpoint, con) {
+			helperIoClose(con)
+
+			return nil
+		}
+
+		go l.serve(ctx, workCtx, endpoint, con)
+	}
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	for endpoint, con := range l.conns {
+		if !slices.Contains(all, endpoint) {
+			delete(l.conns, endpoint)
+			helperIoClose(con)
+		}
+	}
+
+	for endpoint := range l.failed {
+		if !slices.Contains(all, endpoint) {
+			delete(l.failed, endpoint)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// serve takes the work connections of the replica at endpoint. Once its listener is lost, it is let go to be asked
+// to listen again on the next sync.
+func (l *revProxyListener) serve(ctx context.Context, workCtx context.Context, endpoint string, con net.Conn) {
+	err := l.agent.handleRevProxyListen(workCtx, con, endpoint, l.req)
+
+	l.mx.Lock()
+	lost := !l.closed && l.conns[endpoint] == con
+
+	if lost {
+		delete(l.conns, endpoint)
+	}
+	l.mx.Unlock()
+
+	helperIoClose(con)
+
+	if lost && ctx.Err() == nil {
+		l.agent.reportBridgeError(l.bridge(), fmt.Errorf("service replica %s: %w", endpoint, err))
+	}
+}
+
+// fail records endpoint could not listen, telling whether it could before.
+func (l *revProxyListener) fail(endpoint string) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if l.failed[endpoint] {
+		return false
+	}
+
+	l.failed[endpoint] = true
+
+	return true
+}
+
+// add records endpoint is listening on con, unless the listener was closed.
+func (l *revProxyListener) add(endpoint string, con net.Conn) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if l.closed {
+		return false
+	}
+
+	l.conns[endpoint] = con
+	delete(l.failed, endpoint)
+
+	return true
+}
+
+func (l *revProxyListener) listening() int {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	return len(l.conns)
+}
+
+func (l *revProxyListener) close() {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	l.closed = true
+
+	for endpoint, con := range l.conns {
+		delete(l.conns, endpoint)
+		helperIoClose(con)
+	}
+}
@@ -5,11 +5,19 @@ package netmux
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/netip"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
 
 	"github.com/duxthemux/netmux/foundation/memstore"
 	"github.com/duxthemux/netmux/foundation/metrics"
@@ -17,6 +25,9 @@ import (
 	"github.com/duxthemux/netmux/foundation/wire"
 )
 
+// ResolvConfPath is where the service finds the cluster resolvers, when not configured.
+const ResolvConfPath = "/etc/resolv.conf"
+
 func helperIoClose(closer io.Closer) {
 	if err := closer.Close(); err != nil {
 		_, file, line, ok := runtime.Caller(1)
@@ -47,28 +58,203 @@ type revProxyConn struct {
 	Name string
 }
 
+// CmdConnWriteTimeout is for how long writing a frame to an agent control connection may take. Agents that stall for
+// longer are disconnected, to catch up with the replay once connected again.
+const CmdConnWriteTimeout = time.Second * 30
+
+type frame struct {
+	cmd     uint16
+	payload []byte
+}
+
+// cmdConn is an agent control connection, along with the bridges filter it subscribed with. Frames are queued and
+// written by a goroutine of its own (see serveWrites), so they never interleave and a slow agent only delays itself.
+type cmdConn struct {
+	net.Conn
+	Filter       Filter
+	writeTimeout time.Duration
+
+	mx      sync.Mutex
+	queue   []frame
+	ready   chan struct{}
+	stopped bool
+	done    chan struct{}
+}
+
+func newCmdConn(conn net.Conn, filter Filter, writeTimeout time.Duration) *cmdConn {
+	return &cmdConn{
+		Conn:         conn,
+		Filter:       filter,
+		writeTimeout: writeTimeout,
+		ready:        make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+}
+
+// send queues a frame.
+func (c *cmdConn) send(cmd uint16, payload []byte) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.stopped {
+		return net.ErrClosed
+	}
+
+	c.queue = append(c.queue, frame{cmd: cmd, payload: payload})
+
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (c *cmdConn) sendJSON(cmd uint16, payload any) error {
+	bs, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshalling payload: %w", err)
+	}
+
+	return c.send(cmd, bs)
+}
+
+// serveWrites writes the queued frames until stop is called, and what was queued by then is written. Once a write
+// fails or stalls for longer than writeTimeout, the connection is closed.
+func (c *cmdConn) serveWrites(w *wire.Wire) {
+	defer close(c.done)
+
+	for {
+		c.mx.Lock()
+		queue, stopped := c.queue, c.stopped
+		c.queue = nil
+		c.mx.Unlock()
+
+		for _, f := range queue {
+			_ = c.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+
+			if err := w.Write(c.Conn, f.cmd, f.payload); err != nil {
+				slog.Warn("error writing to agent, disconnecting it", "raddr", c.RemoteAddr().String(), "err", err)
+				c.stop()
+				helperIoClose(c.Conn)
+
+				return
+			}
+		}
+
+		if stopped && len(queue) == 0 {
+			return
+		}
+
+		if len(queue) == 0 {
+			<-c.ready
+		}
+	}
+}
+
+// stop lets serveWrites write what is queued and return, refusing anything else.
+func (c *cmdConn) stop() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.stopped = true
+
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
 // Service defines the core Netmux service. This is the software component running from inside infrastructure
 // that will accept and process requests from agents running on remote machines.
 type Service struct {
-	cmdConns            *memstore.Map[net.Conn]
+	cmdConns            *memstore.Map[*cmdConn]
 	revProxyConns       *memstore.Map[*revProxyConn]
 	bridges             *memstore.Map[Bridge]
 	wire                *wire.Wire
 	cmdHandler          map[uint16]CmdHandler
 	eventsLogger        func(e Event)
 	reportMetricFactory metrics.Factory
+	// dnsResolvers are used to answer DNSRequests. When empty, the ones in resolv.conf are used.
+	dnsResolvers []string
+	dialPolicy   DialPolicy
+	clusterInfo  ClusterInfo
+	// cmdConnWriteTimeout is for how long agents may stall reading their control connections.
+	cmdConnWriteTimeout time.Duration
+}
+
+// ClusterInfo provides facts about the cluster the service runs in.
+type ClusterInfo interface {
+	// ClusterCIDRs returns the service and pod networks of the cluster.
+	ClusterCIDRs() []string
+}
+
+// StaticClusterInfo is a ClusterInfo with fixed CIDRs.
+type StaticClusterInfo []string
+
+func (s StaticClusterInfo) ClusterCIDRs() []string {
+	return s
 }
 
-// SendEvent allows publishing of events. Each event will be broadcast to all connected agents.
+var ErrDialDenied = fmt.Errorf("dial denied by policy")
+
+// DialPolicy decides if the service may connect to addr (already resolved) on behalf of agents. Returning an error
+// denies the connection.
+type DialPolicy func(family string, addr netip.AddrPort) error
+
+// CIDRDialPolicy only allows connections to addresses in one of the cidrs.
+func CIDRDialPolicy(cidrs ...string) (DialPolicy, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s: %w", cidr, err)
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	return func(_ string, addr netip.AddrPort) error {
+		for _, prefix := range prefixes {
+			if prefix.Contains(addr.Addr()) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%s is not in the allowed cidrs", addr.Addr())
+	}, nil
+}
+
+// SendEvent allows publishing of events. Each event will be broadcast to all connected agents whose filter
+// accepts the event bridge. Updates to bridges that no longer match an agent filter are sent as deletions, so that
+// agent may forget about them.
 func (s *Service) SendEvent(e Event) error {
 	payload, err := json.Marshal(e)
 	if err != nil {
 		return fmt.Errorf("error marshalling event: %w", err)
 	}
 
-	_ = s.cmdConns.ForEach(func(k string, v net.Conn) error {
-		if err := s.wire.Write(v, CmdEvents, payload); err != nil {
-			slog.Warn("error broadcasting", "conn", v, "err", err)
+	delEvent := Event{EvtName: EventBridgeDel, Bridge: e.Bridge}
+
+	delPayload, err := json.Marshal(delEvent)
+	if err != nil {
+		return fmt.Errorf("error marshalling event: %w", err)
+	}
+
+	_ = s.cmdConns.ForEach(func(k string, v *cmdConn) error {
+		evtPayload := payload
+
+		if !v.Filter.Match(e.Bridge) {
+			if e.EvtName != EventBridgeUp {
+				return nil
+			}
+
+			evtPayload = delPayload
+		}
+
+		if err := v.send(CmdEvents, evtPayload); err != nil {
+			slog.Warn("error broadcasting", "conn", v.RemoteAddr().String(), "err", err)
 		}
 
 		return nil
@@ -128,10 +314,13 @@ func (s *Service) handleConn(ctx context.Context, conn net.Conn) error {
 
 	switch command {
 	case CmdControl:
-		id := s.cmdConns.Add(conn)
-		defer s.cmdConns.Del(id)
+		req := CmdConnControlRequest{}
+
+		if err = json.Unmarshal(payload, &req); err != nil {
+			return fmt.Errorf("error handling command conn: %w", err)
+		}
 
-		if err = s.handleCmdConn(ctx, conn); err != nil {
+		if err = s.handleCmdConn(ctx, newCmdConn(conn, req.Filter, s.cmdConnWriteTimeout)); err != nil {
 			return fmt.Errorf("error handling command conn: %w", err)
 		}
 	case CmdProxy:
@@ -164,6 +353,16 @@ func (s *Service) handleConn(ctx context.Context, conn net.Conn) error {
 		if err = s.handleRevProxyWork(ctx, conn, req); err != nil {
 			return fmt.Errorf("error handling rev proxy work conn: %w", err)
 		}
+	case CmdDNS:
+		req := DNSRequest{}
+
+		if err = json.Unmarshal(payload, &req); err != nil {
+			return fmt.Errorf("error handling dns conn: %w", err)
+		}
+
+		if err = s.handleDNSConn(ctx, conn, req); err != nil {
+			return fmt.Errorf("error handling dns conn: %w", err)
+		}
 	default:
 		slog.Warn(fmt.Sprintf("received unknown command: %s", CmdToString(command)))
 	}
@@ -171,32 +370,105 @@ func (s *Service) handleConn(ctx context.Context, conn net.Conn) error {
 	return nil
 }
 
+// handleDNSConn resolves the query in req with the cluster resolvers, replying with the answer (or the error).
+func (s *Service) handleDNSConn(ctx context.Context, conn net.Conn, req DNSRequest) error {
+	res := DNSResponse{}
+
+	answer, err := s.resolveDNS(ctx, req.Msg)
+	if err != nil {
+		res.Err = err.Error()
+	} else {
+		res.Msg = answer
+	}
+
+	if err := s.wire.WriteJSON(conn, CmdDNS, res); err != nil {
+		return fmt.Errorf("error writing dns response: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Service) resolveDNS(ctx context.Context, packed []byte) ([]byte, error) {
+	query := new(dns.Msg)
+	if err := query.Unpack(packed); err != nil {
+		return nil, fmt.Errorf("error unpacking dns query: %w", err)
+	}
+
+	resolvers := s.dnsResolvers
+	if len(resolvers) == 0 {
+		cfg, err := dns.ClientConfigFromFile(ResolvConfPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", ResolvConfPath, err)
+		}
+
+		for _, server := range cfg.Servers {
+			resolvers = append(resolvers, net.JoinHostPort(server, cfg.Port))
+		}
+	}
+
+	var lastErr error
+
+	for _, resolver := range resolvers {
+		answer, _, err := (&dns.Client{Net: "udp"}).ExchangeContext(ctx, query, resolver)
+		if err == nil && answer.Truncated {
+			answer, _, err = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, query, resolver)
+		}
+
+		if err != nil {
+			lastErr = err
+
+			continue
+		}
+
+		ret, err := answer.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("error packing dns answer: %w", err)
+		}
+
+		return ret, nil
+	}
+
+	return nil, fmt.Errorf("could not resolve %v: %w", query.Question, lastErr)
+}
+
 // handleCmdConn handles commands - typically this will handle the persistent connection between agent
 // and Service.
 //
-//nolint:cyclop
-func (s *Service) handleCmdConn(ctx context.Context, conn net.Conn) error {
+//nolint:cyclop,funlen
+func (s *Service) handleCmdConn(ctx context.Context, conn *cmdConn) error {
 	if ctx.Err() != nil {
 		return fmt.Errorf("context cancelled when handling command conn: %w", ctx.Err())
 	}
 
-	if err := s.wire.WriteJSON(conn, CmdControl, CmdConnControlResponse{}); err != nil {
-		return fmt.Errorf("error writing to %s: %w", conn.RemoteAddr().String(), err)
+	if err := conn.Filter.Validate(); err != nil {
+		res := CmdConnControlResponse{Message: Message{Err: err.Error()}}
+		if err := s.wire.WriteJSON(conn.Conn, CmdControl, res); err != nil {
+			slog.Warn("error writing package", "raddr", conn.RemoteAddr().String(), "err", err)
+		}
+
+		return fmt.Errorf("invalid filter from %s: %w", conn.RemoteAddr().String(), err)
 	}
 
-	if err := s.bridges.ForEach(func(_ string, b Bridge) error {
-		evt := Event{
-			EvtName: EventBridgeAdd,
-			Bridge:  b,
-		}
+	go conn.serveWrites(s.wire)
 
-		if err := s.wire.WriteJSON(conn, CmdEvents, evt); err != nil {
-			return fmt.Errorf("error writing to %s: %w", conn.RemoteAddr().String(), err)
-		}
+	defer func() {
+		conn.stop()
+		<-conn.done
+	}()
 
-		return nil
-	}); err != nil {
-		return fmt.Errorf("error propagating initial bridges: %w", err)
+	// registering and queueing the initial bridges at once, so no event gets lost between replay and live traffic.
+	// Live events are queued after the replay.
+	conn.mx.Lock()
+
+	id := s.cmdConns.Add(conn)
+	defer s.cmdConns.Del(id)
+
+	err := s.replay(conn)
+
+	conn.mx.Unlock()
+
+	if err != nil {
+		return err
 	}
 
 	for {
@@ -207,21 +479,21 @@ func (s *Service) handleCmdConn(ctx context.Context, conn net.Conn) error {
 
 		handler, ok := s.cmdHandler[cmd]
 		if !ok {
-			if err = s.wire.Write(conn, CmdUnknown, nil); err != nil {
+			if err = conn.send(CmdUnknown, nil); err != nil {
 				slog.Warn("error writing package", "raddr", conn.RemoteAddr().String(), "err", err)
 			}
 		}
 
 		res, err := handler(ctx, payload)
 		if err != nil {
-			if err = s.wire.WriteJSON(conn, cmd, Message{Err: err.Error()}); err != nil {
+			if err = conn.sendJSON(cmd, Message{Err: err.Error()}); err != nil {
 				slog.Warn("error writing package", "raddr", conn.RemoteAddr().String(), "err", err)
 			}
 
 			continue
 		}
 
-		if err = s.wire.Write(conn, cmd, res); err != nil {
+		if err = conn.send(cmd, res); err != nil {
 			return fmt.Errorf("error writing command to %s: %w", conn.RemoteAddr().String(), err)
 		}
 
@@ -229,6 +501,102 @@ func (s *Service) handleCmdConn(ctx context.Context, conn net.Conn) error {
 	}
 }
 
+// replay queues the control response and the bridges matching the filter of conn, followed by EventReplayDone. The mx
+// of conn must be held.
+func (s *Service) replay(conn *cmdConn) error {
+	res := CmdConnControlResponse{ProxyConfirm: true}
+	if s.clusterInfo != nil {
+		res.ClusterCIDRs = s.clusterInfo.ClusterCIDRs()
+	}
+
+	frames := make([]frame, 0)
+
+	payload, err := json.Marshal(res)
+	if err != nil {
+		return fmt.Errorf("error marshalling control response: %w", err)
+	}
+
+	frames = append(frames, frame{cmd: CmdControl, payload: payload})
+
+	if err = s.bridges.ForEach(func(_ string, b Bridge) error {
+		if !conn.Filter.Match(b) {
+			return nil
+		}
+
+		payload, err := json.Marshal(Event{EvtName: EventBridgeAdd, Bridge: b})
+		if err != nil {
+			return fmt.Errorf("error marshalling bridge %s: %w", b.Name, err)
+		}
+
+		frames = append(frames, frame{cmd: CmdEvents, payload: payload})
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error propagating initial bridges: %w", err)
+	}
+
+	if payload, err = json.Marshal(Event{EvtName: EventReplayDone}); err != nil {
+		return fmt.Errorf("error marshalling replay end: %w", err)
+	}
+
+	frames = append(frames, frame{cmd: CmdEvents, payload: payload})
+
+	conn.queue = append(conn.queue, frames...)
+
+	select {
+	case conn.ready <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// dial connects to endpoint, checking the dial policy, if any. Names are resolved here, so the policy can be
+// applied to each of their addresses.
+func (s *Service) dial(ctx context.Context, family string, endpoint string) (net.Conn, error) {
+	if s.dialPolicy == nil {
+		return (&net.Dialer{}).DialContext(ctx, family, endpoint) //nolint:wrapcheck
+	}
+
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %s: %w", endpoint, err)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s: %w", endpoint, err)
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %w", host, err)
+	}
+
+	var lastErr error
+
+	for _, addr := range addrs {
+		addrPort := netip.AddrPortFrom(addr.Unmap(), uint16(port))
+
+		if err := s.dialPolicy(family, addrPort); err != nil {
+			lastErr = fmt.Errorf("%w: %w", ErrDialDenied, err)
+
+			continue
+		}
+
+		conn, err := (&net.Dialer{}).DialContext(ctx, family, addrPort.String())
+		if err != nil {
+			lastErr = err
+
+			continue
+		}
+
+		return conn, nil
+	}
+
+	return nil, fmt.Errorf("error connecting to %s: %w", endpoint, lastErr)
+}
+
 func (s *Service) handleProxyConn(ctx context.Context, conn net.Conn, req ProxyRequest) error {
 	if ctx.Err() != nil {
 		return fmt.Errorf("context cancelled handling proxy conn: %w", ctx.Err())
@@ -238,12 +606,32 @@ func (s *Service) handleProxyConn(ctx context.Context, conn net.Conn, req ProxyR
 		req.Family = "tcp"
 	}
 
-	proxy, err := net.Dial(req.Family, req.Endpoint)
+	proxy, err := s.dial(ctx, req.Family, req.Endpoint)
 	if err != nil {
+		if req.Confirm {
+			res := ProxyResponse{Message: Message{Err: err.Error()}, Denied: errors.Is(err, ErrDialDenied)}
+			if err := s.wire.WriteJSON(conn, CmdProxy, res); err != nil {
+				slog.Warn("error writing package", "raddr", conn.RemoteAddr().String(), "err", err)
+			}
+		}
+
 		return fmt.Errorf("error connecting to proxy endopint: %w", err)
 	}
 
-	piper := pipe.New(conn, proxy)
+	if req.Confirm {
+		if err = s.wire.WriteJSON(conn, CmdProxy, ProxyResponse{}); err != nil {
+			helperIoClose(proxy)
+
+			return fmt.Errorf("error confirming proxy conn: %w", err)
+		}
+	}
+
+	var tunnel io.ReadWriteCloser = conn
+	if req.Datagrams {
+		tunnel = newDatagramConn(conn)
+	}
+
+	piper := pipe.New(tunnel, proxy)
 
 	if s.reportMetricFactory != nil {
 		obsB := s.reportMetricFactory.New("proxy", "name", "from", "to").
@@ -382,8 +770,8 @@ func (s *Service) AddEventSource(ctx context.Context, src EventSource) {
 	go func() {
 		for {
 			select {
-			case evt := <-src.Events():
-				if evt == (Event{}) {
+			case evt, ok := <-src.Events():
+				if !ok || evt.EvtName == "" {
 					return
 				}
 
@@ -420,14 +808,44 @@ func WithMetrics(rmf metrics.Factory) Opts {
 	}
 }
 
+// WithClusterInfo makes the service tell agents about the cluster networks.
+func WithClusterInfo(clusterInfo ClusterInfo) Opts {
+	return func(s *Service) {
+		s.clusterInfo = clusterInfo
+	}
+}
+
+// WithDialPolicy restricts which addresses agents may connect to, through proxy requests.
+func WithDialPolicy(policy DialPolicy) Opts {
+	return func(s *Service) {
+		s.dialPolicy = policy
+	}
+}
+
+// WithDNSResolvers sets the resolvers (host:port) used to answer dns queries from agents.
+func WithDNSResolvers(resolvers ...string) Opts {
+	return func(s *Service) {
+		s.dnsResolvers = resolvers
+	}
+}
+
+// WithCmdConnWriteTimeout sets for how long agents may stall reading their control connections before being
+// disconnected, CmdConnWriteTimeout by default.
+func WithCmdConnWriteTimeout(timeout time.Duration) Opts {
+	return func(s *Service) {
+		s.cmdConnWriteTimeout = timeout
+	}
+}
+
 func NewService(opts ...Opts) *Service {
 	ret := Service{
-		cmdConns:      memstore.New[net.Conn](),
+		cmdConns:      memstore.New[*cmdConn](),
 		revProxyConns: memstore.New[*revProxyConn](),
 		cmdHandler:    map[uint16]CmdHandler{},
 		bridges:       memstore.New[Bridge](),
 		eventsLogger: func(e Event) {
 		},
+		cmdConnWriteTimeout: CmdConnWriteTimeout,
 	}
 
 	for _, o := range opts {
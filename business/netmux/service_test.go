@@ -8,12 +8,17 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/duxthemux/netmux/business/netmux"
+	"github.com/duxthemux/netmux/foundation/wire"
 )
 
 const MaxWaitTime = time.Second * 5
@@ -101,7 +106,7 @@ func TestProxy(t *testing.T) {
 		cli, err := netmux.NewAgent(ctx, netmuxServiceListener.Addr().String(), &ZeroIPAllocator{})
 		assert.NoError(t, err)
 
-		cliRwd, err := cli.Proxy(netmux.ProxyRequest{
+		cliRwd, err := cli.Proxy(ctx, netmux.ProxyRequest{
 			Message:  netmux.Message{},
 			Family:   "tcp",
 			Endpoint: proxiedUserServiceListener.Addr().String(),
@@ -204,7 +209,7 @@ func TestProxyCancelConnFromProxy(t *testing.T) {
 		cli, err := netmux.NewAgent(ctx, netmuxServiceListener.Addr().String(), &ZeroIPAllocator{})
 		assert.NoError(t, err)
 
-		cliRwd, err := cli.Proxy(netmux.ProxyRequest{
+		cliRwd, err := cli.Proxy(ctx, netmux.ProxyRequest{
 			Message:  netmux.Message{},
 			Family:   "tcp",
 			Endpoint: proxiedUserServiceListener.Addr().String(),
@@ -297,7 +302,7 @@ func TestProxyCancelConnectionFromService(t *testing.T) {
 		cli, err := netmux.NewAgent(ctx, netmuxServiceListener.Addr().String(), &ZeroIPAllocator{})
 		assert.NoError(t, err)
 
-		cliRwd, err := cli.Proxy(netmux.ProxyRequest{
+		cliRwd, err := cli.Proxy(ctx, netmux.ProxyRequest{
 			Message:  netmux.Message{},
 			Family:   "tcp",
 			Endpoint: proxiedUserServiceListener.Addr().String(),
@@ -371,7 +376,11 @@ func TestEvents(t *testing.T) {
 		assert.NoError(t, err)
 		chListenerReady <- true
 
+		// the service knows no bridges yet: the replay is only its end.
 		evt := <-cli.Events()
+		assert.Equal(t, netmux.EventReplayDone, evt.EvtName)
+
+		evt = <-cli.Events()
 		assert.Equal(t, evt.EvtName, "123")
 
 		chErr <- nil
@@ -572,3 +581,846 @@ func TestRecvEvents(t *testing.T) {
 		t.Fatalf("test timed out")
 	}
 }
+
+// TestRecvEventsDuringReplay broadcasts events while agents are being sent the bridges known: every bridge must reach
+// every agent, with no frame interleaved with another.
+//
+//nolint:paralleltest
+func TestRecvEventsDuringReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const known, live, agents = 200, 200, 4
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	listener := &slowListener{Listener: tcpListener}
+	defer doClose(listener)
+
+	events := &TestEventSource{ch: make(chan netmux.Event)}
+
+	srv := netmux.NewService()
+	srv.AddEventSource(ctx, events)
+
+	for i := 0; i < known; i++ {
+		events.ch <- netmux.Event{EvtName: netmux.EventBridgeAdd, Bridge: netmux.Bridge{Name: fmt.Sprintf("known-%d", i)}}
+	}
+
+	go func() {
+		_ = srv.Serve(ctx, listener)
+	}()
+
+	go func() {
+		// paced, so live events go along the replays.
+		for i := 0; i < live; i++ {
+			events.ch <- netmux.Event{EvtName: netmux.EventBridgeAdd, Bridge: netmux.Bridge{Name: fmt.Sprintf("live-%d", i)}}
+
+			time.Sleep(time.Microsecond * 100)
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < agents; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			expectBridges(t, listener.Addr().String(), known+live)
+		}()
+	}
+
+	wg.Wait()
+}
+
+//nolint:paralleltest
+func TestSlowAgent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// more than the socket buffers of the stalled agent hold.
+	const count = 8192
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer doClose(listener)
+
+	events := &TestEventSource{ch: make(chan netmux.Event)}
+
+	srv := netmux.NewService(netmux.WithCmdConnWriteTimeout(time.Millisecond * 500))
+	srv.AddEventSource(ctx, events)
+
+	go func() {
+		_ = srv.Serve(ctx, listener)
+	}()
+
+	// the stalled agent connects, then never reads again.
+	stalled, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+
+	defer doClose(stalled)
+
+	wire := &wire.Wire{}
+
+	require.NoError(t, wire.WriteJSON(stalled, netmux.CmdControl, netmux.CmdConnControlRequest{}))
+	require.NoError(t, wire.ReadJSON(stalled, netmux.CmdControl, &netmux.CmdConnControlResponse{}))
+
+	filler := strings.Repeat("x", 1024)
+
+	go func() {
+		for i := 0; i < count; i++ {
+			events.ch <- netmux.Event{
+				EvtName: netmux.EventBridgeAdd,
+				Bridge:  netmux.Bridge{Name: fmt.Sprintf("bridge-%d", i), Namespace: filler},
+			}
+		}
+	}()
+
+	// the other agent gets every event all the same.
+	expectBridges(t, listener.Addr().String(), count)
+
+	// and the stalled one, stalling for too long, is let go.
+	time.Sleep(time.Second)
+
+	_ = stalled.SetReadDeadline(time.Now().Add(MaxWaitTime))
+
+	_, err = io.Copy(io.Discard, stalled)
+	assert.NoError(t, err)
+}
+
+// slowListener accepts connections slow to write, so concurrent writes get a chance to interleave.
+type slowListener struct {
+	net.Listener
+}
+
+func (s *slowListener) Accept() (net.Conn, error) {
+	conn, err := s.Listener.Accept()
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	return &slowConn{Conn: conn}, nil
+}
+
+type slowConn struct {
+	net.Conn
+}
+
+func (s *slowConn) Write(p []byte) (int, error) {
+	time.Sleep(time.Microsecond * 50)
+
+	return s.Conn.Write(p) //nolint:wrapcheck
+}
+
+// expectBridges opens a control connection, as agents do, reading frames until count bridges were added.
+func expectBridges(t *testing.T, addr string, count int) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	defer doClose(conn)
+
+	_ = conn.SetReadDeadline(time.Now().Add(MaxWaitTime))
+
+	wire := &wire.Wire{}
+
+	if !assert.NoError(t, wire.WriteJSON(conn, netmux.CmdControl, netmux.CmdConnControlRequest{})) {
+		return
+	}
+
+	res := netmux.CmdConnControlResponse{}
+	if !assert.NoError(t, wire.ReadJSON(conn, netmux.CmdControl, &res)) {
+		return
+	}
+
+	received := map[string]bool{}
+
+	for len(received) < count {
+		evt := netmux.Event{}
+		if !assert.NoError(t, wire.ReadJSON(conn, netmux.CmdEvents, &evt), "after %d bridges", len(received)) {
+			return
+		}
+
+		if evt.EvtName == netmux.EventBridgeAdd {
+			received[evt.Bridge.Name] = true
+		}
+	}
+}
+
+//nolint:funlen,paralleltest
+func TestRecvEventsFiltered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	netmuxServiceListener, err := net.Listen("tcp", "")
+	assert.NoError(t, err)
+
+	defer doClose(netmuxServiceListener)
+
+	testEventSource := &TestEventSource{
+		ch: make(chan netmux.Event),
+	}
+
+	srv := netmux.NewService()
+	srv.AddEventSource(ctx, testEventSource)
+
+	testEventSource.ch <- netmux.Event{
+		EvtName: netmux.EventBridgeAdd,
+		Bridge:  netmux.Bridge{Name: "orders", Namespace: "payments", Labels: "team=checkout"},
+	}
+	testEventSource.ch <- netmux.Event{
+		EvtName: netmux.EventBridgeAdd,
+		Bridge:  netmux.Bridge{Name: "orders", Namespace: "other", Labels: "team=checkout"},
+	}
+
+	go func() {
+		_ = srv.Serve(ctx, netmuxServiceListener)
+	}()
+
+	_, err = netmux.NewAgent(ctx, netmuxServiceListener.Addr().String(), &ZeroIPAllocator{},
+		netmux.AgentWithFilter(netmux.Filter{Labels: "team in ("}))
+	assert.Error(t, err)
+
+	cli, err := netmux.NewAgent(ctx, netmuxServiceListener.Addr().String(), &ZeroIPAllocator{},
+		netmux.AgentWithFilter(netmux.Filter{
+			Namespaces: []string{"payments"},
+			Labels:     "team=checkout",
+			Name:       "ord*",
+		}))
+	assert.NoError(t, err)
+
+	go func() {
+		testEventSource.ch <- netmux.Event{
+			EvtName: netmux.EventBridgeAdd,
+			Bridge:  netmux.Bridge{Name: "billing", Namespace: "payments", Labels: "team=checkout"},
+		}
+		testEventSource.ch <- netmux.Event{
+			EvtName: netmux.EventBridgeUp,
+			Bridge:  netmux.Bridge{Name: "orders", Namespace: "payments", Labels: "team=other"},
+		}
+	}()
+
+	expected := []netmux.Event{
+		{EvtName: netmux.EventBridgeAdd, Bridge: netmux.Bridge{Name: "orders", Namespace: "payments", Labels: "team=checkout"}},
+		{EvtName: netmux.EventReplayDone},
+		{EvtName: netmux.EventBridgeDel, Bridge: netmux.Bridge{Name: "orders", Namespace: "payments", Labels: "team=other"}},
+	}
+
+	for _, want := range expected {
+		select {
+		case evt := <-cli.Events():
+			assert.Equal(t, want, evt)
+		case <-time.After(MaxWaitTime):
+			t.Fatalf("test timed out")
+		}
+	}
+}
+
+type TestBridgeObserver struct {
+	ch     chan error
+	opened chan *netmux.BridgeConn
+	closed chan *netmux.BridgeConn
+}
+
+func (t *TestBridgeObserver) BridgeError(_ netmux.Bridge, err error) {
+	select {
+	case t.ch <- err:
+	default:
+	}
+}
+
+func (t *TestBridgeObserver) BridgeConnOpened(conn *netmux.BridgeConn) {
+	select {
+	case t.opened <- conn:
+	default:
+	}
+}
+
+func (t *TestBridgeObserver) BridgeConnClosed(conn *netmux.BridgeConn) {
+	select {
+	case t.closed <- conn:
+	default:
+	}
+}
+
+func (t *TestBridgeObserver) BridgeTraffic(_ *netmux.BridgeConn, _ int64, _ int64) {}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	tmpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer doClose(tmpListener)
+
+	_, port, err := net.SplitHostPort(tmpListener.Addr().String())
+	assert.NoError(t, err)
+
+	return port
+}
+
+//nolint:funlen,paralleltest
+func TestServeProxySurvivesDialFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	netmuxServiceListener, err := net.Listen("tcp", "")
+	assert.NoError(t, err)
+
+	defer doClose(netmuxServiceListener)
+
+	srv := netmux.NewService()
+
+	go func() {
+		_ = srv.Serve(ctx, netmuxServiceListener)
+	}()
+
+	observer := &TestBridgeObserver{ch: make(chan error, 1)}
+
+	cli, err := netmux.NewAgent(ctx, netmuxServiceListener.Addr().String(), &ZeroIPAllocator{},
+		netmux.AgentWithObserver(observer))
+	assert.NoError(t, err)
+
+	bridge := netmux.Bridge{
+		Name:          "flaky",
+		LocalPort:     freePort(t),
+		ContainerAddr: "127.0.0.1",
+		ContainerPort: freePort(t),
+		Direction:     netmux.DirectionL2C,
+		Family:        netmux.FamilyTCP,
+	}
+
+	chServeErr := make(chan error, 1)
+
+	go func() {
+		chServeErr <- cli.ServeProxy(ctx, bridge)
+	}()
+
+	dialAndRead := func() (string, error) {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", bridge.LocalPort), MaxWaitTime)
+		if err != nil {
+			return "", err
+		}
+
+		defer doClose(conn)
+
+		buf := make([]byte, 128)
+
+		n, err := conn.Read(buf)
+
+		return string(buf[:n]), err
+	}
+
+	// nothing listening at the container addr yet: conn must be dropped and reported.
+	assert.Eventually(t, func() bool {
+		_, err := dialAndRead()
+
+		return err != nil
+	}, MaxWaitTime, time.Millisecond*50)
+
+	select {
+	case err = <-observer.ch:
+		assert.Error(t, err)
+	case <-time.After(MaxWaitTime):
+		t.Fatalf("test timed out waiting for bridge error")
+	}
+
+	upstream, err := net.Listen("tcp", bridge.FullContainerAddr())
+	assert.NoError(t, err)
+
+	defer doClose(upstream)
+
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+
+			_, _ = conn.Write([]byte("ok"))
+			doClose(conn)
+		}
+	}()
+
+	res, err := dialAndRead()
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", res)
+
+	select {
+	case err = <-chServeErr:
+		t.Fatalf("serve proxy should still be running: %v", err)
+	default:
+	}
+}
+
+// LoopbackIPAllocator hands out the loopback addresses, ipv6 included.
+type LoopbackIPAllocator struct{}
+
+func (l *LoopbackIPAllocator) GetIP(_ ...string) (string, error) {
+	return "127.0.0.1", nil
+}
+
+func (l *LoopbackIPAllocator) GetIPv6(_ ...string) (string, error) {
+	return "::1", nil
+}
+
+func (l *LoopbackIPAllocator) HasIPv6() bool {
+	return true
+}
+
+func (l *LoopbackIPAllocator) ReleaseIP(_ string) error {
+	return nil
+}
+
+//nolint:paralleltest
+func TestServeProxyDualStack(t *testing.T) {
+	if listener, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("no ipv6 loopback")
+	} else {
+		doClose(listener)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	netmuxServiceListener, err := net.Listen("tcp", "")
+	require.NoError(t, err)
+
+	defer doClose(netmuxServiceListener)
+
+	srv := netmux.NewService()
+
+	go func() {
+		_ = srv.Serve(ctx, netmuxServiceListener)
+	}()
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer doClose(upstream)
+
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+
+			_, _ = conn.Write([]byte("ok"))
+			doClose(conn)
+		}
+	}()
+
+	_, upstreamPort, err := net.SplitHostPort(upstream.Addr().String())
+	require.NoError(t, err)
+
+	cli, err := netmux.NewAgent(ctx, netmuxServiceListener.Addr().String(), &LoopbackIPAllocator{})
+	require.NoError(t, err)
+
+	bridge := netmux.Bridge{
+		Name:           "dual",
+		LocalPort:      freePort(t),
+		ContainerAddr:  "127.0.0.1",
+		ContainerAddrs: []string{"127.0.0.1", "fd00::1"},
+		ContainerPort:  upstreamPort,
+		Direction:      netmux.DirectionL2C,
+		Family:         netmux.FamilyTCP,
+	}
+
+	hasIPv4, hasIPv6 := bridge.IPFamilies()
+	assert.True(t, hasIPv4)
+	assert.True(t, hasIPv6)
+
+	go func() {
+		_ = cli.ServeProxy(ctx, bridge)
+	}()
+
+	for _, addr := range []string{"127.0.0.1", "::1"} {
+		var conn net.Conn
+
+		require.Eventually(t, func() bool {
+			conn, err = net.Dial("tcp", net.JoinHostPort(addr, bridge.LocalPort))
+
+			return err == nil
+		}, MaxWaitTime, time.Millisecond*50, addr)
+
+		buf, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "ok", string(buf), addr)
+
+		doClose(conn)
+	}
+}
+
+//nolint:funlen,paralleltest
+func TestBridgeConnClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	netmuxServiceListener, err := net.Listen("tcp", "")
+	assert.NoError(t, err)
+
+	defer doClose(netmuxServiceListener)
+
+	srv := netmux.NewService()
+
+	go func() {
+		_ = srv.Serve(ctx, netmuxServiceListener)
+	}()
+
+	observer := &TestBridgeObserver{
+		ch:     make(chan error, 1),
+		opened: make(chan *netmux.BridgeConn, 1),
+		closed: make(chan *netmux.BridgeConn, 1),
+	}
+
+	cli, err := netmux.NewAgent(ctx, netmuxServiceListener.Addr().String(), &ZeroIPAllocator{},
+		netmux.AgentWithObserver(observer))
+	assert.NoError(t, err)
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer doClose(upstream)
+
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+
+			// holds the conn open until the other side goes away.
+			go func() {
+				defer doClose(conn)
+
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	_, upstreamPort, err := net.SplitHostPort(upstream.Addr().String())
+	assert.NoError(t, err)
+
+	bridge := netmux.Bridge{
+		Name:          "killable",
+		LocalPort:     freePort(t),
+		ContainerAddr: "127.0.0.1",
+		ContainerPort: upstreamPort,
+		Direction:     netmux.DirectionL2C,
+		Family:        netmux.FamilyTCP,
+	}
+
+	go func() {
+		_ = cli.ServeProxy(ctx, bridge)
+	}()
+
+	var conn net.Conn
+
+	assert.Eventually(t, func() bool {
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", bridge.LocalPort), MaxWaitTime)
+
+		return err == nil
+	}, MaxWaitTime, time.Millisecond*50)
+
+	defer doClose(conn)
+
+	var bconn *netmux.BridgeConn
+
+	select {
+	case bconn = <-observer.opened:
+	case <-time.After(MaxWaitTime):
+		t.Fatalf("test timed out waiting for conn to be opened")
+	}
+
+	assert.NotEmpty(t, bconn.ID)
+	assert.Equal(t, "killable", bconn.Bridge.Name)
+	assert.Equal(t, conn.LocalAddr().String(), bconn.Peer)
+
+	bconn.Close()
+
+	select {
+	case closed := <-observer.closed:
+		assert.Equal(t, bconn.ID, closed.ID)
+	case <-time.After(MaxWaitTime):
+		t.Fatalf("test timed out waiting for conn to be closed")
+	}
+
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(MaxWaitTime)))
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+//nolint:funlen,paralleltest
+func TestResolveDNS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// plays the cluster resolver
+	resolverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	resolver := &dns.Server{
+		PacketConn: resolverConn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			res := new(dns.Msg).SetReply(req)
+
+			if req.Question[0].Name == "pod-1.headless.ns.svc.cluster.local." {
+				res.Answer = append(res.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 5},
+					A:   net.ParseIP("172.16.0.10"),
+				})
+			} else {
+				res.Rcode = dns.RcodeNameError
+			}
+
+			_ = w.WriteMsg(res)
+		}),
+	}
+
+	go func() {
+		_ = resolver.ActivateAndServe()
+	}()
+
+	defer func() {
+		_ = resolver.Shutdown()
+	}()
+
+	netmuxServiceListener, err := net.Listen("tcp", "")
+	assert.NoError(t, err)
+
+	defer doClose(netmuxServiceListener)
+
+	srv := netmux.NewService(netmux.WithDNSResolvers(resolverConn.LocalAddr().String()))
+
+	go func() {
+		_ = srv.Serve(ctx, netmuxServiceListener)
+	}()
+
+	cli, err := netmux.NewAgent(ctx, netmuxServiceListener.Addr().String(), &ZeroIPAllocator{})
+	assert.NoError(t, err)
+
+	answer, err := cli.ResolveDNS(ctx, new(dns.Msg).SetQuestion("pod-1.headless.ns.svc.cluster.local.", dns.TypeA))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, answer.Rcode)
+
+	if assert.Len(t, answer.Answer, 1) {
+		assert.Equal(t, "172.16.0.10", answer.Answer[0].(*dns.A).A.String())
+	}
+
+	answer, err = cli.ResolveDNS(ctx, new(dns.Msg).SetQuestion("nope.ns.svc.cluster.local.", dns.TypeA))
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeNameError, answer.Rcode)
+}
+
+//nolint:paralleltest
+func TestDialPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer doClose(upstream)
+
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+
+			doClose(conn)
+		}
+	}()
+
+	for _, tc := range []struct {
+		cidr    string
+		allowed bool
+	}{
+		{cidr: "127.0.0.0/8", allowed: true},
+		{cidr: "10.0.0.0/8", allowed: false},
+	} {
+		policy, err := netmux.CIDRDialPolicy(tc.cidr)
+		assert.NoError(t, err)
+
+		netmuxServiceListener, err := net.Listen("tcp", "")
+		assert.NoError(t, err)
+
+		srv := netmux.NewService(netmux.WithDialPolicy(policy))
+
+		go func() {
+			_ = srv.Serve(ctx, netmuxServiceListener)
+		}()
+
+		cli, err := netmux.NewAgent(ctx, netmuxServiceListener.Addr().String(), &ZeroIPAllocator{})
+		assert.NoError(t, err)
+
+		conn, err := cli.Proxy(ctx, netmux.ProxyRequest{
+			Name:     "policy",
+			Family:   netmux.FamilyTCP,
+			Endpoint: upstream.Addr().String(),
+		})
+
+		if tc.allowed {
+			assert.NoError(t, err, tc.cidr)
+			doClose(conn)
+		} else {
+			assert.ErrorIs(t, err, netmux.ErrDialDenied, tc.cidr)
+		}
+
+		doClose(netmuxServiceListener)
+	}
+
+	_, err = netmux.CIDRDialPolicy("not-a-cidr")
+	assert.Error(t, err)
+}
+
+func TestProxyDatagrams(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer doClose(upstream)
+
+	go func() {
+		buf := make([]byte, netmux.MaxDatagramSize)
+
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			_, _ = upstream.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	netmuxServiceListener, err := net.Listen("tcp", "")
+	assert.NoError(t, err)
+
+	defer doClose(netmuxServiceListener)
+
+	srv := netmux.NewService(netmux.WithClusterInfo(netmux.StaticClusterInfo{"10.96.0.0/16"}))
+
+	go func() {
+		_ = srv.Serve(ctx, netmuxServiceListener)
+	}()
+
+	cli, err := netmux.NewAgent(ctx, netmuxServiceListener.Addr().String(), &ZeroIPAllocator{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.96.0.0/16"}, cli.ClusterCIDRs())
+
+	conn, err := cli.Proxy(ctx, netmux.ProxyRequest{
+		Name:      "datagrams",
+		Family:    netmux.FamilyUDP,
+		Endpoint:  upstream.LocalAddr().String(),
+		Datagrams: true,
+	})
+	assert.NoError(t, err)
+
+	defer doClose(conn)
+
+	// each write is a datagram, and each read returns exactly one.
+	for _, msg := range []string{"a", "bb", "ccc"} {
+		_, err = conn.Write([]byte(msg))
+		assert.NoError(t, err)
+	}
+
+	for _, msg := range []string{"a", "bb", "ccc"} {
+		buf := make([]byte, netmux.MaxDatagramSize)
+		n, err := conn.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, string(buf[:n]))
+	}
+}
+
+// NamesIPAllocator records the names addresses are asked for.
+type NamesIPAllocator struct {
+	names chan []string
+}
+
+func (n *NamesIPAllocator) GetIP(names ...string) (string, error) {
+	n.names <- names
+
+	return "127.0.0.1", nil
+}
+
+func (n *NamesIPAllocator) ReleaseIP(_ string) error {
+	return nil
+}
+
+type TestNamer struct {
+	released chan netmux.Bridge
+}
+
+func (t *TestNamer) Names(bridge netmux.Bridge) []string {
+	return []string{bridge.Name + ".ns.ep", bridge.Name}
+}
+
+func (t *TestNamer) ReleaseNames(bridge netmux.Bridge) {
+	t.released <- bridge
+}
+
+//nolint:paralleltest
+func TestServeProxyNamer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	netmuxServiceListener, err := net.Listen("tcp", "")
+	require.NoError(t, err)
+
+	defer doClose(netmuxServiceListener)
+
+	srv := netmux.NewService()
+
+	go func() {
+		_ = srv.Serve(ctx, netmuxServiceListener)
+	}()
+
+	allocator := &NamesIPAllocator{names: make(chan []string, 1)}
+	namer := &TestNamer{released: make(chan netmux.Bridge, 1)}
+
+	cli, err := netmux.NewAgent(ctx, netmuxServiceListener.Addr().String(), allocator, netmux.AgentWithNamer(namer))
+	require.NoError(t, err)
+
+	bridge := netmux.Bridge{
+		Name:          "svc",
+		LocalPort:     freePort(t),
+		ContainerAddr: "127.0.0.1",
+		ContainerPort: "1",
+		Direction:     netmux.DirectionL2C,
+		Family:        netmux.FamilyTCP,
+	}
+
+	bridgeCtx, bridgeCancel := context.WithCancel(ctx)
+
+	go func() {
+		_ = cli.ServeProxy(bridgeCtx, bridge)
+	}()
+
+	select {
+	case names := <-allocator.names:
+		assert.Equal(t, []string{"svc.ns.ep", "svc"}, names)
+	case <-time.After(MaxWaitTime):
+		require.Fail(t, "no address was asked for")
+	}
+
+	bridgeCancel()
+
+	select {
+	case released := <-namer.released:
+		assert.Equal(t, "svc", released.Name)
+	case <-time.After(MaxWaitTime):
+		require.Fail(t, "names were not released")
+	}
+}
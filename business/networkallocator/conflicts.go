@@ -0,0 +1,167 @@
+package networkallocator
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+var ErrNetworkConflict = fmt.Errorf("network conflicts with local networks")
+
+// Conflict is a local network overlapping the one addresses are allocated from: packets to these addresses could be
+// silently routed elsewhere.
+type Conflict struct {
+	Network string `json:"network"`
+	With    string `json:"with"`
+	// Source tells where With was found, as "address of docker0" or "route via tun0".
+	Source string `json:"source"`
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s overlaps %s (%s)", c.Network, c.With, c.Source)
+}
+
+// localNetwork is a network reachable through iface. For interface addresses, prefix keeps the address itself.
+type localNetwork struct {
+	prefix netip.Prefix
+	iface  string
+	source string
+}
+
+// WithCandidates sets networks to fall back to, in order, when the configured one conflicts with local networks.
+// Without candidates, a conflicting network is refused.
+func WithCandidates(cidrs ...string) Opts {
+	return func(n *NetworkAllocator) {
+		n.candidates = cidrs
+	}
+}
+
+// Network returns the network addresses are allocated from - the configured one, or the candidate picked instead.
+func (n *NetworkAllocator) Network() string {
+	return n.network
+}
+
+// Conflicts lists the conflicts found when choosing the network.
+func (n *NetworkAllocator) Conflicts() []Conflict {
+	return slices.Clone(n.conflicts)
+}
+
+// selectNetwork returns the first of cidr and the candidates with no conflicts with local networks. Addresses of
+// iface within a network are not conflicts: they are taken for aliases of our own.
+func (n *NetworkAllocator) selectNetwork(iface string, cidr string) (string, error) {
+	locals, err := localNetworks()
+	if err != nil {
+		slog.Warn("could not check the network for conflicts with local networks", "network", cidr, "err", err)
+
+		return cidr, nil
+	}
+
+	for _, candidate := range append([]string{cidr}, n.candidates...) {
+		network, err := netip.ParsePrefix(candidate)
+		if err != nil {
+			return "", fmt.Errorf("invalid network %s: %w", candidate, err)
+		}
+
+		conflicts := findConflicts(iface, network.Masked(), locals)
+		if len(conflicts) == 0 {
+			if candidate != cidr {
+				slog.Warn("network conflicts with local networks, using another one", "network", cidr,
+					"using", candidate)
+			}
+
+			return candidate, nil
+		}
+
+		for _, conflict := range conflicts {
+			slog.Warn("network conflicts with a local network, addresses could be routed elsewhere",
+				"network", conflict.Network, "with", conflict.With, "source", conflict.Source)
+		}
+
+		n.conflicts = append(n.conflicts, conflicts...)
+	}
+
+	msgs := make([]string, 0, len(n.conflicts))
+	for _, conflict := range n.conflicts {
+		msgs = append(msgs, conflict.String())
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrNetworkConflict, strings.Join(msgs, "; "))
+}
+
+func findConflicts(iface string, network netip.Prefix, locals []localNetwork) []Conflict {
+	ret := make([]Conflict, 0)
+
+	for _, local := range locals {
+		// default routes overlap everything.
+		if local.prefix.Bits() == 0 || !local.prefix.Overlaps(network) {
+			continue
+		}
+
+		if local.iface == iface && network.Contains(local.prefix.Addr()) {
+			continue
+		}
+
+		with := local.prefix.Masked().String()
+
+		// connected routes repeat the interface addresses.
+		if slices.ContainsFunc(ret, func(c Conflict) bool { return c.With == with }) {
+			continue
+		}
+
+		ret = append(ret, Conflict{Network: network.String(), With: with, Source: local.source})
+	}
+
+	return ret
+}
+
+// localNetworks lists the networks of the addresses of all interfaces, and of routes.
+func localNetworks() ([]localNetwork, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("error listing interfaces: %w", err)
+	}
+
+	ret := make([]localNetwork, 0)
+
+	for _, netIface := range ifaces {
+		addrs, err := netIface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("error listing addresses of %s: %w", netIface.Name, err)
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+
+			prefix, ok := ipNetPrefix(ipNet)
+			if !ok {
+				continue
+			}
+
+			ret = append(ret, localNetwork{prefix: prefix, iface: netIface.Name, source: "address of " + netIface.Name})
+		}
+	}
+
+	routes, err := routeNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(ret, routes...), nil
+}
+
+func ipNetPrefix(ipNet *net.IPNet) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(ipNet.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+
+	ones, _ := ipNet.Mask.Size()
+
+	return netip.PrefixFrom(addr.Unmap(), ones), true
+}
@@ -0,0 +1,37 @@
+package networkallocator
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// routeNetworks lists the destinations of the routes in the main table.
+func routeNetworks() ([]localNetwork, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("error listing routes: %w", err)
+	}
+
+	ret := make([]localNetwork, 0, len(routes))
+
+	for _, route := range routes {
+		if route.Dst == nil {
+			continue
+		}
+
+		prefix, ok := ipNetPrefix(route.Dst)
+		if !ok {
+			continue
+		}
+
+		iface := ""
+		if link, err := netlink.LinkByIndex(route.LinkIndex); err == nil {
+			iface = link.Attrs().Name
+		}
+
+		ret = append(ret, localNetwork{prefix: prefix, iface: iface, source: "route via " + iface})
+	}
+
+	return ret, nil
+}
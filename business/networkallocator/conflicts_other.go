@@ -0,0 +1,8 @@
+//go:build !linux
+
+package networkallocator
+
+// routeNetworks is not available on this platform: only interface addresses are checked for conflicts.
+func routeNetworks() ([]localNetwork, error) {
+	return nil, nil
+}
@@ -0,0 +1,87 @@
+package dnsallocator
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+)
+
+// backupName is the name of the nth (from 1, the most recent) backup of fname.
+func backupName(fname string, n int) string {
+	return fname + ".netmux-backup." + strconv.Itoa(n)
+}
+
+// unSyncBackup keeps fileBytes as the most recent backup, rotating the older ones.
+func (m *DNSAllocator) unSyncBackup(fileBytes []byte, perm fs.FileMode) error {
+	if m.backups < 1 {
+		return nil
+	}
+
+	for n := m.backups - 1; n > 0; n-- {
+		err := os.Rename(backupName(m.fname, n), backupName(m.fname, n+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate hosts file backups: %w", err)
+		}
+	}
+
+	if err := os.WriteFile(backupName(m.fname, 1), fileBytes, perm); err != nil {
+		return fmt.Errorf("failed to backup hosts file: %w", err)
+	}
+
+	return nil
+}
+
+// Backups lists the backups of the hosts file, the most recent first.
+func (m *DNSAllocator) Backups() []string {
+	ret := make([]string, 0, m.backups)
+
+	for n := 1; n <= m.backups; n++ {
+		if _, err := os.Stat(backupName(m.fname, n)); err == nil {
+			ret = append(ret, backupName(m.fname, n))
+		}
+	}
+
+	return ret
+}
+
+// Restore replaces the hosts file with its nth backup, from 1 - the most recent.
+func (m *DNSAllocator) Restore(n int) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if n < 1 || n > m.backups {
+		return fmt.Errorf("%w: %d", ErrNoSuchBackup, n)
+	}
+
+	fileBytes, err := os.ReadFile(backupName(m.fname, n))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %d", ErrNoSuchBackup, n)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to read hosts file backup: %w", err)
+	}
+
+	unlock, err := lockHosts(m.fname)
+	if err != nil {
+		return fmt.Errorf("failed to lock hosts file: %w", err)
+	}
+
+	defer unlock()
+
+	info, err := os.Stat(m.fname)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read hosts file: %w", err)
+	}
+
+	// the backup replaces whatever is there.
+	if err = writeAtomic(m.fname, fileBytes, info, func(fs.FileInfo) bool { return true }); err != nil {
+		return err
+	}
+
+	m.content = parseHosts(fileBytes)
+
+	return nil
+}
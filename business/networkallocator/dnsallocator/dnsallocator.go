@@ -1,13 +1,17 @@
 package dnsallocator
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
 )
 
 type DNSEntry struct {
@@ -18,7 +22,22 @@ type DNSEntry struct {
 
 type DNSEntries []DNSEntry
 
-const DefaultFilePerm = 0o600
+const (
+	DefaultFilePerm = 0o644
+	// BlockBegin and BlockEnd delimit the entries managed by netmux. Lines out of the block are never touched.
+	BlockBegin = "# BEGIN netmux - entries managed by netmux, do not edit"
+	BlockEnd   = "# END netmux"
+	// DefaultBackups is how many copies of the hosts file, as it was before being changed, are kept.
+	DefaultBackups = 3
+	// maxAttempts limits how many times an update is retried when someone else changes the file in between.
+	maxAttempts = 3
+	commentTag  = "src: netmux"
+)
+
+var (
+	ErrConcurrentEdit = fmt.Errorf("hosts file changed by someone else while updating it")
+	ErrNoSuchBackup   = fmt.Errorf("no such backup")
+)
 
 func (d DNSEntries) FindByIP(ip string) DNSEntry {
 	for _, v := range d {
@@ -91,106 +110,153 @@ func (e *DNSEntry) CommentMatches(s string) bool {
 	return strings.Contains(e.Comment, s)
 }
 
+// DNSAllocator manages entries of the hosts file. Its entries live in a block of their own (see BlockBegin); other
+// lines are kept as they are. Changes are written to a temporary file that replaces the hosts file, with the file
+// locked, so readers never see it half written and concurrent changes are not lost.
 type DNSAllocator struct {
+	mx      sync.Mutex
 	fname   string
+	content hostsContent
+	backups int
+	// backedUp tells if the hosts file was already backed up, which happens once, before changing it for the first
+	// time.
+	backedUp bool
+}
+
+// hostsContent is a parsed hosts file: the lines before and after the managed block, and the entries within.
+type hostsContent struct {
+	before  []string
 	entries DNSEntries
+	after   []string
+	newline string
 }
 
-func (m *DNSAllocator) LoadBytes(bs []byte) {
-	fileScanner := bufio.NewScanner(bytes.NewReader(bs))
-	for fileScanner.Scan() {
-		if len(fileScanner.Text()) < 1 {
+// parseHosts parses a hosts file. Entries of former versions, out of the block but tagged as ours, are moved into
+// the block.
+func parseHosts(bs []byte) hostsContent {
+	ret := hostsContent{before: []string{}, entries: DNSEntries{}, after: []string{}, newline: "\n"}
+
+	if bytes.Contains(bs, []byte("\r\n")) {
+		ret.newline = "\r\n"
+	}
+
+	lines := strings.Split(strings.ReplaceAll(string(bs), "\r\n", "\n"), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	outside := &ret.before
+	inBlock := false
+
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == BlockBegin:
+			inBlock = true
+
+			continue
+		case trimmed == BlockEnd && inBlock:
+			inBlock = false
+			outside = &ret.after
+
 			continue
 		}
 
-		hosyEntry := DNSEntry{}
+		isEntry := trimmed != "" && !strings.HasPrefix(trimmed, "#")
 
-		hosyEntry.Load(fileScanner.Text())
-		m.entries = append(m.entries, hosyEntry)
+		entry := DNSEntry{}
+		entry.Load(trimmed)
+
+		switch {
+		case inBlock && isEntry, isEntry && entry.CommentMatches(commentTag):
+			ret.entries = append(ret.entries, entry)
+		case !inBlock:
+			*outside = append(*outside, line)
+		}
 	}
+
+	return ret
 }
 
-func (m *DNSAllocator) Bytes() []byte {
+// Bytes renders the hosts file. The block is left out when empty.
+func (h hostsContent) Bytes() []byte {
 	buf := &bytes.Buffer{}
 
-	for _, e := range m.entries {
-		l := e.String()
-		buf.WriteString(l)
-		buf.WriteString("\n")
+	writeLine := func(line string) {
+		buf.WriteString(line)
+		buf.WriteString(h.newline)
 	}
 
-	return buf.Bytes()
-}
-
-func (m *DNSAllocator) RemoveByComment(comment string, exception string) error {
-	var hostEntries []DNSEntry
-
-	err := m.Load()
-	if err != nil {
-		return fmt.Errorf("failed to load hosts file: %w", err)
+	for _, line := range h.before {
+		writeLine(line)
 	}
 
-	for _, entry := range m.entries {
-		for _, n := range entry.Names {
-			if n == exception {
-				hostEntries = append(hostEntries, entry)
+	if len(h.entries) > 0 {
+		writeLine(BlockBegin)
 
-				goto leaveLoop
-			}
+		for _, e := range h.entries {
+			writeLine(e.String())
 		}
 
-		if !entry.CommentMatches(comment) {
-			hostEntries = append(hostEntries, entry)
-		}
+		writeLine(BlockEnd)
+	}
 
-	leaveLoop:
+	for _, line := range h.after {
+		writeLine(line)
 	}
 
-	m.entries = hostEntries
+	return buf.Bytes()
+}
 
-	return m.unSyncSave()
+func (m *DNSAllocator) LoadBytes(bs []byte) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.content = parseHosts(bs)
 }
 
-func (m *DNSAllocator) RemoveByName(name string) error {
-	var hostEntries []DNSEntry //nolint:prealloc
+func (m *DNSAllocator) Bytes() []byte {
+	m.mx.Lock()
+	defer m.mx.Unlock()
 
-	err := m.Load()
-	if err != nil {
-		return fmt.Errorf("failed to load hosts file: %w", err)
-	}
+	return m.content.Bytes()
+}
 
-	found := false
+// RemoveByComment removes our entries with comment in their comments, but the ones named exception.
+func (m *DNSAllocator) RemoveByComment(comment string, exception string) error {
+	return m.update(func(entries DNSEntries) DNSEntries {
+		return slices.DeleteFunc(entries, func(entry DNSEntry) bool {
+			return entry.CommentMatches(comment) && !slices.Contains(entry.Names, exception)
+		})
+	})
+}
 
-	for _, entry := range m.entries {
-		for _, n := range entry.Names {
-			if n == name {
+// RemoveByName removes our entries named name.
+func (m *DNSAllocator) RemoveByName(name string) error {
+	return m.update(func(entries DNSEntries) DNSEntries {
+		return slices.DeleteFunc(entries, func(entry DNSEntry) bool {
+			if slices.Contains(entry.Names, name) {
 				slog.Debug(fmt.Sprintf("Removing hosts entry: %s", entry.String()))
 
-				found = true
-
-				break
+				return true
 			}
-		}
 
-		hostEntries = append(hostEntries, entry)
-	}
-
-	if found {
-		m.entries = hostEntries
-
-		return m.unSyncSave()
-	}
-
-	return nil
+			return false
+		})
+	})
 }
 
 func (m *DNSAllocator) Equals(dnsAllocator *DNSAllocator) bool {
-	if len(m.entries) != len(dnsAllocator.entries) {
+	entries := m.Entries()
+	other := dnsAllocator.Entries()
+
+	if len(entries) != len(other) {
 		return false
 	}
 
-	for i := range m.entries {
-		if !m.entries[i].Equals(dnsAllocator.entries[i]) {
+	for i := range entries {
+		if !entries[i].Equals(other[i]) {
 			return false
 		}
 	}
@@ -200,6 +266,7 @@ func (m *DNSAllocator) Equals(dnsAllocator *DNSAllocator) bool {
 
 func (m *DNSAllocator) Load() error {
 	slog.Debug(fmt.Sprintf("Loading hosts from %s", m.fname))
+
 	fileBytes, err := os.ReadFile(m.fname)
 
 	switch {
@@ -208,48 +275,218 @@ func (m *DNSAllocator) Load() error {
 	case err != nil && errors.Is(err, os.ErrNotExist):
 		return nil
 	default:
-		m.entries = make([]DNSEntry, 0)
 		m.LoadBytes(fileBytes)
 
 		return nil
 	}
 }
 
-func (m *DNSAllocator) unSyncSave() error {
-	// slog.Debug(fmt.Sprintff("Saving hosts to %s", m.fname)
-	err := os.WriteFile(m.fname, m.Bytes(), DefaultFilePerm)
+// update changes our entries through fn, with the hosts file locked. If someone not honoring the lock changes the
+// file in between, the update is done again.
+func (m *DNSAllocator) update(fn func(entries DNSEntries) DNSEntries) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	unlock, err := lockHosts(m.fname)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to lock hosts file: %w", err)
+	}
+
+	defer unlock()
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		err = m.unSyncUpdate(fn)
+		if !errors.Is(err, ErrConcurrentEdit) {
+			return err
+		}
+
+		slog.Debug("hosts file changed while updating it, trying again", "attempt", attempt)
+	}
+
+	return err
+}
+
+func (m *DNSAllocator) unSyncUpdate(fn func(entries DNSEntries) DNSEntries) error {
+	info, err := os.Stat(m.fname)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read hosts file: %w", err)
 	}
 
+	fileBytes, err := os.ReadFile(m.fname)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read hosts file: %w", err)
+	}
+
+	content := parseHosts(fileBytes)
+	content.entries = fn(slices.Clone(content.entries))
+
+	newBytes := content.Bytes()
+	if bytes.Equal(newBytes, fileBytes) {
+		m.content = content
+
+		return nil
+	}
+
+	if info != nil && !m.backedUp {
+		if err = m.unSyncBackup(fileBytes, info.Mode().Perm()); err != nil {
+			return err
+		}
+
+		m.backedUp = true
+	}
+
+	if err = writeAtomic(m.fname, newBytes, info, func(current fs.FileInfo) bool {
+		return sameContent(info, current)
+	}); err != nil {
+		return err
+	}
+
+	m.content = content
+
 	return nil
 }
 
-func (m *DNSAllocator) Add(adr string, names []string, comment string) error {
-	err := m.Load()
+// sameContent tells, from their sizes and modification times, if the file did not change between before and after.
+func sameContent(before fs.FileInfo, after fs.FileInfo) bool {
+	if before == nil || after == nil {
+		return before == nil && after == nil
+	}
+
+	return before.Size() == after.Size() && before.ModTime().Equal(after.ModTime())
+}
+
+// writeAtomic replaces fname with a temporary file holding fileBytes, with the mode (and, if possible, the owner) of
+// the current file, described by info. Right before replacing it, unchanged is called with the current state of the
+// file: if it tells the file changed, ErrConcurrentEdit is returned. A symlinked fname is replaced where it points to,
+// keeping the link. Files that can not be replaced, as bind mounted ones (like /etc/hosts in containers), are written
+// over instead, with the lock of the file held by the caller.
+func writeAtomic(fname string, fileBytes []byte, info fs.FileInfo, unchanged func(current fs.FileInfo) bool) error {
+	if target, err := filepath.EvalSymlinks(fname); err == nil {
+		fname = target
+	}
+
+	err := replaceFile(fname, fileBytes, info, unchanged)
+	if errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EXDEV) {
+		slog.Debug("hosts file can not be replaced, writing over it", "err", err)
+
+		err = writeInPlace(fname, fileBytes, unchanged)
+	}
+
+	switch {
+	case errors.Is(err, ErrConcurrentEdit):
+		return err
+	case err != nil:
+		return fmt.Errorf("failed to write hosts file: %w", err)
+	default:
+		return nil
+	}
+}
+
+func replaceFile(fname string, fileBytes []byte, info fs.FileInfo, unchanged func(current fs.FileInfo) bool) error {
+	perm := fs.FileMode(DefaultFilePerm)
+	if info != nil {
+		perm = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fname), filepath.Base(fname)+".netmux-*")
 	if err != nil {
-		return fmt.Errorf("failed to load hosts file: %w", err)
+		return err //nolint:wrapcheck
+	}
+
+	_, err = tmp.Write(fileBytes)
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+
+	if err == nil && info != nil {
+		chown(tmp.Name(), info)
 	}
 
+	if err == nil {
+		err = checkUnchanged(fname, unchanged)
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), fname)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// writeInPlace truncates fname and writes fileBytes over it, keeping the file itself.
+func writeInPlace(fname string, fileBytes []byte, unchanged func(current fs.FileInfo) bool) error {
+	if err := checkUnchanged(fname, unchanged); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(fname, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	_, err = file.Write(fileBytes)
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err //nolint:wrapcheck
+}
+
+func checkUnchanged(fname string, unchanged func(current fs.FileInfo) bool) error {
+	current, err := os.Stat(fname)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err //nolint:wrapcheck
+	}
+
+	if !unchanged(current) {
+		return ErrConcurrentEdit
+	}
+
+	return nil
+}
+
+func (m *DNSAllocator) Add(adr string, names []string, comment string) error {
 	entry := DNSEntry{
 		Addr:    adr,
 		Names:   names,
-		Comment: "src: netmux " + comment,
+		Comment: commentTag + " " + comment,
 	}
 
 	slog.Debug(fmt.Sprintf("Adding hosts entry: %s", entry.String()))
 
-	m.entries = append(m.entries, entry)
-
-	return m.unSyncSave()
+	return m.update(func(entries DNSEntries) DNSEntries {
+		return append(entries, entry)
+	})
 }
 
 func (m *DNSAllocator) CleanUp(exception string) error {
-	return m.RemoveByComment("src: netmux", exception)
+	return m.RemoveByComment(commentTag, exception)
 }
 
+// Entries lists our entries, as last loaded or written.
 func (m *DNSAllocator) Entries() DNSEntries {
-	return m.entries
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	return slices.Clone(m.content.entries)
 }
 
 type Opts func(h *DNSAllocator)
@@ -261,9 +498,17 @@ var WithFile = func(f string) func(h *DNSAllocator) {
 	}
 }
 
+// WithBackups sets how many backups of the hosts file are kept. Zero disables backups.
+func WithBackups(n int) Opts {
+	return func(h *DNSAllocator) {
+		h.backups = n
+	}
+}
+
 func New(opts ...Opts) *DNSAllocator {
 	ret := new(DNSAllocator)
 	ret.fname = Fname
+	ret.backups = DefaultBackups
 
 	for _, o := range opts {
 		o(ret)
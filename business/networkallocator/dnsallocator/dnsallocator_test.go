@@ -0,0 +1,181 @@
+package dnsallocator_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/duxthemux/netmux/business/networkallocator/dnsallocator"
+)
+
+const userHosts = `# some comments
+127.0.0.1	localhost
+::1     localhost ip6-localhost   # odd  spacing
+
+10.0.0.1 vpn.corp #added by the vpn
+`
+
+func hostsFile(t *testing.T, content string) string {
+	t.Helper()
+
+	fname := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(fname, []byte(content), 0o640))
+
+	return fname
+}
+
+func readFile(t *testing.T, fname string) string {
+	t.Helper()
+
+	fileBytes, err := os.ReadFile(fname)
+	require.NoError(t, err)
+
+	return string(fileBytes)
+}
+
+func TestManagedBlock(t *testing.T) {
+	t.Parallel()
+
+	fname := hostsFile(t, userHosts)
+	allocator := dnsallocator.New(dnsallocator.WithFile(fname))
+
+	require.NoError(t, allocator.Add("10.10.10.1", []string{"svc", "svc.ns"}, "ip: 10.10.10.1"))
+	require.NoError(t, allocator.Add("10.10.10.2", []string{"other"}, "ip: 10.10.10.2"))
+
+	assert.Equal(t, userHosts+dnsallocator.BlockBegin+"\n"+
+		"10.10.10.1 svc svc.ns #src: netmux ip: 10.10.10.1\n"+
+		"10.10.10.2 other #src: netmux ip: 10.10.10.2\n"+
+		dnsallocator.BlockEnd+"\n", readFile(t, fname))
+
+	info, err := os.Stat(fname)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+
+	// user lines added after the block stay there.
+	require.NoError(t, os.WriteFile(fname, []byte(readFile(t, fname)+"192.168.0.1 printer\n"), 0o640))
+
+	require.NoError(t, allocator.RemoveByName("svc.ns"))
+	assert.Len(t, allocator.Entries(), 1)
+	assert.True(t, strings.HasSuffix(readFile(t, fname), dnsallocator.BlockEnd+"\n192.168.0.1 printer\n"))
+
+	require.NoError(t, allocator.CleanUp(""))
+	assert.Empty(t, allocator.Entries())
+	assert.Equal(t, userHosts+"192.168.0.1 printer\n", readFile(t, fname))
+}
+
+func TestFormerEntriesMovedToBlock(t *testing.T) {
+	t.Parallel()
+
+	fname := hostsFile(t, "127.0.0.1 localhost\r\n10.10.10.1 svc #src: netmux ip: 10.10.10.1\r\n::1 localhost\r\n")
+	allocator := dnsallocator.New(dnsallocator.WithFile(fname))
+
+	require.NoError(t, allocator.Load())
+	assert.Len(t, allocator.Entries(), 1)
+
+	require.NoError(t, allocator.Add("10.10.10.2", []string{"other"}, "ip: 10.10.10.2"))
+
+	assert.Equal(t, "127.0.0.1 localhost\r\n::1 localhost\r\n"+dnsallocator.BlockBegin+"\r\n"+
+		"10.10.10.1 svc #src: netmux ip: 10.10.10.1\r\n"+
+		"10.10.10.2 other #src: netmux ip: 10.10.10.2\r\n"+
+		dnsallocator.BlockEnd+"\r\n", readFile(t, fname))
+
+	assert.Equal(t, "10.10.10.2", allocator.Entries().FindByName("other").Addr)
+}
+
+func TestSymlinkedFile(t *testing.T) {
+	t.Parallel()
+
+	target := hostsFile(t, userHosts)
+
+	fname := filepath.Join(t.TempDir(), "hosts")
+	if err := os.Symlink(target, fname); err != nil {
+		t.Skipf("symlinks not available: %v", err)
+	}
+
+	allocator := dnsallocator.New(dnsallocator.WithFile(fname))
+	require.NoError(t, allocator.Add("10.10.10.1", []string{"svc"}, "ip: 10.10.10.1"))
+
+	// the file is changed where the link points to, and the link kept.
+	info, err := os.Lstat(fname)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSymlink, info.Mode().Type())
+
+	assert.Contains(t, readFile(t, target), "10.10.10.1 svc #src: netmux ip: 10.10.10.1\n")
+
+	require.NoError(t, allocator.CleanUp(""))
+	assert.Equal(t, userHosts, readFile(t, target))
+}
+
+func TestBackups(t *testing.T) {
+	t.Parallel()
+
+	fname := hostsFile(t, userHosts)
+
+	// the file is backed up once per allocator, before its first change.
+	first := dnsallocator.New(dnsallocator.WithFile(fname), dnsallocator.WithBackups(2))
+	require.NoError(t, first.Add("10.10.10.1", []string{"svc"}, "ip: 10.10.10.1"))
+	require.NoError(t, first.Add("10.10.10.2", []string{"other"}, "ip: 10.10.10.2"))
+
+	assert.Len(t, first.Backups(), 1)
+
+	changed := readFile(t, fname)
+
+	second := dnsallocator.New(dnsallocator.WithFile(fname), dnsallocator.WithBackups(2))
+	require.NoError(t, second.CleanUp(""))
+
+	third := dnsallocator.New(dnsallocator.WithFile(fname), dnsallocator.WithBackups(2))
+	require.NoError(t, third.Add("10.10.10.3", []string{"third"}, "ip: 10.10.10.3"))
+
+	backups := third.Backups()
+	require.Len(t, backups, 2)
+	assert.Equal(t, userHosts, readFile(t, backups[0]))
+	assert.Equal(t, changed, readFile(t, backups[1]))
+
+	require.NoError(t, third.Restore(2))
+	assert.Equal(t, changed, readFile(t, fname))
+	assert.Len(t, third.Entries(), 2)
+
+	assert.ErrorIs(t, third.Restore(3), dnsallocator.ErrNoSuchBackup)
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	t.Parallel()
+
+	fname := hostsFile(t, userHosts)
+
+	const writers, entries = 4, 10
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < writers; w++ {
+		w := w
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			// each writer is on its own, as separate processes would be.
+			allocator := dnsallocator.New(dnsallocator.WithFile(fname), dnsallocator.WithBackups(0))
+
+			for e := 0; e < entries; e++ {
+				addr := fmt.Sprintf("10.10.%d.%d", w, e)
+				assert.NoError(t, allocator.Add(addr, []string{addr + ".svc"}, "ip: "+addr))
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	allocator := dnsallocator.New(dnsallocator.WithFile(fname))
+	require.NoError(t, allocator.Load())
+
+	assert.Len(t, allocator.Entries(), writers*entries)
+	assert.True(t, strings.HasPrefix(readFile(t, fname), userHosts))
+}
@@ -0,0 +1,51 @@
+//go:build !windows
+
+package dnsallocator
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockHosts takes an exclusive (advisory) lock of fname, creating it if needed. As the file is replaced on writes, the
+// lock is taken again if it was replaced while waiting for it.
+func lockHosts(fname string) (func(), error) {
+	for {
+		file, err := os.OpenFile(fname, os.O_RDONLY|os.O_CREATE, DefaultFilePerm)
+		if err != nil {
+			return nil, fmt.Errorf("error opening %s: %w", fname, err)
+		}
+
+		if err = unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+			_ = file.Close()
+
+			return nil, fmt.Errorf("error locking %s: %w", fname, err)
+		}
+
+		locked, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+
+			return nil, fmt.Errorf("error checking %s: %w", fname, err)
+		}
+
+		if current, err := os.Stat(fname); err == nil && os.SameFile(locked, current) {
+			return func() {
+				_ = file.Close()
+			}, nil
+		}
+
+		_ = file.Close()
+	}
+}
+
+// chown gives fname the owner of info, if allowed to.
+func chown(fname string, info fs.FileInfo) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		_ = os.Chown(fname, int(stat.Uid), int(stat.Gid))
+	}
+}
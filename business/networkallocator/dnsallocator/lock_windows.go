@@ -0,0 +1,35 @@
+package dnsallocator
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockHosts takes an exclusive lock of a lock file next to fname: files open elsewhere can't be replaced on windows,
+// so fname itself is not locked.
+func lockHosts(fname string) (func(), error) {
+	file, err := os.OpenFile(fname+".netmux-lock", os.O_RDWR|os.O_CREATE, DefaultFilePerm)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock of %s: %w", fname, err)
+	}
+
+	overlapped := &windows.Overlapped{}
+
+	err = windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, overlapped)
+	if err != nil {
+		_ = file.Close()
+
+		return nil, fmt.Errorf("error locking %s: %w", fname, err)
+	}
+
+	return func() {
+		_ = windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, overlapped)
+		_ = file.Close()
+	}, nil
+}
+
+// chown does nothing on windows: the replaced file keeps the permissions of the directory.
+func chown(string, fs.FileInfo) {}
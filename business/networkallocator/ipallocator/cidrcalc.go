@@ -2,84 +2,57 @@ package ipallocator
 
 import (
 	"fmt"
-	"strconv"
+	"net/netip"
 	"strings"
 )
 
-// GetIPV4Addrs will return a slice of strings, each one is an IP Address, part of the CIDR described.
-func GetIPV4Addrs(net string, skipGw bool, skipNetwork bool) ([]string, error) {
-	net = strings.TrimSpace(net)
-	parts := strings.Split(net, "/")
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("cidr %s is not in the format A.B.C.D/MASK", net)
-	}
-
-	base := parts[0]
-	maskStr := parts[1]
+// MaxPoolSize limits how many addresses are taken from a network - an ipv6 /64 has far more than we'll ever need.
+const MaxPoolSize = 1 << 16
 
-	mask, err := strconv.Atoi(maskStr)
+// GetAddrs will return a slice of strings, each one is an IP Address, part of the CIDR described - up to MaxPoolSize
+// of them. For ipv4, skipGw leaves out addresses ending in .0 and skipNetwork the ones ending in .255. For ipv6,
+// skipGw leaves out the first address of the network (the subnet router anycast address).
+func GetAddrs(cidr string, skipGw bool, skipNetwork bool) ([]string, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
 	if err != nil {
-		return nil, fmt.Errorf("mask is not int: %s", err)
+		return nil, fmt.Errorf("cidr %s is not valid: %w", cidr, err)
 	}
 
-	if mask > 32 {
-		return nil, fmt.Errorf("mask cannot be bigger than 32")
-	}
+	prefix = prefix.Masked()
 
-	parts = strings.Split(base, ".")
-	if len(parts) != 4 {
-		return nil, fmt.Errorf("could not find 4 octets in %s", base)
-	}
-
-	a, b, c, d := parts[0], parts[1], parts[2], parts[3]
+	ret := make([]string, 0)
 
-	aint, err := strconv.Atoi(a)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing octet A(%s): %w", a, err)
-	}
+	for addr := prefix.Addr(); prefix.Contains(addr) && len(ret) < MaxPoolSize; addr = addr.Next() {
+		if skipAddr(prefix, addr, skipGw, skipNetwork) {
+			continue
+		}
 
-	bint, err := strconv.Atoi(b)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing octet B(%s): %w", b, err)
+		ret = append(ret, addr.String())
 	}
 
-	cint, err := strconv.Atoi(c)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing octet C(%s): %w", c, err)
-	}
+	return ret, nil
+}
 
-	dint, err := strconv.Atoi(d)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing octet D(%s): %w", d, err)
+func skipAddr(prefix netip.Prefix, addr netip.Addr, skipGw bool, skipNetwork bool) bool {
+	if addr.Is6() {
+		return skipGw && addr == prefix.Addr()
 	}
 
-	ret := make([]string, 0)
-
-	for count := 1 << (32 - mask); count > 0; count-- {
-
-		if aint > 255 {
-			return nil, fmt.Errorf("invalid entry")
-		}
+	last := addr.As4()[3]
 
-		if (dint != 0 || !skipGw) && (dint != 255 || !skipNetwork) {
-			ret = append(ret, fmt.Sprintf("%v.%v.%v.%v", aint, bint, cint, dint))
-		}
+	return (skipGw && last == 0) || (skipNetwork && last == 255)
+}
 
-		dint++
-		if dint > 255 {
-			dint = 0
-			cint++
-			if cint > 255 {
-				cint = 0
-				bint++
-				if bint > 255 {
-					aint++
-					bint = 0
-				}
-			}
-		}
+// GetIPV4Addrs works as GetAddrs, for ipv4 networks only.
+func GetIPV4Addrs(cidr string, skipGw bool, skipNetwork bool) ([]string, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		return nil, fmt.Errorf("cidr %s is not valid: %w", cidr, err)
+	}
 
+	if !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("cidr %s is not ipv4", cidr)
 	}
 
-	return ret, nil
+	return GetAddrs(cidr, skipGw, skipNetwork)
 }
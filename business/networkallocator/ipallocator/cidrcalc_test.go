@@ -53,3 +53,21 @@ func TestGetAddrsNM23WoNetworkNorGW(t *testing.T) {
 	assert.Equal(t, strs[254], "10.0.1.1")
 	assert.Equal(t, strs[507], "10.0.1.254")
 }
+
+func TestGetAddrsIPv6(t *testing.T) {
+	strs, err := ipallocator.GetAddrs("fd6e:786d::/120", true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 255, len(strs))
+	assert.Equal(t, "fd6e:786d::1", strs[0])
+	assert.Equal(t, "fd6e:786d::ff", strs[254])
+
+	strs, err = ipallocator.GetAddrs("fd6e:786d::/64", true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, ipallocator.MaxPoolSize, len(strs))
+
+	_, err = ipallocator.GetIPV4Addrs("fd6e:786d::/120", true, true)
+	assert.Error(t, err)
+
+	_, err = ipallocator.GetAddrs("10.0.0.0", true, true)
+	assert.Error(t, err)
+}
@@ -3,6 +3,8 @@ package ipallocator
 import (
 	"fmt"
 	"log/slog"
+	"net/netip"
+	"slices"
 	"sync"
 
 	shell2 "github.com/duxthemux/netmux/business/shell"
@@ -14,43 +16,87 @@ type IPAllocator struct {
 	iface      string
 	freeAddrs  []string
 	allocAddrs []string
+	// aliases tells if allocated addresses are added to iface. When off, addresses are only book kept - eg: for
+	// addresses already routed to the host, as 127.0.0.0/8 on linux.
+	aliases   bool
+	leases    map[string]*Lease
+	leaseFile string
 }
 
+type Opts func(i *IPAllocator)
+
+// WithAliases enables or disables adding allocated addresses as aliases of the interface. It is enabled by default.
+func WithAliases(enabled bool) Opts {
+	return func(i *IPAllocator) {
+		i.aliases = enabled
+	}
+}
+
+// Allocate allocates any free address, preferring the ones nobody holds a lease for.
 func (i *IPAllocator) Allocate() (string, error) {
+	return i.AllocateFor("")
+}
+
+// AllocateAddr works like Allocate, but for a specific address, that must be free.
+func (i *IPAllocator) AllocateAddr(ipAddress string) error {
 	i.Lock()
 	defer i.Unlock()
 
-	if len(i.freeAddrs) == 0 {
-		return "", fmt.Errorf("no more free addresses")
+	for idx, addr := range i.freeAddrs {
+		if addr == ipAddress {
+			_, err := i.unSyncAllocateAt(idx)
+
+			return err
+		}
 	}
 
-	addr := i.freeAddrs[0]
+	return fmt.Errorf("address %s is not free", ipAddress)
+}
 
-	i.freeAddrs = i.freeAddrs[1:]
+func (i *IPAllocator) unSyncAllocateAt(idx int) (string, error) {
+	addr := i.freeAddrs[idx]
 
-	i.allocAddrs = append(i.allocAddrs, addr)
+	i.freeAddrs = append(i.freeAddrs[:idx], i.freeAddrs[idx+1:]...)
 
-	err := i.shell.IfconfigAddAlias(i.iface, addr, "255.255.255.0", "10.0.0.1")
-	if err != nil {
-		i.freeAddrs = append(i.freeAddrs, addr)
+	if i.aliases {
+		// a host mask: with a shared subnet, removing the first alias could take the others with it.
+		err := i.shell.IfconfigAddAlias(i.iface, addr, hostMask(addr), "10.0.0.1")
+		if err != nil {
+			i.freeAddrs = append(i.freeAddrs, addr)
 
-		return "", fmt.Errorf("error adding alias: %w", err)
+			return "", fmt.Errorf("error adding alias: %w", err)
+		}
 	}
 
+	i.allocAddrs = append(i.allocAddrs, addr)
+
 	return addr, nil
 }
 
+// hostMask is the netmask of a single ipv4 address. For ipv6 it is empty, and shells use a /128.
+func hostMask(addr string) string {
+	if ip, err := netip.ParseAddr(addr); err == nil && ip.Is6() {
+		return ""
+	}
+
+	return "255.255.255.255"
+}
+
 func (i *IPAllocator) Release(ipAddress string) error {
 	i.Lock()
 	defer i.Unlock()
 
-	err := i.shell.IfconfigRemAlias(i.iface, ipAddress)
-	if err != nil {
-		return fmt.Errorf("error removing alias: %w", err)
+	if i.aliases {
+		err := i.shell.IfconfigRemAlias(i.iface, ipAddress)
+		if err != nil {
+			return fmt.Errorf("error removing alias: %w", err)
+		}
 	}
 
 	i.freeAddrs = append(i.freeAddrs, ipAddress)
 
+	i.unSyncTouchLease(ipAddress)
+
 	for idx, addr := range i.allocAddrs {
 		if addr == ipAddress {
 			i.allocAddrs[idx] = i.allocAddrs[len(i.allocAddrs)-1]
@@ -63,8 +109,17 @@ func (i *IPAllocator) Release(ipAddress string) error {
 	return nil
 }
 
+// Allocated lists the allocated addresses.
+func (i *IPAllocator) Allocated() []string {
+	i.Lock()
+	defer i.Unlock()
+
+	return slices.Clone(i.allocAddrs)
+}
+
 func (i *IPAllocator) ReleaseAll(fnCleanupEach func(s string) error) error {
-	for _, addr := range i.allocAddrs {
+	// Release changes allocAddrs: a copy is iterated.
+	for _, addr := range i.Allocated() {
 		if err := i.Release(addr); err != nil {
 			return fmt.Errorf("error releasing ip address: %w", err)
 		}
@@ -77,28 +132,57 @@ func (i *IPAllocator) ReleaseAll(fnCleanupEach func(s string) error) error {
 	return nil
 }
 
+// CleanUp removes aliases of free addresses, possibly left behind by a previous run.
 func (i *IPAllocator) CleanUp() {
-	for _, addr := range i.freeAddrs {
-		err := i.Release(addr)
+	if !i.aliases {
+		return
+	}
+
+	// only the aliases found are removed, unless they can't be listed.
+	addrs, err := i.Leftovers()
+	if err != nil {
+		slog.Debug("error listing leftover aliases, trying every free address", "err", err)
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	if err != nil {
+		addrs = slices.Clone(i.freeAddrs)
+	}
+
+	// aliases are removed directly: Release would put the addresses in the free list again.
+	for _, addr := range addrs {
+		err := i.shell.IfconfigRemAlias(i.iface, addr)
 		if err != nil {
 			slog.Debug(fmt.Sprintf("Cleanning ip - error for ip %s: %s", addr, err.Error()))
 		}
 	}
 }
 
-func New(iface string, cidr string) (*IPAllocator, error) {
+func New(iface string, cidr string, opts ...Opts) (*IPAllocator, error) {
 	ret := &IPAllocator{
 		shell:     shell2.New(),
 		iface:     iface,
 		freeAddrs: []string{},
+		aliases:   true,
+		leases:    map[string]*Lease{},
+	}
+
+	for _, opt := range opts {
+		opt(ret)
 	}
 
-	freeAddrs, err := GetIPV4Addrs(cidr, true, true)
+	freeAddrs, err := GetAddrs(cidr, true, true)
 	if err != nil {
 		return nil, fmt.Errorf("error allocating network addresses: %w", err)
 	}
 
 	ret.freeAddrs = freeAddrs
 
+	if err = ret.loadLeases(); err != nil {
+		return nil, err
+	}
+
 	return ret, nil
 }
@@ -0,0 +1,209 @@
+package ipallocator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const leaseFilePerm = 0o600
+
+// Lease binds an address to a name (typically the local name of a bridge), so the name gets the same address back
+// whenever it is free - across reconnections and restarts.
+type Lease struct {
+	Name     string    `json:"name"`
+	Addr     string    `json:"addr"`
+	LastUsed time.Time `json:"lastUsed"`
+	// Active tells if the address is allocated at the moment.
+	Active bool `json:"active"`
+}
+
+// WithLeaseFile persists leases in fname, loading the existing ones when the allocator is created.
+func WithLeaseFile(fname string) Opts {
+	return func(i *IPAllocator) {
+		i.leaseFile = fname
+	}
+}
+
+// AllocateFor allocates an address for name: the one leased to it if free, otherwise an address nobody holds a lease
+// for. When all free addresses are leased, the one of the least recently used lease is reclaimed. An empty name
+// works as Allocate, and gets no lease.
+func (i *IPAllocator) AllocateFor(name string) (string, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	if len(i.freeAddrs) == 0 {
+		return "", fmt.Errorf("no more free addresses")
+	}
+
+	addr, err := i.unSyncAllocateAt(i.unSyncPickFree(name))
+	if err != nil {
+		return "", err
+	}
+
+	for leaseName, lease := range i.leases {
+		if lease.Addr == addr && leaseName != name {
+			slog.Debug("reclaiming lease", "name", leaseName, "addr", addr)
+			delete(i.leases, leaseName)
+		}
+	}
+
+	if name != "" {
+		i.leases[name] = &Lease{Name: name, Addr: addr, LastUsed: time.Now()}
+	}
+
+	i.unSyncSaveLeases()
+
+	return addr, nil
+}
+
+// unSyncPickFree returns the index, in freeAddrs, of the address to hand to name.
+func (i *IPAllocator) unSyncPickFree(name string) int {
+	leased := make(map[string]*Lease, len(i.leases))
+	for _, lease := range i.leases {
+		leased[lease.Addr] = lease
+	}
+
+	if lease, ok := i.leases[name]; ok && name != "" {
+		if idx := slices.Index(i.freeAddrs, lease.Addr); idx >= 0 {
+			return idx
+		}
+	}
+
+	reclaim := -1
+
+	for idx, addr := range i.freeAddrs {
+		lease, ok := leased[addr]
+		if !ok {
+			return idx
+		}
+
+		if reclaim < 0 || lease.LastUsed.Before(leased[i.freeAddrs[reclaim]].LastUsed) {
+			reclaim = idx
+		}
+	}
+
+	return reclaim
+}
+
+// unSyncTouchLease records that the address leased to someone was just used.
+func (i *IPAllocator) unSyncTouchLease(addr string) {
+	for _, lease := range i.leases {
+		if lease.Addr == addr {
+			lease.LastUsed = time.Now()
+
+			i.unSyncSaveLeases()
+
+			return
+		}
+	}
+}
+
+// Leases lists the current leases, by name.
+func (i *IPAllocator) Leases() []Lease {
+	i.Lock()
+	defer i.Unlock()
+
+	ret := make([]Lease, 0, len(i.leases))
+
+	for _, lease := range i.leases {
+		entry := *lease
+		entry.Active = slices.Contains(i.allocAddrs, lease.Addr)
+		ret = append(ret, entry)
+	}
+
+	slices.SortFunc(ret, func(a, b Lease) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return ret
+}
+
+// loadLeases reads the lease file, dropping leases of addresses that are no longer part of the network.
+func (i *IPAllocator) loadLeases() error {
+	if i.leaseFile == "" {
+		return nil
+	}
+
+	fileBytes, err := os.ReadFile(i.leaseFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("error reading leases: %w", err)
+	}
+
+	leases := make([]Lease, 0)
+	if err = json.Unmarshal(fileBytes, &leases); err != nil {
+		return fmt.Errorf("error parsing leases in %s: %w", i.leaseFile, err)
+	}
+
+	for idx := range leases {
+		lease := leases[idx]
+		if lease.Name == "" || !slices.Contains(i.freeAddrs, lease.Addr) {
+			continue
+		}
+
+		lease.Active = false
+		i.leases[lease.Name] = &lease
+	}
+
+	return nil
+}
+
+// unSyncSaveLeases writes the lease file - to a temporary file first, so a crash never leaves it half written.
+// Failing to save is not fatal: leases are just not kept across restarts.
+func (i *IPAllocator) unSyncSaveLeases() {
+	if i.leaseFile == "" {
+		return
+	}
+
+	leases := make([]Lease, 0, len(i.leases))
+	for _, lease := range i.leases {
+		leases = append(leases, Lease{Name: lease.Name, Addr: lease.Addr, LastUsed: lease.LastUsed})
+	}
+
+	slices.SortFunc(leases, func(a, b Lease) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	fileBytes, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		slog.Warn("error encoding leases", "err", err)
+
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(i.leaseFile), filepath.Base(i.leaseFile)+".*")
+	if err != nil {
+		slog.Warn("error saving leases", "err", err)
+
+		return
+	}
+
+	_, err = tmp.Write(fileBytes)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Chmod(tmp.Name(), leaseFilePerm)
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), i.leaseFile)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+
+		slog.Warn("error saving leases", "err", err)
+	}
+}
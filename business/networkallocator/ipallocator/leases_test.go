@@ -0,0 +1,96 @@
+package ipallocator_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/duxthemux/netmux/business/networkallocator/ipallocator"
+)
+
+func newAllocator(t *testing.T, leaseFile string) *ipallocator.IPAllocator {
+	t.Helper()
+
+	// 10.0.0.0/29 without the network address: 10.0.0.1 to 10.0.0.7.
+	allocator, err := ipallocator.New("lo", "10.0.0.0/29",
+		ipallocator.WithAliases(false),
+		ipallocator.WithLeaseFile(leaseFile))
+	require.NoError(t, err)
+
+	return allocator
+}
+
+func TestLeasesSurviveRestarts(t *testing.T) {
+	leaseFile := filepath.Join(t.TempDir(), "leases.json")
+
+	allocator := newAllocator(t, leaseFile)
+
+	orders, err := allocator.AllocateFor("orders")
+	require.NoError(t, err)
+
+	payments, err := allocator.AllocateFor("payments")
+	require.NoError(t, err)
+
+	// a new allocator, as after a restart.
+	allocator = newAllocator(t, leaseFile)
+
+	// an anonymous allocation does not take leased addresses.
+	other, err := allocator.Allocate()
+	require.NoError(t, err)
+	assert.NotEqual(t, orders, other)
+	assert.NotEqual(t, payments, other)
+
+	again, err := allocator.AllocateFor("payments")
+	require.NoError(t, err)
+	assert.Equal(t, payments, again)
+
+	require.NoError(t, allocator.Release(again))
+
+	again, err = allocator.AllocateFor("payments")
+	require.NoError(t, err)
+	assert.Equal(t, payments, again)
+
+	leases := allocator.Leases()
+	require.Len(t, leases, 2)
+	assert.Equal(t, "orders", leases[0].Name)
+	assert.Equal(t, orders, leases[0].Addr)
+	assert.False(t, leases[0].Active)
+	assert.Equal(t, "payments", leases[1].Name)
+	assert.True(t, leases[1].Active)
+}
+
+func TestLeasesReclaimLeastRecentlyUsed(t *testing.T) {
+	allocator := newAllocator(t, "")
+
+	addrs := map[string]string{}
+
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "z"} {
+		addr, err := allocator.AllocateFor(name)
+		require.NoError(t, err)
+
+		addrs[name] = addr
+	}
+
+	// released in this order: "c" is the least recently used.
+	for _, name := range []string{"c", "a", "e"} {
+		require.NoError(t, allocator.Release(addrs[name]))
+	}
+
+	addr, err := allocator.AllocateFor("g")
+	require.NoError(t, err)
+	assert.Equal(t, addrs["c"], addr)
+
+	// "a" keeps its address.
+	addr, err = allocator.AllocateFor("a")
+	require.NoError(t, err)
+	assert.Equal(t, addrs["a"], addr)
+
+	names := make([]string, 0)
+	for _, lease := range allocator.Leases() {
+		names = append(names, lease.Name)
+	}
+
+	assert.Equal(t, []string{"a", "b", "d", "e", "f", "g", "z"}, names)
+}
@@ -0,0 +1,96 @@
+package ipallocator
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+var ErrNotFree = fmt.Errorf("address is not free")
+
+// Leftovers lists the aliases of the interface, within the network, that are not allocated - typically left behind by
+// a previous run that did not end cleanly. Without aliases there are no leftovers.
+func (i *IPAllocator) Leftovers() ([]string, error) {
+	if !i.aliases {
+		return nil, nil
+	}
+
+	aliases, err := i.shell.IfconfigAliases(i.iface)
+	if err != nil {
+		return nil, fmt.Errorf("error listing aliases: %w", err)
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	ret := make([]string, 0)
+
+	for _, addr := range aliases {
+		if slices.Contains(i.freeAddrs, addr) {
+			ret = append(ret, addr)
+		}
+	}
+
+	return ret, nil
+}
+
+// Adopt books a free address as allocated to name, without adding it to the interface: it is meant for leftovers
+// (or, without aliases, any address known to be in use) to be taken back. An empty name gets no lease.
+func (i *IPAllocator) Adopt(ipAddress string, name string) error {
+	i.Lock()
+	defer i.Unlock()
+
+	idx := slices.Index(i.freeAddrs, ipAddress)
+	if idx < 0 {
+		return fmt.Errorf("%w: %s", ErrNotFree, ipAddress)
+	}
+
+	i.freeAddrs = append(i.freeAddrs[:idx], i.freeAddrs[idx+1:]...)
+	i.allocAddrs = append(i.allocAddrs, ipAddress)
+
+	if name == "" {
+		return nil
+	}
+
+	for leaseName, lease := range i.leases {
+		if lease.Addr == ipAddress && leaseName != name {
+			delete(i.leases, leaseName)
+		}
+	}
+
+	i.leases[name] = &Lease{Name: name, Addr: ipAddress, LastUsed: time.Now()}
+
+	i.unSyncSaveLeases()
+
+	return nil
+}
+
+// RemoveLeftover removes an alias that is not allocated.
+func (i *IPAllocator) RemoveLeftover(ipAddress string) error {
+	i.Lock()
+	defer i.Unlock()
+
+	if !i.aliases || !slices.Contains(i.freeAddrs, ipAddress) {
+		return fmt.Errorf("%w: %s", ErrNotFree, ipAddress)
+	}
+
+	if err := i.shell.IfconfigRemAlias(i.iface, ipAddress); err != nil {
+		return fmt.Errorf("error removing alias: %w", err)
+	}
+
+	return nil
+}
+
+// LeaseName returns the name holding a lease for ipAddress, if any.
+func (i *IPAllocator) LeaseName(ipAddress string) string {
+	i.Lock()
+	defer i.Unlock()
+
+	for name, lease := range i.leases {
+		if lease.Addr == ipAddress {
+			return name
+		}
+	}
+
+	return ""
+}
@@ -3,6 +3,9 @@ package networkallocator
 import (
 	"fmt"
 	"log/slog"
+	"net/netip"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 
@@ -10,17 +13,194 @@ import (
 	"github.com/duxthemux/netmux/business/networkallocator/ipallocator"
 )
 
+const (
+	// ModeAlias adds every allocated address as an alias of the interface, which requires root.
+	ModeAlias = "alias"
+	// ModeLoopback hands out addresses from 127.0.0.0/8. Linux routes the whole network to lo, so no alias (and no
+	// privilege) is needed.
+	ModeLoopback = "loopback"
+)
+
+var (
+	ErrInvalidMode          = fmt.Errorf("invalid allocator mode")
+	ErrNotLoopback          = fmt.Errorf("network is not within 127.0.0.0/8")
+	ErrLoopbackNotSupported = fmt.Errorf("loopback mode not supported on this platform")
+	ErrNoIPv6               = fmt.Errorf("no ipv6 network configured")
+)
+
+var loopbackNetwork = netip.MustParsePrefix("127.0.0.0/8")
+
 type NetworkAllocator struct {
 	sync.Mutex
-	ipAllocator  *ipallocator.IPAllocator
+	ipAllocator *ipallocator.IPAllocator
+	// ipAllocator6 hands out the ipv6 addresses of dual stack bridges, from network6. Nil if there is no such network.
+	ipAllocator6 *ipallocator.IPAllocator
+	cidr6        string
+	network6     netip.Prefix
 	dnsAllocator *dnsallocator.DNSAllocator
+	// hostsFile tells if names are published in the hosts file. When it is off, names are only available through
+	// LookupName (eg: to the embedded dns server).
+	hostsFile bool
+	namesMx   sync.RWMutex
+	names     map[string][]string
+	mode      string
+	leaseFile string
+	// network is the one addresses are allocated from: the configured one, or a candidate if it had conflicts.
+	network    string
+	candidates []string
+	conflicts  []Conflict
+	// adopted holds the addresses taken back by Reconcile, by the first of their names, until claimed by GetIP.
+	adopted map[string]string
+}
+
+type Opts func(n *NetworkAllocator)
+
+// WithHostsFile enables or disables publishing names in the hosts file. It is enabled by default.
+func WithHostsFile(enabled bool) Opts {
+	return func(n *NetworkAllocator) {
+		n.hostsFile = enabled
+	}
+}
+
+// WithHostsFileName publishes names in fname instead of the hosts file of the system.
+func WithHostsFileName(fname string) Opts {
+	return func(n *NetworkAllocator) {
+		n.dnsAllocator = dnsallocator.New(dnsallocator.WithFile(fname))
+	}
+}
+
+// WithMode sets how addresses are made reachable: ModeAlias (the default) or ModeLoopback.
+func WithMode(mode string) Opts {
+	return func(n *NetworkAllocator) {
+		n.mode = mode
+	}
+}
+
+// WithLeaseFile keeps the addresses leased to names in fname, so they survive restarts.
+func WithLeaseFile(fname string) Opts {
+	return func(n *NetworkAllocator) {
+		n.leaseFile = fname
+	}
+}
+
+// WithIPv6Network sets an ipv6 network (typically an ULA, as fd6e:786d:7578::/112) to give dual stack bridges their
+// ipv6 address from.
+func WithIPv6Network(cidr string) Opts {
+	return func(n *NetworkAllocator) {
+		n.cidr6 = cidr
+	}
+}
+
+// HostsBackups lists the backups of the hosts file, the most recent first.
+func (n *NetworkAllocator) HostsBackups() []string {
+	return n.dnsAllocator.Backups()
+}
+
+// RestoreHosts replaces the hosts file with its nth backup (from 1, the most recent), reloading our entries.
+func (n *NetworkAllocator) RestoreHosts(backup int) error {
+	n.Lock()
+	defer n.Unlock()
+
+	if err := n.dnsAllocator.Restore(backup); err != nil {
+		return fmt.Errorf("error restoring hosts file: %w", err)
+	}
+
+	return nil
+}
+
+// Leases lists the addresses leased to names.
+func (n *NetworkAllocator) Leases() []ipallocator.Lease {
+	ret := n.ipAllocator.Leases()
+
+	if n.ipAllocator6 != nil {
+		ret = append(ret, n.ipAllocator6.Leases()...)
+	}
+
+	return ret
+}
+
+// LookupName returns the addresses allocated to name, if any.
+func (n *NetworkAllocator) LookupName(name string) ([]string, bool) {
+	n.namesMx.RLock()
+	defer n.namesMx.RUnlock()
+
+	addrs, ok := n.names[strings.ToLower(name)]
+
+	return slices.Clone(addrs), ok
 }
 
+func (n *NetworkAllocator) setNames(ipAddress string, names []string) {
+	n.namesMx.Lock()
+	defer n.namesMx.Unlock()
+
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if !slices.Contains(n.names[name], ipAddress) {
+			n.names[name] = append(n.names[name], ipAddress)
+		}
+	}
+}
+
+func (n *NetworkAllocator) delNames(ipAddress string) {
+	n.namesMx.Lock()
+	defer n.namesMx.Unlock()
+
+	for name, addrs := range n.names {
+		addrs = slices.DeleteFunc(addrs, func(addr string) bool {
+			return addr == ipAddress
+		})
+
+		if len(addrs) == 0 {
+			delete(n.names, name)
+
+			continue
+		}
+
+		n.names[name] = addrs
+	}
+}
+
+// HasIPv6 tells if GetIPv6 can be used.
+func (n *NetworkAllocator) HasIPv6() bool {
+	return n.ipAllocator6 != nil
+}
+
+// GetIP allocates an address from the main network, publishing names for it. Names previously published for other
+// addresses are replaced.
 func (n *NetworkAllocator) GetIP(names ...string) (string, error) {
 	n.Lock()
 	defer n.Unlock()
 
+	return n.unSyncGetIP(n.ipAllocator, true, names)
+}
+
+// GetIPv6 allocates an address from the ipv6 network, publishing names for it alongside the ones they already have -
+// so a bridge can be dual stack by calling GetIP and then GetIPv6.
+func (n *NetworkAllocator) GetIPv6(names ...string) (string, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.ipAllocator6 == nil {
+		return "", ErrNoIPv6
+	}
+
+	return n.unSyncGetIP(n.ipAllocator6, false, names)
+}
+
+func (n *NetworkAllocator) unSyncGetIP(
+	allocator *ipallocator.IPAllocator,
+	replace bool,
+	names []string,
+) (string, error) {
+	if addr, ok := n.unSyncClaim(allocator, names); ok {
+		return addr, nil
+	}
+
 	for _, name := range names {
+		if !n.hostsFile || !replace {
+			break
+		}
+
 		existingEntry := n.dnsAllocator.Entries().FindByName(name)
 		if len(existingEntry.Names) > 0 {
 			if err := n.dnsAllocator.RemoveByName(name); err != nil {
@@ -29,12 +209,31 @@ func (n *NetworkAllocator) GetIP(names ...string) (string, error) {
 		}
 	}
 
-	ipaddr, err := n.ipAllocator.Allocate()
+	// addresses are leased to the first name, so it gets the same one back whenever it is free.
+	leaseName := ""
+	if len(names) > 0 {
+		leaseName = names[0]
+	}
+
+	ipaddr, err := allocator.AllocateFor(leaseName)
 	if err != nil {
 		return "", fmt.Errorf("error allocating ip address: %w", err)
 	}
 
+	n.setNames(ipaddr, names)
+
+	if !n.hostsFile {
+		return ipaddr, nil
+	}
+
 	if err := n.dnsAllocator.Add(ipaddr, names, "name: "+strings.Join(names, ",")+" ip: "+ipaddr); err != nil {
+		// the caller gets no address to release: it is released here.
+		n.delNames(ipaddr)
+
+		if releaseErr := allocator.Release(ipaddr); releaseErr != nil {
+			slog.Warn("error releasing address", "addr", ipaddr, "err", releaseErr)
+		}
+
 		return "", fmt.Errorf("error allocating name: %w", err)
 	}
 
@@ -45,14 +244,44 @@ func (n *NetworkAllocator) ReleaseIP(ipAddress string) error {
 	n.Lock()
 	defer n.Unlock()
 
+	return n.unSyncReleaseIP(ipAddress)
+}
+
+// ReleaseAll releases every allocated address, adopted ones included, removing their names.
+func (n *NetworkAllocator) ReleaseAll() error {
+	n.Lock()
+	defer n.Unlock()
+
+	clear(n.adopted)
+
+	for _, allocator := range []*ipallocator.IPAllocator{n.ipAllocator, n.ipAllocator6} {
+		if allocator == nil {
+			continue
+		}
+
+		for _, addr := range allocator.Allocated() {
+			if err := n.unSyncReleaseIP(addr); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (n *NetworkAllocator) unSyncReleaseIP(ipAddress string) error {
 	slog.Debug("releasing ipAddress address", "ipAddress", ipAddress)
 
-	err := n.dnsAllocator.RemoveByComment("ip: "+ipAddress, "")
-	if err != nil {
-		return fmt.Errorf("error removing dns entry: %w", err)
+	n.delNames(ipAddress)
+
+	if n.hostsFile {
+		err := n.dnsAllocator.RemoveByComment("ip: "+ipAddress, "")
+		if err != nil {
+			return fmt.Errorf("error removing dns entry: %w", err)
+		}
 	}
 
-	err = n.ipAllocator.Release(ipAddress)
+	err := n.allocatorFor(ipAddress).Release(ipAddress)
 	if err != nil {
 		return fmt.Errorf("error releasing ipAddress address: %w", err)
 	}
@@ -60,29 +289,111 @@ func (n *NetworkAllocator) ReleaseIP(ipAddress string) error {
 	return nil
 }
 
+// CleanUp removes aliases and hosts entries left behind (but the ones named exception), releasing adopted addresses
+// nobody claimed.
 func (n *NetworkAllocator) CleanUp(exception string) error {
+	n.Lock()
+	n.unSyncReleaseUnclaimed()
+	n.Unlock()
+
+	n.ipAllocator.CleanUp()
+
+	if n.ipAllocator6 != nil {
+		n.ipAllocator6.CleanUp()
+	}
+
+	if !n.hostsFile {
+		return nil
+	}
+
 	if err := n.dnsAllocator.CleanUp(exception); err != nil {
 		return fmt.Errorf("error cleanning up dns: %w", err)
 	}
 
-	n.ipAllocator.CleanUp()
-
 	return nil
 }
 
+// DNSEntries lists the hosts file entries or, when not using it, the names allocated by us.
 func (n *NetworkAllocator) DNSEntries() []dnsallocator.DNSEntry {
-	return n.dnsAllocator.Entries()
+	if n.hostsFile {
+		return n.dnsAllocator.Entries()
+	}
+
+	n.namesMx.RLock()
+	defer n.namesMx.RUnlock()
+
+	byAddr := map[string]*dnsallocator.DNSEntry{}
+	ret := make([]dnsallocator.DNSEntry, 0)
+
+	for name, addrs := range n.names {
+		for _, addr := range addrs {
+			if byAddr[addr] == nil {
+				byAddr[addr] = &dnsallocator.DNSEntry{Addr: addr, Comment: "src: netmux ip: " + addr}
+			}
+
+			byAddr[addr].Names = append(byAddr[addr].Names, name)
+		}
+	}
+
+	for _, entry := range byAddr {
+		slices.Sort(entry.Names)
+		ret = append(ret, *entry)
+	}
+
+	slices.SortFunc(ret, func(a, b dnsallocator.DNSEntry) int {
+		return strings.Compare(a.Addr, b.Addr)
+	})
+
+	return ret
 }
 
-func New(iface string, cidr string) (*NetworkAllocator, error) {
-	slog.Debug("Creating NWAllocator", "iface", iface, "cidr", cidr)
-	myIpallocator, err := ipallocator.New(iface, cidr)
+func New(iface string, cidr string, opts ...Opts) (*NetworkAllocator, error) {
+	ret := &NetworkAllocator{
+		dnsAllocator: dnsallocator.New(),
+		hostsFile:    true,
+		names:        map[string][]string{},
+		mode:         ModeAlias,
+		adopted:      map[string]string{},
+	}
+
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	slog.Debug("Creating NWAllocator", "iface", iface, "cidr", cidr, "mode", ret.mode)
+
+	if err := checkMode(ret.mode, cidr); err != nil {
+		return nil, err
+	}
+
+	// 127.0.0.0/8 overlaps lo by design.
+	if ret.mode != ModeLoopback {
+		var err error
+
+		if cidr, err = ret.selectNetwork(iface, cidr); err != nil {
+			return nil, err
+		}
+	}
+
+	ret.network = cidr
+
+	myIpallocator, err := ipallocator.New(iface, cidr,
+		ipallocator.WithAliases(ret.mode == ModeAlias),
+		ipallocator.WithLeaseFile(ret.leaseFile))
 	if err != nil {
 		return nil, err
 	}
 
-	ret := &NetworkAllocator{
-		ipAllocator: myIpallocator, dnsAllocator: dnsallocator.New(),
+	ret.ipAllocator = myIpallocator
+
+	if ret.cidr6 != "" {
+		if ret.ipAllocator6, err = ret.newIPv6Allocator(iface); err != nil {
+			return nil, err
+		}
+	}
+
+	if !ret.hostsFile {
+		return ret, nil
 	}
 
 	err = ret.dnsAllocator.Load()
@@ -92,3 +403,53 @@ func New(iface string, cidr string) (*NetworkAllocator, error) {
 
 	return ret, nil
 }
+
+func (n *NetworkAllocator) newIPv6Allocator(iface string) (*ipallocator.IPAllocator, error) {
+	network6, err := netip.ParsePrefix(n.cidr6)
+	if err != nil || !network6.Addr().Is6() || network6.Addr().Is4In6() {
+		return nil, fmt.Errorf("invalid ipv6 network: %s", n.cidr6)
+	}
+
+	n.network6 = network6.Masked()
+
+	if n.mode == ModeLoopback {
+		return nil, fmt.Errorf("%w: ipv6 has no loopback network to use", ErrInvalidMode)
+	}
+
+	leaseFile := n.leaseFile
+	if leaseFile != "" {
+		ext := filepath.Ext(leaseFile)
+		leaseFile = strings.TrimSuffix(leaseFile, ext) + "-v6" + ext
+	}
+
+	allocator, err := ipallocator.New(iface, n.network6.String(), ipallocator.WithLeaseFile(leaseFile))
+	if err != nil {
+		return nil, fmt.Errorf("error creating ipv6 allocator: %w", err)
+	}
+
+	return allocator, nil
+}
+
+func checkMode(mode string, cidr string) error {
+	switch mode {
+	case ModeAlias:
+		return nil
+	case ModeLoopback:
+		if !loopbackRouted {
+			return ErrLoopbackNotSupported
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("error parsing network %s: %w", cidr, err)
+		}
+
+		if !loopbackNetwork.Contains(prefix.Addr()) || prefix.Bits() < loopbackNetwork.Bits() {
+			return fmt.Errorf("%w: %s", ErrNotLoopback, cidr)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidMode, mode)
+	}
+}
@@ -0,0 +1,4 @@
+package networkallocator
+
+// loopbackRouted tells if the whole 127.0.0.0/8 reaches lo with no alias.
+const loopbackRouted = true
@@ -0,0 +1,292 @@
+package networkallocator_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/duxthemux/netmux/business/networkallocator"
+	"github.com/duxthemux/netmux/business/shell"
+)
+
+// TestLoopbackMode needs no privileges: addresses are not added to any interface.
+func TestLoopbackMode(t *testing.T) {
+	allocator, err := networkallocator.New("lo", "127.10.10.0/29",
+		networkallocator.WithMode(networkallocator.ModeLoopback),
+		networkallocator.WithHostsFile(false))
+	require.NoError(t, err)
+
+	require.NoError(t, allocator.CleanUp(""))
+
+	first, err := allocator.GetIP("svc-a", "svc-a.ns")
+	require.NoError(t, err)
+
+	second, err := allocator.GetIP("svc-b")
+	require.NoError(t, err)
+
+	assert.NotEqual(t, first, second)
+
+	addrs, ok := allocator.LookupName("SVC-A.ns")
+	assert.True(t, ok)
+	assert.Equal(t, []string{first}, addrs)
+
+	// the address is usable right away.
+	listener, err := net.Listen("tcp", net.JoinHostPort(first, "0"))
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+
+	_ = conn.Close()
+	_ = listener.Close()
+
+	require.NoError(t, allocator.ReleaseIP(first))
+
+	_, ok = allocator.LookupName("svc-a")
+	assert.False(t, ok)
+
+	// svc-a gets its address back.
+	again, err := allocator.GetIP("svc-a")
+	require.NoError(t, err)
+	assert.Equal(t, first, again)
+}
+
+// TestHostsFileUnwritable needs no privileges either: the hosts file is a temporary one.
+func TestHostsFileUnwritable(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "etc")
+	require.NoError(t, os.Mkdir(dir, 0o755))
+
+	allocator, err := networkallocator.New("lo", "127.10.10.0/29",
+		networkallocator.WithMode(networkallocator.ModeLoopback),
+		networkallocator.WithHostsFileName(filepath.Join(dir, "hosts")))
+	require.NoError(t, err)
+
+	// the hosts file can not be written (its directory is gone, as root ignores permissions): addresses are not
+	// kept by allocations failing to publish their names.
+	require.NoError(t, os.RemoveAll(dir))
+
+	for i := 0; i < 16; i++ {
+		_, err = allocator.GetIP(fmt.Sprintf("svc-%d", i))
+		require.Error(t, err)
+	}
+
+	_, ok := allocator.LookupName("svc-0")
+	assert.False(t, ok)
+
+	// once writable again, the whole network is there to allocate from.
+	require.NoError(t, os.Mkdir(dir, 0o755))
+
+	for i := 0; i < 6; i++ {
+		_, err = allocator.GetIP(fmt.Sprintf("svc-%d", i))
+		require.NoError(t, err)
+	}
+}
+
+func TestLoopbackModeRejectsOtherNetworks(t *testing.T) {
+	_, err := networkallocator.New("lo", "10.10.10.0/24",
+		networkallocator.WithMode(networkallocator.ModeLoopback),
+		networkallocator.WithHostsFile(false))
+	assert.ErrorIs(t, err, networkallocator.ErrNotLoopback)
+
+	_, err = networkallocator.New("lo", "127.10.10.0/24",
+		networkallocator.WithMode("magic"),
+		networkallocator.WithHostsFile(false))
+	assert.ErrorIs(t, err, networkallocator.ErrInvalidMode)
+}
+
+// inNetns moves the test to a network namespace of its own, so aliases don't leak into the host. The (locked) thread
+// is discarded when the test ends.
+func inNetns(t *testing.T) {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	runtime.LockOSThread()
+	require.NoError(t, unix.Unshare(unix.CLONE_NEWNET))
+
+	lo, err := netlink.LinkByName("lo")
+	require.NoError(t, err)
+	require.NoError(t, netlink.LinkSetUp(lo))
+}
+
+//nolint:paralleltest
+func TestDualStack(t *testing.T) {
+	inNetns(t)
+
+	allocator, err := networkallocator.New("lo", "10.10.10.0/29",
+		networkallocator.WithIPv6Network("fd6e:786d:7578::/125"),
+		networkallocator.WithHostsFile(false))
+	require.NoError(t, err)
+	require.True(t, allocator.HasIPv6())
+
+	addr4, err := allocator.GetIP("svc", "svc.ns")
+	require.NoError(t, err)
+
+	addr6, err := allocator.GetIPv6("svc", "svc.ns")
+	require.NoError(t, err)
+	assert.Contains(t, addr6, ":")
+
+	addrs, ok := allocator.LookupName("svc.ns")
+	assert.True(t, ok)
+	assert.ElementsMatch(t, []string{addr4, addr6}, addrs)
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(addr6, "0"))
+	require.NoError(t, err)
+	_ = listener.Close()
+
+	require.NoError(t, allocator.ReleaseIP(addr6))
+
+	addrs, ok = allocator.LookupName("svc")
+	assert.True(t, ok)
+	assert.Equal(t, []string{addr4}, addrs)
+
+	require.NoError(t, allocator.ReleaseIP(addr4))
+
+	_, ok = allocator.LookupName("svc")
+	assert.False(t, ok)
+
+	require.NoError(t, allocator.CleanUp(""))
+}
+
+func TestIPv6NotInLoopbackMode(t *testing.T) {
+	_, err := networkallocator.New("lo", "127.10.10.0/29",
+		networkallocator.WithMode(networkallocator.ModeLoopback),
+		networkallocator.WithIPv6Network("fd6e:786d:7578::/125"),
+		networkallocator.WithHostsFile(false))
+	assert.ErrorIs(t, err, networkallocator.ErrInvalidMode)
+
+	allocator, err := networkallocator.New("lo", "127.10.10.0/29",
+		networkallocator.WithMode(networkallocator.ModeLoopback),
+		networkallocator.WithHostsFile(false))
+	require.NoError(t, err)
+
+	assert.False(t, allocator.HasIPv6())
+
+	_, err = allocator.GetIPv6("svc")
+	assert.ErrorIs(t, err, networkallocator.ErrNoIPv6)
+}
+
+//nolint:paralleltest
+func TestReconcile(t *testing.T) {
+	inNetns(t)
+
+	leaseFile := filepath.Join(t.TempDir(), "leases.json")
+
+	newAllocator := func() *networkallocator.NetworkAllocator {
+		allocator, err := networkallocator.New("lo", "10.10.10.0/29",
+			networkallocator.WithLeaseFile(leaseFile),
+			networkallocator.WithHostsFile(false))
+		require.NoError(t, err)
+
+		return allocator
+	}
+
+	// a run that never released its addresses.
+	crashed := newAllocator()
+
+	addr, err := crashed.GetIP("svc", "svc.ns")
+	require.NoError(t, err)
+
+	// the next one takes the address back, by its lease.
+	allocator := newAllocator()
+
+	reconciliation, err := allocator.Reconcile(true)
+	require.NoError(t, err)
+	require.Len(t, reconciliation.Adopted, 1)
+	assert.Equal(t, addr, reconciliation.Adopted[0].Addr)
+	assert.Empty(t, reconciliation.Removed)
+
+	addrs, ok := allocator.LookupName("svc")
+	assert.True(t, ok)
+	assert.Equal(t, []string{addr}, addrs)
+
+	// and hands it to the same names, with the alias still there.
+	again, err := allocator.GetIP("svc", "svc.ns")
+	require.NoError(t, err)
+	assert.Equal(t, addr, again)
+
+	aliases, err := shell.Aliases("lo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{addr}, aliases)
+
+	// another crash, and a run that cleans up instead.
+	allocator = newAllocator()
+
+	reconciliation, err = allocator.Reconcile(false)
+	require.NoError(t, err)
+	assert.Empty(t, reconciliation.Adopted)
+	assert.Equal(t, []string{addr}, reconciliation.Removed)
+
+	aliases, err = shell.Aliases("lo")
+	require.NoError(t, err)
+	assert.Empty(t, aliases)
+
+	// released addresses are not left over.
+	_, err = allocator.GetIP("other")
+	require.NoError(t, err)
+	require.NoError(t, allocator.ReleaseAll())
+
+	_, ok = allocator.LookupName("other")
+	assert.False(t, ok)
+
+	reconciliation, err = newAllocator().Reconcile(true)
+	require.NoError(t, err)
+	assert.Empty(t, reconciliation.Adopted)
+	assert.Empty(t, reconciliation.Removed)
+}
+
+//nolint:paralleltest
+func TestNetworkConflicts(t *testing.T) {
+	inNetns(t)
+
+	// a docker like network, and a vpn like route - on lo, as other links can't be created everywhere.
+	lo, err := netlink.LinkByName("lo")
+	require.NoError(t, err)
+
+	addr, err := netlink.ParseAddr("10.10.0.1/16")
+	require.NoError(t, err)
+	require.NoError(t, netlink.AddrAdd(lo, addr))
+
+	_, vpn, err := net.ParseCIDR("10.20.0.0/16")
+	require.NoError(t, err)
+	require.NoError(t, netlink.RouteAdd(&netlink.Route{LinkIndex: lo.Attrs().Index, Dst: vpn}))
+
+	_, err = networkallocator.New("lo", "10.10.10.0/24", networkallocator.WithHostsFile(false))
+	require.ErrorIs(t, err, networkallocator.ErrNetworkConflict)
+	assert.Contains(t, err.Error(), "10.10.0.0/16")
+
+	allocator, err := networkallocator.New("lo", "10.10.10.0/24",
+		networkallocator.WithCandidates("10.20.1.0/24", "10.30.1.0/24"),
+		networkallocator.WithHostsFile(false))
+	require.NoError(t, err)
+
+	assert.Equal(t, "10.30.1.0/24", allocator.Network())
+	assert.Equal(t, []networkallocator.Conflict{
+		{Network: "10.10.10.0/24", With: "10.10.0.0/16", Source: "address of lo"},
+		{Network: "10.20.1.0/24", With: "10.20.0.0/16", Source: "route via lo"},
+	}, allocator.Conflicts())
+
+	// our own aliases are not conflicts.
+	addr4, err := allocator.GetIP("svc")
+	require.NoError(t, err)
+
+	allocator, err = networkallocator.New("lo", "10.30.1.0/24", networkallocator.WithHostsFile(false))
+	require.NoError(t, err)
+	assert.Empty(t, allocator.Conflicts())
+
+	require.NoError(t, allocator.CleanUp(""))
+
+	aliases, err := shell.Aliases("lo")
+	require.NoError(t, err)
+	assert.NotContains(t, aliases, addr4)
+}
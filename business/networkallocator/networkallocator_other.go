@@ -0,0 +1,6 @@
+//go:build !linux
+
+package networkallocator
+
+// loopbackRouted tells if the whole 127.0.0.0/8 reaches lo with no alias.
+const loopbackRouted = false
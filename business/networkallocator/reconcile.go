@@ -0,0 +1,222 @@
+package networkallocator
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+
+	"github.com/duxthemux/netmux/business/networkallocator/dnsallocator"
+	"github.com/duxthemux/netmux/business/networkallocator/ipallocator"
+)
+
+const hostsComment = "src: netmux"
+
+// Reconciliation tells what was found, left behind by a previous run, when the allocator was reconciled.
+type Reconciliation struct {
+	// Adopted addresses, with their names, are handed back to the first of their names by GetIP and GetIPv6.
+	Adopted []dnsallocator.DNSEntry `json:"adopted"`
+	// Removed addresses had their alias or hosts entries removed.
+	Removed []string `json:"removed"`
+}
+
+// Reconcile looks for aliases and hosts entries left behind by a previous run that did not end cleanly. If adopt is
+// true, the ones still usable - an alias with names, from the hosts file or a lease - are booked as allocated, and
+// given back when their names ask for an address again. Everything else is removed.
+//
+// It is meant to be called once, before any address is allocated.
+func (n *NetworkAllocator) Reconcile(adopt bool) (Reconciliation, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	ret := Reconciliation{Adopted: []dnsallocator.DNSEntry{}, Removed: []string{}}
+
+	leftovers, err := n.leftovers()
+	if err != nil {
+		return ret, err
+	}
+
+	entries := dnsallocator.DNSEntries{}
+
+	if n.hostsFile {
+		if err = n.dnsAllocator.Load(); err != nil {
+			return ret, fmt.Errorf("error loading dns entries: %w", err)
+		}
+
+		for _, entry := range n.dnsAllocator.Entries() {
+			if entry.CommentMatches(hostsComment) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	for _, addr := range leftovers {
+		if !adopt || !n.adopt(addr, entries, &ret) {
+			if err = n.allocatorFor(addr).RemoveLeftover(addr); err != nil {
+				return ret, fmt.Errorf("error removing leftover alias: %w", err)
+			}
+
+			ret.Removed = append(ret.Removed, addr)
+		}
+	}
+
+	removed := map[string]bool{}
+
+	for _, entry := range entries {
+		if removed[entry.Addr] || n.isAdopted(entry.Addr) {
+			continue
+		}
+
+		// without aliases, addresses need nothing but their names to be usable again.
+		if adopt && n.mode == ModeLoopback && n.adopt(entry.Addr, entries, &ret) {
+			continue
+		}
+
+		removed[entry.Addr] = true
+
+		if err = n.dnsAllocator.RemoveByComment("ip: "+entry.Addr, ""); err != nil {
+			return ret, fmt.Errorf("error removing dns entry: %w", err)
+		}
+
+		ret.Removed = append(ret.Removed, entry.Addr)
+	}
+
+	if len(ret.Adopted) > 0 || len(ret.Removed) > 0 {
+		slog.Info("reconciled leftovers of a previous run", "adopted", len(ret.Adopted), "removed", len(ret.Removed))
+	}
+
+	return ret, nil
+}
+
+// leftovers lists the leftover aliases of both networks.
+func (n *NetworkAllocator) leftovers() ([]string, error) {
+	ret, err := n.ipAllocator.Leftovers()
+	if err != nil {
+		return nil, fmt.Errorf("error finding leftover aliases: %w", err)
+	}
+
+	if n.ipAllocator6 != nil {
+		leftovers6, err := n.ipAllocator6.Leftovers()
+		if err != nil {
+			return nil, fmt.Errorf("error finding leftover ipv6 aliases: %w", err)
+		}
+
+		ret = append(ret, leftovers6...)
+	}
+
+	return ret, nil
+}
+
+// adopt books addr as allocated, if names for it are known, telling if it was adopted.
+func (n *NetworkAllocator) adopt(addr string, entries dnsallocator.DNSEntries, reconciliation *Reconciliation) bool {
+	if n.isAdopted(addr) {
+		return true
+	}
+
+	allocator := n.allocatorFor(addr)
+
+	names := make([]string, 0)
+
+	for _, entry := range entries {
+		if entry.Addr == addr {
+			names = append(names, entry.Names...)
+		}
+	}
+
+	hasEntry := len(names) > 0
+
+	if !hasEntry {
+		if name := allocator.LeaseName(addr); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return false
+	}
+
+	if err := allocator.Adopt(addr, names[0]); err != nil {
+		slog.Debug("could not adopt address", "addr", addr, "err", err)
+
+		return false
+	}
+
+	if n.hostsFile && !hasEntry {
+		if err := n.dnsAllocator.Add(addr, names, "name: "+strings.Join(names, ",")+" ip: "+addr); err != nil {
+			slog.Warn("error adding dns entry of adopted address", "addr", addr, "err", err)
+		}
+	}
+
+	n.setNames(addr, names)
+	n.adopted[strings.ToLower(names[0])] = addr
+
+	reconciliation.Adopted = append(reconciliation.Adopted, dnsallocator.DNSEntry{
+		Addr:    addr,
+		Names:   names,
+		Comment: hostsComment + " ip: " + addr,
+	})
+
+	return true
+}
+
+func (n *NetworkAllocator) isAdopted(addr string) bool {
+	for _, adopted := range n.adopted {
+		if adopted == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unSyncClaim hands the address adopted for names, if any, back to them.
+func (n *NetworkAllocator) unSyncClaim(allocator *ipallocator.IPAllocator, names []string) (string, bool) {
+	if len(names) == 0 {
+		return "", false
+	}
+
+	key := strings.ToLower(names[0])
+
+	addr, ok := n.adopted[key]
+	if !ok || n.allocatorFor(addr) != allocator {
+		return "", false
+	}
+
+	delete(n.adopted, key)
+
+	n.delNames(addr)
+	n.setNames(addr, names)
+
+	if n.hostsFile {
+		if err := n.dnsAllocator.RemoveByComment("ip: "+addr, ""); err != nil {
+			slog.Warn("error removing dns entry of adopted address", "addr", addr, "err", err)
+		}
+
+		if err := n.dnsAllocator.Add(addr, names, "name: "+strings.Join(names, ",")+" ip: "+addr); err != nil {
+			slog.Warn("error adding dns entry of adopted address", "addr", addr, "err", err)
+		}
+	}
+
+	return addr, true
+}
+
+// unSyncReleaseUnclaimed releases adopted addresses nobody asked for.
+func (n *NetworkAllocator) unSyncReleaseUnclaimed() {
+	for name, addr := range n.adopted {
+		delete(n.adopted, name)
+
+		if err := n.unSyncReleaseIP(addr); err != nil {
+			slog.Warn("error releasing adopted address", "addr", addr, "err", err)
+		}
+	}
+}
+
+// allocatorFor returns the allocator of the network addr belongs to.
+func (n *NetworkAllocator) allocatorFor(addr string) *ipallocator.IPAllocator {
+	ipAddr, err := netip.ParseAddr(addr)
+	if err == nil && n.ipAllocator6 != nil && n.network6.Contains(ipAddr) {
+		return n.ipAllocator6
+	}
+
+	return n.ipAllocator
+}
@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,10 +36,17 @@ type KubernetesInfo struct {
 	Port      string `json:"port,omitempty"      yaml:"port,omitempty"`
 	Kubectl   string `json:"kubectl"             yaml:"kubectl"`
 	User      string `json:"user"                yaml:"user"`
+	// Selector finds the nx-server pods by label, instead of through the Endpoint service.
+	Selector string `json:"selector,omitempty" yaml:"selector,omitempty"`
+	// Replicas is how many ready pods to keep port forwards to, 1 by default. Not available through kubectl.
+	Replicas int `json:"replicas,omitempty" yaml:"replicas,omitempty"`
+	// Transport of the port forward through the api: websocket, spdy or auto (default) - websockets, falling back to
+	// spdy when refused.
+	Transport string `json:"transport,omitempty" yaml:"transport,omitempty"`
 }
 
 func (k KubernetesInfo) IsZeroValue() bool {
-	return k.Config == "" || k.Namespace == "" || k.Context == "" || k.Endpoint == ""
+	return k.Config == "" || k.Namespace == "" || k.Context == "" || (k.Endpoint == "" && k.Selector == "")
 }
 
 type portForwardAPodRequest struct {
@@ -58,10 +66,125 @@ type portForwardAPodRequest struct {
 	ReadyCh chan struct{}
 }
 
+// ForwardFunc forwards localPort to podPort of pod, closing ready once it listens. It returns when stop is closed or
+// the connection to the pod is lost.
+type ForwardFunc func(ctx context.Context, pod corev1.Pod, localPort int, podPort int, ready chan struct{},
+	stop <-chan struct{}) error
+
 type PortForwarder struct {
 	portAllocationMx sync.Mutex
-	stopCh           chan struct{}
-	Port             int
+	mx               sync.Mutex
+	// Port is the local port of the primary port forward - the first one. As it changes when the port forward is
+	// established again, read it with LocalPort.
+	Port        int
+	forwardings []*forwarding
+	// lost receives the port forwards that ended without being stopped.
+	lost chan *forwarding
+	// OnError, when set, is notified about errors happening after the port forward was started.
+	OnError func(err error)
+	// OnReconnect, when set, is notified when the primary port forward changed - after its pod went away or the
+	// forward was lost - with the new local port.
+	OnReconnect func(port int)
+	clientset   kubernetes.Interface
+	restConfig  *rest.Config
+	forward     ForwardFunc
+	// transport is the one the port forward through the api uses, auto until decided.
+	transport string
+}
+
+type Opts func(p *PortForwarder)
+
+// WithClientset sets the kubernetes client used to find (and follow) the pod to forward to, instead of one created
+// from the kubeconfig.
+func WithClientset(clientset kubernetes.Interface) Opts {
+	return func(p *PortForwarder) {
+		p.clientset = clientset
+	}
+}
+
+// WithRestConfig sets the config to reach the kubernetes api with, instead of the one in the kubeconfig.
+func WithRestConfig(config *rest.Config) Opts {
+	return func(p *PortForwarder) {
+		p.restConfig = config
+	}
+}
+
+// WithForwardFunc replaces the port forward through the kubernetes api.
+func WithForwardFunc(forward ForwardFunc) Opts {
+	return func(p *PortForwarder) {
+		p.forward = forward
+	}
+}
+
+// LocalPort returns the local port being forwarded.
+func (p *PortForwarder) LocalPort() int {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	return p.Port
+}
+
+// LocalPorts returns the local ports of all port forwards, the primary one first.
+func (p *PortForwarder) LocalPorts() []int {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	ret := make([]int, 0, len(p.forwardings))
+
+	for _, fwd := range p.forwardings {
+		ret = append(ret, fwd.port)
+	}
+
+	return ret
+}
+
+// Pods returns the names of the pods being forwarded to, the primary one first. They are not known through kubectl.
+func (p *PortForwarder) Pods() []string {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	ret := make([]string, 0, len(p.forwardings))
+
+	for _, fwd := range p.forwardings {
+		if fwd.pod.Name != "" {
+			ret = append(ret, fwd.pod.Name)
+		}
+	}
+
+	return ret
+}
+
+// setForwardings replaces the current port forwards, telling if the primary one changed.
+func (p *PortForwarder) setForwardings(forwardings []*forwarding) bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	var before, after *forwarding
+
+	if len(p.forwardings) > 0 {
+		before = p.forwardings[0]
+	}
+
+	if len(forwardings) > 0 {
+		after = forwardings[0]
+	}
+
+	p.forwardings = forwardings
+	p.Port = 0
+
+	if after != nil {
+		p.Port = after.port
+	}
+
+	return before != after
+}
+
+func (p *PortForwarder) notifyError(err error) {
+	slog.Warn("error while port forwarding", "err", err)
+
+	if p.OnError != nil {
+		p.OnError(err)
+	}
 }
 
 func (p *PortForwarder) findAvailableLocalPort() (int, error) {
@@ -106,7 +229,14 @@ func resolveClientConfig(configFile string, context string) (*rest.Config, error
 
 const PFWaitTimeout = time.Second * 5
 
-//nolint:funlen
+var (
+	ErrNoReadyPod  = fmt.Errorf("no ready pod")
+	ErrForwardLost = fmt.Errorf("port forward lost")
+	ErrNeedsApi    = fmt.Errorf("selector and replicas need the port forward through the api, not kubectl")
+)
+
+// Start establishes the port forward, and keeps it up until ctx is done: when the pod it points at goes away or the
+// forward is lost, it is established again on a new local port, and OnReconnect is called.
 func (p *PortForwarder) Start(ctx context.Context, kinfo KubernetesInfo) error {
 	switch {
 	case kinfo.User != "":
@@ -118,48 +248,165 @@ func (p *PortForwarder) Start(ctx context.Context, kinfo KubernetesInfo) error {
 	}
 }
 
-func checkPodOrService(ctx context.Context, req *portForwardAPodRequest) error {
-	if ctx.Err() != nil {
-		return fmt.Errorf("error checking pod: %w", ctx.Err())
+// target is what a port forward points at: the ready pods of a service, the ready pods with some labels, or a single
+// pod.
+type target struct {
+	namespace string
+	name      string
+	selector  string
+	isPod     bool
+	// replicas is how many pods to forward to.
+	replicas int
+}
+
+// parseTarget reads the endpoint as kubectl does: a service by default, or kind/name.
+func parseTarget(kinfo KubernetesInfo) target {
+	ret := target{namespace: kinfo.Namespace, name: kinfo.Endpoint, selector: kinfo.Selector, replicas: kinfo.Replicas}
+
+	if ret.replicas < 1 {
+		ret.replicas = 1
 	}
 
-	clientset, err := kubernetes.NewForConfig(req.RestConfig)
-	if err != nil {
-		return fmt.Errorf("error creating kubernetes client: %w", err)
+	if ret.selector != "" {
+		ret.name = ""
+
+		return ret
 	}
 
-	endpointsList, err := clientset.CoreV1().Endpoints(req.Pod.Namespace).List(
-		ctx, metav1.ListOptions{ //nolint:exhaustruct,exhaustivestruct
-			FieldSelector: "metadata.name=" + req.Pod.Name,
-		})
-	if err != nil {
-		return fmt.Errorf("unable to find service %s: %w", req.Pod.Name, err)
+	kind, name, found := strings.Cut(kinfo.Endpoint, "/")
+	if !found {
+		return ret
+	}
+
+	ret.name = name
+
+	switch strings.ToLower(kind) {
+	case "pod", "pods", "po":
+		ret.isPod = true
+		ret.replicas = 1
+	}
+
+	return ret
+}
+
+func (t target) String() string {
+	if t.selector != "" {
+		return t.selector
+	}
+
+	return t.name
+}
+
+// podReady tells if pod is ready to receive traffic.
+func podReady(pod corev1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.PodIP == "" {
+		return false
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// readyPods lists the pods to forward to, in a stable order: the target pod itself, the ready pods with the target
+// labels or the ones behind the target service.
+//
+//nolint:cyclop
+func readyPods(ctx context.Context, clientset kubernetes.Interface, tgt target) ([]corev1.Pod, error) {
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("error checking pod: %w", ctx.Err())
 	}
 
-	if len(endpointsList.Items) > 0 && len(endpointsList.Items[0].Subsets) > 0 && len(endpointsList.Items[0].Subsets[0].Addresses) > 0 {
-		ipadddr := endpointsList.Items[0].Subsets[0].Addresses[0].IP
+	ret := make([]corev1.Pod, 0)
+
+	switch {
+	case tgt.isPod:
+		pod, err := clientset.CoreV1().Pods(tgt.namespace).Get(ctx, tgt.name, metav1.GetOptions{}) //nolint:exhaustruct
+		if err != nil {
+			return nil, fmt.Errorf("unable to find pod %s: %w", tgt.name, err)
+		}
 
-		pods, err := clientset.CoreV1().Pods(req.Pod.Namespace).List(
+		if pod.DeletionTimestamp == nil {
+			ret = append(ret, *pod)
+		}
+	case tgt.selector != "":
+		pods, err := clientset.CoreV1().Pods(tgt.namespace).List(
 			ctx, metav1.ListOptions{ //nolint:exhaustruct,exhaustivestruct
-				FieldSelector: "status.podIP=" + ipadddr,
+				LabelSelector: tgt.selector,
 			})
 		if err != nil {
-			return fmt.Errorf( //nolint:goerr113
-				"unable to find pod for service %s: %s",
-				req.Pod.Name, err.Error())
+			return nil, fmt.Errorf("unable to list pods %s: %w", tgt.selector, err)
 		}
 
-		req.Pod.Name = pods.Items[0].Name
-		return nil
+		for _, pod := range pods.Items {
+			if podReady(pod) {
+				ret = append(ret, pod)
+			}
+		}
+
+		slices.SortFunc(ret, func(a, b corev1.Pod) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+	default:
+		endpoints, err := clientset.CoreV1().Endpoints(tgt.namespace).Get(ctx, tgt.name, metav1.GetOptions{}) //nolint:exhaustruct,lll
+		if err != nil {
+			return nil, fmt.Errorf("unable to find service %s: %w", tgt.name, err)
+		}
+
+		for _, subset := range endpoints.Subsets {
+			for _, addr := range subset.Addresses {
+				pod, err := podOf(ctx, clientset, tgt, addr)
+				if err != nil {
+					return nil, err
+				}
+
+				if pod != nil {
+					ret = append(ret, *pod)
+				}
+			}
+		}
+	}
+
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("%w: could not resolve ip for endpoint %s", ErrNoReadyPod, tgt)
+	}
+
+	return ret, nil
+}
+
+// podOf finds the pod behind an endpoints address. There is nothing to get when the address tells it.
+func podOf(ctx context.Context, clientset kubernetes.Interface, tgt target, addr corev1.EndpointAddress) (*corev1.Pod, error) { //nolint:lll
+	if addr.TargetRef != nil && addr.TargetRef.Kind == "Pod" {
+		return &corev1.Pod{ //nolint:exhaustruct
+			ObjectMeta: metav1.ObjectMeta{Name: addr.TargetRef.Name, Namespace: tgt.namespace, UID: addr.TargetRef.UID}, //nolint:exhaustruct,lll
+			Status:     corev1.PodStatus{PodIP: addr.IP},                                                                //nolint:exhaustruct
+		}, nil
+	}
+
+	pods, err := clientset.CoreV1().Pods(tgt.namespace).List(
+		ctx, metav1.ListOptions{ //nolint:exhaustruct,exhaustivestruct
+			FieldSelector: "status.podIP=" + addr.IP,
+		})
+	if err != nil {
+		return nil, fmt.Errorf("unable to find pod for service %s: %w", tgt.name, err)
+	}
+
+	for _, pod := range pods.Items {
+		pod := pod
+		if pod.Status.PodIP == addr.IP {
+			return &pod, nil
+		}
 	}
 
-	return fmt.Errorf("could not resolve ip for endpoint %s", req.Pod.Name)
+	return nil, nil //nolint:nilnil
 }
 
-// portForwardAPod wil effectively do the port forward but to a pod.
-// If the PF is expected to be closed w a service, please consider
-// PFStart, it will resolve a pod from service and "pretend" PF
-// is being oriented to a service.
+// portForwardAPod wil effectively do the port forward but to a pod. It returns once req.StopCh is closed or the
+// connection to the pod is lost.
 func portForwardAPod(ctx context.Context, req *portForwardAPodRequest) error {
 	if ctx.Err() != nil {
 		return fmt.Errorf("context closed when port forwarding: %w", ctx.Err())
@@ -196,19 +443,46 @@ func portForwardAPod(ctx context.Context, req *portForwardAPodRequest) error {
 		return fmt.Errorf("error forwarding ports: %w", err)
 	}
 
-	go func() {
-		<-ctx.Done()
-		portForwader.Close()
-	}()
-
 	return nil
 }
 
-func New() *PortForwarder {
-	return &PortForwarder{}
+func New(opts ...Opts) *PortForwarder {
+	ret := &PortForwarder{}
+
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	return ret
+}
+
+func dialLocalPort(port int) error {
+	con, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%v", port), time.Second)
+	if err != nil {
+		return fmt.Errorf("error dialing local port: %w", err)
+	}
+
+	_ = con.Close()
+
+	return nil
 }
 
 func (p *PortForwarder) startSudo(ctx context.Context, kinfo KubernetesInfo) error {
+	if kinfo.Selector != "" || kinfo.Replicas > 1 {
+		return ErrNeedsApi
+	}
+
+	fwd, err := p.establishSudo(ctx, kinfo)
+	if err != nil {
+		return err
+	}
+
+	go p.superviseSudo(ctx, kinfo, fwd)
+
+	return nil
+}
+
+func (p *PortForwarder) establishSudo(ctx context.Context, kinfo KubernetesInfo) (*forwarding, error) {
 	kubectlCmdTentative := "kubectl"
 	if kinfo.Kubectl != "" {
 		kubectlCmdTentative = kinfo.Kubectl
@@ -216,14 +490,13 @@ func (p *PortForwarder) startSudo(ctx context.Context, kinfo KubernetesInfo) err
 
 	kubectlCmd, err := exec.LookPath(kubectlCmdTentative)
 	if err != nil {
-		return fmt.Errorf("kubectl not found in path: %w", err)
+		return nil, fmt.Errorf("kubectl not found in path: %w", err)
 	}
 
 	port, err := p.findAvailableLocalPort()
 	if err != nil {
-		return fmt.Errorf("could not allocate port: %w", err)
+		return nil, fmt.Errorf("could not allocate port: %w", err)
 	}
-	p.Port = port
 
 	cmdLine := fmt.Sprintf("KUBECONFIG=%s %s port-forward  --context=%s --namespace=%s %s %v:%s\n",
 		kinfo.Config,
@@ -236,116 +509,194 @@ func (p *PortForwarder) startSudo(ctx context.Context, kinfo KubernetesInfo) err
 
 	slog.Debug("port forward as sudo cmdline", "cmdline", cmdLine)
 
+	cmdCtx, cancel := context.WithCancel(ctx)
+
 	sh := shell.New()
-	shellWriter, err := sh.CmdAs(ctx, kinfo.User)
+	shellWriter, err := sh.CmdAs(cmdCtx, kinfo.User)
 	if err != nil {
-		return fmt.Errorf("could not create user shell: %w", err)
+		cancel()
+
+		return nil, fmt.Errorf("could not create user shell: %w", err)
 	}
 
 	_, err = shellWriter.Write([]byte(cmdLine))
 	if err != nil {
-		return fmt.Errorf("error piping stdin: %w", err)
+		cancel()
+
+		return nil, fmt.Errorf("error piping stdin: %w", err)
 	}
 
 	bo := backoff.NewExponentialBackOff()
 	bo.MaxElapsedTime = time.Second * 15
 
 	if err := backoff.Retry(func() error {
-		con, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", port))
-		if err != nil {
-			return err
-		}
+		return dialLocalPort(port)
+	}, backoff.WithContext(bo, ctx)); err != nil {
+		cancel()
 
-		_ = con.Close()
-		return nil
-	}, bo); err != nil {
-		return fmt.Errorf("error confirming port is available: %w", err)
+		return nil, fmt.Errorf("error confirming port is available: %w", err)
 	}
 
-	return nil
+	fwd := &forwarding{port: port, stop: cancel, done: make(chan error)}
+
+	p.setForwardings([]*forwarding{fwd})
+
+	return fwd, nil
 }
 
 func (p *PortForwarder) startApi(ctx context.Context, kinfo KubernetesInfo) error {
-	stopCh := make(chan struct{}, 1)
-	p.stopCh = stopCh
-
-	// use the current context in kubeconfig
-	config, err := resolveClientConfig(kinfo.Config, kinfo.Context)
+	podPort, err := strconv.Atoi(kinfo.Port)
 	if err != nil {
-		return fmt.Errorf("error resolving client userconfig: %w", err)
+		return fmt.Errorf("error converting port to int: %w", err)
+	}
+
+	if err = p.setupApi(kinfo); err != nil {
+		return err
+	}
+
+	tgt := parseTarget(kinfo)
+
+	p.lost = make(chan *forwarding)
+
+	if _, err = p.reconcile(ctx, tgt, podPort); err != nil {
+		p.stopAll()
+
+		return fmt.Errorf("error port forwarding: %w", err)
 	}
 
-	lport, err := p.findAvailableLocalPort()
+	slog.Info("Port forwarding is ready to get traffic. have fun!")
+
+	go p.superviseApi(ctx, tgt, podPort)
+
+	return nil
+}
+
+// setupApi creates the kubernetes client and port forward function not given as options.
+func (p *PortForwarder) setupApi(kinfo KubernetesInfo) error {
+	if p.clientset != nil && p.forward != nil {
+		return nil
+	}
+
+	config := p.restConfig
+	if config == nil {
+		// use the current context in kubeconfig
+		var err error
+
+		config, err = resolveClientConfig(kinfo.Config, kinfo.Context)
+		if err != nil {
+			return fmt.Errorf("error resolving client userconfig: %w", err)
+		}
+	}
+
+	if p.clientset == nil {
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return fmt.Errorf("error creating kubernetes client: %w", err)
+		}
+
+		p.clientset = clientset
+	}
+
+	if p.forward != nil {
+		return nil
+	}
+
+	transport, err := parseTransport(kinfo.Transport)
 	if err != nil {
-		return fmt.Errorf("error finding available local port: %w", err)
+		return err
 	}
 
-	rport, err := strconv.Atoi(kinfo.Port)
+	p.transport = transport
+
+	dialer, err := newWebSocketDialer(config)
 	if err != nil {
-		return fmt.Errorf("error converting port to int: %w", err)
+		return err
 	}
 
-	pfreq := &portForwardAPodRequest{
-		RestConfig: config,
-		Pod: corev1.Pod{
-			TypeMeta: metav1.TypeMeta{},
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      kinfo.Endpoint,
-				Namespace: kinfo.Namespace,
+	p.forward = func(ctx context.Context, pod corev1.Pod, localPort int, podPort int, ready chan struct{},
+		stop <-chan struct{},
+	) error {
+		if p.transportFor(ctx, dialer, pod, podPort) == TransportWebSocket {
+			return webSocketForward(ctx, dialer, pod, localPort, podPort, ready, stop)
+		}
+
+		return portForwardAPod(ctx, &portForwardAPodRequest{
+			RestConfig: config,
+			Pod:        pod,
+			LocalPort:  localPort,
+			PodPort:    podPort,
+			// stream is used to tell the port forwarder where to place its output or
+			// where to expect input if needed. For the port forwarding we just need
+			// the output eventually
+			Streams: genericclioptions.IOStreams{
+				In:     os.Stdin,
+				Out:    os.Stdout,
+				ErrOut: os.Stderr,
 			},
-		},
-		LocalPort: lport,
-		PodPort:   rport,
-		Streams:   genericclioptions.IOStreams{},
-		StopCh:    nil,
-		ReadyCh:   nil,
+			StopCh:  stop,
+			ReadyCh: ready,
+		})
 	}
 
-	pfreq.RestConfig = config
-
-	// stopCh control the port forwarding lifecycle. When it gets closed the
-	// port forward will terminate
+	return nil
+}
 
-	// readyCh communicate when the port forward is ready to get traffic
-	readyCh := make(chan struct{})
-	errCh := make(chan error)
-	// stream is used to tell the port forwarder where to place its output or
-	// where to expect input if needed. For the port forwarding we just need
-	// the output eventually
-	stream := genericclioptions.IOStreams{
-		In:     os.Stdin,
-		Out:    os.Stdout,
-		ErrOut: os.Stderr,
+// establishApi forwards a local port to pod. Once established, the forward is sent to lost if it ends without being
+// stopped.
+func (p *PortForwarder) establishApi(ctx context.Context, pod corev1.Pod, podPort int) (*forwarding, error) {
+	localPort, err := p.findAvailableLocalPort()
+	if err != nil {
+		return nil, fmt.Errorf("error finding available local port: %w", err)
 	}
 
-	pfreq.Streams = stream
-	pfreq.ReadyCh = readyCh
-	pfreq.StopCh = stopCh
-	err = checkPodOrService(ctx, pfreq)
+	// stop controls the port forwarding lifecycle: when it gets closed the port forward will terminate, while ready
+	// communicates when the port forward is ready to get traffic.
+	stop := make(chan struct{})
+	ready := make(chan struct{})
 
-	if err != nil {
-		return fmt.Errorf("error checking pod or service: %w", err)
+	fwd := &forwarding{
+		pod:  pod,
+		port: localPort,
+		done: make(chan error, 1),
 	}
 
+	fwd.stop = sync.OnceFunc(func() {
+		fwd.stopped.Store(true)
+		close(stop)
+	})
+
 	go func() {
-		err := portForwardAPod(ctx, pfreq)
-		if err != nil {
-			slog.Warn("error while port forwarding", "err", err)
-			errCh <- err
-		}
+		fwd.done <- p.forward(ctx, pod, localPort, podPort, ready, stop)
 	}()
 
 	select {
-	case err = <-errCh:
-		if err != nil {
-			return fmt.Errorf("error port forwarding: %w", err)
+	case err = <-fwd.done:
+		if err == nil {
+			err = ErrForwardLost
 		}
+
+		return nil, fmt.Errorf("error port forwarding to %s: %w", pod.Name, err)
+	case <-ctx.Done():
+		fwd.stop()
+
+		return nil, fmt.Errorf("error port forwarding to %s: %w", pod.Name, ctx.Err())
 	case <-time.After(PFWaitTimeout):
-	case <-readyCh:
+	case <-ready:
 	}
-	slog.Info("Port forwarding is ready to get traffic. have fun!")
 
-	p.Port = lport
+	go func() {
+		fwd.err = fwd.lost(<-fwd.done)
+		fwd.ended.Store(true)
 
-	return nil
+		if fwd.stopped.Load() {
+			return
+		}
+
+		select {
+		case p.lost <- fwd:
+		case <-ctx.Done():
+		}
+	}()
+
+	return fwd, nil
 }
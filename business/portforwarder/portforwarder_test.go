@@ -0,0 +1,210 @@
+package portforwarder_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/duxthemux/netmux/business/portforwarder"
+)
+
+const MaxWaitTime = time.Second * 5
+
+const namespace = "netmux"
+
+func pod(name string, ip string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, UID: types.UID(name)},
+		Status:     corev1.PodStatus{PodIP: ip},
+	}
+}
+
+func endpoints(pods ...*corev1.Pod) *corev1.Endpoints {
+	addrs := make([]corev1.EndpointAddress, 0, len(pods))
+
+	for _, pod := range pods {
+		addrs = append(addrs, corev1.EndpointAddress{
+			IP:        pod.Status.PodIP,
+			TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: pod.Name, Namespace: namespace},
+		})
+	}
+
+	return &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "netmux", Namespace: namespace},
+		Subsets:    []corev1.EndpointSubset{{Addresses: addrs}},
+	}
+}
+
+// FakeForward listens on the local port instead of forwarding it, telling which pod each forward went to. A forward
+// is lost once something is sent to lose.
+type FakeForward struct {
+	pods chan string
+	lose chan struct{}
+}
+
+func (f *FakeForward) Forward(_ context.Context, pod corev1.Pod, localPort int, _ int, ready chan struct{},
+	stop <-chan struct{},
+) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	f.pods <- pod.Name
+
+	close(ready)
+
+	select {
+	case <-stop:
+	case <-f.lose:
+	}
+
+	return nil
+}
+
+func expectPod(t *testing.T, fwd *FakeForward, name string) {
+	t.Helper()
+
+	select {
+	case got := <-fwd.pods:
+		assert.Equal(t, name, got)
+	case <-time.After(MaxWaitTime):
+		require.Fail(t, "no port forward to "+name)
+	}
+}
+
+func expectReconnect(t *testing.T, reconnects chan int, pf *portforwarder.PortForwarder) {
+	t.Helper()
+
+	select {
+	case port := <-reconnects:
+		assert.Equal(t, pf.LocalPort(), port)
+
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		require.NoError(t, err)
+
+		_ = conn.Close()
+	case <-time.After(MaxWaitTime):
+		require.Fail(t, "port forward was not established again")
+	}
+}
+
+//nolint:paralleltest
+func TestFollowsPods(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	podA, podB := pod("nx-server-a", "10.0.0.1"), pod("nx-server-b", "10.0.0.2")
+	clientset := fake.NewSimpleClientset(podA, podB, endpoints(podA))
+
+	fwd := &FakeForward{pods: make(chan string, 4), lose: make(chan struct{})}
+	reconnects := make(chan int, 4)
+
+	pf := portforwarder.New(portforwarder.WithClientset(clientset), portforwarder.WithForwardFunc(fwd.Forward))
+	pf.OnReconnect = func(port int) {
+		reconnects <- port
+	}
+
+	err := pf.Start(ctx, portforwarder.KubernetesInfo{Namespace: namespace, Endpoint: "service/netmux", Port: "50000"})
+	require.NoError(t, err)
+
+	expectPod(t, fwd, "nx-server-a")
+	assert.Equal(t, []string{"nx-server-a"}, pf.Pods())
+
+	// a rollout replaces the pod behind the service.
+	_, err = clientset.CoreV1().Endpoints(namespace).Update(ctx, endpoints(podB), metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	expectPod(t, fwd, "nx-server-b")
+	expectReconnect(t, reconnects, pf)
+	assert.Equal(t, []string{"nx-server-b"}, pf.Pods())
+
+	// the connection to the pod breaks.
+	fwd.lose <- struct{}{}
+
+	expectPod(t, fwd, "nx-server-b")
+	expectReconnect(t, reconnects, pf)
+}
+
+//nolint:paralleltest
+func TestNoReadyPod(t *testing.T) {
+	clientset := fake.NewSimpleClientset(endpoints())
+	fwd := &FakeForward{pods: make(chan string, 1), lose: make(chan struct{})}
+
+	pf := portforwarder.New(portforwarder.WithClientset(clientset), portforwarder.WithForwardFunc(fwd.Forward))
+
+	err := pf.Start(context.Background(),
+		portforwarder.KubernetesInfo{Namespace: namespace, Endpoint: "netmux", Port: "50000"})
+	require.ErrorIs(t, err, portforwarder.ErrNoReadyPod)
+}
+
+func readyPod(name string, ip string) *corev1.Pod {
+	ret := pod(name, ip)
+	ret.Labels = map[string]string{"app": "nx-server"}
+	ret.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+
+	return ret
+}
+
+//nolint:paralleltest
+func TestSelectorReplicas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unready := readyPod("nx-server-0", "10.0.0.10")
+	unready.Status.Conditions[0].Status = corev1.ConditionFalse
+
+	clientset := fake.NewSimpleClientset(unready,
+		readyPod("nx-server-a", "10.0.0.1"), readyPod("nx-server-b", "10.0.0.2"), readyPod("nx-server-c", "10.0.0.3"),
+		pod("other", "10.0.0.4"))
+
+	fwd := &FakeForward{pods: make(chan string, 8), lose: make(chan struct{})}
+	reconnects := make(chan int, 4)
+
+	pf := portforwarder.New(portforwarder.WithClientset(clientset), portforwarder.WithForwardFunc(fwd.Forward))
+	pf.OnReconnect = func(port int) {
+		reconnects <- port
+	}
+
+	err := pf.Start(ctx, portforwarder.KubernetesInfo{
+		Namespace: namespace,
+		Selector:  "app=nx-server",
+		Replicas:  2,
+		Port:      "50000",
+	})
+	require.NoError(t, err)
+
+	expectPod(t, fwd, "nx-server-a")
+	expectPod(t, fwd, "nx-server-b")
+	assert.Equal(t, []string{"nx-server-a", "nx-server-b"}, pf.Pods())
+	assert.Len(t, pf.LocalPorts(), 2)
+	assert.Equal(t, pf.LocalPorts()[0], pf.LocalPort())
+
+	// the primary pod goes away: the other one becomes primary, and the third one makes up the replicas.
+	err = clientset.CoreV1().Pods(namespace).Delete(ctx, "nx-server-a", metav1.DeleteOptions{})
+	require.NoError(t, err)
+
+	expectPod(t, fwd, "nx-server-c")
+	expectReconnect(t, reconnects, pf)
+	assert.Equal(t, []string{"nx-server-b", "nx-server-c"}, pf.Pods())
+}
+
+//nolint:paralleltest
+func TestSelectorNeedsApi(t *testing.T) {
+	err := portforwarder.New().Start(context.Background(),
+		portforwarder.KubernetesInfo{Namespace: namespace, Selector: "app=nx-server", User: "someone", Port: "50000"})
+	require.ErrorIs(t, err, portforwarder.ErrNeedsApi)
+}
@@ -0,0 +1,316 @@
+package portforwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	// HealthCheckInterval is how often a port forward through kubectl, which can not be followed as the api one, is
+	// checked to be listening.
+	HealthCheckInterval = time.Second * 5
+	// WatchRetryInterval is how long to wait before watching the target again, after the watch could not be started.
+	WatchRetryInterval = time.Second * 5
+	// ReestablishMaxInterval limits the backoff between attempts to establish lost port forwards again.
+	ReestablishMaxInterval = time.Second * 30
+)
+
+// forwarding is an established port forward.
+type forwarding struct {
+	pod  corev1.Pod
+	port int
+	stop func()
+	// done receives the result of the forward, once it ends.
+	done    chan error
+	stopped atomic.Bool
+	// ended is set, along with err, once the forward ended without being stopped.
+	ended atomic.Bool
+	err   error
+}
+
+// lost tells the forward ended.
+func (f *forwarding) lost(err error) error {
+	if err == nil {
+		return ErrForwardLost
+	}
+
+	return fmt.Errorf("%w: %w", ErrForwardLost, err)
+}
+
+func (p *PortForwarder) stopAll() {
+	p.mx.Lock()
+	forwardings := p.forwardings
+	p.mx.Unlock()
+
+	for _, fwd := range forwardings {
+		fwd.stop()
+	}
+}
+
+// reconcile keeps port forwards to up to tgt.replicas ready pods: the current ones still ready, and new ones making up
+// the number. Forwards to pods no longer ready, or lost, are stopped. It tells if it should be called again soon, as
+// pods are ready but could not be forwarded to, and notifies OnReconnect when the primary forward changed.
+//
+//nolint:cyclop
+func (p *PortForwarder) reconcile(ctx context.Context, tgt target, podPort int) (bool, error) {
+	p.mx.Lock()
+	current := p.forwardings
+	p.mx.Unlock()
+
+	errs := make([]error, 0)
+
+	pods, err := readyPods(ctx, p.clientset, tgt)
+	if err != nil && !errors.Is(err, ErrNoReadyPod) {
+		// without knowing which pods are ready, keep forwarding to the same ones.
+		errs = append(errs, err)
+
+		for _, fwd := range current {
+			pods = append(pods, fwd.pod)
+		}
+	}
+
+	ready := map[string]bool{}
+
+	for _, pod := range pods {
+		ready[pod.Name] = true
+	}
+
+	forwardings := make([]*forwarding, 0, tgt.replicas)
+	forwarded := map[string]bool{}
+
+	for _, fwd := range current {
+		if len(forwardings) < tgt.replicas && !fwd.ended.Load() && ready[fwd.pod.Name] {
+			forwardings = append(forwardings, fwd)
+			forwarded[fwd.pod.Name] = true
+
+			continue
+		}
+
+		fwd.stop()
+	}
+
+	for _, pod := range pods {
+		if len(forwardings) >= tgt.replicas {
+			break
+		}
+
+		if forwarded[pod.Name] {
+			continue
+		}
+
+		fwd, err := p.establishApi(ctx, pod, podPort)
+		if err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+
+		forwardings = append(forwardings, fwd)
+	}
+
+	if p.setForwardings(forwardings) && len(current) > 0 && len(forwardings) > 0 {
+		slog.Info("port forward established again", "pod", forwardings[0].pod.Name, "port", forwardings[0].port)
+
+		if p.OnReconnect != nil {
+			p.OnReconnect(forwardings[0].port)
+		}
+	}
+
+	again := len(errs) > 0
+
+	if len(forwardings) == 0 {
+		if errors.Is(err, ErrNoReadyPod) {
+			errs = append(errs, err)
+		}
+
+		return again, fmt.Errorf("no port forward to %s: %w", tgt, errors.Join(errs...))
+	}
+
+	return again, errors.Join(errs...)
+}
+
+// superviseApi follows the pods of tgt, keeping port forwards to the ready ones until ctx is done: when a pod is no
+// longer ready (or gone) or its forward is lost, another one is forwarded to.
+//
+//nolint:cyclop,funlen
+func (p *PortForwarder) superviseApi(ctx context.Context, tgt target, podPort int) {
+	defer p.stopAll()
+
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxInterval = ReestablishMaxInterval
+	bo.MaxElapsedTime = 0
+
+	retry := time.NewTimer(0)
+	<-retry.C
+
+	reconcile := func() {
+		again, err := p.reconcile(ctx, tgt, podPort)
+		if err != nil && ctx.Err() == nil {
+			p.notifyError(err)
+		}
+
+		if !again {
+			bo.Reset()
+
+			return
+		}
+
+		retry.Reset(bo.NextBackOff())
+	}
+
+	for {
+		watcher, err := p.watchTarget(ctx, tgt)
+		if err != nil {
+			p.notifyError(fmt.Errorf("error watching %s: %w", tgt, err))
+		} else {
+			// events may have been missed while no watch was running.
+			reconcile()
+		}
+
+		var events <-chan watch.Event
+		if watcher != nil {
+			events = watcher.ResultChan()
+		}
+
+		rewatch := time.After(WatchRetryInterval)
+
+	watching:
+		for {
+			select {
+			case <-ctx.Done():
+				if watcher != nil {
+					watcher.Stop()
+				}
+
+				return
+			case fwd := <-p.lost:
+				p.notifyError(fmt.Errorf("%s: %w", fwd.pod.Name, fwd.err))
+				reconcile()
+			case <-retry.C:
+				reconcile()
+			case <-rewatch:
+				if watcher == nil {
+					break watching
+				}
+			case _, ok := <-events:
+				if !ok {
+					break watching
+				}
+
+				reconcile()
+			}
+		}
+
+		if watcher != nil {
+			watcher.Stop()
+		}
+	}
+}
+
+// watchTarget starts watching tgt: the endpoints of a service, the pods with some labels or a pod.
+//
+//nolint:ireturn
+func (p *PortForwarder) watchTarget(ctx context.Context, tgt target) (watch.Interface, error) {
+	opts := metav1.ListOptions{ //nolint:exhaustruct,exhaustivestruct
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", tgt.name).String(),
+	}
+
+	var (
+		watcher watch.Interface
+		err     error
+	)
+
+	switch {
+	case tgt.selector != "":
+		opts.FieldSelector = ""
+		opts.LabelSelector = tgt.selector
+		watcher, err = p.clientset.CoreV1().Pods(tgt.namespace).Watch(ctx, opts)
+	case tgt.isPod:
+		watcher, err = p.clientset.CoreV1().Pods(tgt.namespace).Watch(ctx, opts)
+	default:
+		watcher, err = p.clientset.CoreV1().Endpoints(tgt.namespace).Watch(ctx, opts)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error starting watch: %w", err)
+	}
+
+	return watcher, nil
+}
+
+// reestablish retries establishing a port forward, with exponential backoff, until it succeeds or ctx is done. Once
+// established, OnReconnect is notified.
+func (p *PortForwarder) reestablish(
+	ctx context.Context,
+	establish func() (*forwarding, error),
+) (*forwarding, error) {
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxInterval = ReestablishMaxInterval
+	bo.MaxElapsedTime = 0
+
+	var fwd *forwarding
+
+	err := backoff.Retry(func() error {
+		var err error
+
+		fwd, err = establish()
+		if err != nil && ctx.Err() == nil {
+			p.notifyError(fmt.Errorf("error establishing port forward again: %w", err))
+		}
+
+		return err
+	}, backoff.WithContext(bo, ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error establishing port forward again: %w", err)
+	}
+
+	slog.Info("port forward established again", "port", fwd.port)
+
+	if p.OnReconnect != nil {
+		p.OnReconnect(fwd.port)
+	}
+
+	return fwd, nil
+}
+
+// superviseSudo checks, every HealthCheckInterval, that the port forward through kubectl is still listening, starting
+// it again when not, until ctx is done.
+func (p *PortForwarder) superviseSudo(ctx context.Context, kinfo KubernetesInfo, fwd *forwarding) {
+	ticker := time.NewTicker(HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			fwd.stop()
+
+			return
+		case <-ticker.C:
+		}
+
+		err := dialLocalPort(fwd.port)
+		if err == nil {
+			continue
+		}
+
+		fwd.stop()
+		p.notifyError(fwd.lost(err))
+
+		fwd, err = p.reestablish(ctx, func() (*forwarding, error) {
+			return p.establishSudo(ctx, kinfo)
+		})
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package portforwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/duxthemux/netmux/foundation/pipe"
+)
+
+// Transports of the port forward through the api. Auto tries websockets, falling back to spdy when refused.
+const (
+	TransportAuto      = "auto"
+	TransportWebSocket = "websocket"
+	TransportSPDY      = "spdy"
+)
+
+// PortForwardWebSocketProtocol is the subprotocol of the port forward over websockets. Messages start with their
+// channel - data (0) and errors (1) of the forwarded port - and each channel starts with the port, as 2 bytes.
+const PortForwardWebSocketProtocol = "v4.channel.k8s.io"
+
+const (
+	dataChannel = iota
+	errorChannel
+)
+
+const portPrefixLen = 2
+
+var (
+	ErrUnknownTransport = fmt.Errorf("unknown port forward transport")
+	ErrWebSocketRefused = fmt.Errorf("websocket port forward refused")
+	ErrRemote           = fmt.Errorf("port forward error")
+)
+
+func parseTransport(transport string) (string, error) {
+	switch strings.ToLower(transport) {
+	case "", TransportAuto:
+		return TransportAuto, nil
+	case TransportWebSocket:
+		return TransportWebSocket, nil
+	case TransportSPDY:
+		return TransportSPDY, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownTransport, transport)
+	}
+}
+
+// headerCapture is the innermost round tripper of a rest config: it keeps the headers the outer ones (authentication,
+// impersonation and such) set, for the websocket handshake to send them.
+type headerCapture struct {
+	header http.Header
+}
+
+func (h *headerCapture) RoundTrip(req *http.Request) (*http.Response, error) {
+	h.header = req.Header.Clone()
+
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil //nolint:exhaustruct
+}
+
+// webSocketDialer opens port forward websockets to pods, as the rest config tells.
+type webSocketDialer struct {
+	config *rest.Config
+	dialer *websocket.Dialer
+}
+
+func newWebSocketDialer(config *rest.Config) (*webSocketDialer, error) {
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating tls config: %w", err)
+	}
+
+	proxy := config.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+
+	return &webSocketDialer{
+		config: config,
+		dialer: &websocket.Dialer{ //nolint:exhaustruct
+			Proxy:            proxy,
+			TLSClientConfig:  tlsConfig,
+			Subprotocols:     []string{PortForwardWebSocketProtocol},
+			HandshakeTimeout: PFWaitTimeout,
+		},
+	}, nil
+}
+
+// headers returns the headers the requests of the rest config have.
+func (w *webSocketDialer) headers(ctx context.Context, target string) (http.Header, error) {
+	capture := &headerCapture{}
+
+	roundTripper, err := rest.HTTPWrappersForConfig(w.config, capture)
+	if err != nil {
+		return nil, fmt.Errorf("error wrapping round tripper: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	res, err := roundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("error authenticating request: %w", err)
+	}
+
+	_ = res.Body.Close()
+
+	return capture.header, nil
+}
+
+// dial opens a port forward websocket to podPort of pod.
+func (w *webSocketDialer) dial(ctx context.Context, pod corev1.Pod, podPort int) (*websocket.Conn, error) {
+	target, err := url.Parse(w.config.Host)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing host: %w", err)
+	}
+
+	if target.Scheme == "" {
+		target, err = url.Parse("https://" + w.config.Host)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing host: %w", err)
+		}
+	}
+
+	target.Path = strings.TrimSuffix(target.Path, "/") +
+		fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/portforward", pod.Namespace, pod.Name)
+	target.RawQuery = url.Values{"ports": []string{strconv.Itoa(podPort)}}.Encode()
+
+	header, err := w.headers(ctx, target.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake sets its own.
+	for _, name := range []string{"Connection", "Upgrade", "Sec-Websocket-Key", "Sec-Websocket-Version",
+		"Sec-Websocket-Extensions", "Sec-Websocket-Protocol"} {
+		header.Del(name)
+	}
+
+	switch target.Scheme {
+	case "https":
+		target.Scheme = "wss"
+	case "http":
+		target.Scheme = "ws"
+	}
+
+	conn, res, err := w.dialer.DialContext(ctx, target.String(), header)
+	if res != nil && res.Body != nil {
+		_ = res.Body.Close()
+	}
+
+	if err != nil {
+		if res != nil {
+			return nil, fmt.Errorf("%w: %s", ErrWebSocketRefused, res.Status)
+		}
+
+		return nil, fmt.Errorf("error dialing websocket: %w", err)
+	}
+
+	if conn.Subprotocol() != PortForwardWebSocketProtocol {
+		_ = conn.Close()
+
+		return nil, fmt.Errorf("%w: subprotocol %q", ErrWebSocketRefused, conn.Subprotocol())
+	}
+
+	return conn, nil
+}
+
+// channelConn reads and writes the data channel of a port forward websocket.
+type channelConn struct {
+	ws      *websocket.Conn
+	buf     []byte
+	prefix  [errorChannel + 1]int
+	writeMx sync.Mutex
+}
+
+func newChannelConn(ws *websocket.Conn) *channelConn {
+	return &channelConn{ws: ws, prefix: [errorChannel + 1]int{portPrefixLen, portPrefixLen}}
+}
+
+func (c *channelConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		_, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return 0, io.EOF
+			}
+
+			return 0, fmt.Errorf("error reading websocket: %w", err)
+		}
+
+		if len(msg) == 0 || msg[0] > errorChannel {
+			continue
+		}
+
+		channel, data := msg[0], msg[1:]
+
+		// each channel starts with the port.
+		skip := min(c.prefix[channel], len(data))
+		c.prefix[channel] -= skip
+		data = data[skip:]
+
+		if channel == errorChannel {
+			if len(data) > 0 {
+				return 0, fmt.Errorf("%w: %s", ErrRemote, data)
+			}
+
+			continue
+		}
+
+		c.buf = data
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+
+	return n, nil
+}
+
+func (c *channelConn) Write(p []byte) (int, error) {
+	c.writeMx.Lock()
+	defer c.writeMx.Unlock()
+
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, append([]byte{dataChannel}, p...)); err != nil {
+		return 0, fmt.Errorf("error writing websocket: %w", err)
+	}
+
+	return len(p), nil
+}
+
+func (c *channelConn) Close() error {
+	c.writeMx.Lock()
+	_ = c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.writeMx.Unlock()
+
+	if err := c.ws.Close(); err != nil {
+		return fmt.Errorf("error closing websocket: %w", err)
+	}
+
+	return nil
+}
+
+// webSocketForward forwards localPort to podPort of pod over websockets - one per accepted connection - until stop is
+// closed.
+func webSocketForward(ctx context.Context, dialer *webSocketDialer, pod corev1.Pod, localPort int, podPort int,
+	ready chan struct{}, stop <-chan struct{},
+) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(localPort)))
+	if err != nil {
+		return fmt.Errorf("error listening: %w", err)
+	}
+
+	close(ready)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stop:
+		case <-ctx.Done():
+		}
+
+		_ = listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+				return fmt.Errorf("error accepting connection: %w", err)
+			}
+		}
+
+		go func() {
+			if err := serveWebSocketConn(ctx, dialer, conn, pod, podPort); err != nil {
+				slog.Warn("error port forwarding connection over websocket", "pod", pod.Name, "err", err)
+			}
+		}()
+	}
+}
+
+func serveWebSocketConn(ctx context.Context, dialer *webSocketDialer, conn net.Conn, pod corev1.Pod, podPort int) error {
+	ws, err := dialer.dial(ctx, pod, podPort)
+	if err != nil {
+		_ = conn.Close()
+
+		return err
+	}
+
+	if err = pipe.New(conn, newChannelConn(ws)).Run(ctx); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error piping: %w", err)
+	}
+
+	return nil
+}
+
+// transportFor returns the transport to forward to pod with: the configured one, or - when auto - websockets unless
+// refused. As the decision is kept, the handshake is tried only once, opening (and closing right away) a connection
+// to the pod.
+func (p *PortForwarder) transportFor(ctx context.Context, dialer *webSocketDialer, pod corev1.Pod, podPort int) string {
+	p.mx.Lock()
+	transport := p.transport
+	p.mx.Unlock()
+
+	if transport != TransportAuto {
+		return transport
+	}
+
+	ws, err := dialer.dial(ctx, pod, podPort)
+	if err != nil {
+		if !errors.Is(err, ErrWebSocketRefused) {
+			slog.Warn("could not try the websocket port forward, using spdy", "err", err)
+
+			return TransportSPDY
+		}
+
+		slog.Info("websocket port forward refused, falling back to spdy", "err", err)
+
+		transport = TransportSPDY
+	} else {
+		_ = newChannelConn(ws).Close()
+
+		transport = TransportWebSocket
+	}
+
+	p.mx.Lock()
+	p.transport = transport
+	p.mx.Unlock()
+
+	return transport
+}
+
+// Transport returns the transport of the port forward through the api, auto until decided.
+func (p *PortForwarder) Transport() string {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	return p.transport
+}
@@ -0,0 +1,327 @@
+package portforwarder_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+
+	"github.com/duxthemux/netmux/business/portforwarder"
+)
+
+const podPort = 50000
+
+// FakeAPI serves the port forward of pods, forwarding to an echo server instead. Websockets are refused unless
+// webSockets is set.
+type FakeAPI struct {
+	webSockets bool
+	echo       string
+
+	mx         sync.Mutex
+	transports []string
+	auth       []string
+}
+
+func (f *FakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/namespaces/"+namespace+"/pods/nx-server-a/portforward" {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	f.mx.Lock()
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	f.mx.Unlock()
+
+	switch {
+	case websocket.IsWebSocketUpgrade(r) && f.webSockets:
+		f.serveWebSocket(w, r)
+	case httpstream.IsUpgradeRequest(r) && !websocket.IsWebSocketUpgrade(r):
+		f.serveSPDY(w, r)
+	default:
+		http.Error(w, "upgrade request required", http.StatusBadRequest)
+	}
+}
+
+func (f *FakeAPI) used(transport string) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	f.transports = append(f.transports, transport)
+}
+
+func (f *FakeAPI) Transports() []string {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	return append([]string{}, f.transports...)
+}
+
+func (f *FakeAPI) Auth() []string {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	return append([]string{}, f.auth...)
+}
+
+func (f *FakeAPI) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("ports") != strconv.Itoa(podPort) {
+		http.Error(w, "wrong port", http.StatusBadRequest)
+
+		return
+	}
+
+	upgrader := websocket.Upgrader{Subprotocols: []string{portforwarder.PortForwardWebSocketProtocol}}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		_ = ws.Close()
+	}()
+
+	f.used(portforwarder.TransportWebSocket)
+
+	upstream, err := net.Dial("tcp", f.echo)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		_ = upstream.Close()
+	}()
+
+	port := binary.LittleEndian.AppendUint16(nil, podPort)
+
+	for _, channel := range []byte{0, 1} {
+		if err = ws.WriteMessage(websocket.BinaryMessage, append([]byte{channel}, port...)); err != nil {
+			return
+		}
+	}
+
+	go func() {
+		buf := make([]byte, 1024)
+
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+
+			if err = ws.WriteMessage(websocket.BinaryMessage, append([]byte{0}, buf[:n]...)); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if len(msg) > 1 && msg[0] == 0 {
+			if _, err = upstream.Write(msg[1:]); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (f *FakeAPI) serveSPDY(w http.ResponseWriter, r *http.Request) {
+	if _, err := httpstream.Handshake(r, w, []string{"portforward.k8s.io"}); err != nil {
+		return
+	}
+
+	f.used(portforwarder.TransportSPDY)
+
+	conn := spdy.NewResponseUpgrader().UpgradeResponse(w, r,
+		func(stream httpstream.Stream, _ <-chan struct{}) error {
+			if stream.Headers().Get(corev1.PortHeader) != strconv.Itoa(podPort) {
+				return fmt.Errorf("wrong port")
+			}
+
+			go func() {
+				defer func() {
+					_ = stream.Close()
+				}()
+
+				if stream.Headers().Get(corev1.StreamType) != corev1.StreamTypeData {
+					return
+				}
+
+				upstream, err := net.Dial("tcp", f.echo)
+				if err != nil {
+					return
+				}
+
+				defer func() {
+					_ = upstream.Close()
+				}()
+
+				go func() {
+					_, _ = io.Copy(stream, upstream)
+				}()
+
+				_, _ = io.Copy(upstream, stream)
+			}()
+
+			return nil
+		})
+	if conn == nil {
+		return
+	}
+
+	<-conn.CloseChan()
+}
+
+func echoServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func startThroughApi(t *testing.T, api *FakeAPI, transport string) *portforwarder.PortForwarder {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv := httptest.NewTLSServer(api)
+	t.Cleanup(srv.Close)
+
+	podA := pod("nx-server-a", "10.0.0.1")
+
+	pf := portforwarder.New(
+		portforwarder.WithClientset(fake.NewSimpleClientset(podA, endpoints(podA))),
+		portforwarder.WithRestConfig(&rest.Config{
+			Host:            srv.URL,
+			BearerToken:     "secret",
+			TLSClientConfig: rest.TLSClientConfig{Insecure: true},
+		}))
+
+	err := pf.Start(ctx, portforwarder.KubernetesInfo{
+		Namespace: namespace,
+		Endpoint:  "netmux",
+		Port:      strconv.Itoa(podPort),
+		Transport: transport,
+	})
+	require.NoError(t, err)
+
+	return pf
+}
+
+func expectEcho(t *testing.T, pf *portforwarder.PortForwarder) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", pf.LocalPort()), MaxWaitTime)
+	require.NoError(t, err)
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(MaxWaitTime)))
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 4)
+
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+//nolint:paralleltest
+func TestWebSocketTransport(t *testing.T) {
+	api := &FakeAPI{webSockets: true, echo: echoServer(t)}
+
+	pf := startThroughApi(t, api, portforwarder.TransportWebSocket)
+
+	expectEcho(t, pf)
+	assert.Equal(t, portforwarder.TransportWebSocket, pf.Transport())
+	assert.Equal(t, []string{portforwarder.TransportWebSocket}, api.Transports())
+	assert.Contains(t, api.Auth(), "Bearer secret")
+}
+
+//nolint:paralleltest
+func TestAutoTransportPrefersWebSocket(t *testing.T) {
+	api := &FakeAPI{webSockets: true, echo: echoServer(t)}
+
+	pf := startThroughApi(t, api, "")
+
+	expectEcho(t, pf)
+	assert.Equal(t, portforwarder.TransportWebSocket, pf.Transport())
+	assert.NotContains(t, api.Transports(), portforwarder.TransportSPDY)
+}
+
+//nolint:paralleltest
+func TestAutoTransportFallsBackToSPDY(t *testing.T) {
+	api := &FakeAPI{echo: echoServer(t)}
+
+	pf := startThroughApi(t, api, portforwarder.TransportAuto)
+
+	expectEcho(t, pf)
+	assert.Equal(t, portforwarder.TransportSPDY, pf.Transport())
+	assert.Equal(t, []string{portforwarder.TransportSPDY}, api.Transports())
+}
+
+//nolint:paralleltest
+func TestUnknownTransport(t *testing.T) {
+	podA := pod("nx-server-a", "10.0.0.1")
+
+	pf := portforwarder.New(
+		portforwarder.WithClientset(fake.NewSimpleClientset(podA, endpoints(podA))),
+		portforwarder.WithRestConfig(&rest.Config{Host: "https://127.0.0.1:1"}))
+
+	err := pf.Start(context.Background(), portforwarder.KubernetesInfo{
+		Namespace: namespace,
+		Endpoint:  "netmux",
+		Port:      strconv.Itoa(podPort),
+		Transport: "carrier-pigeon",
+	})
+	require.ErrorIs(t, err, portforwarder.ErrUnknownTransport)
+}
@@ -0,0 +1,194 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// AliasLabelSuffix is appended to the interface name to label the addresses we add (eg: lo:nx), so they can be told
+// apart from the ones added by others. Labels only exist for ipv4: ipv6 aliases can't be identified.
+const AliasLabelSuffix = ":nx"
+
+var (
+	ErrNoSuchInterface = fmt.Errorf("no such interface")
+	ErrAliasNotOwned   = fmt.Errorf("address exists but was not added by netmux")
+	ErrInvalidAddress  = fmt.Errorf("invalid address")
+	ErrLabelTooLong    = fmt.Errorf("interface name too long for an alias label")
+)
+
+// aliasLabel returns the label of the aliases we add to iface.
+func aliasLabel(iface string) (string, error) {
+	label := iface + AliasLabelSuffix
+	if len(label) >= unix.IFNAMSIZ {
+		return "", fmt.Errorf("%w: %s", ErrLabelTooLong, iface)
+	}
+
+	return label, nil
+}
+
+func aliasLink(iface string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil, fmt.Errorf("%w: %s", ErrNoSuchInterface, iface)
+		}
+
+		return nil, fmt.Errorf("error finding interface %s: %w", iface, err)
+	}
+
+	return link, nil
+}
+
+// aliasAddr builds the address to add, with netmask (dotted, as 255.255.255.0) as its mask. A host mask is used
+// if netmask is empty.
+func aliasAddr(iface string, ipaddr string, netmask string) (*netlink.Addr, error) {
+	ip := net.ParseIP(ipaddr)
+	if ip == nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAddress, ipaddr)
+	}
+
+	addr := &netlink.Addr{IPNet: netlink.NewIPNet(ip)}
+
+	if netmask != "" {
+		mask := net.ParseIP(netmask)
+		if mask == nil || ip.To4() == nil || mask.To4() == nil {
+			return nil, fmt.Errorf("%w: netmask %s for %s", ErrInvalidAddress, netmask, ipaddr)
+		}
+
+		addr.Mask = net.IPMask(mask.To4())
+		if ones, bits := addr.Mask.Size(); ones == 0 && bits == 0 {
+			return nil, fmt.Errorf("%w: netmask %s is not contiguous", ErrInvalidAddress, netmask)
+		}
+	}
+
+	// listeners are bound to aliases right after adding them: ipv6 ones can't wait for duplicate address detection.
+	if ip.To4() == nil {
+		addr.Flags = unix.IFA_F_NODAD
+	}
+
+	if ip.To4() != nil {
+		label, err := aliasLabel(iface)
+		if err != nil {
+			return nil, err
+		}
+
+		addr.Label = label
+	}
+
+	return addr, nil
+}
+
+// findAlias returns the address ipaddr of link, or nil if there is none.
+func findAlias(link netlink.Link, ipaddr string) (*netlink.Addr, error) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("error listing addresses of %s: %w", link.Attrs().Name, err)
+	}
+
+	ip := net.ParseIP(ipaddr)
+
+	for i := range addrs {
+		if addrs[i].IP.Equal(ip) {
+			return &addrs[i], nil
+		}
+	}
+
+	return nil, nil //nolint:nilnil
+}
+
+func owned(link netlink.Link, addr *netlink.Addr) bool {
+	if addr.IP.To4() == nil {
+		return true
+	}
+
+	return addr.Label == link.Attrs().Name+AliasLabelSuffix
+}
+
+// AddAlias adds ipaddr to iface, labelled as ours. Adding an alias we already own is not an error.
+func AddAlias(iface string, ipaddr string, netmask string) error {
+	link, err := aliasLink(iface)
+	if err != nil {
+		return err
+	}
+
+	addr, err := aliasAddr(iface, ipaddr, netmask)
+	if err != nil {
+		return err
+	}
+
+	err = netlink.AddrAdd(link, addr)
+	if err == nil {
+		return nil
+	}
+
+	if !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("error adding %s to %s: %w", ipaddr, iface, err)
+	}
+
+	existing, err := findAlias(link, ipaddr)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil && !owned(link, existing) {
+		return fmt.Errorf("%w: %s on %s", ErrAliasNotOwned, ipaddr, iface)
+	}
+
+	return nil
+}
+
+// RemoveAlias removes ipaddr from iface. Removing an alias that does not exist is not an error, while removing one
+// we don't own is.
+func RemoveAlias(iface string, ipaddr string) error {
+	link, err := aliasLink(iface)
+	if err != nil {
+		return err
+	}
+
+	existing, err := findAlias(link, ipaddr)
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		return nil
+	}
+
+	if !owned(link, existing) {
+		return fmt.Errorf("%w: %s on %s", ErrAliasNotOwned, ipaddr, iface)
+	}
+
+	if err = netlink.AddrDel(link, existing); err != nil && !errors.Is(err, unix.EADDRNOTAVAIL) {
+		return fmt.Errorf("error removing %s from %s: %w", ipaddr, iface, err)
+	}
+
+	return nil
+}
+
+// Aliases lists the ipv4 aliases we own on iface.
+func Aliases(iface string) ([]string, error) {
+	link, err := aliasLink(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("error listing addresses of %s: %w", iface, err)
+	}
+
+	ret := make([]string, 0)
+
+	for i := range addrs {
+		if owned(link, &addrs[i]) {
+			ret = append(ret, addrs[i].IP.String())
+		}
+	}
+
+	return ret, nil
+}
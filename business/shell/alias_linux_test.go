@@ -0,0 +1,71 @@
+package shell_test
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/duxthemux/netmux/business/shell"
+)
+
+// inNetns moves the test to a network namespace of its own, so nothing leaks into the host. The (locked) thread is
+// discarded when the test ends.
+func inNetns(t *testing.T) {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	runtime.LockOSThread()
+	require.NoError(t, unix.Unshare(unix.CLONE_NEWNET))
+
+	// lo comes down, and without 127.0.0.1, in a new namespace.
+	lo, err := netlink.LinkByName("lo")
+	require.NoError(t, err)
+	require.NoError(t, netlink.LinkSetUp(lo))
+}
+
+//nolint:paralleltest
+func TestAliases(t *testing.T) {
+	inNetns(t)
+
+	sh := shell.New()
+
+	require.NoError(t, sh.IfconfigAddAlias("lo", "10.10.10.1", "255.255.255.255", ""))
+	require.NoError(t, sh.IfconfigAddAlias("lo", "10.10.10.2", "", ""))
+
+	// adding again is fine.
+	require.NoError(t, sh.IfconfigAddAlias("lo", "10.10.10.1", "255.255.255.255", ""))
+
+	aliases, err := shell.Aliases("lo")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"10.10.10.1", "10.10.10.2"}, aliases)
+
+	// 127.0.0.1 belongs to lo, not to us.
+	assert.ErrorIs(t, sh.IfconfigAddAlias("lo", "127.0.0.1", "255.0.0.0", ""), shell.ErrAliasNotOwned)
+	assert.ErrorIs(t, sh.IfconfigRemAlias("lo", "127.0.0.1"), shell.ErrAliasNotOwned)
+
+	require.NoError(t, sh.IfconfigRemAlias("lo", "10.10.10.1"))
+	// removing again is fine.
+	require.NoError(t, sh.IfconfigRemAlias("lo", "10.10.10.1"))
+
+	aliases, err = shell.Aliases("lo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.10.10.2"}, aliases)
+
+	out, err := exec.Command("ip", "-4", "addr", "show", "dev", "lo").CombinedOutput()
+	if err == nil {
+		assert.Contains(t, string(out), "lo:nx")
+	}
+
+	assert.ErrorIs(t, sh.IfconfigAddAlias("nope0", "10.10.10.3", "", ""), shell.ErrNoSuchInterface)
+	assert.ErrorIs(t, sh.IfconfigAddAlias("lo", "10.10.10", "", ""), shell.ErrInvalidAddress)
+	assert.ErrorIs(t, sh.IfconfigAddAlias("lo", "10.10.10.3", "255.0.255.0", ""), shell.ErrInvalidAddress)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"os"
 )
 
@@ -23,5 +24,31 @@ func shStdio(cmdline string) error {
 type Shell interface {
 	IfconfigAddAlias(iface string, ipaddr string, netmask string, gw string) error
 	IfconfigRemAlias(iface string, ipaddr string) error
+	// IfconfigAliases lists the addresses of iface that may have been added by IfconfigAddAlias. Where aliases can't
+	// be told apart from other addresses, all of them are listed.
+	IfconfigAliases(iface string) ([]string, error)
 	CmdAs(ctx context.Context, user string) (io.Writer, error)
 }
+
+// interfaceAddrs lists all addresses of iface.
+func interfaceAddrs(iface string) ([]string, error) {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("error finding interface %s: %w", iface, err)
+	}
+
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("error listing addresses of %s: %w", iface, err)
+	}
+
+	ret := make([]string, 0, len(addrs))
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ret = append(ret, ipNet.IP.String())
+		}
+	}
+
+	return ret, nil
+}
@@ -6,18 +6,31 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"strings"
 )
 
 type darwinShell struct{}
 
 func (w *darwinShell) IfconfigAddAlias(iface string, ipaddr string, _ string, _ string) error {
+	if strings.Contains(ipaddr, ":") {
+		return shStdio(fmt.Sprintf("ifconfig %s inet6 %s prefixlen 128 alias", iface, ipaddr))
+	}
+
 	return shStdio(fmt.Sprintf("ifconfig %s alias %s", iface, ipaddr))
 }
 
 func (w *darwinShell) IfconfigRemAlias(iface string, ipaddr string) error {
+	if strings.Contains(ipaddr, ":") {
+		return shStdio(fmt.Sprintf("ifconfig %s inet6 %s -alias", iface, ipaddr))
+	}
+
 	return shStdio(fmt.Sprintf("ifconfig %s -alias %s", iface, ipaddr))
 }
 
+func (w *darwinShell) IfconfigAliases(iface string) ([]string, error) {
+	return interfaceAddrs(iface)
+}
+
 func (w *darwinShell) CmdAs(ctx context.Context, user string) (io.Writer, error) {
 
 	cmd := exec.CommandContext(ctx, "su", "-", user)
@@ -6,16 +6,39 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"strings"
 )
 
 type linuxShell struct{}
 
-func (w *linuxShell) IfconfigAddAlias(iface string, ipaddr string, netmask string, gw string) error {
-	return shStdio(fmt.Sprintf("ip addr add %s dev %s", ipaddr, iface))
+// IfconfigAddAlias adds ipaddr to iface through netlink. The gateway is not needed on linux.
+func (w *linuxShell) IfconfigAddAlias(iface string, ipaddr string, netmask string, _ string) error {
+	return AddAlias(iface, ipaddr, netmask)
 }
 
 func (w *linuxShell) IfconfigRemAlias(iface string, ipaddr string) error {
-	return shStdio(fmt.Sprintf("ip addr del %s dev %s", ipaddr, iface))
+	return RemoveAlias(iface, ipaddr)
+}
+
+// IfconfigAliases lists our (labelled) ipv4 aliases of iface, and all its ipv6 addresses.
+func (w *linuxShell) IfconfigAliases(iface string) ([]string, error) {
+	aliases, err := Aliases(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := interfaceAddrs(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if strings.Contains(addr, ":") {
+			aliases = append(aliases, addr)
+		}
+	}
+
+	return aliases, nil
 }
 
 func (w *linuxShell) CmdAs(ctx context.Context, user string) (io.Writer, error) {
@@ -16,7 +16,12 @@ import (
 type winShell struct{}
 
 func (w *winShell) IfconfigAddAlias(iface string, ipaddr string, netmask string, gw string) error {
-	err := shStdio(fmt.Sprintf("netsh interface ip add address %s %s %s", iface, ipaddr, netmask))
+	cmdline := fmt.Sprintf("netsh interface ip add address %s %s %s", iface, ipaddr, netmask)
+	if strings.Contains(ipaddr, ":") {
+		cmdline = fmt.Sprintf("netsh interface ipv6 add address %s %s", iface, ipaddr)
+	}
+
+	err := shStdio(cmdline)
 	if err != nil {
 		return err
 	}
@@ -25,9 +30,17 @@ func (w *winShell) IfconfigAddAlias(iface string, ipaddr string, netmask string,
 }
 
 func (w *winShell) IfconfigRemAlias(iface string, ipaddr string) error {
+	if strings.Contains(ipaddr, ":") {
+		return shStdio(fmt.Sprintf("netsh interface ipv6 delete address %s %s", iface, ipaddr))
+	}
+
 	return shStdio(fmt.Sprintf("netsh interface ip delete address %s %s", iface, ipaddr))
 }
 
+func (w *winShell) IfconfigAliases(iface string) ([]string, error) {
+	return interfaceAddrs(iface)
+}
+
 func (w *winShell) CmdAs(ctx context.Context, user string) (io.Writer, error) {
 
 	cmd := exec.CommandContext(ctx, "runas", "/user:"+user, "cmd")
@@ -0,0 +1,255 @@
+// Package tun routes whole networks (typically the service and pod networks of a cluster) through netmux. Packets
+// sent to those networks reach a TUN device and are handled by a userspace TCP/IP stack: every tcp connection and udp
+// flow is terminated locally and handed to a Dialer, so no per service ip or hosts entry is needed.
+package tun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/duxthemux/netmux/foundation/pipe"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+var ErrNotSupported = fmt.Errorf("tun mode not supported on this platform")
+
+const (
+	nicID = 1
+	// DefaultMTU is the mtu used for the device.
+	DefaultMTU = 1500
+	// DefaultUDPIdleTimeout is how long an udp flow is kept without traffic in any direction.
+	DefaultUDPIdleTimeout = time.Minute
+	tcpMaxInFlight        = 1024
+)
+
+// Dialer reaches the original destination of the connections and flows accepted by the Stack.
+type Dialer interface {
+	DialTCP(ctx context.Context, addr string) (io.ReadWriteCloser, error)
+	// DialUDP must return a connection that keeps datagram boundaries.
+	DialUDP(ctx context.Context, addr string) (io.ReadWriteCloser, error)
+}
+
+// Stack is a userspace TCP/IP stack that accepts any tcp connection or udp flow arriving through its link
+// endpoint, and pipes it to the connection obtained from a Dialer.
+type Stack struct {
+	stack          *stack.Stack
+	link           stack.LinkEndpoint
+	dialer         Dialer
+	ctx            context.Context //nolint:containedctx
+	cancel         context.CancelFunc
+	udpIdleTimeout time.Duration
+}
+
+type Opts func(s *Stack)
+
+// WithUDPIdleTimeout sets how long an udp flow without traffic is kept open.
+func WithUDPIdleTimeout(d time.Duration) Opts {
+	return func(s *Stack) {
+		s.udpIdleTimeout = d
+	}
+}
+
+// NewStack creates a stack on top of link. Connections are handled until ctx is done or Close is called.
+func NewStack(ctx context.Context, link stack.LinkEndpoint, dialer Dialer, opts ...Opts) (*Stack, error) {
+	ret := &Stack{
+		link:           link,
+		dialer:         dialer,
+		udpIdleTimeout: DefaultUDPIdleTimeout,
+	}
+
+	for _, o := range opts {
+		o(ret)
+	}
+
+	ret.ctx, ret.cancel = context.WithCancel(ctx)
+
+	ret.stack = stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+
+	// handlers are set before creating the nic, as packets may flow as soon as it is attached.
+	tcpForwarder := tcp.NewForwarder(ret.stack, 0, tcpMaxInFlight, ret.handleTCP)
+	ret.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+
+	udpForwarder := udp.NewForwarder(ret.stack, ret.handleUDP)
+	ret.stack.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	if err := ret.stack.CreateNIC(nicID, link); err != nil {
+		ret.cancel()
+
+		return nil, fmt.Errorf("error creating nic: %s", err)
+	}
+
+	// promiscuous mode and spoofing let the stack accept packets to, and answer from, any address.
+	if err := ret.stack.SetPromiscuousMode(nicID, true); err != nil {
+		ret.cancel()
+
+		return nil, fmt.Errorf("error setting promiscuous mode: %s", err)
+	}
+
+	if err := ret.stack.SetSpoofing(nicID, true); err != nil {
+		ret.cancel()
+
+		return nil, fmt.Errorf("error setting spoofing: %s", err)
+	}
+
+	ret.stack.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: nicID},
+		{Destination: header.IPv6EmptySubnet, NIC: nicID},
+	})
+
+	return ret, nil
+}
+
+// Close stops the stack, ending all the connections it handles.
+func (s *Stack) Close() {
+	s.cancel()
+	s.stack.Close()
+}
+
+// Wait blocks until the link endpoint is done - eg: after Close and the underlying device is gone.
+func (s *Stack) Wait() {
+	s.stack.Wait()
+}
+
+func destination(id stack.TransportEndpointID) string {
+	return net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
+}
+
+// handleTCP is called by the forwarder in its own goroutine for every new connection. The destination is dialed
+// before completing the handshake, so a failure to reach it is seen by the client as a refused connection.
+func (s *Stack) handleTCP(req *tcp.ForwarderRequest) {
+	addr := destination(req.ID())
+
+	remote, err := s.dialer.DialTCP(s.ctx, addr)
+	if err != nil {
+		slog.Debug("tun: error dialing tcp", "addr", addr, "err", err)
+		req.Complete(true)
+
+		return
+	}
+
+	var wq waiter.Queue
+
+	endpoint, tcpErr := req.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		slog.Debug("tun: error creating tcp endpoint", "addr", addr, "err", tcpErr)
+		req.Complete(true)
+		helperIoClose(remote)
+
+		return
+	}
+
+	req.Complete(false)
+
+	if err = pipe.New(gonet.NewTCPConn(&wq, endpoint), remote).Run(s.ctx); err != nil {
+		slog.Debug("tun: tcp connection ended", "addr", addr, "err", err)
+	}
+}
+
+// handleUDP is called synchronously by the forwarder for the first datagram of every new flow.
+func (s *Stack) handleUDP(req *udp.ForwarderRequest) {
+	addr := destination(req.ID())
+
+	var wq waiter.Queue
+
+	endpoint, tcpErr := req.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		slog.Debug("tun: error creating udp endpoint", "addr", addr, "err", tcpErr)
+
+		return
+	}
+
+	local := gonet.NewUDPConn(s.stack, &wq, endpoint)
+
+	go func() {
+		remote, err := s.dialer.DialUDP(s.ctx, addr)
+		if err != nil {
+			slog.Debug("tun: error dialing udp", "addr", addr, "err", err)
+			helperIoClose(local)
+
+			return
+		}
+
+		flow := &idleConn{UDPConn: local, timeout: s.udpIdleTimeout}
+		flow.touch()
+
+		if err = pipe.New(flow, &activityConn{ReadWriteCloser: remote, flow: flow}).Run(s.ctx); err != nil {
+			slog.Debug("tun: udp flow ended", "addr", addr, "err", err)
+		}
+	}()
+}
+
+// idleConn ends an udp flow once no datagram went through it, in any direction, for timeout.
+type idleConn struct {
+	*gonet.UDPConn
+	timeout    time.Duration
+	lastActive atomic.Int64
+}
+
+func (c *idleConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	for {
+		deadline := time.Unix(0, c.lastActive.Load()).Add(c.timeout)
+		if !time.Now().Before(deadline) {
+			return 0, io.EOF
+		}
+
+		if err := c.UDPConn.SetReadDeadline(deadline); err != nil {
+			return 0, fmt.Errorf("error setting deadline: %w", err)
+		}
+
+		n, err := c.UDPConn.Read(p)
+		if err == nil {
+			c.touch()
+
+			return n, nil
+		}
+
+		// a timeout only ends the flow if there was no traffic in the other direction meanwhile.
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return n, err //nolint:wrapcheck
+		}
+	}
+}
+
+// activityConn reports the traffic coming from the remote side of a flow.
+type activityConn struct {
+	io.ReadWriteCloser
+	flow *idleConn
+}
+
+func (c *activityConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.flow.touch()
+	}
+
+	return n, err //nolint:wrapcheck
+}
+
+func helperIoClose(closer io.Closer) {
+	if err := closer.Close(); err != nil {
+		slog.Debug("tun: error closing", "err", err)
+	}
+}
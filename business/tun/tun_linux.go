@@ -0,0 +1,109 @@
+package tun
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+)
+
+// Device is a TUN device routing a set of networks to a Stack.
+type Device struct {
+	*Stack
+	name  string
+	fd    int
+	mx    sync.Mutex
+	cidrs []string
+}
+
+// Open creates the TUN device name, routes cidrs to it and serves them with a Stack. The device, and its routes,
+// go away with Close.
+func Open(ctx context.Context, name string, cidrs []string, dialer Dialer, opts ...Opts) (*Device, error) {
+	fd, err := tun.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("error opening tun device %s: %w", name, err)
+	}
+
+	ret := &Device{name: name, fd: fd}
+
+	link, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: DefaultMTU})
+	if err != nil {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("error creating link endpoint: %w", err)
+	}
+
+	ret.Stack, err = NewStack(ctx, link, dialer, opts...)
+	if err != nil {
+		_ = unix.Close(fd)
+
+		return nil, err
+	}
+
+	if err = ret.setup(cidrs); err != nil {
+		ret.Close()
+
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (d *Device) setup(cidrs []string) error {
+	if err := run("ip", "link", "set", "dev", d.name, "mtu", strconv.Itoa(DefaultMTU), "up"); err != nil {
+		return err
+	}
+
+	return d.Route(cidrs)
+}
+
+// Route routes cidrs to the device, instead of the networks it routed so far.
+func (d *Device) Route(cidrs []string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for _, cidr := range cidrs {
+		if err := run("ip", "route", "replace", cidr, "dev", d.name); err != nil {
+			return err
+		}
+	}
+
+	for _, cidr := range d.cidrs {
+		if !slices.Contains(cidrs, cidr) {
+			if err := run("ip", "route", "del", cidr, "dev", d.name); err != nil {
+				return err
+			}
+		}
+	}
+
+	d.cidrs = slices.Clone(cidrs)
+
+	return nil
+}
+
+// Name is the name of the device.
+func (d *Device) Name() string {
+	return d.name
+}
+
+// Close stops the stack and removes the device.
+func (d *Device) Close() {
+	d.Stack.Close()
+	_ = unix.Close(d.fd)
+	d.Stack.Wait()
+}
+
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error running %s %v: %w - %s", name, args, err, string(out))
+	}
+
+	return nil
+}
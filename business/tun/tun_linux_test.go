@@ -0,0 +1,167 @@
+package tun_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/duxthemux/netmux/business/tun"
+)
+
+// fakeDialer sends every connection to local echo servers, no matter the destination.
+type fakeDialer struct {
+	tcpAddr string
+	udpAddr string
+	dialed  chan string
+}
+
+func (f *fakeDialer) DialTCP(_ context.Context, addr string) (io.ReadWriteCloser, error) {
+	f.dialed <- "tcp " + addr
+
+	return net.Dial("tcp", f.tcpAddr)
+}
+
+func (f *fakeDialer) DialUDP(_ context.Context, addr string) (io.ReadWriteCloser, error) {
+	f.dialed <- "udp " + addr
+
+	return net.Dial("udp", f.udpAddr)
+}
+
+func echoServers(t *testing.T) (string, string) {
+	t.Helper()
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tcpListener.Close() })
+
+	go func() {
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = udpConn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+
+		for {
+			n, addr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			_, _ = udpConn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return tcpListener.Addr().String(), udpConn.LocalAddr().String()
+}
+
+//nolint:paralleltest
+func TestDevice(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skip("requires /dev/net/tun")
+	}
+
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("requires ip")
+	}
+
+	dialer := &fakeDialer{dialed: make(chan string, 10)}
+	dialer.tcpAddr, dialer.udpAddr = echoServers(t)
+
+	// the device lives in a network namespace of its own, bound to this (locked) thread. The stack and the dialer
+	// run on other threads, so they still reach the echo servers. The thread is discarded when the test ends.
+	runtime.LockOSThread()
+	require.NoError(t, unix.Unshare(unix.CLONE_NEWNET))
+	require.NoError(t, exec.Command("ip", "link", "set", "lo", "up").Run())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	device, err := tun.Open(ctx, "nxtest0", []string{"10.96.0.0/16"}, dialer)
+	require.NoError(t, err)
+
+	defer device.Close()
+
+	assert.Equal(t, "nxtest0", device.Name())
+	require.NoError(t, exec.Command("ip", "addr", "add", "198.18.0.1/32", "dev", "nxtest0").Run())
+
+	// no subtests: they would run on other threads, outside the namespace.
+	testTCP(t, dialer)
+	testUDP(t, dialer)
+
+	// the networks change: the device routes the new ones only.
+	require.NoError(t, device.Route([]string{"10.97.0.0/16"}))
+
+	routes, err := exec.Command("ip", "route", "show", "dev", "nxtest0").Output()
+	require.NoError(t, err)
+	assert.Contains(t, string(routes), "10.97.0.0/16")
+	assert.NotContains(t, string(routes), "10.96.0.0/16")
+}
+
+func testTCP(t *testing.T, dialer *fakeDialer) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", "10.96.0.10:80", 5*time.Second)
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	assert.Equal(t, "tcp 10.96.0.10:80", <-dialer.dialed)
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func testUDP(t *testing.T, dialer *fakeDialer) {
+	t.Helper()
+
+	conn, err := net.Dial("udp", "10.96.0.10:53")
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	for _, msg := range []string{"first", "second datagram"} {
+		_, err = conn.Write([]byte(msg))
+		require.NoError(t, err)
+
+		buf := make([]byte, 1500)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(buf[:n]))
+	}
+
+	assert.Equal(t, "udp 10.96.0.10:53", <-dialer.dialed)
+}
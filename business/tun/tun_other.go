@@ -0,0 +1,25 @@
+//go:build !linux
+
+package tun
+
+import "context"
+
+// Device is a TUN device routing a set of networks to a Stack.
+type Device struct {
+	*Stack
+}
+
+// Open is not supported on this platform.
+func Open(_ context.Context, _ string, _ []string, _ Dialer, _ ...Opts) (*Device, error) {
+	return nil, ErrNotSupported
+}
+
+// Name is the name of the device.
+func (d *Device) Name() string {
+	return ""
+}
+
+// Route is not supported on this platform.
+func (d *Device) Route(_ []string) error {
+	return ErrNotSupported
+}
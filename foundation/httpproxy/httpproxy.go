@@ -0,0 +1,172 @@
+// Package httpproxy implements an HTTP forward proxy, supporting both CONNECT tunnels and plain requests with absolute
+// URIs. Where connections go is decided by the Dialer provided, which receives the requested address unresolved.
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/duxthemux/netmux/foundation/pipe"
+)
+
+// ErrNotAllowed should be wrapped by dialers refusing to connect to an address, so clients are told so.
+var ErrNotAllowed = fmt.Errorf("connection not allowed")
+
+// Dialer connects to addr (host:port, where host may be a name) on behalf of a client.
+type Dialer func(ctx context.Context, addr string) (io.ReadWriteCloser, error)
+
+const ReadHeaderTimeout = time.Second * 5
+
+type Proxy struct {
+	dialer  Dialer
+	forward *httputil.ReverseProxy
+}
+
+func New(dialer Dialer) *Proxy {
+	ret := &Proxy{dialer: dialer}
+
+	ret.forward = &httputil.ReverseProxy{
+		// requests to a forward proxy already carry the absolute url: nothing to rewrite.
+		Director: func(req *http.Request) {},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+				conn, err := dialer(ctx, addr)
+				if err != nil {
+					return nil, err
+				}
+
+				return asNetConn(conn), nil
+			},
+			ForceAttemptHTTP2: false,
+		},
+		ErrorHandler: func(writer http.ResponseWriter, req *http.Request, err error) {
+			http.Error(writer, err.Error(), statusFor(err))
+		},
+	}
+
+	return ret
+}
+
+// Serve accepts proxy requests from listener until it fails or ctx is done.
+func (p *Proxy) Serve(ctx context.Context, listener net.Listener) error {
+	server := http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: ReadHeaderTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		_ = server.Close()
+	}()
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error serving http proxy: %w", err)
+	}
+
+	return nil
+}
+
+// ServeHTTP implements http.Handler.
+func (p *Proxy) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodConnect {
+		p.serveConnect(writer, req)
+
+		return
+	}
+
+	if !req.URL.IsAbs() {
+		http.Error(writer, "this is a proxy: absolute uri required", http.StatusBadRequest)
+
+		return
+	}
+
+	p.forward.ServeHTTP(writer, req)
+}
+
+func (p *Proxy) serveConnect(writer http.ResponseWriter, req *http.Request) {
+	hijacker, ok := writer.(http.Hijacker)
+	if !ok {
+		http.Error(writer, "connection can't be hijacked", http.StatusInternalServerError)
+
+		return
+	}
+
+	target, err := p.dialer(req.Context(), req.Host)
+	if err != nil {
+		http.Error(writer, err.Error(), statusFor(err))
+
+		return
+	}
+
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		_ = target.Close()
+
+		slog.Warn("error hijacking proxy conn", "err", err)
+
+		return
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		_ = target.Close()
+
+		return
+	}
+
+	// the client may have sent data already, along with the request.
+	if buffered := bufrw.Reader.Buffered(); buffered > 0 {
+		data, _ := bufrw.Peek(buffered)
+
+		if _, err = target.Write(data); err != nil {
+			_ = target.Close()
+
+			return
+		}
+	}
+
+	if err = pipe.New(conn, target).Run(req.Context()); err != nil {
+		slog.Debug("error piping proxy conn", "host", req.Host, "err", err)
+	}
+}
+
+func statusFor(err error) int {
+	if errors.Is(err, ErrNotAllowed) {
+		return http.StatusForbidden
+	}
+
+	return http.StatusBadGateway
+}
+
+// asNetConn makes conn usable by http.Transport, if it is not a net.Conn already.
+func asNetConn(conn io.ReadWriteCloser) net.Conn {
+	if netConn, ok := conn.(net.Conn); ok {
+		return netConn
+	}
+
+	return &rwcConn{ReadWriteCloser: conn}
+}
+
+type rwcConn struct {
+	io.ReadWriteCloser
+}
+
+func (r *rwcConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (r *rwcConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (r *rwcConn) SetDeadline(_ time.Time) error      { return nil }
+func (r *rwcConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (r *rwcConn) SetWriteDeadline(_ time.Time) error { return nil }
@@ -0,0 +1,96 @@
+package httpproxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/duxthemux/netmux/foundation/httpproxy"
+)
+
+//nolint:funlen,paralleltest
+func TestProxy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("plain " + r.Host))
+	}))
+	defer plain.Close()
+
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secure " + r.Host))
+	}))
+	defer secure.Close()
+
+	proxy := httpproxy.New(func(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+		switch {
+		case strings.HasPrefix(addr, "plain.ns.svc.cluster.local:"):
+			return (&net.Dialer{}).DialContext(ctx, "tcp", plain.Listener.Addr().String())
+		case strings.HasPrefix(addr, "secure.ns.svc.cluster.local:"):
+			return (&net.Dialer{}).DialContext(ctx, "tcp", secure.Listener.Addr().String())
+		default:
+			return nil, fmt.Errorf("%w: %s", httpproxy.ErrNotAllowed, addr)
+		}
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	go func() {
+		_ = proxy.Serve(ctx, listener)
+	}()
+
+	proxyURL, err := url.Parse("http://" + listener.Addr().String())
+	assert.NoError(t, err)
+
+	cli := http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+	}}
+
+	get := func(u string) (int, string) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		assert.NoError(t, err)
+
+		res, err := cli.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+
+		defer func() {
+			_ = res.Body.Close()
+		}()
+
+		body, err := io.ReadAll(res.Body)
+		assert.NoError(t, err)
+
+		return res.StatusCode, string(body)
+	}
+
+	status, body := get("http://plain.ns.svc.cluster.local/")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "plain plain.ns.svc.cluster.local", body)
+
+	status, body = get("https://secure.ns.svc.cluster.local/")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "secure secure.ns.svc.cluster.local", body)
+
+	status, _ = get("http://elsewhere.com/")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://elsewhere.com/", nil)
+	assert.NoError(t, err)
+
+	_, err = cli.Do(req) //nolint:bodyclose
+	assert.ErrorContains(t, err, "Forbidden")
+}
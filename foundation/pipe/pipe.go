@@ -8,6 +8,7 @@ import (
 	"io"
 	"log/slog"
 	"runtime"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/errgroup"
@@ -32,12 +33,12 @@ func helperIoClose(closer io.Closer) {
 // countWriter is a wrapper to a io.Writer that allows tracking the amount of data written to it.
 type countWriter struct {
 	w       io.Writer
-	counter int64
+	counter atomic.Int64
 }
 
 // Write - same as io.Writer.Write. Every call will add the len of p to the counter.
 func (c *countWriter) Write(p []byte) (int, error) {
-	c.counter += int64(len(p))
+	c.counter.Add(int64(len(p)))
 
 	ret, err := c.w.Write(p)
 	if err != nil {
@@ -49,9 +50,7 @@ func (c *countWriter) Write(p []byte) (int, error) {
 
 // TotalWReset returns acc data and resets counter.
 func (c *countWriter) TotalWReset() int64 {
-	ret := c.counter
-	c.counter = 0
-	return ret
+	return c.counter.Swap(0)
 }
 
 // NewCountWriter creates a new countWriter on top of a pre-existing writer.
@@ -70,6 +69,8 @@ type Float64Metric func(i float64)
 type Pipe struct {
 	AMetric Float64Metric
 	BMetric Float64Metric
+	// OnClose, when set, is called once Run is over and the last metrics were reported.
+	OnClose func()
 	a       io.ReadWriteCloser
 	b       io.ReadWriteCloser
 }
@@ -140,7 +141,22 @@ func (p *Pipe) Run(ctx context.Context) error {
 		return nil
 	})
 
-	if err := group.Wait(); err != nil {
+	err := group.Wait()
+
+	// reporting what was copied since the last metrics collection.
+	if p.AMetric != nil {
+		p.AMetric(float64(aCountWriter.TotalWReset()))
+	}
+
+	if p.BMetric != nil {
+		p.BMetric(float64(bCountWriter.TotalWReset()))
+	}
+
+	if p.OnClose != nil {
+		p.OnClose()
+	}
+
+	if err != nil {
 		return fmt.Errorf("error processing pipe: %w", err)
 	}
 
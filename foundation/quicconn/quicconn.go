@@ -0,0 +1,411 @@
+// Package quicconn carries streams over quic: each one is a stream of a quic connection shared by the dialer, so
+// streams do not block each other when packets are lost. Listener hands the streams of accepted connections over as
+// net.Conn, and Dialer opens them, establishing the connection again when lost.
+//
+// Connection migration is not supported: once the local address changes (eg: after changing networks), the connection
+// is lost along with its streams, so the proxied connections they carried are cut - only new ones go over the
+// connection established again.
+//
+// Connections are authenticated by tls 1.3 (with client certificates, if the server requires them) and, optionally, a
+// token the client sends on the first stream of each connection.
+package quicconn
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN is the tls application protocol of the connections.
+const ALPN = "netmux"
+
+const (
+	KeepAlivePeriod = time.Second * 10
+	MaxIdleTimeout  = time.Second * 30
+	// MaxStreams is how many streams (proxied connections) a connection may have open at once.
+	MaxStreams  = 4096
+	authTimeout = time.Second * 10
+	maxTokenLen = 4096
+)
+
+const (
+	authOK = iota + 1
+	authDenied
+)
+
+// application error codes the connections are closed with.
+const (
+	codeClosed quic.ApplicationErrorCode = iota
+	codeUnauthorized
+)
+
+var (
+	ErrUnauthorized = fmt.Errorf("quic connection unauthorized")
+	ErrClosed       = fmt.Errorf("closed: %w", net.ErrClosed)
+)
+
+func quicConfig() *quic.Config {
+	return &quic.Config{ //nolint:exhaustruct
+		KeepAlivePeriod:    KeepAlivePeriod,
+		MaxIdleTimeout:     MaxIdleTimeout,
+		MaxIncomingStreams: MaxStreams,
+	}
+}
+
+// Conn is a stream of a quic connection.
+type Conn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes both directions of the stream - closing a quic.Stream only ends the writing one.
+func (c *Conn) Close() error {
+	c.Stream.CancelRead(0)
+
+	if err := c.Stream.Close(); err != nil {
+		return fmt.Errorf("error closing stream: %w", err)
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Listener accepts the streams of quic connections.
+type Listener struct {
+	listener *quic.Listener
+	token    string
+	conns    chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+}
+
+type ListenerOpts func(l *Listener)
+
+// WithToken only accepts connections whose client sends the token.
+func WithToken(token string) ListenerOpts {
+	return func(l *Listener) {
+		l.token = token
+	}
+}
+
+// Listen accepts quic connections at addr (udp). tlsConfig must have a certificate.
+func Listen(addr string, tlsConfig *tls.Config, opts ...ListenerOpts) (*Listener, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{ALPN}
+
+	listener, err := quic.ListenAddr(addr, tlsConfig, quicConfig())
+	if err != nil {
+		return nil, fmt.Errorf("error listening: %w", err)
+	}
+
+	ret := &Listener{
+		listener: listener,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	go ret.acceptConnections()
+
+	return ret, nil
+}
+
+func (l *Listener) acceptConnections() {
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+
+		go l.serveConnection(conn)
+	}
+}
+
+// serveConnection authenticates the connection, then hands its streams over.
+func (l *Listener) serveConnection(conn quic.Connection) {
+	if err := l.authenticate(conn); err != nil {
+		slog.Warn("quic connection refused", "raddr", conn.RemoteAddr().String(), "err", err)
+
+		_ = conn.CloseWithError(codeUnauthorized, "unauthorized")
+
+		return
+	}
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		select {
+		case l.conns <- &Conn{Stream: stream, conn: conn}:
+		case <-l.done:
+			_ = conn.CloseWithError(codeClosed, "listener closed")
+
+			return
+		}
+	}
+}
+
+// authenticate reads the token the client sends on the first stream, and tells if it was accepted.
+func (l *Listener) authenticate(conn quic.Connection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return fmt.Errorf("error accepting auth stream: %w", err)
+	}
+
+	defer func() {
+		_ = (&Conn{Stream: stream, conn: conn}).Close()
+	}()
+
+	_ = stream.SetDeadline(time.Now().Add(authTimeout))
+
+	token, err := io.ReadAll(io.LimitReader(stream, maxTokenLen))
+	if err != nil {
+		return fmt.Errorf("error reading token: %w", err)
+	}
+
+	if l.token != "" && subtle.ConstantTimeCompare(token, []byte(l.token)) != 1 {
+		_, _ = stream.Write([]byte{authDenied})
+
+		return ErrUnauthorized
+	}
+
+	if _, err = stream.Write([]byte{authOK}); err != nil {
+		return fmt.Errorf("error confirming auth: %w", err)
+	}
+
+	return nil
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+// Close stops accepting connections, closing the ones accepted.
+func (l *Listener) Close() error {
+	var err error
+
+	l.once.Do(func() {
+		close(l.done)
+
+		err = l.listener.Close()
+	})
+
+	if err != nil {
+		return fmt.Errorf("error closing listener: %w", err)
+	}
+
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Dialer opens streams of a quic connection to addr, establishing it when first needed and again once lost.
+type Dialer struct {
+	addr      string
+	tlsConfig *tls.Config
+	token     string
+
+	mx   sync.Mutex
+	conn quic.Connection
+	// dialing is closed once the connection being established (if any) is, or failed to.
+	dialing chan struct{}
+	closed  bool
+}
+
+// NewDialer creates a dialer to the listener at addr (udp). The token is sent if the listener requires one.
+func NewDialer(addr string, tlsConfig *tls.Config, token string) *Dialer {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS13} //nolint:exhaustruct
+	}
+
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{ALPN}
+
+	return &Dialer{addr: addr, tlsConfig: tlsConfig, token: token}
+}
+
+// Connect establishes the connection, unless there is one already.
+func (d *Dialer) Connect(ctx context.Context) error {
+	_, err := d.connection(ctx)
+
+	return err
+}
+
+// connection returns the established connection, or establishes it. Only one dial runs at a time, without holding
+// mx - callers wait for it (or their ctx) instead, dialing themselves if it fails.
+func (d *Dialer) connection(ctx context.Context) (quic.Connection, error) {
+	for {
+		d.mx.Lock()
+
+		if d.closed {
+			d.mx.Unlock()
+
+			return nil, ErrClosed
+		}
+
+		if d.conn != nil && d.conn.Context().Err() == nil {
+			conn := d.conn
+			d.mx.Unlock()
+
+			return conn, nil
+		}
+
+		if d.dialing == nil {
+			break
+		}
+
+		dialing := d.dialing
+		d.mx.Unlock()
+
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("error dialing quic: %w", ctx.Err())
+		}
+	}
+
+	dialing := make(chan struct{})
+	d.dialing = dialing
+	d.mx.Unlock()
+
+	conn, err := d.dial(ctx)
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.dialing = nil
+	close(dialing)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if d.closed {
+		_ = conn.CloseWithError(codeClosed, "")
+
+		return nil, ErrClosed
+	}
+
+	d.conn = conn
+
+	return conn, nil
+}
+
+// dial establishes an authenticated connection.
+func (d *Dialer) dial(ctx context.Context) (quic.Connection, error) {
+	conn, err := quic.DialAddr(ctx, d.addr, d.tlsConfig, quicConfig())
+	if err != nil {
+		return nil, fmt.Errorf("error dialing quic: %w", err)
+	}
+
+	if err = d.authenticate(ctx, conn); err != nil {
+		_ = conn.CloseWithError(codeClosed, "")
+
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (d *Dialer) authenticate(ctx context.Context, conn quic.Connection) error {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("error opening auth stream: %w", err)
+	}
+
+	_ = stream.SetDeadline(time.Now().Add(authTimeout))
+
+	// the token is always sent - even empty - as the listener takes the first stream for it.
+	if _, err = stream.Write([]byte(d.token)); err != nil {
+		return fmt.Errorf("error sending token: %w", err)
+	}
+
+	if err = stream.Close(); err != nil {
+		return fmt.Errorf("error sending token: %w", err)
+	}
+
+	res := make([]byte, 1)
+	if _, err = io.ReadFull(stream, res); err != nil {
+		// the connection may be closed before the denial is read.
+		var appErr *quic.ApplicationError
+		if errors.As(err, &appErr) && appErr.ErrorCode == codeUnauthorized {
+			return ErrUnauthorized
+		}
+
+		return fmt.Errorf("error reading auth confirmation: %w", err)
+	}
+
+	if res[0] != authOK {
+		return ErrUnauthorized
+	}
+
+	return nil
+}
+
+// Dial opens a stream. As all streams go to the same listener, the endpoint is ignored.
+func (d *Dialer) Dial(ctx context.Context, _ string) (net.Conn, error) {
+	conn, err := d.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error opening stream: %w", err)
+	}
+
+	return &Conn{Stream: stream, conn: conn}, nil
+}
+
+// Close closes the connection, and its streams. Dialing is no longer possible.
+func (d *Dialer) Close() error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.closed = true
+
+	if d.conn == nil {
+		return nil
+	}
+
+	if err := d.conn.CloseWithError(codeClosed, ""); err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("error closing quic connection: %w", err)
+	}
+
+	return nil
+}
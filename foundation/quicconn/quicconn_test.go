@@ -0,0 +1,214 @@
+package quicconn_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/duxthemux/netmux/foundation/quicconn"
+)
+
+// tlsConfigs returns the tls configs of a server (with a certificate for 127.0.0.1) and of a client trusting it.
+func tlsConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+
+	return srv.TLS, srv.Client().Transport.(*http.Transport).TLSClientConfig //nolint:forcetypeassert
+}
+
+func echoListener(t *testing.T, serverTLS *tls.Config, opts ...quicconn.ListenerOpts) string {
+	t.Helper()
+
+	listener, err := quicconn.Listen("127.0.0.1:0", serverTLS, opts...)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+//nolint:paralleltest
+func TestStreams(t *testing.T) {
+	serverTLS, clientTLS := tlsConfigs(t)
+	addr := echoListener(t, serverTLS, quicconn.WithToken("secret"))
+
+	dialer := quicconn.NewDialer(addr, clientTLS, "secret")
+	defer func() {
+		_ = dialer.Close()
+	}()
+
+	ctx := context.Background()
+
+	// streams share the connection, without blocking each other.
+	first, err := dialer.Dial(ctx, "")
+	require.NoError(t, err)
+
+	second, err := dialer.Dial(ctx, "")
+	require.NoError(t, err)
+
+	assert.Equal(t, first.LocalAddr(), second.LocalAddr())
+
+	for i, conn := range []io.ReadWriteCloser{second, first} {
+		msg := fmt.Sprintf("stream %d", i)
+
+		_, err = conn.Write([]byte(msg))
+		require.NoError(t, err)
+
+		buf := make([]byte, len(msg))
+
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(buf))
+
+		require.NoError(t, conn.Close())
+	}
+}
+
+//nolint:paralleltest
+func TestUnauthorized(t *testing.T) {
+	serverTLS, clientTLS := tlsConfigs(t)
+	addr := echoListener(t, serverTLS, quicconn.WithToken("secret"))
+
+	dialer := quicconn.NewDialer(addr, clientTLS, "guess")
+	defer func() {
+		_ = dialer.Close()
+	}()
+
+	_, err := dialer.Dial(context.Background(), "")
+	require.ErrorIs(t, err, quicconn.ErrUnauthorized)
+}
+
+//nolint:paralleltest
+func TestDialClosed(t *testing.T) {
+	serverTLS, clientTLS := tlsConfigs(t)
+	addr := echoListener(t, serverTLS)
+
+	dialer := quicconn.NewDialer(addr, clientTLS, "")
+	require.NoError(t, dialer.Connect(context.Background()))
+	require.NoError(t, dialer.Close())
+
+	_, err := dialer.Dial(context.Background(), "")
+	require.ErrorIs(t, err, quicconn.ErrClosed)
+}
+
+//nolint:paralleltest
+func TestDialConcurrently(t *testing.T) {
+	serverTLS, clientTLS := tlsConfigs(t)
+	addr := echoListener(t, serverTLS)
+
+	dialer := quicconn.NewDialer(addr, clientTLS, "")
+	defer func() {
+		_ = dialer.Close()
+	}()
+
+	const dials = 8
+
+	conns := make(chan net.Conn, dials)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < dials; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			conn, err := dialer.Dial(context.Background(), "")
+			assert.NoError(t, err)
+
+			conns <- conn
+		}()
+	}
+
+	wg.Wait()
+	close(conns)
+
+	// a single connection is established for all of them.
+	var laddr net.Addr
+
+	for conn := range conns {
+		require.NotNil(t, conn)
+
+		if laddr == nil {
+			laddr = conn.LocalAddr()
+		}
+
+		assert.Equal(t, laddr, conn.LocalAddr())
+
+		_ = conn.Close()
+	}
+}
+
+//nolint:paralleltest
+func TestDialWaitsForCtx(t *testing.T) {
+	_, clientTLS := tlsConfigs(t)
+
+	// a server never answering, so dialing it hangs.
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer func() {
+		_ = pconn.Close()
+	}()
+
+	dialer := quicconn.NewDialer(pconn.LocalAddr().String(), clientTLS, "")
+	defer func() {
+		_ = dialer.Close()
+	}()
+
+	slowCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	slow := make(chan error, 1)
+
+	go func() {
+		_, err := dialer.Dial(slowCtx, "")
+		slow <- err
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	// waiting behind the hanging dial ends with the ctx of the waiting one.
+	ctx, cancelWait := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancelWait()
+
+	start := time.Now()
+
+	_, err = dialer.Dial(ctx, "")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second*2)
+
+	cancel()
+	require.Error(t, <-slow)
+}
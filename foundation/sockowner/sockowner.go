@@ -0,0 +1,15 @@
+// Package sockowner finds out which local process owns a TCP connection, on the platforms that allow it.
+package sockowner
+
+import "fmt"
+
+var (
+	ErrNotFound     = fmt.Errorf("socket owner not found")
+	ErrNotSupported = fmt.Errorf("socket owner lookup not supported on this platform")
+)
+
+// Process identifies the owner of a socket.
+type Process struct {
+	PID  int    `json:"pid"`
+	Name string `json:"name"`
+}
@@ -0,0 +1,91 @@
+package sockowner
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// Lookup finds the process owning the TCP socket whose local address is local and is connected to remote.
+// Addresses are in the host:port format.
+func Lookup(local string, remote string) (Process, error) {
+	owners, err := lsof("-iTCP@" + local)
+	if err != nil {
+		return Process{}, err
+	}
+
+	proc, found := owners[local+"->"+remote]
+	if !found {
+		return Process{}, ErrNotFound
+	}
+
+	return proc, nil
+}
+
+// Table holds the TCP connections of the host and their owners as found when it was created, so that many sockets
+// are looked up at the cost of a single lsof run.
+type Table struct {
+	owners map[string]Process
+}
+
+// NewTable lists the established TCP connections of the host and the processes owning them.
+func NewTable() (*Table, error) {
+	owners, err := lsof("-iTCP")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Table{owners: owners}, nil
+}
+
+// Lookup finds, in the table, the process owning the TCP socket whose local address is local and is connected to
+// remote. Addresses are in the host:port format.
+func (t *Table) Lookup(local string, remote string) (Process, error) {
+	proc, found := t.owners[local+"->"+remote]
+	if !found {
+		return Process{}, ErrNotFound
+	}
+
+	return proc, nil
+}
+
+// lsof lists the owners of the established connections selected by filter, by their <local>-><remote> name.
+func lsof(filter string) (map[string]Process, error) {
+	//nolint:gosec
+	out, err := exec.Command("lsof", "-n", "-P", filter, "-sTCP:ESTABLISHED", "-F", "pcn").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running lsof: %w", err)
+	}
+
+	ret := make(map[string]Process)
+	proc := Process{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+
+	// lsof field output: p<pid>, c<command> and then n<local>-><remote> for each file of that process.
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		switch line[0] {
+		case 'p':
+			pid, err := strconv.Atoi(line[1:])
+			if err != nil {
+				return nil, fmt.Errorf("error parsing lsof pid: %w", err)
+			}
+
+			proc = Process{PID: pid}
+		case 'c':
+			proc.Name = line[1:]
+		case 'n':
+			if _, found := ret[line[1:]]; !found {
+				ret[line[1:]] = proc
+			}
+		}
+	}
+
+	return ret, nil
+}
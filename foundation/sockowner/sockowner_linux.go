@@ -0,0 +1,258 @@
+package sockowner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Lookup finds the process owning the TCP socket whose local address is local and is connected to remote.
+// Addresses are in the host:port format.
+func Lookup(local string, remote string) (Process, error) {
+	localAddr, err := netip.ParseAddrPort(local)
+	if err != nil {
+		return Process{}, fmt.Errorf("error parsing local address %s: %w", local, err)
+	}
+
+	remoteAddr, err := netip.ParseAddrPort(remote)
+	if err != nil {
+		return Process{}, fmt.Errorf("error parsing remote address %s: %w", remote, err)
+	}
+
+	inode, err := findInode(normalize(localAddr), normalize(remoteAddr))
+	if err != nil {
+		return Process{}, err
+	}
+
+	return findProcess(inode)
+}
+
+func normalize(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+// findInode scans /proc/net/tcp and /proc/net/tcp6 for the socket connecting local and remote.
+func findInode(local netip.AddrPort, remote netip.AddrPort) (string, error) {
+	for _, fname := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		file, err := os.Open(fname)
+		if err != nil {
+			continue
+		}
+
+		inode := scanInode(bufio.NewScanner(file), local, remote)
+
+		_ = file.Close()
+
+		if inode != "" {
+			return inode, nil
+		}
+	}
+
+	return "", ErrNotFound
+}
+
+func scanInode(scanner *bufio.Scanner, local netip.AddrPort, remote netip.AddrPort) string {
+	const inodeField = 9
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) <= inodeField {
+			continue
+		}
+
+		lAddr, err := parseProcAddr(fields[1])
+		if err != nil || lAddr != local {
+			continue
+		}
+
+		rAddr, err := parseProcAddr(fields[2])
+		if err != nil || rAddr != remote {
+			continue
+		}
+
+		return fields[inodeField]
+	}
+
+	return ""
+}
+
+// parseProcAddr decodes addresses as found in /proc/net/tcp: hex encoded, 32 bits words in host (little endian)
+// order, followed by the port.
+func parseProcAddr(s string) (netip.AddrPort, error) {
+	hexAddr, hexPort, found := strings.Cut(s, ":")
+	if !found {
+		return netip.AddrPort{}, fmt.Errorf("invalid address: %s", s)
+	}
+
+	raw, err := hex.DecodeString(hexAddr)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %s: %w", s, err)
+	}
+
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port %s: %w", s, err)
+	}
+
+	for i := 0; i+4 <= len(raw); i += 4 {
+		binary.BigEndian.PutUint32(raw[i:], binary.LittleEndian.Uint32(raw[i:]))
+	}
+
+	addr, ok := netip.AddrFromSlice(raw)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("invalid address: %s", s)
+	}
+
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+}
+
+// findProcess looks for the process holding a file descriptor for the socket inode.
+func findProcess(inode string) (Process, error) {
+	target := "socket:[" + inode + "]"
+
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/*")
+	if err != nil {
+		return Process{}, fmt.Errorf("error listing file descriptors: %w", err)
+	}
+
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || link != target {
+			continue
+		}
+
+		if proc, ok := fdProcess(fd); ok {
+			return proc, nil
+		}
+	}
+
+	return Process{}, ErrNotFound
+}
+
+// fdProcess tells the process a file descriptor path (/proc/<pid>/fd/<fd>) belongs to.
+func fdProcess(fd string) (Process, bool) {
+	pidDir := filepath.Dir(filepath.Dir(fd))
+
+	pid, err := strconv.Atoi(filepath.Base(pidDir))
+	if err != nil {
+		return Process{}, false
+	}
+
+	comm, err := os.ReadFile(filepath.Join(pidDir, "comm"))
+	if err != nil {
+		return Process{PID: pid}, true
+	}
+
+	return Process{PID: pid, Name: strings.TrimSpace(string(comm))}, true
+}
+
+type socketKey struct {
+	local  netip.AddrPort
+	remote netip.AddrPort
+}
+
+// Table holds the TCP sockets of the host and their owners as found when it was created, so that many sockets are
+// looked up at the cost of a single scan of /proc.
+type Table struct {
+	owners map[socketKey]Process
+}
+
+// NewTable scans the TCP sockets of the host and the processes owning them.
+func NewTable() (*Table, error) {
+	inodes := make(map[string]socketKey)
+
+	for _, fname := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		file, err := os.Open(fname)
+		if err != nil {
+			continue
+		}
+
+		scanInodes(bufio.NewScanner(file), inodes)
+
+		_ = file.Close()
+	}
+
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/*")
+	if err != nil {
+		return nil, fmt.Errorf("error listing file descriptors: %w", err)
+	}
+
+	ret := &Table{owners: make(map[socketKey]Process)}
+
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil {
+			continue
+		}
+
+		inode, found := strings.CutPrefix(link, "socket:[")
+		if !found {
+			continue
+		}
+
+		key, found := inodes[strings.TrimSuffix(inode, "]")]
+		if !found {
+			continue
+		}
+
+		if _, found = ret.owners[key]; found {
+			continue
+		}
+
+		if proc, ok := fdProcess(fd); ok {
+			ret.owners[key] = proc
+		}
+	}
+
+	return ret, nil
+}
+
+func scanInodes(scanner *bufio.Scanner, inodes map[string]socketKey) {
+	const inodeField = 9
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) <= inodeField {
+			continue
+		}
+
+		lAddr, err := parseProcAddr(fields[1])
+		if err != nil {
+			continue
+		}
+
+		rAddr, err := parseProcAddr(fields[2])
+		if err != nil {
+			continue
+		}
+
+		inodes[fields[inodeField]] = socketKey{local: lAddr, remote: rAddr}
+	}
+}
+
+// Lookup finds, in the table, the process owning the TCP socket whose local address is local and is connected to
+// remote. Addresses are in the host:port format.
+func (t *Table) Lookup(local string, remote string) (Process, error) {
+	localAddr, err := netip.ParseAddrPort(local)
+	if err != nil {
+		return Process{}, fmt.Errorf("error parsing local address %s: %w", local, err)
+	}
+
+	remoteAddr, err := netip.ParseAddrPort(remote)
+	if err != nil {
+		return Process{}, fmt.Errorf("error parsing remote address %s: %w", remote, err)
+	}
+
+	proc, found := t.owners[socketKey{local: normalize(localAddr), remote: normalize(remoteAddr)}]
+	if !found {
+		return Process{}, ErrNotFound
+	}
+
+	return proc, nil
+}
@@ -0,0 +1,70 @@
+package sockowner_test
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/duxthemux/netmux/foundation/sockowner"
+)
+
+func TestLookupOwnConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	proc, err := sockowner.Lookup(conn.LocalAddr().String(), conn.RemoteAddr().String())
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getpid(), proc.PID)
+
+	_, err = sockowner.Lookup("127.0.0.1:1", "127.0.0.1:2")
+	assert.ErrorIs(t, err, sockowner.ErrNotFound)
+}
+
+func TestTableOwnConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	conns := make([]net.Conn, 0)
+
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.NoError(t, err)
+
+		conns = append(conns, conn)
+	}
+
+	owners, err := sockowner.NewTable()
+	assert.NoError(t, err)
+
+	for _, conn := range conns {
+		proc, err := owners.Lookup(conn.LocalAddr().String(), conn.RemoteAddr().String())
+		assert.NoError(t, err)
+		assert.Equal(t, os.Getpid(), proc.PID)
+	}
+
+	_, err = owners.Lookup("127.0.0.1:1", "127.0.0.1:2")
+	assert.ErrorIs(t, err, sockowner.ErrNotFound)
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !darwin
+
+package sockowner
+
+// Lookup is not supported on this platform.
+func Lookup(_ string, _ string) (Process, error) {
+	return Process{}, ErrNotSupported
+}
+
+// Table is not supported on this platform.
+type Table struct{}
+
+// NewTable is not supported on this platform.
+func NewTable() (*Table, error) {
+	return nil, ErrNotSupported
+}
+
+// Lookup is not supported on this platform.
+func (t *Table) Lookup(_ string, _ string) (Process, error) {
+	return Process{}, ErrNotSupported
+}
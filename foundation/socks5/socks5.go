@@ -0,0 +1,236 @@
+// Package socks5 implements a minimal SOCKS5 server (RFC 1928): no authentication and CONNECT requests only. Where
+// connections go is decided by the Dialer provided, which receives the requested address unresolved.
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+
+	"github.com/duxthemux/netmux/foundation/pipe"
+)
+
+const (
+	version5 = 0x05
+
+	methodNoAuth       = 0x00
+	methodNoAcceptable = 0xff
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	RepSucceeded           = 0x00
+	RepGeneralFailure      = 0x01
+	RepNotAllowed          = 0x02
+	RepHostUnreachable     = 0x04
+	RepConnectionRefused   = 0x05
+	RepCommandNotSupported = 0x07
+	RepAddressNotSupported = 0x08
+)
+
+var (
+	// ErrNotAllowed should be wrapped by dialers refusing to connect to an address, so clients are told so.
+	ErrNotAllowed = fmt.Errorf("connection not allowed")
+
+	ErrUnsupportedVersion = fmt.Errorf("unsupported socks version")
+	ErrNoAcceptableMethod = fmt.Errorf("no acceptable authentication method")
+	ErrUnsupportedCommand = fmt.Errorf("unsupported socks command")
+	ErrUnsupportedAddress = fmt.Errorf("unsupported address type")
+)
+
+// Dialer connects to addr (host:port, where host may be a name) on behalf of a client.
+type Dialer func(ctx context.Context, addr string) (io.ReadWriteCloser, error)
+
+type Server struct {
+	dialer Dialer
+}
+
+func New(dialer Dialer) *Server {
+	return &Server{dialer: dialer}
+}
+
+// Serve accepts connections from listener until it fails or ctx is done - in which case the listener is closed.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+
+		_ = listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("context cancelled when serving socks: %w", context.Cause(ctx))
+			}
+
+			return fmt.Errorf("error accepting socks conn: %w", err)
+		}
+
+		go func() {
+			if err := s.ServeConn(ctx, conn); err != nil {
+				slog.Debug("error serving socks conn", "client", conn.RemoteAddr().String(), "err", err)
+			}
+		}()
+	}
+}
+
+// ServeConn handles the socks handshake in conn and, if all goes well, pipes it to the requested address.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if err := s.negotiate(conn); err != nil {
+		return err
+	}
+
+	addr, err := readRequest(conn)
+	if err != nil {
+		rep := byte(RepGeneralFailure)
+
+		switch {
+		case errors.Is(err, ErrUnsupportedCommand):
+			rep = RepCommandNotSupported
+		case errors.Is(err, ErrUnsupportedAddress):
+			rep = RepAddressNotSupported
+		}
+
+		_ = writeReply(conn, rep)
+
+		return err
+	}
+
+	target, err := s.dialer(ctx, addr)
+	if err != nil {
+		_ = writeReply(conn, replyFor(err))
+
+		return fmt.Errorf("error dialing %s: %w", addr, err)
+	}
+
+	if err = writeReply(conn, RepSucceeded); err != nil {
+		_ = target.Close()
+
+		return err
+	}
+
+	if err = pipe.New(conn, target).Run(ctx); err != nil {
+		return fmt.Errorf("error piping %s: %w", addr, err)
+	}
+
+	return nil
+}
+
+func replyFor(err error) byte {
+	var opErr *net.OpError
+
+	switch {
+	case errors.Is(err, ErrNotAllowed):
+		return RepNotAllowed
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return RepConnectionRefused
+	default:
+		return RepHostUnreachable
+	}
+}
+
+func (s *Server) negotiate(conn net.Conn) error {
+	header := make([]byte, 2) //nolint:gomnd
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("error reading greeting: %w", err)
+	}
+
+	if header[0] != version5 {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("error reading auth methods: %w", err)
+	}
+
+	for _, method := range methods {
+		if method == methodNoAuth {
+			if _, err := conn.Write([]byte{version5, methodNoAuth}); err != nil {
+				return fmt.Errorf("error writing method selection: %w", err)
+			}
+
+			return nil
+		}
+	}
+
+	_, _ = conn.Write([]byte{version5, methodNoAcceptable})
+
+	return ErrNoAcceptableMethod
+}
+
+// readRequest reads a request, returning the address requested as host:port.
+func readRequest(conn net.Conn) (string, error) {
+	header := make([]byte, 4) //nolint:gomnd
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("error reading request: %w", err)
+	}
+
+	if header[0] != version5 {
+		return "", fmt.Errorf("%w: %d", ErrUnsupportedVersion, header[0])
+	}
+
+	if header[1] != cmdConnect {
+		return "", fmt.Errorf("%w: %d", ErrUnsupportedCommand, header[1])
+	}
+
+	var host string
+
+	switch header[3] {
+	case atypIPv4, atypIPv6:
+		size := net.IPv4len
+		if header[3] == atypIPv6 {
+			size = net.IPv6len
+		}
+
+		addr := make([]byte, size)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", fmt.Errorf("error reading address: %w", err)
+		}
+
+		host = net.IP(addr).String()
+	case atypDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", fmt.Errorf("error reading domain length: %w", err)
+		}
+
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", fmt.Errorf("error reading domain: %w", err)
+		}
+
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("%w: %d", ErrUnsupportedAddress, header[3])
+	}
+
+	port := make([]byte, 2) //nolint:gomnd
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", fmt.Errorf("error reading port: %w", err)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeReply answers a request. We never report the bound address, as it is meaningless in our case.
+func writeReply(conn net.Conn, rep byte) error {
+	if _, err := conn.Write([]byte{version5, rep, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		return fmt.Errorf("error writing reply: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package socks5_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/proxy"
+
+	"github.com/duxthemux/netmux/foundation/socks5"
+)
+
+func echoServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+//nolint:paralleltest
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echoAddr := echoServer(t)
+
+	requested := make(chan string, 1)
+
+	srv := socks5.New(func(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+		requested <- addr
+
+		if addr == "forbidden.ns.svc.cluster.local:80" {
+			return nil, fmt.Errorf("%w: by policy", socks5.ErrNotAllowed)
+		}
+
+		return (&net.Dialer{}).DialContext(ctx, "tcp", echoAddr)
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	go func() {
+		_ = srv.Serve(ctx, listener)
+	}()
+
+	dialer, err := proxy.SOCKS5("tcp", listener.Addr().String(), nil, proxy.Direct)
+	assert.NoError(t, err)
+
+	conn, err := dialer.Dial("tcp", "echo.ns.svc.cluster.local:80")
+	assert.NoError(t, err)
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	assert.Equal(t, "echo.ns.svc.cluster.local:80", <-requested)
+
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	_, err = dialer.Dial("tcp", "forbidden.ns.svc.cluster.local:80")
+	assert.ErrorContains(t, err, "not allowed")
+	assert.Equal(t, "forbidden.ns.svc.cluster.local:80", <-requested)
+
+	_, err = dialer.Dial("tcp", "10.0.0.1:5432")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:5432", <-requested)
+}
@@ -0,0 +1,259 @@
+// Package sshdial opens connections through an ssh server - a jump host, or bastion - as ssh -L does. The ssh
+// connection is shared by all of them, kept alive, and established again when lost.
+package sshdial
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DefaultPort = "22"
+	// KeepAliveInterval is how often the ssh server is asked to reply, the connection being closed (and established
+	// again when needed) if it does not within KeepAliveTimeout.
+	KeepAliveInterval = time.Second * 15
+	KeepAliveTimeout  = time.Second * 10
+	HandshakeTimeout  = time.Second * 10
+)
+
+var ErrClosed = fmt.Errorf("ssh dialer closed: %w", net.ErrClosed)
+
+// Dialer opens connections through the ssh server at addr.
+type Dialer struct {
+	addr    string
+	config  *ssh.ClientConfig
+	netDial func(ctx context.Context, addr string) (net.Conn, error)
+
+	mx     sync.Mutex
+	client *ssh.Client
+	closed bool
+}
+
+type Opts func(d *Dialer)
+
+// WithNetDial opens the connection to the ssh server with netDial (eg: through a proxy), instead of over tcp.
+func WithNetDial(netDial func(ctx context.Context, addr string) (net.Conn, error)) Opts {
+	return func(d *Dialer) {
+		d.netDial = netDial
+	}
+}
+
+// NewDialer creates a dialer through the ssh server at addr (host or host:port), authenticating as config tells.
+func NewDialer(addr string, config *ssh.ClientConfig, opts ...Opts) *Dialer {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, DefaultPort)
+	}
+
+	ret := &Dialer{
+		addr:   addr,
+		config: config,
+		netDial: func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "tcp", addr) //nolint:exhaustruct,wrapcheck
+		},
+	}
+
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	return ret
+}
+
+// Connect establishes the ssh connection, unless there is one already.
+func (d *Dialer) Connect(ctx context.Context) error {
+	_, err := d.sshClient(ctx)
+
+	return err
+}
+
+func (d *Dialer) sshClient(ctx context.Context) (*ssh.Client, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if d.closed {
+		return nil, ErrClosed
+	}
+
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	client, err := d.dialSSH(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	d.client = client
+
+	lost := make(chan struct{})
+
+	go d.keepAlive(client, lost)
+
+	go func() {
+		err := client.Wait()
+
+		slog.Debug("ssh connection closed", "addr", d.addr, "err", err)
+
+		close(lost)
+		d.forget(client)
+	}()
+
+	return client, nil
+}
+
+func (d *Dialer) dialSSH(ctx context.Context) (*ssh.Client, error) {
+	conn, err := d.netDial(ctx, d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing ssh server: %w", err)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > HandshakeTimeout {
+		deadline = time.Now().Add(HandshakeTimeout)
+	}
+
+	_ = conn.SetDeadline(deadline)
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, d.addr, d.config)
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, fmt.Errorf("error establishing ssh connection: %w", err)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// forget drops client, if still the current one, so the next dial establishes a new connection.
+func (d *Dialer) forget(client *ssh.Client) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if d.client == client {
+		d.client = nil
+	}
+}
+
+// keepAlive closes client once the server stops replying, until it is lost.
+func (d *Dialer) keepAlive(client *ssh.Client, lost <-chan struct{}) {
+	ticker := time.NewTicker(KeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lost:
+			return
+		case <-ticker.C:
+		}
+
+		replied := make(chan error, 1)
+
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+
+		select {
+		case err := <-replied:
+			if err == nil {
+				continue
+			}
+
+			slog.Debug("ssh keepalive failed", "addr", d.addr, "err", err)
+		case <-time.After(KeepAliveTimeout):
+			slog.Warn("ssh server not replying, closing connection", "addr", d.addr)
+		}
+
+		_ = client.Close()
+
+		return
+	}
+}
+
+// Dial connects to addr (host:port, as the ssh server resolves it) through the ssh server. A lost ssh connection is
+// established again.
+func (d *Dialer) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := d.dial(ctx, addr)
+
+	var openErr *ssh.OpenChannelError
+	if err == nil || errors.As(err, &openErr) || ctx.Err() != nil || errors.Is(err, ErrClosed) {
+		return conn, err
+	}
+
+	// the ssh connection may have been lost without noticing yet: try once more, on a new one.
+	slog.Debug("dialing through ssh failed, trying a new connection", "addr", d.addr, "err", err)
+
+	return d.dial(ctx, addr)
+}
+
+func (d *Dialer) dial(ctx context.Context, addr string) (net.Conn, error) {
+	client, err := d.sshClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	dialed := make(chan result, 1)
+
+	go func() {
+		conn, err := client.Dial("tcp", addr)
+		dialed <- result{conn: conn, err: err}
+	}()
+
+	select {
+	case res := <-dialed:
+		if res.err != nil {
+			var openErr *ssh.OpenChannelError
+			if !errors.As(res.err, &openErr) {
+				_ = client.Close()
+				d.forget(client)
+			}
+
+			return nil, fmt.Errorf("error dialing %s through ssh: %w", addr, res.err)
+		}
+
+		return res.conn, nil
+	case <-ctx.Done():
+		go func() {
+			if res := <-dialed; res.conn != nil {
+				_ = res.conn.Close()
+			}
+		}()
+
+		return nil, fmt.Errorf("error dialing %s through ssh: %w", addr, ctx.Err())
+	}
+}
+
+// Close closes the ssh connection, and the connections through it. Dialing is no longer possible.
+func (d *Dialer) Close() error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.closed = true
+
+	if d.client == nil {
+		return nil
+	}
+
+	err := d.client.Close()
+	d.client = nil
+
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("error closing ssh connection: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package sshdial_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/duxthemux/netmux/foundation/sshdial"
+	"github.com/duxthemux/netmux/foundation/sshdial/sshdialtest"
+)
+
+func echoServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func expectEcho(t *testing.T, dialer *sshdial.Dialer, addr string) {
+	t.Helper()
+
+	conn, err := dialer.Dial(context.Background(), addr)
+	require.NoError(t, err)
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 4)
+
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func newDialer(t *testing.T, config *ssh.ClientConfig, jumpHost *sshdialtest.JumpHost) *sshdial.Dialer {
+	t.Helper()
+
+	dialer := sshdial.NewDialer(jumpHost.Addr(), config)
+
+	t.Cleanup(func() {
+		_ = dialer.Close()
+	})
+
+	return dialer
+}
+
+//nolint:paralleltest
+func TestDialThroughJumpHost(t *testing.T) {
+	jumpHost := sshdialtest.NewJumpHost(t)
+	echo := echoServer(t)
+
+	dialer := newDialer(t, jumpHost.ClientConfig(), jumpHost)
+
+	expectEcho(t, dialer, echo)
+	expectEcho(t, dialer, echo)
+
+	// an unreachable target does not bring the ssh connection down.
+	_, err := dialer.Dial(context.Background(), "127.0.0.1:1")
+
+	var openErr *ssh.OpenChannelError
+	require.ErrorAs(t, err, &openErr)
+
+	expectEcho(t, dialer, echo)
+	assert.Equal(t, 1, jumpHost.Conns())
+}
+
+//nolint:paralleltest
+func TestReconnects(t *testing.T) {
+	jumpHost := sshdialtest.NewJumpHost(t)
+	echo := echoServer(t)
+
+	dialer := newDialer(t, jumpHost.ClientConfig(), jumpHost)
+
+	expectEcho(t, dialer, echo)
+
+	jumpHost.Drop()
+
+	expectEcho(t, dialer, echo)
+	assert.Equal(t, 1, jumpHost.Conns())
+}
+
+//nolint:paralleltest
+func TestUnknownHostKey(t *testing.T) {
+	jumpHost := sshdialtest.NewJumpHost(t)
+
+	config := jumpHost.ClientConfig()
+	config.HostKeyCallback = ssh.FixedHostKey(sshdialtest.NewSigner(t).PublicKey())
+
+	require.Error(t, newDialer(t, config, jumpHost).Connect(context.Background()))
+}
+
+//nolint:paralleltest
+func TestUnknownClientKey(t *testing.T) {
+	jumpHost := sshdialtest.NewJumpHost(t)
+
+	config := jumpHost.ClientConfig()
+	config.Auth = []ssh.AuthMethod{ssh.PublicKeys(sshdialtest.NewSigner(t))}
+
+	require.Error(t, newDialer(t, config, jumpHost).Connect(context.Background()))
+}
+
+//nolint:paralleltest
+func TestDialClosed(t *testing.T) {
+	jumpHost := sshdialtest.NewJumpHost(t)
+
+	dialer := newDialer(t, jumpHost.ClientConfig(), jumpHost)
+	require.NoError(t, dialer.Connect(context.Background()))
+	require.NoError(t, dialer.Close())
+
+	_, err := dialer.Dial(context.Background(), echoServer(t))
+	require.ErrorIs(t, err, sshdial.ErrClosed)
+}
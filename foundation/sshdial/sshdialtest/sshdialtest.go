@@ -0,0 +1,178 @@
+// Package sshdialtest provides an in-process ssh server forwarding connections, as jump hosts do, for tests.
+package sshdialtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// NewSigner generates an ed25519 key.
+func NewSigner(t testing.TB) ssh.Signer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	ret, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	return ret
+}
+
+// JumpHost is an ssh server forwarding direct-tcpip channels, as ssh -L requires, for clients with ClientKey.
+type JumpHost struct {
+	HostKey   ssh.Signer
+	ClientKey ssh.Signer
+
+	listener net.Listener
+	mx       sync.Mutex
+	conns    []net.Conn
+}
+
+// NewJumpHost starts a jump host, closed once the test is over.
+func NewJumpHost(t testing.TB) *JumpHost {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	ret := &JumpHost{HostKey: NewSigner(t), ClientKey: NewSigner(t), listener: listener}
+
+	config := &ssh.ServerConfig{ //nolint:exhaustruct
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(ret.ClientKey.PublicKey().Marshal()) {
+				return nil, fmt.Errorf("unknown key")
+			}
+
+			return &ssh.Permissions{}, nil //nolint:exhaustruct
+		},
+	}
+	config.AddHostKey(ret.HostKey)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			ret.mx.Lock()
+			ret.conns = append(ret.conns, conn)
+			ret.mx.Unlock()
+
+			go ret.serve(conn, config)
+		}
+	}()
+
+	return ret
+}
+
+func (j *JumpHost) Addr() string {
+	return j.listener.Addr().String()
+}
+
+// ClientConfig authenticates with ClientKey, accepting HostKey only.
+func (j *JumpHost) ClientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{ //nolint:exhaustruct
+		User:            "netmux",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(j.ClientKey)},
+		HostKeyCallback: ssh.FixedHostKey(j.HostKey.PublicKey()),
+		Timeout:         time.Second,
+	}
+}
+
+func (j *JumpHost) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip")
+
+			continue
+		}
+
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+
+		if err = ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+
+			continue
+		}
+
+		upstream, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+
+			continue
+		}
+
+		channel, chReqs, err := newChannel.Accept()
+		if err != nil {
+			_ = upstream.Close()
+
+			continue
+		}
+
+		go ssh.DiscardRequests(chReqs)
+
+		go pipe(channel, upstream)
+	}
+}
+
+func pipe(channel ssh.Channel, upstream net.Conn) {
+	defer func() {
+		_ = channel.Close()
+		_ = upstream.Close()
+	}()
+
+	go func() {
+		_, _ = io.Copy(channel, upstream)
+		_ = channel.CloseWrite()
+	}()
+
+	_, _ = io.Copy(upstream, channel)
+}
+
+// Drop closes every connection of the jump host, as a restart or a network change would.
+func (j *JumpHost) Drop() {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	for _, conn := range j.conns {
+		_ = conn.Close()
+	}
+
+	j.conns = nil
+}
+
+// Conns tells how many connections the jump host has accepted since started, or dropped.
+func (j *JumpHost) Conns() int {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	return len(j.conns)
+}
@@ -0,0 +1,308 @@
+// Package upstream dials through the proxy outbound connections are required to go through: HTTP CONNECT (with basic
+// or NTLM authentication) or SOCKS5. Whether an address goes through the proxy is decided as HTTPS_PROXY and NO_PROXY
+// do - addresses of the local host never do.
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-ntlmssp"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// Authentication schemes for http proxies, given credentials in the proxy url.
+const (
+	AuthBasic = "basic"
+	AuthNTLM  = "ntlm"
+)
+
+var (
+	ErrProxyRefused      = fmt.Errorf("proxy refused connection")
+	ErrUnsupportedScheme = fmt.Errorf("unsupported proxy scheme")
+	ErrUnknownAuth       = fmt.Errorf("unknown proxy authentication")
+)
+
+// Dialer connects to addresses through the proxy they require, if any.
+type Dialer struct {
+	proxyFunc func(*url.URL) (*url.URL, error)
+	auth      string
+	forward   *net.Dialer
+}
+
+type Opts func(d *Dialer)
+
+// WithProxy goes through proxyURL (http://, https://, socks5:// or socks5h://, with user:password when the proxy
+// requires them) except for the hosts noProxy tells, as NO_PROXY does, instead of the proxies of the environment.
+func WithProxy(proxyURL string, noProxy string) Opts {
+	return func(d *Dialer) {
+		d.proxyFunc = (&httpproxy.Config{HTTPSProxy: proxyURL, NoProxy: noProxy}).ProxyFunc() //nolint:exhaustruct
+	}
+}
+
+// WithAuth authenticates to http proxies with auth, AuthBasic by default. NTLM takes the user as DOMAIN\user.
+func WithAuth(auth string) Opts {
+	return func(d *Dialer) {
+		d.auth = auth
+	}
+}
+
+// New creates a dialer going through the proxies of the environment (HTTPS_PROXY and NO_PROXY), unless told otherwise.
+func New(opts ...Opts) *Dialer {
+	ret := &Dialer{
+		proxyFunc: httpproxy.FromEnvironment().ProxyFunc(),
+		auth:      AuthBasic,
+		forward:   &net.Dialer{}, //nolint:exhaustruct
+	}
+
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	return ret
+}
+
+// ProxyFor tells the proxy addr goes through, nil when it is dialed directly.
+func (d *Dialer) ProxyFor(addr string) (*url.URL, error) {
+	proxyURL, err := d.proxyFunc(&url.URL{Scheme: "https", Host: addr}) //nolint:exhaustruct
+	if err != nil {
+		return nil, fmt.Errorf("error finding proxy for %s: %w", addr, err)
+	}
+
+	return proxyURL, nil
+}
+
+// Dial connects to addr (host:port), through its proxy if it has one.
+func (d *Dialer) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	proxyURL, err := d.ProxyFor(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL == nil {
+		return d.forward.DialContext(ctx, "tcp", addr) //nolint:wrapcheck
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return d.dialConnect(ctx, proxyURL, addr)
+	case "socks5", "socks5h":
+		return d.dialSOCKS5(ctx, proxyURL, addr)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, proxyURL.Scheme)
+	}
+}
+
+func (d *Dialer) dialSOCKS5(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, d.forward)
+	if err != nil {
+		return nil, fmt.Errorf("error creating socks5 dialer: %w", err)
+	}
+
+	conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr) //nolint:forcetypeassert
+	if err != nil {
+		return nil, fmt.Errorf("error dialing %s through socks5 proxy %s: %w", addr, proxyURL.Host, err)
+	}
+
+	return conn, nil
+}
+
+func (d *Dialer) dialConnect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := d.dialProxy(ctx, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake is bound to ctx: once done, the connection is on its own.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	ret, err := d.connect(conn, proxyURL, addr)
+
+	if !stop() {
+		err = fmt.Errorf("error dialing %s through proxy %s: %w", addr, proxyURL.Host, ctx.Err())
+	}
+
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (d *Dialer) dialProxy(ctx context.Context, proxyURL *url.URL) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing proxy: %w", err)
+	}
+
+	if proxyURL.Scheme != "https" {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname(), MinVersion: tls.VersionTLS12}) //nolint:exhaustruct
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+
+		return nil, fmt.Errorf("error establishing tls with proxy: %w", err)
+	}
+
+	return tlsConn, nil
+}
+
+// connect asks the proxy to connect to addr, authenticating as proxyURL tells.
+func (d *Dialer) connect(conn net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+
+	var authorization string
+
+	if proxyURL.User != nil {
+		user := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+
+		switch d.auth {
+		case AuthBasic, "":
+			authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+		case AuthNTLM:
+			var err error
+
+			authorization, err = d.ntlmAuthorization(conn, reader, addr, user, password)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnknownAuth, d.auth)
+		}
+	}
+
+	res, err := roundTrip(conn, reader, addr, authorization)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrProxyRefused, res.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// ntlmAuthorization negotiates with the proxy, over conn, the authorization the CONNECT request must carry.
+func (d *Dialer) ntlmAuthorization(
+	conn net.Conn,
+	reader *bufio.Reader,
+	addr string,
+	user string,
+	password string,
+) (string, error) {
+	user, domain, domainNeeded := ntlmssp.GetDomain(user)
+
+	negotiate, err := ntlmssp.NewNegotiateMessage(domain, "")
+	if err != nil {
+		return "", fmt.Errorf("error creating ntlm negotiate message: %w", err)
+	}
+
+	res, err := roundTrip(conn, reader, addr, "NTLM "+base64.StdEncoding.EncodeToString(negotiate))
+	if err != nil {
+		return "", err
+	}
+
+	// the challenge comes along a body to skip, on a connection that must be kept.
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusProxyAuthRequired {
+		return "", fmt.Errorf("%w: expected ntlm challenge, got %s", ErrProxyRefused, res.Status)
+	}
+
+	var challenge []byte
+
+	for _, value := range res.Header.Values("Proxy-Authenticate") {
+		if encoded, ok := strings.CutPrefix(value, "NTLM "); ok {
+			if challenge, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded)); err != nil {
+				return "", fmt.Errorf("error decoding ntlm challenge: %w", err)
+			}
+		}
+	}
+
+	if challenge == nil {
+		return "", fmt.Errorf("%w: no ntlm challenge", ErrProxyRefused)
+	}
+
+	authenticate, err := ntlmssp.ProcessChallenge(challenge, user, password, domainNeeded)
+	if err != nil {
+		return "", fmt.Errorf("error answering ntlm challenge: %w", err)
+	}
+
+	return "NTLM " + base64.StdEncoding.EncodeToString(authenticate), nil
+}
+
+func roundTrip(conn net.Conn, reader *bufio.Reader, addr string, authorization string) (*http.Response, error) {
+	req := &http.Request{ //nolint:exhaustruct
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr}, //nolint:exhaustruct
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("error writing to proxy: %w", err)
+	}
+
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("error reading from proxy: %w", err)
+	}
+
+	return res, nil
+}
+
+// bufferedConn reads what the proxy sent past its response first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p) //nolint:wrapcheck
+}
@@ -0,0 +1,238 @@
+package upstream_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/duxthemux/netmux/foundation/httpproxy"
+	"github.com/duxthemux/netmux/foundation/socks5"
+	"github.com/duxthemux/netmux/foundation/upstream"
+)
+
+// target is an address only reachable through the proxies below: the local host is never proxied.
+const target = "nx-server.example.com:50000"
+
+func echoServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// toEcho connects target to an echo server, refusing anything else.
+func toEcho(t *testing.T) func(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+	t.Helper()
+
+	echo := echoServer(t)
+
+	return func(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+		if addr != target {
+			return nil, httpproxy.ErrNotAllowed
+		}
+
+		return (&net.Dialer{}).DialContext(ctx, "tcp", echo)
+	}
+}
+
+// httpProxy serves CONNECT requests authorized, as authorized tells, to target.
+func httpProxy(t *testing.T, authorized func(writer http.ResponseWriter, req *http.Request) bool) string {
+	t.Helper()
+
+	proxy := httpproxy.New(toEcho(t))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if !authorized(writer, req) {
+			return
+		}
+
+		proxy.ServeHTTP(writer, req)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL
+}
+
+func basicProxy(t *testing.T) string {
+	t.Helper()
+
+	return httpProxy(t, func(writer http.ResponseWriter, req *http.Request) bool {
+		expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("ops:secret"))
+		if req.Header.Get("Proxy-Authorization") != expected {
+			writer.Header().Set("Proxy-Authenticate", "Basic")
+			writer.WriteHeader(http.StatusProxyAuthRequired)
+
+			return false
+		}
+
+		return true
+	})
+}
+
+// ntlmChallenge is a minimal NTLMv2 challenge message: unicode, no target name nor info.
+func ntlmChallenge() string {
+	var msg bytes.Buffer
+
+	msg.WriteString("NTLMSSP\x00")
+	_ = binary.Write(&msg, binary.LittleEndian, uint32(2))
+	msg.Write(make([]byte, 8))                                  // target name
+	_ = binary.Write(&msg, binary.LittleEndian, uint32(1|1<<9)) // unicode, ntlm
+	msg.WriteString("01234567")                                 // server challenge
+	msg.Write(make([]byte, 16))                                 // reserved, target info
+
+	return base64.StdEncoding.EncodeToString(msg.Bytes())
+}
+
+// ntlmMessageType tells the type of the ntlm message authorization carries, 0 if none.
+func ntlmMessageType(authorization string) uint32 {
+	msg, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authorization, "NTLM "))
+	if err != nil || len(msg) < 12 || !strings.HasPrefix(authorization, "NTLM ") {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(msg[8:12])
+}
+
+func ntlmProxy(t *testing.T) string {
+	t.Helper()
+
+	return httpProxy(t, func(writer http.ResponseWriter, req *http.Request) bool {
+		switch ntlmMessageType(req.Header.Get("Proxy-Authorization")) {
+		case 1:
+			writer.Header().Set("Proxy-Authenticate", "NTLM "+ntlmChallenge())
+		case 3:
+			return true
+		default:
+			writer.Header().Set("Proxy-Authenticate", "NTLM")
+		}
+
+		writer.WriteHeader(http.StatusProxyAuthRequired)
+
+		return false
+	})
+}
+
+func socksProxy(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		_ = socks5.New(toEcho(t)).Serve(context.Background(), listener)
+	}()
+
+	return "socks5://" + listener.Addr().String()
+}
+
+func expectEcho(t *testing.T, dialer *upstream.Dialer, addr string) {
+	t.Helper()
+
+	conn, err := dialer.Dial(context.Background(), addr)
+	require.NoError(t, err)
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 4)
+
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+//nolint:paralleltest
+func TestConnectBasic(t *testing.T) {
+	proxyURL := strings.Replace(basicProxy(t), "http://", "http://ops:secret@", 1)
+
+	expectEcho(t, upstream.New(upstream.WithProxy(proxyURL, "")), target)
+}
+
+//nolint:paralleltest
+func TestConnectRefused(t *testing.T) {
+	proxyURL := strings.Replace(basicProxy(t), "http://", "http://ops:guess@", 1)
+
+	_, err := upstream.New(upstream.WithProxy(proxyURL, "")).Dial(context.Background(), target)
+	require.ErrorIs(t, err, upstream.ErrProxyRefused)
+}
+
+//nolint:paralleltest
+func TestConnectNTLM(t *testing.T) {
+	proxyURL := strings.Replace(ntlmProxy(t), "http://", "http://CORP%5Cops:secret@", 1)
+
+	expectEcho(t, upstream.New(upstream.WithProxy(proxyURL, ""), upstream.WithAuth(upstream.AuthNTLM)), target)
+}
+
+//nolint:paralleltest
+func TestSOCKS5(t *testing.T) {
+	expectEcho(t, upstream.New(upstream.WithProxy(socksProxy(t), "")), target)
+}
+
+//nolint:paralleltest
+func TestNoProxy(t *testing.T) {
+	dialer := upstream.New(upstream.WithProxy("http://proxy.example.com:3128", "internal.example.com,10.0.0.0/8"))
+
+	for addr, proxied := range map[string]bool{
+		target:                         true,
+		"api.internal.example.com:443": false,
+		"10.0.3.17:50000":              false,
+		"localhost:50000":              false,
+		"127.0.0.1:50000":              false,
+	} {
+		proxyURL, err := dialer.ProxyFor(addr)
+		require.NoError(t, err)
+		assert.Equal(t, proxied, proxyURL != nil, addr)
+	}
+
+	// the local host is dialed directly.
+	expectEcho(t, dialer, echoServer(t))
+}
+
+//nolint:paralleltest
+func TestEnvironment(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", socksProxy(t))
+	t.Setenv("NO_PROXY", "")
+
+	expectEcho(t, upstream.New(), target)
+}
@@ -44,13 +44,10 @@ func (wi *Wire) Write(writer io.Writer, cmd uint16, payload []byte) error {
 func (wi *Wire) Read(reader io.Reader) (cmd uint16, payload []byte, err error) {
 	header := make([]byte, HeaderLen)
 
-	readBytes, err := reader.Read(header)
-	if err != nil {
+	// streams (quic, websockets, tunnels) may return less than asked for on each read.
+	if _, err := io.ReadFull(reader, header); err != nil {
 		return 0, nil, fmt.Errorf("error reading header: %w", err)
 	}
-	if readBytes < HeaderLen {
-		return
-	}
 
 	id := header[:4]
 
@@ -74,7 +71,7 @@ func (wi *Wire) Read(reader io.Reader) (cmd uint16, payload []byte, err error) {
 
 	payload = make([]byte, plLen)
 
-	if _, err := reader.Read(payload); err != nil {
+	if _, err := io.ReadFull(reader, payload); err != nil {
 		return 0, nil, fmt.Errorf("error reading payload: %w", err)
 	}
 
@@ -3,6 +3,7 @@ package wire_test
 import (
 	"bytes"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 
@@ -50,3 +51,27 @@ func TestWireProto(t *testing.T) {
 		})
 	}
 }
+
+//nolint:paralleltest
+func TestWireShortReads(t *testing.T) {
+	aWire := wire.Wire{}
+
+	buf := &bytes.Buffer{}
+
+	large := bytes.Repeat([]byte("bridge"), 10000)
+
+	assert.NoError(t, aWire.Write(buf, 1, large))
+	assert.NoError(t, aWire.Write(buf, 2, []byte("next")))
+
+	reader := iotest.OneByteReader(buf)
+
+	cmd, pl, err := aWire.Read(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(1), cmd)
+	assert.Equal(t, large, pl)
+
+	cmd, pl, err = aWire.Read(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(2), cmd)
+	assert.Equal(t, []byte("next"), pl)
+}
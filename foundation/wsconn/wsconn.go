@@ -0,0 +1,312 @@
+// Package wsconn carries streams over websockets, as binary messages, so they can go through http ingresses and
+// proxies. Listener is an http.Handler handing upgraded requests over as connections, and Dialer opens them. Both
+// sides may authenticate with a bearer token; tls (and client certificates) is up to the http server and the dialer.
+package wsconn
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocol is the websocket subprotocol of the streams.
+const Subprotocol = "netmux.v1"
+
+const (
+	closeTimeout     = time.Second
+	handshakeTimeout = time.Second * 10
+)
+
+var (
+	ErrRefused = fmt.Errorf("websocket refused")
+	ErrClosed  = fmt.Errorf("listener closed: %w", net.ErrClosed)
+)
+
+// Conn is a stream over a websocket. Each write is sent as one binary message.
+type Conn struct {
+	ws      *websocket.Conn
+	reader  io.Reader
+	writeMx sync.Mutex
+}
+
+func NewConn(ws *websocket.Conn) *Conn {
+	return &Conn{ws: ws}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			msgType, reader, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+
+				return 0, fmt.Errorf("error reading websocket: %w", err)
+			}
+
+			if msgType != websocket.BinaryMessage {
+				continue
+			}
+
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(p)
+		if errors.Is(err, io.EOF) {
+			c.reader = nil
+
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		if err != nil {
+			return n, fmt.Errorf("error reading websocket: %w", err)
+		}
+
+		return n, nil
+	}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.writeMx.Lock()
+	defer c.writeMx.Unlock()
+
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, fmt.Errorf("error writing websocket: %w", err)
+	}
+
+	return len(p), nil
+}
+
+// Close tells the peer the stream is over, then closes the websocket.
+func (c *Conn) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout))
+
+	if err := c.ws.Close(); err != nil {
+		return fmt.Errorf("error closing websocket: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return fmt.Errorf("error setting read deadline: %w", err)
+	}
+
+	if err := c.ws.SetWriteDeadline(t); err != nil {
+		return fmt.Errorf("error setting write deadline: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return fmt.Errorf("error setting read deadline: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	if err := c.ws.SetWriteDeadline(t); err != nil {
+		return fmt.Errorf("error setting write deadline: %w", err)
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type addr string
+
+func (a addr) Network() string {
+	return "websocket"
+}
+
+func (a addr) String() string {
+	return string(a)
+}
+
+// Listener accepts the streams of websockets upgraded by its ServeHTTP.
+type Listener struct {
+	addr      addr
+	token     string
+	upgrader  websocket.Upgrader
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type ListenerOpts func(l *Listener)
+
+// WithToken only accepts websockets whose requests have the bearer token.
+func WithToken(token string) ListenerOpts {
+	return func(l *Listener) {
+		l.token = token
+	}
+}
+
+// NewListener creates a listener; address is what Addr tells (eg: the url it is served at).
+func NewListener(address string, opts ...ListenerOpts) *Listener {
+	ret := &Listener{
+		addr: addr(address),
+		upgrader: websocket.Upgrader{ //nolint:exhaustruct
+			Subprotocols:     []string{Subprotocol},
+			HandshakeTimeout: handshakeTimeout,
+		},
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	return ret
+}
+
+func (l *Listener) authorized(r *http.Request) bool {
+	if l.token == "" {
+		return true
+	}
+
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(l.token)) == 1
+}
+
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !l.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+
+		return
+	}
+
+	if !slices.Contains(websocket.Subprotocols(r), Subprotocol) {
+		http.Error(w, "unsupported subprotocol", http.StatusBadRequest)
+
+		return
+	}
+
+	ws, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied.
+		return
+	}
+
+	select {
+	case l.conns <- NewConn(ws):
+	case <-l.done:
+		_ = ws.Close()
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+// Close stops accepting streams. Websockets being upgraded are closed; the http server is up to the caller.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Dialer opens streams to ws:// and wss:// urls served by a Listener.
+type Dialer struct {
+	// TLSConfig verifies the server and, with certificates, authenticates the client.
+	TLSConfig *tls.Config
+	// Token is sent as a bearer token, when set.
+	Token string
+	// Proxy returns the http proxy to go through - the ones of the environment when nil.
+	Proxy func(*http.Request) (*url.URL, error)
+	// NetDial opens the connection to the server (host:port), replacing Proxy when set.
+	NetDial func(ctx context.Context, addr string) (net.Conn, error)
+}
+
+func (d *Dialer) Dial(ctx context.Context, target string) (net.Conn, error) {
+	proxy := d.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+
+	dialer := &websocket.Dialer{ //nolint:exhaustruct
+		Proxy:            proxy,
+		TLSClientConfig:  d.TLSConfig,
+		Subprotocols:     []string{Subprotocol},
+		HandshakeTimeout: handshakeTimeout,
+	}
+
+	if d.NetDial != nil {
+		dialer.Proxy = nil
+		dialer.NetDialContext = func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+			return d.NetDial(ctx, addr)
+		}
+	}
+
+	header := http.Header{}
+	if d.Token != "" {
+		header.Set("Authorization", "Bearer "+d.Token)
+	}
+
+	ws, res, err := dialer.DialContext(ctx, target, header)
+	if res != nil && res.Body != nil {
+		_ = res.Body.Close()
+	}
+
+	if err != nil {
+		if res != nil {
+			return nil, fmt.Errorf("%w: %s", ErrRefused, res.Status)
+		}
+
+		return nil, fmt.Errorf("error dialing websocket: %w", err)
+	}
+
+	if ws.Subprotocol() != Subprotocol {
+		_ = ws.Close()
+
+		return nil, fmt.Errorf("%w: subprotocol %q", ErrRefused, ws.Subprotocol())
+	}
+
+	return NewConn(ws), nil
+}
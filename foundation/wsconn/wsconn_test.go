@@ -0,0 +1,87 @@
+package wsconn_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/duxthemux/netmux/foundation/wsconn"
+)
+
+func echoListener(t *testing.T, opts ...wsconn.ListenerOpts) (*wsconn.Listener, string) {
+	t.Helper()
+
+	listener := wsconn.NewListener("test", opts...)
+
+	srv := httptest.NewServer(listener)
+	t.Cleanup(srv.Close)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener, "ws://" + strings.TrimPrefix(srv.URL, "http://")
+}
+
+//nolint:paralleltest
+func TestEcho(t *testing.T) {
+	_, target := echoListener(t, wsconn.WithToken("secret"))
+
+	conn, err := (&wsconn.Dialer{Token: "secret"}).Dial(context.Background(), target)
+	require.NoError(t, err)
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// larger than the websocket buffers, read back in smaller chunks than written.
+	payload := bytes.Repeat([]byte("netmux"), 64*1024)
+
+	go func() {
+		_, _ = conn.Write(payload[:1000])
+		_, _ = conn.Write(payload[1000:])
+	}()
+
+	got := make([]byte, len(payload))
+
+	_, err = io.ReadFull(conn, got)
+	require.NoError(t, err)
+	assert.Equal(t, payload, got)
+}
+
+//nolint:paralleltest
+func TestRefused(t *testing.T) {
+	_, target := echoListener(t, wsconn.WithToken("secret"))
+
+	_, err := (&wsconn.Dialer{}).Dial(context.Background(), target)
+	require.ErrorIs(t, err, wsconn.ErrRefused)
+}
+
+//nolint:paralleltest
+func TestAcceptClosed(t *testing.T) {
+	listener := wsconn.NewListener("test")
+
+	require.NoError(t, listener.Close())
+
+	_, err := listener.Accept()
+	require.ErrorIs(t, err, wsconn.ErrClosed)
+}